@@ -1,6 +1,7 @@
 import * as cdk from '@aws-cdk/core';
 import * as s3 from '@aws-cdk/aws-s3';
 import * as lambda from '@aws-cdk/aws-lambda';
+import * as dynamodb from '@aws-cdk/aws-dynamodb';
 import events = require('@aws-cdk/aws-events');
 import targets = require('@aws-cdk/aws-events-targets');
 import assets = require("@aws-cdk/aws-s3-assets");
@@ -18,10 +19,21 @@ export class InfraStack extends cdk.Stack {
         path: path.join(__dirname, '../../../build/AccessKeyRotator.zip'),
     });
 
+    // Keeps the journal of all rotations and the locks of the principals
+    const stateTable = new dynamodb.Table(this, 'AccessKeyRotatorState', {
+        partitionKey: { name: 'pk', type: dynamodb.AttributeType.STRING },
+        sortKey: { name: 'sk', type: dynamodb.AttributeType.STRING },
+        billingMode: dynamodb.BillingMode.PAY_PER_REQUEST,
+        removalPolicy: cdk.RemovalPolicy.RETAIN,
+    });
+
     // Define ENV variables
     var env = {
         "CLOUD_PROVIDER": this.node.tryGetContext("cloudProvider"),
         "IAM_USER": this.node.tryGetContext("iamUser"),
+        "IAM_USERS": this.node.tryGetContext("iamUsers"),
+        "IAM_USER_PATH_PREFIX": this.node.tryGetContext("iamUserPathPrefix"),
+        "IAM_USER_TAG": this.node.tryGetContext("iamUserTag"),
         "SECRETS_STORE": this.node.tryGetContext("secretsStore"),
         "SECRET_NAME": this.node.tryGetContext("secretName"),
         "REPO_OWNER": this.node.tryGetContext("repoOwner"),
@@ -29,6 +41,9 @@ export class InfraStack extends cdk.Stack {
         "TOKEN_CONFIG_STORE_PATH": this.node.tryGetContext("ssmParam"),
         "GITHUB_APP_ID": this.node.tryGetContext("githubAppID"),
         "GITHUB_INST_ID": this.node.tryGetContext("githubInstID"),
+        "STATE_STORE": "dynamodb",
+        "STATE_TABLE": stateTable.tableName,
+        "LOCK_LEASE": this.node.tryGetContext("lockLease"),
     }
 
     // Create IAM role  to be assumed by the lambda
@@ -45,13 +60,68 @@ export class InfraStack extends cdk.Stack {
         resources: [ssmRessource],
     }));
 
-    // be able to list, create, delete IAM access keys
-    var iamRessource = ['arn', 'aws', 'iam', '', this.account, 'user/'+env.IAM_USER].join(':'); 
+    // be able to read the token from Secrets Manager (if referenced by its ARN)
+    if (String(env.TOKEN_CONFIG_STORE_PATH).startsWith('arn:aws:secretsmanager:')) {
+        lambdaIAMRole.addToPolicy(new iam.PolicyStatement({
+            actions: ['secretsmanager:GetSecretValue'],
+            resources: [String(env.TOKEN_CONFIG_STORE_PATH).split('#')[0]],
+        }));
+    }
+
+    // be able to publish keys to Secrets Manager
+    if (env.SECRETS_STORE === 'secretsmanager') {
+        lambdaIAMRole.addToPolicy(new iam.PolicyStatement({
+            actions: ['secretsmanager:DescribeSecret', 'secretsmanager:CreateSecret', 'secretsmanager:PutSecretValue', 'secretsmanager:UpdateSecretVersionStage', 'secretsmanager:DeleteSecret', 'secretsmanager:RestoreSecret'],
+            resources: [['arn', 'aws', 'secretsmanager', this.region, this.account, 'secret:'+env.SECRET_NAME+'*'].join(':')],
+        }));
+    }
+
+    // be able to keep the rotation state and locks
     lambdaIAMRole.addToPolicy(new iam.PolicyStatement({
-        actions: ['iam:ListAccessKeys', 'iam:CreateAccessKey', 'iam:DeleteAccessKey'],
-        resources: [iamRessource],
+        actions: ['dynamodb:GetItem', 'dynamodb:PutItem', 'dynamodb:UpdateItem', 'dynamodb:DeleteItem', 'dynamodb:Query', 'dynamodb:Scan'],
+        resources: [stateTable.tableArn],
     }));
 
+    // be able to list, create, update, delete IAM access keys of the selected users
+    var iamUsers: string[] = [];
+    if (env.IAM_USER) {
+        iamUsers.push('user/'+env.IAM_USER);
+    }
+    if (env.IAM_USERS) {
+        String(env.IAM_USERS).split(',').forEach(user => iamUsers.push('user/'+user.trim()));
+    }
+    if (env.IAM_USER_TAG) {
+        // Tagged users can be anywhere
+        iamUsers = ['user/*'];
+    } else if (env.IAM_USER_PATH_PREFIX) {
+        iamUsers.push('user/'+String(env.IAM_USER_PATH_PREFIX).replace(/^\/+/, '')+'*');
+    }
+    var iamRessources = iamUsers.map(user => ['arn', 'aws', 'iam', '', this.account, user].join(':'));
+    if (iamRessources.length > 0) {
+        lambdaIAMRole.addToPolicy(new iam.PolicyStatement({
+            actions: ['iam:ListAccessKeys', 'iam:CreateAccessKey', 'iam:UpdateAccessKey', 'iam:DeleteAccessKey', 'iam:GetAccessKeyLastUsed'],
+            resources: iamRessources,
+        }));
+    }
+
+    // be able to look up IAM users by path prefix or tag (ListUsers doesn't support resource restrictions)
+    if (env.IAM_USER_PATH_PREFIX || env.IAM_USER_TAG) {
+        lambdaIAMRole.addToPolicy(new iam.PolicyStatement({
+            actions: ['iam:ListUsers'],
+            resources: ['*'],
+        }));
+    }
+    if (env.IAM_USER_TAG) {
+        lambdaIAMRole.addToPolicy(new iam.PolicyStatement({
+            actions: ['iam:ListUserTags'],
+            resources: iamRessources,
+        }));
+    }
+
+    // New keys are verified with backoff (about a minute per key by default) before they are
+    // published, so use the maximum run time. It matches the default lease of the locks.
+    const rotationTimeout = cdk.Duration.minutes(15);
+
     const handler = new lambda.Function(this, "AccessKeyRotatorLambda", {
         runtime: lambda.Runtime.GO_1_X,
         handler: "build/access-key-rotator.lambda",
@@ -60,7 +130,8 @@ export class InfraStack extends cdk.Stack {
             asset.s3ObjectKey
         ),
         environment: env,
-        role: lambdaIAMRole 
+        role: lambdaIAMRole,
+        timeout: rotationTimeout,
     })
 
     // This is used for debugging 
@@ -69,7 +140,8 @@ export class InfraStack extends cdk.Stack {
         handler: "access-key-rotator.lambda",
         code: lambda.Code.fromAsset('../../build/AccessKeyRotator.zip'),
         environment: env,
-        role: lambdaIAMRole 
+        role: lambdaIAMRole,
+        timeout: rotationTimeout,
     });
 
     // Create s3 bucket
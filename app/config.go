@@ -0,0 +1,656 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	c "github.com/dorneanu/go-key-rotator/configstore"
+	k "github.com/dorneanu/go-key-rotator/keymanager"
+	s "github.com/dorneanu/go-key-rotator/secretsstore"
+	"github.com/kelseyhightower/envconfig"
+	"gopkg.in/yaml.v2"
+)
+
+// RotationConfig describes several rotation jobs. It can be written in YAML or JSON:
+//
+//	grace_period: 72h
+//	policy:
+//	  max_age: 720h
+//	github:
+//	  app_id: 1234
+//	  installation_id: 5678
+//	  private_key_path: /github/private-key
+//	jobs:
+//	  - name: deploy
+//	    source:
+//	      provider: aws
+//	      principal: deploy
+//	    destinations:
+//	      - type: github
+//	        owner: dorneanu
+//	        repos: [access-key-rotator, infra]
+//	        secret_name: AWS_KEY_{{ .Principal | sanitize | upper }}
+//	      - type: github
+//	        owner: dorneanu
+//	        repo: playground
+//	        format: separate
+//	        id_name: AWS_ACCESS_KEY_ID
+//	        secret_name: AWS_SECRET_ACCESS_KEY
+//	        optional: true
+//	      - type: github
+//	        owner: dorneanu
+//	        organization: true
+//	        app: dependabot
+//	        visibility: selected
+//	        selected_repos: [infra]
+//	        secret_name: AWS_KEY_{{ .Principal | sanitize | upper }}
+//	      - type: secretsmanager
+//	        secret_name: ci/{{ .Principal }}
+//	      - type: kubernetes
+//	        namespace: ci
+//	        secret_name: aws-{{ .Principal | lower }}
+//	        restart_deployments: true
+//	verification:
+//	  attempts: 10
+//	state:
+//	  type: dynamodb
+//	  table: access-key-rotator-state
+//	  lock_lease: 10m
+type RotationConfig struct {
+	GracePeriod  time.Duration      `yaml:"grace_period"`
+	Policy       RotationPolicy     `yaml:"policy"`
+	Verification VerificationPolicy `yaml:"verification"`
+	Github       GithubConfig       `yaml:"github"`
+	Gitlab       GitlabConfig       `yaml:"gitlab"`
+	Vault        VaultConfig        `yaml:"vault"`
+	Kubernetes   KubernetesConfig   `yaml:"kubernetes"`
+	State        StateConfig        `yaml:"state"`
+	Jobs         []JobConfig        `yaml:"jobs"`
+}
+
+// GithubConfig holds the settings needed to authenticate as Github application.
+// If app_id or installation_id are missing, they're taken from the environment.
+type GithubConfig struct {
+	AppID          int64 `yaml:"app_id"`
+	InstallationID int64 `yaml:"installation_id"`
+
+	// PrivateKeyPath is the key of the private key within the config store
+	PrivateKeyPath string `yaml:"private_key_path"`
+}
+
+// GitlabConfig holds the settings needed to access the GitLab API
+type GitlabConfig struct {
+	// URL of the GitLab instance (default: https://gitlab.com)
+	URL string `yaml:"url"`
+
+	// TokenPath is the key of the access token within the config store
+	TokenPath string `yaml:"token_path"`
+}
+
+// VaultConfig holds the settings needed to access HashiCorp Vault.
+// Settings which are missing are taken from the environment (VAULT_ADDR, VAULT_TOKEN, ...).
+type VaultConfig struct {
+	Address   string `yaml:"address"`
+	Namespace string `yaml:"namespace"`
+
+	// AuthMethod is token (default), approle or aws
+	AuthMethod string `yaml:"auth_method"`
+	AuthMount  string `yaml:"auth_mount"`
+
+	// TokenPath is the key of the token (token auth) or the secret ID (approle auth) within the config store
+	TokenPath string `yaml:"token_path"`
+	RoleID    string `yaml:"role_id"`
+
+	// Role and IAMServerID are used by the aws auth method
+	Role        string `yaml:"role"`
+	IAMServerID string `yaml:"iam_server_id"`
+}
+
+// settings returns the settings of the Vault client. Missing values are taken from the environment.
+func (vc VaultConfig) settings() (s.VaultSettings, error) {
+	var settings s.VaultSettings
+	err := envconfig.Process("", &settings)
+	if err != nil {
+		return settings, fmt.Errorf("Couldn't get ENV variables for vault settings: %s", err)
+	}
+
+	for _, field := range []struct {
+		value  string
+		target *string
+	}{
+		{vc.Address, &settings.Address},
+		{vc.Namespace, &settings.Namespace},
+		{vc.AuthMount, &settings.AuthMount},
+		{vc.RoleID, &settings.RoleID},
+		{vc.Role, &settings.Role},
+		{vc.IAMServerID, &settings.IAMServerID},
+	} {
+		if field.value != "" {
+			*field.target = field.value
+		}
+	}
+	if vc.AuthMethod != "" {
+		settings.AuthMethod = s.VaultAuthMethod(vc.AuthMethod)
+	}
+	return settings, nil
+}
+
+// StateConfig specifies where the journal of all rotations is kept (optional).
+// The CLI may use a local file, the Lambda a DynamoDB table.
+type StateConfig struct {
+	// Type is file or dynamodb
+	Type  string `yaml:"type"`
+	Path  string `yaml:"path"`
+	Table string `yaml:"table"`
+
+	// LockLease specifies how long a run may lock the keys of a principal (default: 15m)
+	LockLease time.Duration `yaml:"lock_lease"`
+}
+
+// validate checks whether the settings needed by the type are present
+func (sc StateConfig) validate() error {
+	if sc.LockLease < 0 {
+		return fmt.Errorf("lock_lease must not be negative")
+	}
+
+	switch sc.Type {
+	case "":
+		if sc.Path != "" || sc.Table != "" {
+			return fmt.Errorf("type is required")
+		}
+	case "file":
+		if sc.Path == "" {
+			return fmt.Errorf("path is required by the file state store")
+		}
+	case "dynamodb":
+		if sc.Table == "" {
+			return fmt.Errorf("table is required by the dynamodb state store")
+		}
+	default:
+		return fmt.Errorf("unknown state store %q (expected file or dynamodb)", sc.Type)
+	}
+	return nil
+}
+
+// KubernetesConfig holds the settings needed to access the API server of a cluster.
+// Without a server, the in-cluster configuration (service account of the pod) is used.
+type KubernetesConfig struct {
+	Server string `yaml:"server"`
+	CAFile string `yaml:"ca_file"`
+
+	// TokenPath is the key of the bearer token within the config store
+	TokenPath string `yaml:"token_path"`
+}
+
+// JobConfig maps the keys of a source to the destinations they should be published to
+type JobConfig struct {
+	Name         string              `yaml:"name"`
+	Source       SourceConfig        `yaml:"source"`
+	Destinations []DestinationConfig `yaml:"destinations"`
+}
+
+// SourceConfig specifies the cloud provider and the principals whose keys should be rotated
+type SourceConfig struct {
+	Provider   string   `yaml:"provider"`
+	Principal  string   `yaml:"principal"`
+	Principals []string `yaml:"principals"`
+	PathPrefix string   `yaml:"path_prefix"`
+	Tag        string   `yaml:"tag"`
+}
+
+// DestinationConfig specifies where keys should be published to.
+// The secret name may be a template (see secretsstore.RenderSecretName).
+type DestinationConfig struct {
+	Type       string `yaml:"type"`
+	SecretName string `yaml:"secret_name"`
+
+	// Github repositories (or the organization). Secrets are written to Actions (default),
+	// Dependabot or Codespaces and may be limited to an environment of the repositories.
+	Owner        string   `yaml:"owner"`
+	Repo         string   `yaml:"repo"`
+	Repos        []string `yaml:"repos"`
+	Organization bool     `yaml:"organization"`
+	App          string   `yaml:"app"`
+	Environment  string   `yaml:"environment"`
+
+	// Repositories which may access an organization secret (visibility all, private or selected)
+	Visibility    string   `yaml:"visibility"`
+	SelectedRepos []string `yaml:"selected_repos"`
+
+	// GitLab projects (full path or ID) or group and variable flags
+	Project          string   `yaml:"project"`
+	Projects         []string `yaml:"projects"`
+	Group            string   `yaml:"group"`
+	Masked           bool     `yaml:"masked"`
+	Protected        bool     `yaml:"protected"`
+	EnvironmentScope string   `yaml:"environment_scope"`
+
+	// KMS key used to encrypt new AWS Secrets Manager secrets
+	KMSKeyID string `yaml:"kms_key_id"`
+
+	// Vault KV v2 engine (default: secret) and the number of versions to keep
+	Mount       string `yaml:"mount"`
+	MaxVersions int    `yaml:"max_versions"`
+
+	// Kubernetes namespace (default: default), metadata of the secret and whether
+	// Deployments annotated with access-key-rotator/restart-on-rotation are restarted
+	Namespace          string            `yaml:"namespace"`
+	Labels             map[string]string `yaml:"labels"`
+	Annotations        map[string]string `yaml:"annotations"`
+	RestartDeployments bool              `yaml:"restart_deployments"`
+
+	// Local file encrypted to the age recipients. The identity file is needed to update an existing file.
+	Path         string   `yaml:"path"`
+	Recipients   []string `yaml:"recipients"`
+	IdentityFile string   `yaml:"identity_file"`
+	Armor        bool     `yaml:"armor"`
+
+	// Format specifies how keys are stored: secret (default), separate, json or env.
+	// The separate format stores the key ID as id_name next to secret_name.
+	Format    string `yaml:"format"`
+	IDName    string `yaml:"id_name"`
+	IDKey     string `yaml:"id_key"`
+	SecretKey string `yaml:"secret_key"`
+
+	// Optional destinations don't cause a rotation to fail if they can't be updated
+	Optional bool `yaml:"optional"`
+}
+
+// layout returns the secret layout of the destination
+func (dc DestinationConfig) layout() (s.SecretLayout, error) {
+	format, err := s.ParseSecretFormat(dc.Format)
+	if err != nil {
+		return s.SecretLayout{}, err
+	}
+	return s.SecretLayout{
+		Format:    format,
+		Name:      dc.SecretName,
+		IDName:    dc.IDName,
+		IDKey:     dc.IDKey,
+		SecretKey: dc.SecretKey,
+	}, nil
+}
+
+// repos returns all repositories the secret should be written to
+func (dc DestinationConfig) repos() []string {
+	if dc.Repo == "" {
+		return dc.Repos
+	}
+	return append([]string{dc.Repo}, dc.Repos...)
+}
+
+// githubTargets returns all repositories (or the organization) the secrets should be written to
+func (dc DestinationConfig) githubTargets() []s.GithubSecretTarget {
+	if dc.Organization {
+		return []s.GithubSecretTarget{{Owner: dc.Owner, App: s.GithubSecretApp(dc.App)}}
+	}
+	var targets []s.GithubSecretTarget
+	for _, repo := range dc.repos() {
+		targets = append(targets, s.GithubSecretTarget{Owner: dc.Owner, Repo: repo, Environment: dc.Environment, App: s.GithubSecretApp(dc.App)})
+	}
+	return targets
+}
+
+// gitlabTargets returns all projects (or the group) the variables should be written to
+func (dc DestinationConfig) gitlabTargets() []s.GitlabTarget {
+	var targets []s.GitlabTarget
+	projects := dc.Projects
+	if dc.Project != "" {
+		projects = append([]string{dc.Project}, projects...)
+	}
+	for _, project := range projects {
+		targets = append(targets, s.GitlabTarget{Project: project})
+	}
+	if dc.Group != "" {
+		targets = append(targets, s.GitlabTarget{Group: dc.Group})
+	}
+	return targets
+}
+
+// ReadRotationConfig reads the rotation config either from a local file or from the config store
+func ReadRotationConfig(ctx context.Context, configStore c.ConfigStore, path, configStoreKey string) (*RotationConfig, error) {
+	var data []byte
+	switch {
+	case path != "":
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't read config file: %s", err)
+		}
+		data = content
+	case configStoreKey != "":
+		value, err := configStore.GetValue(ctx, configStoreKey)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't get config from config store: %s", err)
+		}
+		data = []byte(value)
+	default:
+		return nil, fmt.Errorf("neither config file nor config store key specified")
+	}
+	return ParseRotationConfig(data)
+}
+
+// ParseRotationConfig parses and validates a rotation config in YAML or JSON format
+func ParseRotationConfig(data []byte) (*RotationConfig, error) {
+	config := &RotationConfig{}
+
+	// JSON is valid YAML. Unknown fields are rejected in order to catch typos.
+	err := yaml.UnmarshalStrict(data, config)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rotation config: %s", err)
+	}
+
+	err = config.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// Validate checks the config and reports all problems at once
+func (rc *RotationConfig) Validate() error {
+	var problems []string
+	problem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if rc.GracePeriod < 0 {
+		problem("grace_period: must not be negative")
+	}
+	if rc.Policy.MaxAge < 0 || rc.Policy.MinAge < 0 || rc.Policy.UnusedFor < 0 {
+		problem("policy: durations must not be negative")
+	}
+	if rc.Policy.MaxAge > 0 && rc.Policy.MinAge > rc.Policy.MaxAge {
+		problem("policy: min_age (%s) must not exceed max_age (%s)", rc.Policy.MinAge, rc.Policy.MaxAge)
+	}
+	if rc.Verification.Attempts < 0 || rc.Verification.Delay < 0 {
+		problem("verification: attempts and delay must not be negative")
+	}
+	if err := rc.State.validate(); err != nil {
+		problem("state: %s", err)
+	}
+	switch s.VaultAuthMethod(rc.Vault.AuthMethod) {
+	case "", s.VaultAuthToken, s.VaultAuthAppRole, s.VaultAuthAWS:
+	default:
+		problem("vault.auth_method: unknown auth method %q (expected token, approle or aws)", rc.Vault.AuthMethod)
+	}
+
+	if len(rc.Jobs) == 0 {
+		problem("jobs: at least one job is required")
+	}
+
+	names := make(map[string]int)
+	for i, job := range rc.Jobs {
+		path := fmt.Sprintf("jobs[%d]", i)
+		if other, ok := names[job.name()]; ok {
+			problem("%s: job name %q is already used by jobs[%d]", path, job.name(), other)
+		}
+		names[job.name()] = i
+
+		src := job.Source
+		switch src.Provider {
+		case "":
+			problem("%s.source.provider: is required", path)
+		case "aws":
+			if src.Principal == "" && len(src.Principals) == 0 && src.PathPrefix == "" && src.Tag == "" {
+				problem("%s.source: one of principal, principals, path_prefix or tag is required", path)
+			}
+		case "gcp":
+			if src.Principal == "" && len(src.Principals) == 0 {
+				problem("%s.source: principal or principals (service account emails) is required", path)
+			}
+		case "azure":
+			if src.Principal == "" && len(src.Principals) == 0 {
+				problem("%s.source: principal or principals (application client IDs) is required", path)
+			}
+			if err := validateGracePeriod(src.Provider, rc.GracePeriod); err != nil {
+				problem("%s.source.provider: %s", path, err)
+			}
+		default:
+			problem("%s.source.provider: unknown provider %q (expected aws, gcp or azure)", path, src.Provider)
+		}
+
+		if len(job.Destinations) == 0 {
+			problem("%s.destinations: at least one destination is required", path)
+		}
+		for j, dest := range job.Destinations {
+			destPath := fmt.Sprintf("%s.destinations[%d]", path, j)
+			switch dest.Type {
+			case "":
+				problem("%s.type: is required", destPath)
+			case "github":
+				if dest.Owner == "" {
+					problem("%s.owner: is required", destPath)
+				}
+				switch {
+				case dest.Organization && len(dest.repos()) > 0:
+					problem("%s: repo and repos can't be used for organization secrets (use selected_repos)", destPath)
+				case !dest.Organization && len(dest.repos()) == 0:
+					problem("%s: repo or repos is required", destPath)
+				}
+				for _, target := range dest.githubTargets() {
+					if err := target.Validate(); err != nil && target.Owner != "" {
+						problem("%s: %s", destPath, err)
+						break
+					}
+				}
+				options := s.GithubSecretOptions{Visibility: dest.Visibility, SelectedRepos: dest.SelectedRepos}
+				if dest.Organization {
+					if err := options.Validate(); err != nil {
+						problem("%s: %s", destPath, err)
+					}
+				} else if dest.Visibility != "" || len(dest.SelectedRepos) > 0 {
+					problem("%s: visibility and selected_repos are only used by organization secrets", destPath)
+				}
+				if rc.Github.PrivateKeyPath == "" {
+					problem("%s: github.private_key_path is required for github destinations", destPath)
+				}
+			case "gitlab":
+				if len(dest.gitlabTargets()) == 0 {
+					problem("%s: project, projects or group is required", destPath)
+				}
+				if rc.Gitlab.TokenPath == "" {
+					problem("%s: gitlab.token_path is required for gitlab destinations", destPath)
+				}
+			case "secretsmanager":
+			case "vault":
+			case "kubernetes":
+				if dest.Format == string(s.SecretFormatSeparate) {
+					problem("%s.format: kubernetes secrets store ID and secret as data keys (use id_key and secret_key)", destPath)
+				}
+			case "file":
+				if dest.Path == "" {
+					problem("%s.path: is required", destPath)
+				}
+				if len(dest.Recipients) == 0 && dest.IdentityFile == "" {
+					problem("%s: recipients or identity_file is required", destPath)
+				}
+			default:
+				problem("%s.type: unknown destination type %q (expected github, gitlab, secretsmanager, vault, kubernetes or file)", destPath, dest.Type)
+			}
+
+			layout, err := dest.layout()
+			if err == nil {
+				err = layout.Validate()
+			}
+			if err == nil {
+				_, err = layout.Render(s.SecretNameData{})
+			}
+			if err != nil {
+				problem("%s: %s", destPath, err)
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid rotation config:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// name returns the name of the job which defaults to the provider
+func (jc JobConfig) name() string {
+	if jc.Name != "" {
+		return jc.Name
+	}
+	return jc.Source.Provider
+}
+
+// NewAccessKeyRotatorAppFromConfig sets up an AccessKeyRotatorApp running the jobs of the config
+func NewAccessKeyRotatorAppFromConfig(ctx context.Context, config *RotationConfig, configStore c.ConfigStore) (*AccessKeyRotatorApp, error) {
+	clients := &destinationClients{config: config, configStore: configStore}
+
+	var jobs []RotationJob
+	for _, jc := range config.Jobs {
+		selector := k.IAMUserSelector{
+			Users:      jc.Source.Principals,
+			PathPrefix: jc.Source.PathPrefix,
+			Tag:        jc.Source.Tag,
+		}
+		if jc.Source.Principal != "" {
+			selector.Users = append([]string{jc.Source.Principal}, selector.Users...)
+		}
+		principals, err := newPrincipals(ctx, jc.Source.Provider, selector)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", jc.name(), err)
+		}
+
+		var destinations []destinationFactory
+		for _, dc := range jc.Destinations {
+			factories, err := clients.destinations(ctx, dc)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", jc.name(), err)
+			}
+			destinations = append(destinations, factories...)
+		}
+
+		jobsOfConfig, err := newRotationJobs(jc.name(), jc.Source.Provider, principals, destinations)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", jc.name(), err)
+		}
+		jobs = append(jobs, jobsOfConfig...)
+	}
+
+	// Jobs must not overwrite each other's secrets either
+	err := checkDestinations(jobs)
+	if err != nil {
+		return nil, err
+	}
+	rotatorApp := newAccessKeyRotatorAppWithJobs(configStore, jobs, config.GracePeriod, config.Policy)
+	rotatorApp.StateStore, err = newStateStore(ctx, config.State)
+	if err != nil {
+		return nil, fmt.Errorf("state: %s", err)
+	}
+	rotatorApp.LockLease = config.State.LockLease
+	rotatorApp.Verification = config.Verification
+	return rotatorApp, nil
+}
+
+// destinationClients creates the API clients needed by the destinations of a config.
+// Every client is created once and shared by all destinations.
+type destinationClients struct {
+	config      *RotationConfig
+	configStore c.ConfigStore
+
+	github         *s.GithubClient
+	gitlab         s.GitlabVariablesService
+	secretsManager s.SecretsManagerService
+	vault          s.VaultKVService
+	kubernetes     s.KubernetesService
+}
+
+// destinations returns the destinations described by dc
+func (dcs *destinationClients) destinations(ctx context.Context, dc DestinationConfig) ([]destinationFactory, error) {
+	layout, err := dc.layout()
+	if err != nil {
+		return nil, err
+	}
+
+	var destinations []destinationFactory
+	switch dc.Type {
+	case "github":
+		if dcs.github == nil {
+			dcs.github, err = newGithubClient(ctx, dcs.configStore, dcs.config.Github.PrivateKeyPath, s.GithubAppSettings{
+				ApplicationID:  dcs.config.Github.AppID,
+				InstallationID: dcs.config.Github.InstallationID,
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+		options := s.GithubSecretOptions{Visibility: dc.Visibility, SelectedRepos: dc.SelectedRepos}
+		for _, target := range dc.githubTargets() {
+			destinations = append(destinations, githubTargetDestination(dcs.github, target, layout, options, dc.Optional))
+		}
+	case "gitlab":
+		if dcs.gitlab == nil {
+			dcs.gitlab, err = newGitlabClient(ctx, dcs.configStore, dcs.config.Gitlab.TokenPath, dcs.config.Gitlab.URL)
+			if err != nil {
+				return nil, err
+			}
+		}
+		options := s.GitlabVariableOptions{
+			Masked:           dc.Masked,
+			Protected:        dc.Protected,
+			EnvironmentScope: dc.EnvironmentScope,
+		}
+		for _, target := range dc.gitlabTargets() {
+			destinations = append(destinations, gitlabDestination(dcs.gitlab, target, layout, options, dc.Optional))
+		}
+	case "secretsmanager":
+		if dcs.secretsManager == nil {
+			dcs.secretsManager, err = s.NewSecretsManagerClient(ctx)
+			if err != nil {
+				return nil, err
+			}
+		}
+		options := s.SecretsManagerOptions{KMSKeyID: dc.KMSKeyID}
+		destinations = append(destinations, secretsManagerDestination(dcs.secretsManager, layout, options, dc.Optional))
+	case "vault":
+		if dcs.vault == nil {
+			settings, err := dcs.config.Vault.settings()
+			if err != nil {
+				return nil, err
+			}
+			dcs.vault, err = newVaultClient(ctx, dcs.configStore, dcs.config.Vault.TokenPath, settings)
+			if err != nil {
+				return nil, err
+			}
+		}
+		options := s.VaultKVOptions{Mount: dc.Mount, MaxVersions: dc.MaxVersions}
+		destinations = append(destinations, vaultDestination(dcs.vault, layout, options, dc.Optional))
+	case "kubernetes":
+		if dcs.kubernetes == nil {
+			dcs.kubernetes, err = newKubernetesClient(ctx, dcs.configStore, dcs.config.Kubernetes.TokenPath, s.KubernetesSettings{
+				Server: dcs.config.Kubernetes.Server,
+				CAFile: dcs.config.Kubernetes.CAFile,
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+		options := s.KubernetesSecretOptions{
+			Namespace:          dc.Namespace,
+			Labels:             dc.Labels,
+			Annotations:        dc.Annotations,
+			RestartDeployments: dc.RestartDeployments,
+		}
+		destinations = append(destinations, kubernetesDestination(dcs.kubernetes, layout, options, dc.Optional))
+	case "file":
+		file, err := s.NewAgeSecretsFile(s.AgeFileSettings{
+			Path:         dc.Path,
+			Recipients:   dc.Recipients,
+			IdentityFile: dc.IdentityFile,
+			Armor:        dc.Armor,
+		})
+		if err != nil {
+			return nil, err
+		}
+		destinations = append(destinations, fileDestination(file, layout, dc.Optional))
+	default:
+		return nil, fmt.Errorf("unknown destination type %q", dc.Type)
+	}
+	return destinations, nil
+}
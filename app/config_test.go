@@ -0,0 +1,451 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dorneanu/go-key-rotator/mocks"
+	s "github.com/dorneanu/go-key-rotator/secretsstore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+const testRotationConfig = `
+grace_period: 72h
+policy:
+  max_age: 720h
+  never_rotate: [AKIAEXCLUDED]
+github:
+  private_key_path: /github/private-key
+jobs:
+  - name: deploy
+    source:
+      provider: aws
+      path_prefix: /deploy/
+    destinations:
+      - type: github
+        owner: dorneanu
+        repo: access-key-rotator
+        secret_name: AWS_KEY_{{ .Principal | sanitize | upper }}
+      - type: github
+        owner: dorneanu
+        repos: [infra, playground]
+        format: separate
+        id_name: AWS_ACCESS_KEY_ID_{{ .Principal | sanitize | upper }}
+        secret_name: AWS_SECRET_ACCESS_KEY_{{ .Principal | sanitize | upper }}
+        optional: true
+`
+
+func TestParseRotationConfig(t *testing.T) {
+	t.Run("YAML", func(t *testing.T) {
+		config, err := ParseRotationConfig([]byte(testRotationConfig))
+		assert.NoError(t, err)
+		assert.Equal(t, 72*time.Hour, config.GracePeriod)
+		assert.Equal(t, 720*time.Hour, config.Policy.MaxAge)
+		assert.Equal(t, []string{"AKIAEXCLUDED"}, config.Policy.NeverRotate)
+		assert.Equal(t, 1, len(config.Jobs))
+		assert.Equal(t, "/deploy/", config.Jobs[0].Source.PathPrefix)
+		assert.Equal(t, 2, len(config.Jobs[0].Destinations))
+		assert.Equal(t, []string{"access-key-rotator"}, config.Jobs[0].Destinations[0].repos())
+		assert.Equal(t, []string{"infra", "playground"}, config.Jobs[0].Destinations[1].repos())
+		assert.True(t, config.Jobs[0].Destinations[1].Optional)
+
+		layout, err := config.Jobs[0].Destinations[1].layout()
+		assert.NoError(t, err)
+		assert.Equal(t, s.SecretFormatSeparate, layout.Format)
+		assert.Equal(t, []string{"AWS_ACCESS_KEY_ID_{{ .Principal | sanitize | upper }}",
+			"AWS_SECRET_ACCESS_KEY_{{ .Principal | sanitize | upper }}"}, layout.Names())
+	})
+
+	t.Run("JSON", func(t *testing.T) {
+		config, err := ParseRotationConfig([]byte(`{
+			"github": {"private_key_path": "/github/private-key"},
+			"jobs": [{
+				"source": {"provider": "aws", "principal": "deploy"},
+				"destinations": [{"type": "github", "owner": "dorneanu", "repo": "app", "secret_name": "AWS_KEY"}]
+			}]
+		}`))
+		assert.NoError(t, err)
+		assert.Equal(t, "deploy", config.Jobs[0].Source.Principal)
+		assert.Equal(t, "aws", config.Jobs[0].name())
+	})
+
+	t.Run("Unknown fields are rejected", func(t *testing.T) {
+		_, err := ParseRotationConfig([]byte("jobs: []\nmax_age: 720h\n"))
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "max_age")
+	})
+
+	t.Run("All problems are reported", func(t *testing.T) {
+		_, err := ParseRotationConfig([]byte(`
+policy:
+  min_age: 48h
+  max_age: 24h
+verification:
+  attempts: -1
+state:
+  type: dynamodb
+jobs:
+  - name: deploy
+    source:
+      provider: aws
+    destinations:
+      - type: github
+        secret_name: "{{ .Unknown }}"
+  - name: deploy
+    source:
+      provider: openstack
+    destinations:
+      - type: s3
+        format: separate
+        secret_name: AWS_KEY
+`))
+		assert.Error(t, err)
+		for _, problem := range []string{
+			"policy: min_age (48h0m0s) must not exceed max_age (24h0m0s)",
+			"verification: attempts and delay must not be negative",
+			"state: table is required by the dynamodb state store",
+			"jobs[0].source: one of principal, principals, path_prefix or tag is required",
+			"jobs[0].destinations[0].owner: is required",
+			"jobs[0].destinations[0]: repo or repos is required",
+			"jobs[0].destinations[0]: github.private_key_path is required",
+			"jobs[0].destinations[0]: couldn't render secret name template",
+			"jobs[1].destinations[0]: name of the ID secret is required for the separate format",
+			`jobs[1]: job name "deploy" is already used by jobs[0]`,
+			`jobs[1].source.provider: unknown provider "openstack"`,
+			`jobs[1].destinations[0].type: unknown destination type "s3"`,
+		} {
+			assert.Contains(t, err.Error(), problem)
+		}
+	})
+
+	t.Run("Azure client secrets can't be deactivated", func(t *testing.T) {
+		_, err := ParseRotationConfig([]byte(`
+grace_period: 24h
+jobs:
+  - source:
+      provider: azure
+    destinations:
+      - type: github
+        owner: dorneanu
+        repo: access-key-rotator
+        secret_name: AZURE_CLIENT_SECRET
+`))
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "jobs[0].source: principal or principals (application client IDs) is required")
+		assert.Contains(t, err.Error(), "jobs[0].source.provider: azure doesn't support a grace period")
+	})
+
+	t.Run("Grace period of settings is checked as well", func(t *testing.T) {
+		assert.Error(t, validateGracePeriod("azure", time.Hour))
+		assert.NoError(t, validateGracePeriod("azure", 0))
+		assert.NoError(t, validateGracePeriod("aws", time.Hour))
+	})
+
+	t.Run("Jobs are required", func(t *testing.T) {
+		_, err := ParseRotationConfig([]byte("grace_period: 1h\n"))
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "jobs: at least one job is required")
+	})
+}
+
+func TestReadRotationConfig(t *testing.T) {
+	t.Run("From file", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "rotator")
+		assert.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		path := filepath.Join(dir, "rotator.yaml")
+		assert.NoError(t, ioutil.WriteFile(path, []byte(testRotationConfig), 0600))
+
+		config, err := ReadRotationConfig(context.TODO(), &mocks.ConfigStore{}, path, "")
+		assert.NoError(t, err)
+		assert.Equal(t, "deploy", config.Jobs[0].Name)
+	})
+
+	t.Run("From config store", func(t *testing.T) {
+		configStore := &mocks.ConfigStore{}
+		configStore.On("GetValue", mock.Anything, "/rotator/config").Return(testRotationConfig, nil).Once()
+
+		config, err := ReadRotationConfig(context.TODO(), configStore, "", "/rotator/config")
+		assert.NoError(t, err)
+		assert.Equal(t, "deploy", config.Jobs[0].Name)
+		configStore.AssertExpectations(t)
+	})
+
+	t.Run("Config store fails", func(t *testing.T) {
+		configStore := &mocks.ConfigStore{}
+		configStore.On("GetValue", mock.Anything, "/rotator/config").Return("", errors.New("Access denied")).Once()
+
+		_, err := ReadRotationConfig(context.TODO(), configStore, "", "/rotator/config")
+		assert.Error(t, err)
+	})
+
+	t.Run("Missing file", func(t *testing.T) {
+		_, err := ReadRotationConfig(context.TODO(), &mocks.ConfigStore{}, "/does/not/exist.yaml", "")
+		assert.Error(t, err)
+	})
+}
+
+func TestRotationPolicy_merge(t *testing.T) {
+	config := RotationPolicy{MaxAge: 720 * time.Hour, MinAge: time.Hour, NeverRotate: []string{"ID1"}}
+	merged := config.merge(RotationPolicy{MaxAge: 48 * time.Hour})
+	assert.Equal(t, RotationPolicy{MaxAge: 48 * time.Hour, MinAge: time.Hour, NeverRotate: []string{"ID1"}}, merged)
+}
+
+func TestDestinationClients(t *testing.T) {
+	configStore := &mocks.ConfigStore{}
+	configStore.On("GetValue", mock.Anything, "/gitlab/token").Return("TOKEN\n", nil).Once()
+
+	config, err := ParseRotationConfig([]byte(`
+gitlab:
+  url: https://gitlab.example.com
+  token_path: /gitlab/token
+jobs:
+  - source:
+      provider: gcp
+      principal: deploy@project.iam.gserviceaccount.com
+    destinations:
+      - type: gitlab
+        projects: [platform/app, platform/infra]
+        group: platform
+        secret_name: GCP_KEY
+        masked: true
+        environment_scope: production
+      - type: gitlab
+        project: "42"
+        secret_name: GCP_KEY
+      - type: secretsmanager
+        secret_name: ci/{{ .Provider }}
+        kms_key_id: alias/ci
+`))
+	assert.NoError(t, err)
+
+	clients := &destinationClients{config: config, configStore: configStore}
+	var targets []string
+	for _, dc := range config.Jobs[0].Destinations {
+		factories, err := clients.destinations(context.TODO(), dc)
+		assert.NoError(t, err)
+		for _, factory := range factories {
+			dest, err := factory(s.SecretNameData{Provider: "gcp"})
+			assert.NoError(t, err)
+			targets = append(targets, dest.SecretsStore.Destination())
+		}
+	}
+	assert.Equal(t, []string{
+		"gitlab:platform/app/GCP_KEY@production",
+		"gitlab:platform/infra/GCP_KEY@production",
+		"gitlab:group:platform/GCP_KEY@production",
+		"gitlab:42/GCP_KEY",
+		"secretsmanager:ci/gcp",
+	}, targets)
+
+	// The client is only created once
+	configStore.AssertExpectations(t)
+
+	t.Run("Gitlab destinations need a target and a token", func(t *testing.T) {
+		_, err := ParseRotationConfig([]byte(`
+jobs:
+  - source:
+      provider: gcp
+    destinations:
+      - type: gitlab
+        secret_name: GCP_KEY
+`))
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "jobs[0].destinations[0]: project, projects or group is required")
+		assert.Contains(t, err.Error(), "jobs[0].destinations[0]: gitlab.token_path is required")
+		assert.Contains(t, err.Error(), "jobs[0].source: principal or principals (service account emails) is required")
+	})
+}
+
+func TestVaultConfig(t *testing.T) {
+	configStore := &mocks.ConfigStore{}
+	configStore.On("GetValue", mock.Anything, "/vault/secret-id").Return("SECRET-ID\n", nil).Once()
+
+	config, err := ParseRotationConfig([]byte(`
+vault:
+  address: https://vault.example.com
+  auth_method: token
+  token_path: /vault/secret-id
+jobs:
+  - source:
+      provider: aws
+      principal: deploy
+    destinations:
+      - type: vault
+        mount: kv
+        secret_name: ci/{{ .Principal }}
+        max_versions: 3
+`))
+	assert.NoError(t, err)
+
+	settings, err := config.Vault.settings()
+	assert.NoError(t, err)
+	assert.Equal(t, "https://vault.example.com", settings.Address)
+	assert.Equal(t, s.VaultAuthToken, settings.AuthMethod)
+
+	clients := &destinationClients{config: config, configStore: configStore}
+	factories, err := clients.destinations(context.TODO(), config.Jobs[0].Destinations[0])
+	assert.NoError(t, err)
+	dest, err := factories[0](s.SecretNameData{Principal: "deploy"})
+	assert.NoError(t, err)
+	assert.Equal(t, "vault:kv/ci/deploy", dest.SecretsStore.Destination())
+	configStore.AssertExpectations(t)
+
+	t.Run("Unknown auth method", func(t *testing.T) {
+		_, err := ParseRotationConfig([]byte(`
+vault:
+  auth_method: kubernetes
+jobs:
+  - source:
+      provider: aws
+      principal: deploy
+    destinations:
+      - type: vault
+        secret_name: ci/deploy
+`))
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), `vault.auth_method: unknown auth method "kubernetes"`)
+	})
+}
+
+func TestKubernetesConfig(t *testing.T) {
+	configStore := &mocks.ConfigStore{}
+	configStore.On("GetValue", mock.Anything, "/kubernetes/token").Return("TOKEN\n", nil).Once()
+
+	config, err := ParseRotationConfig([]byte(`
+kubernetes:
+  server: https://kubernetes.example.com
+  token_path: /kubernetes/token
+jobs:
+  - source:
+      provider: aws
+      principal: Deploy
+    destinations:
+      - type: kubernetes
+        namespace: ci
+        secret_name: aws-{{ .Principal | lower }}
+        labels:
+          team: platform
+        restart_deployments: true
+`))
+	assert.NoError(t, err)
+
+	clients := &destinationClients{config: config, configStore: configStore}
+	factories, err := clients.destinations(context.TODO(), config.Jobs[0].Destinations[0])
+	assert.NoError(t, err)
+	dest, err := factories[0](s.SecretNameData{Principal: "Deploy"})
+	assert.NoError(t, err)
+	assert.Equal(t, "kubernetes:ci/aws-deploy", dest.SecretsStore.Destination())
+	configStore.AssertExpectations(t)
+
+	t.Run("Separate format isn't supported", func(t *testing.T) {
+		_, err := ParseRotationConfig([]byte(`
+jobs:
+  - source:
+      provider: aws
+      principal: deploy
+    destinations:
+      - type: kubernetes
+        format: separate
+        id_name: aws-id
+        secret_name: aws-secret
+`))
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "jobs[0].destinations[0].format: kubernetes secrets store ID and secret as data keys")
+	})
+}
+
+func TestGithubTargets(t *testing.T) {
+	config, err := ParseRotationConfig([]byte(`
+github:
+  private_key_path: /github/private-key
+jobs:
+  - source:
+      provider: aws
+      principal: deploy
+    destinations:
+      - type: github
+        owner: dorneanu
+        repos: [app, infra]
+        environment: production
+        secret_name: AWS_KEY
+      - type: github
+        owner: dorneanu
+        organization: true
+        app: codespaces
+        visibility: selected
+        selected_repos: [app]
+        secret_name: AWS_KEY
+      - type: github
+        owner: dorneanu
+        repo: app
+        app: dependabot
+        secret_name: AWS_KEY
+      - type: github
+        owner: dorneanu
+        repo: app
+        secret_name: AWS_KEY
+`))
+	assert.NoError(t, err)
+
+	// The client isn't used before keys are published
+	clients := &destinationClients{config: config, github: &s.GithubClient{}}
+	var targets []string
+	for _, dc := range config.Jobs[0].Destinations {
+		factories, err := clients.destinations(context.TODO(), dc)
+		assert.NoError(t, err)
+		for _, factory := range factories {
+			dest, err := factory(s.SecretNameData{})
+			assert.NoError(t, err)
+			targets = append(targets, dest.SecretsStore.Destination())
+		}
+	}
+	assert.Equal(t, []string{
+		"github:dorneanu/app@production/AWS_KEY",
+		"github:dorneanu/infra@production/AWS_KEY",
+		"github-codespaces:org:dorneanu/AWS_KEY",
+		"github-dependabot:dorneanu/app/AWS_KEY",
+		"github:dorneanu/app/AWS_KEY",
+	}, targets)
+
+	t.Run("Invalid targets", func(t *testing.T) {
+		_, err := ParseRotationConfig([]byte(`
+github:
+  private_key_path: /github/private-key
+jobs:
+  - source:
+      provider: aws
+      principal: deploy
+    destinations:
+      - type: github
+        owner: dorneanu
+        organization: true
+        repo: app
+        visibility: selected
+        secret_name: AWS_KEY
+      - type: github
+        owner: dorneanu
+        repo: app
+        app: dependabot
+        environment: production
+        visibility: all
+        secret_name: AWS_KEY
+`))
+		assert.Error(t, err)
+		for _, problem := range []string{
+			"jobs[0].destinations[0]: repo and repos can't be used for organization secrets (use selected_repos)",
+			"jobs[0].destinations[0]: the selected visibility requires at least one repository",
+			"jobs[0].destinations[1]: environment secrets are only supported by actions",
+			"jobs[0].destinations[1]: visibility and selected_repos are only used by organization secrets",
+		} {
+			assert.Contains(t, err.Error(), problem)
+		}
+	})
+}
@@ -0,0 +1,111 @@
+package app
+
+import (
+	"fmt"
+	"strings"
+
+	k "github.com/dorneanu/go-key-rotator/keymanager"
+	s "github.com/dorneanu/go-key-rotator/secretsstore"
+)
+
+// RotationJob binds the keys of a single principal (e.g. an IAM user) to the destinations
+// the rotated keys are published to
+type RotationJob struct {
+	// Name identifies the job within logs and results (e.g. aws:deploy-user)
+	Name         string
+	KeyManager   k.KeyManager
+	Destinations []Destination
+
+	// Provider and Principal tell whose keys are rotated (e.g. aws and deploy-user)
+	Provider  string
+	Principal string
+
+	// Verifier checks new keys before they are published (optional)
+	Verifier k.KeyVerifier
+}
+
+// lockName identifies the principal whose keys are rotated by the job. Jobs rotating the keys
+// of the same principal share it, even if they are run by different configs.
+func (j RotationJob) lockName() string {
+	switch {
+	case j.Provider != "" && j.Principal != "":
+		return j.Provider + ":" + j.Principal
+	case j.Name != "":
+		return j.Name
+	}
+	return "default"
+}
+
+// Destination is a secrets store a job publishes its rotated keys to
+type Destination struct {
+	SecretsStore s.SecretsStore
+
+	// Optional destinations don't cause a rotation to fail (and to be rolled back)
+	// if they can't be updated
+	Optional bool
+}
+
+// orderedDestinations returns the required destinations followed by the optional ones
+func (j RotationJob) orderedDestinations() []Destination {
+	ordered := make([]Destination, 0, len(j.Destinations))
+	for _, optional := range []bool{false, true} {
+		for _, dest := range j.Destinations {
+			if dest.Optional == optional {
+				ordered = append(ordered, dest)
+			}
+		}
+	}
+	return ordered
+}
+
+// KeyRotation describes a key which has been replaced by a new one
+type KeyRotation struct {
+	OldKeyID string
+	NewKeyID string
+}
+
+// JobResult holds the outcome of a single rotation job
+type JobResult struct {
+	Job     string
+	Rotated []KeyRotation
+	Err     error
+
+	// Transaction lists the changes made by the job and tells how far they were undone if it failed
+	Transaction *RotationTransaction
+}
+
+// String returns a human readable summary of the result
+func (r JobResult) String() string {
+	if r.Err != nil && r.Transaction != nil && len(r.Transaction.Steps) > 0 {
+		return fmt.Sprintf("%s: failed: %s [%s]", r.Job, r.Err, r.Transaction)
+	}
+	if r.Err != nil {
+		return fmt.Sprintf("%s: failed: %s", r.Job, r.Err)
+	}
+	if len(r.Rotated) == 0 {
+		return fmt.Sprintf("%s: no keys rotated", r.Job)
+	}
+
+	rotated := make([]string, 0, len(r.Rotated))
+	for _, rot := range r.Rotated {
+		rotated = append(rotated, fmt.Sprintf("%s -> %s", rot.OldKeyID, rot.NewKeyID))
+	}
+	return fmt.Sprintf("%s: rotated %s", r.Job, strings.Join(rotated, ", "))
+}
+
+// jobsError summarizes the failed jobs within results (if any)
+func jobsError(results []JobResult) error {
+	var failed []string
+	for _, r := range results {
+		if r.Err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %s", r.Job, r.Err))
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	if len(results) == 1 {
+		return results[0].Err
+	}
+	return fmt.Errorf("%d of %d jobs failed: %s", len(failed), len(results), strings.Join(failed, "; "))
+}
@@ -0,0 +1,211 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/dorneanu/go-key-rotator/entity"
+	"github.com/dorneanu/go-key-rotator/mocks"
+	s "github.com/dorneanu/go-key-rotator/secretsstore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestNewRotationJobs(t *testing.T) {
+	principals := []principal{
+		{name: "deploy", keyManager: &mocks.KeyManager{}},
+		{name: "ci-user", keyManager: &mocks.KeyManager{}},
+	}
+
+	var secretNames []string
+	newDestination := func(secretName string) destinationFactory {
+		return func(data s.SecretNameData) (Destination, error) {
+			name, err := s.RenderSecretName(secretName, data)
+			if err != nil {
+				return Destination{}, err
+			}
+			secretNames = append(secretNames, name)
+
+			store := &mocks.SecretsStore{}
+			store.On("Destination").Return("github:owner/repo/" + name)
+			return Destination{SecretsStore: store}, nil
+		}
+	}
+
+	t.Run("Every principal gets its own secret", func(t *testing.T) {
+		secretNames = nil
+		jobs, err := newRotationJobs("aws", "aws", principals, []destinationFactory{
+			newDestination("AWS_KEY_{{ .Principal | sanitize | upper }}"),
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, 2, len(jobs))
+		assert.Equal(t, "aws:deploy", jobs[0].Name)
+		assert.Equal(t, "aws:ci-user", jobs[1].Name)
+		assert.Equal(t, 1, len(jobs[0].Destinations))
+		assert.Equal(t, []string{"AWS_KEY_DEPLOY", "AWS_KEY_CI_USER"}, secretNames)
+	})
+
+	t.Run("Multiple destinations", func(t *testing.T) {
+		secretNames = nil
+		jobs, err := newRotationJobs("deploy", "aws", principals[:1], []destinationFactory{
+			newDestination("AWS_KEY_{{ .Provider | upper }}"),
+			newDestination("{{ .Principal | upper }}_KEY"),
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, "deploy:deploy", jobs[0].Name)
+		assert.Equal(t, 2, len(jobs[0].Destinations))
+		assert.Equal(t, []string{"AWS_KEY_AWS", "DEPLOY_KEY"}, secretNames)
+	})
+
+	t.Run("Principals must not share a secret", func(t *testing.T) {
+		_, err := newRotationJobs("aws", "aws", principals, []destinationFactory{newDestination("AWS_KEY")})
+		assert.Error(t, err)
+	})
+
+	t.Run("Invalid template", func(t *testing.T) {
+		_, err := newRotationJobs("aws", "aws", principals, []destinationFactory{newDestination("{{ .Unknown }}")})
+		assert.Error(t, err)
+	})
+
+	t.Run("No principals", func(t *testing.T) {
+		_, err := newRotationJobs("aws", "aws", nil, []destinationFactory{newDestination("AWS_KEY")})
+		assert.Error(t, err)
+	})
+}
+
+func TestRunJobs(t *testing.T) {
+	// First job rotates successfully
+	okKeyManager := &mocks.KeyManager{}
+	okKeyManager.On("ListAccessKeys", mock.Anything).Return([]entity.AccessKey{
+		{ID: "OLD1", Status: entity.KeyStatusActive},
+	}, nil).Once()
+	okKeyManager.On("RotateAccessKey", mock.Anything, "OLD1").Return(entity.AccessKey{ID: "NEW1"}, nil).Once()
+	okKeyManager.On("DeleteAccessKey", mock.Anything, "OLD1").Return(nil).Once()
+
+	okSecretsStore := &mocks.SecretsStore{}
+	okSecretsStore.On("EncryptKey", mock.Anything, mock.AnythingOfType("entity.AccessKey")).
+		Return(&entity.EncryptedKey{ID: "NEW1"}, nil).Once()
+	okSecretsStore.On("CreateSecret", mock.Anything, mock.AnythingOfType("entity.EncryptedKey")).
+		Return(nil).Once()
+	okSecretsStore.On("Destination").Return("github:owner/repo/AWS_KEY_DEPLOY")
+
+	// Second job can't list its keys
+	failingKeyManager := &mocks.KeyManager{}
+	failingKeyManager.On("ListAccessKeys", mock.Anything).Return(nil, errors.New("Access denied")).Once()
+
+	rotatorApp := &AccessKeyRotatorApp{
+		Jobs: []RotationJob{
+			{Name: "aws:deploy", KeyManager: okKeyManager, Destinations: []Destination{{SecretsStore: okSecretsStore}}},
+			{Name: "aws:ci", KeyManager: failingKeyManager, Destinations: []Destination{{SecretsStore: &mocks.SecretsStore{}}}},
+		},
+	}
+
+	results := rotatorApp.RunJobs(context.TODO())
+	assert.Equal(t, 2, len(results))
+	assert.NoError(t, results[0].Err)
+	assert.Equal(t, []KeyRotation{{OldKeyID: "OLD1", NewKeyID: "NEW1"}}, results[0].Rotated)
+	assert.Error(t, results[1].Err)
+	okKeyManager.AssertExpectations(t)
+	okSecretsStore.AssertExpectations(t)
+
+	// UploadSecrets reports the failed job
+	failingKeyManager.On("ListAccessKeys", mock.Anything).Return(nil, errors.New("Access denied")).Once()
+	okKeyManager.On("ListAccessKeys", mock.Anything).Return([]entity.AccessKey{}, nil).Once()
+	err := rotatorApp.UploadSecrets(context.TODO())
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "aws:ci")
+}
+
+func TestListKeysMultipleJobs(t *testing.T) {
+	first := &mocks.KeyManager{}
+	first.On("ListAccessKeys", mock.Anything).Return([]entity.AccessKey{{ID: "ID1", Owner: "deploy"}}, nil).Once()
+	second := &mocks.KeyManager{}
+	second.On("ListAccessKeys", mock.Anything).Return([]entity.AccessKey{{ID: "ID2", Owner: "ci"}}, nil).Once()
+
+	rotatorApp := &AccessKeyRotatorApp{
+		Jobs: []RotationJob{
+			{Name: "aws:deploy", KeyManager: first},
+			{Name: "aws:ci", KeyManager: second},
+		},
+	}
+
+	keys, err := rotatorApp.ListKeys(context.TODO())
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(keys))
+}
+
+func TestPublishKeyFanOut(t *testing.T) {
+	newStore := func(destination string, uploadErr error) *mocks.SecretsStore {
+		store := &mocks.SecretsStore{}
+		store.On("Destination").Return(destination)
+		store.On("EncryptKey", mock.Anything, mock.AnythingOfType("entity.AccessKey")).
+			Return(&entity.EncryptedKey{ID: "NEW"}, nil).Maybe()
+		store.On("CreateSecret", mock.Anything, mock.AnythingOfType("entity.EncryptedKey")).
+			Return(uploadErr).Maybe()
+		return store
+	}
+
+	newApp := func(destinations ...Destination) (*AccessKeyRotatorApp, *mocks.KeyManager) {
+		keyManager := &mocks.KeyManager{}
+		keyManager.On("ListAccessKeys", mock.Anything).Return([]entity.AccessKey{
+			{ID: "OLD", Status: entity.KeyStatusActive},
+		}, nil).Once()
+		keyManager.On("RotateAccessKey", mock.Anything, "OLD").Return(entity.AccessKey{ID: "NEW"}, nil).Once()
+		return &AccessKeyRotatorApp{
+			Jobs: []RotationJob{{Name: "aws:deploy", KeyManager: keyManager, Destinations: destinations}},
+		}, keyManager
+	}
+
+	t.Run("Key is written to every destination", func(t *testing.T) {
+		first := newStore("github:owner/app/AWS_KEY", nil)
+		second := newStore("github:owner/infra/AWS_KEY", nil)
+		rotatorApp, keyManager := newApp(Destination{SecretsStore: first}, Destination{SecretsStore: second})
+		keyManager.On("DeleteAccessKey", mock.Anything, "OLD").Return(nil).Once()
+
+		err := rotatorApp.UploadSecrets(context.TODO())
+		assert.NoError(t, err)
+		first.AssertNumberOfCalls(t, "CreateSecret", 1)
+		second.AssertNumberOfCalls(t, "CreateSecret", 1)
+		keyManager.AssertExpectations(t)
+	})
+
+	t.Run("Failing required destination keeps a key which can't be unpublished", func(t *testing.T) {
+		optional := newStore("github:owner/playground/AWS_KEY", nil)
+		first := newStore("github:owner/app/AWS_KEY", nil)
+		failing := newStore("github:owner/infra/AWS_KEY", errors.New("Upload failed"))
+		rotatorApp, keyManager := newApp(
+			Destination{SecretsStore: optional, Optional: true},
+			Destination{SecretsStore: first},
+			Destination{SecretsStore: failing},
+		)
+
+		results := rotatorApp.RunJobs(context.TODO())
+		err := results[0].Err
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "github:owner/infra/AWS_KEY: Couldn't upload secrets: Upload failed")
+		assert.Contains(t, err.Error(), "new key NEW is kept, it is published to: github:owner/app/AWS_KEY")
+		assert.Contains(t, err.Error(), "old key OLD is still published to: github:owner/infra/AWS_KEY, github:owner/playground/AWS_KEY")
+		assert.Equal(t, TransactionPartiallyRolledBack, results[0].Transaction.State)
+		keyManager.AssertExpectations(t)
+
+		// Neither the published new key nor the old key which is still in use is deleted
+		keyManager.AssertNotCalled(t, "DeleteAccessKey", mock.Anything, mock.Anything)
+		keyManager.AssertNotCalled(t, "DeactivateAccessKey", mock.Anything, mock.Anything)
+
+		// Optional destinations are updated last
+		optional.AssertNotCalled(t, "CreateSecret", mock.Anything, mock.Anything)
+	})
+
+	t.Run("Failing optional destination doesn't fail the rotation", func(t *testing.T) {
+		required := newStore("github:owner/app/AWS_KEY", nil)
+		optional := newStore("github:owner/playground/AWS_KEY", errors.New("Upload failed"))
+		rotatorApp, keyManager := newApp(Destination{SecretsStore: required}, Destination{SecretsStore: optional, Optional: true})
+		keyManager.On("DeleteAccessKey", mock.Anything, "OLD").Return(nil).Once()
+
+		results := rotatorApp.RunJobs(context.TODO())
+		assert.NoError(t, results[0].Err)
+		assert.Equal(t, []KeyRotation{{OldKeyID: "OLD", NewKeyID: "NEW"}}, results[0].Rotated)
+		keyManager.AssertExpectations(t)
+	})
+}
@@ -0,0 +1,128 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	st "github.com/dorneanu/go-key-rotator/statestore"
+)
+
+// rotationJournal records the rotations of a job within the state store. Without a
+// state store, the records are only kept in memory.
+type rotationJournal struct {
+	store st.StateStore
+	job   RotationJob
+	now   func() time.Time
+
+	records []*st.RotationRecord
+
+	// firstSteps holds the index of the first transaction step of every record
+	firstSteps []int
+}
+
+// newJournal returns the journal of a job
+func (a *AccessKeyRotatorApp) newJournal(job RotationJob) *rotationJournal {
+	return &rotationJournal{store: a.StateStore, job: job, now: time.Now}
+}
+
+// current returns the record of the rotation in progress
+func (j *rotationJournal) current() *st.RotationRecord {
+	return j.records[len(j.records)-1]
+}
+
+// start records the beginning of the rotation of a key. Its changes are recorded
+// by tx starting with the next step.
+func (j *rotationJournal) start(ctx context.Context, tx *RotationTransaction, oldKeyID string) error {
+	now := j.now().UTC()
+	r := &st.RotationRecord{
+		ID:        fmt.Sprintf("%s/%s", now.Format("20060102T150405.000000000Z"), oldKeyID),
+		Job:       j.job.Name,
+		Provider:  j.job.Provider,
+		Principal: j.job.Principal,
+		OldKeyID:  oldKeyID,
+		StartedAt: now,
+	}
+	r.Log(now, st.PhaseStarted, "")
+	j.records = append(j.records, r)
+	j.firstSteps = append(j.firstSteps, len(tx.Steps))
+	return j.save(ctx, r)
+}
+
+// log moves the rotation in progress to the specified phase
+func (j *rotationJournal) log(ctx context.Context, phase st.RotationPhase, message string) error {
+	r := j.current()
+	r.Log(j.now().UTC(), phase, message)
+	return j.save(ctx, r)
+}
+
+// keyCreated records the ID of the new key
+func (j *rotationJournal) keyCreated(ctx context.Context, newKeyID string) error {
+	j.current().NewKeyID = newKeyID
+	return j.log(ctx, st.PhaseKeyCreated, newKeyID)
+}
+
+// published records a destination which holds the new key
+func (j *rotationJournal) published(ctx context.Context, destination string) error {
+	r := j.current()
+	r.Published = append(r.Published, destination)
+	r.UpdatedAt = j.now().UTC()
+	return j.save(ctx, r)
+}
+
+// finish records the outcome of a failed job. Rotations which have been undone completely are rolled back.
+// Completed rotations which were kept stay completed, all other ones failed and need attention.
+func (j *rotationJournal) finish(ctx context.Context, tx *RotationTransaction, jobErr error) {
+	for i, r := range j.records {
+		last := len(tx.Steps)
+		if i+1 < len(j.firstSteps) {
+			last = j.firstSteps[i+1]
+		}
+		steps := tx.Steps[j.firstSteps[i]:last]
+
+		undone, kept := 0, 0
+		for _, step := range steps {
+			switch step.State {
+			case StepUndone:
+				undone++
+			case StepKept:
+				kept++
+			}
+		}
+		if kept == len(steps) && r.Phase == st.PhaseCompleted {
+			continue
+		}
+		phase := st.PhaseFailed
+		if undone == len(steps) {
+			phase = st.PhaseRolledBack
+		}
+
+		r.Outcome = fmt.Sprintf("%s (%s)", jobErr, tx.State)
+		r.Log(j.now().UTC(), phase, r.Outcome)
+		err := j.save(ctx, r)
+		if err != nil {
+			log.Printf("Couldn't save outcome of rotation %s: %s\n", r.ID, err)
+		}
+	}
+}
+
+// save writes a record to the state store (if any)
+func (j *rotationJournal) save(ctx context.Context, r *st.RotationRecord) error {
+	if j.store == nil {
+		return nil
+	}
+	err := j.store.SaveRotation(ctx, *r)
+	if err != nil {
+		return fmt.Errorf("Couldn't save rotation state: %s", err)
+	}
+	return nil
+}
+
+// Rotations returns the journal of the rotations of a job (or of all jobs) ordered by their start
+func (a *AccessKeyRotatorApp) Rotations(ctx context.Context, job string) ([]st.RotationRecord, error) {
+	if a.StateStore == nil {
+		return nil, fmt.Errorf("no state store configured")
+	}
+	return a.StateStore.ListRotations(ctx, job)
+}
@@ -0,0 +1,102 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dorneanu/go-key-rotator/entity"
+	"github.com/dorneanu/go-key-rotator/mocks"
+	s "github.com/dorneanu/go-key-rotator/secretsstore"
+	st "github.com/dorneanu/go-key-rotator/statestore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestRunJobJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	newApp := func(keyManager *mocks.KeyManager, store *mocks.SecretsStore, state st.StateStore) *AccessKeyRotatorApp {
+		jobs, err := newRotationJobs("aws", "aws", []principal{{name: "deploy", keyManager: keyManager}}, []destinationFactory{
+			func(data s.SecretNameData) (Destination, error) {
+				return Destination{SecretsStore: store}, nil
+			},
+		})
+		assert.NoError(t, err)
+		rotatorApp := newAccessKeyRotatorAppWithJobs(&mocks.ConfigStore{}, jobs, 0, RotationPolicy{})
+		rotatorApp.StateStore = state
+		return rotatorApp
+	}
+
+	newStore := func(uploadErr error) *mocks.SecretsStore {
+		store := &mocks.SecretsStore{}
+		store.On("Destination").Return("github:owner/app/AWS_KEY")
+		store.On("EncryptKey", mock.Anything, mock.AnythingOfType("entity.AccessKey")).Return(&entity.EncryptedKey{}, nil)
+		store.On("CreateSecret", mock.Anything, mock.AnythingOfType("entity.EncryptedKey")).Return(uploadErr)
+		return store
+	}
+
+	t.Run("Completed rotation", func(t *testing.T) {
+		state := st.NewFileStateStore(filepath.Join(dir, "completed.json"))
+		keyManager := &mocks.KeyManager{}
+		keyManager.On("ListAccessKeys", mock.Anything).Return([]entity.AccessKey{{ID: "OLD", Status: entity.KeyStatusActive}}, nil).Once()
+		keyManager.On("RotateAccessKey", mock.Anything, "OLD").Return(entity.AccessKey{ID: "NEW", Secret: "secret"}, nil).Once()
+		keyManager.On("DeleteAccessKey", mock.Anything, "OLD").Return(nil).Once()
+
+		rotatorApp := newApp(keyManager, newStore(nil), state)
+		assert.NoError(t, rotatorApp.UploadSecrets(context.TODO()))
+
+		records, err := rotatorApp.Rotations(context.TODO(), "aws:deploy")
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(records))
+		assert.Equal(t, "aws", records[0].Provider)
+		assert.Equal(t, "deploy", records[0].Principal)
+		assert.Equal(t, "OLD", records[0].OldKeyID)
+		assert.Equal(t, "NEW", records[0].NewKeyID)
+		assert.Equal(t, st.PhaseCompleted, records[0].Phase)
+		assert.Equal(t, []string{"github:owner/app/AWS_KEY"}, records[0].Published)
+
+		var phases []st.RotationPhase
+		for _, entry := range records[0].Journal {
+			phases = append(phases, entry.Phase)
+		}
+		assert.Equal(t, []st.RotationPhase{st.PhaseStarted, st.PhaseKeyCreated, st.PhasePublished, st.PhaseRetired, st.PhaseCompleted}, phases)
+
+		// Secrets never end up in the state
+		content, err := ioutil.ReadFile(filepath.Join(dir, "completed.json"))
+		assert.NoError(t, err)
+		assert.NotContains(t, string(content), "secret\"")
+	})
+
+	t.Run("Rolled back rotation", func(t *testing.T) {
+		state := st.NewFileStateStore(filepath.Join(dir, "rolled-back.json"))
+		keyManager := &mocks.KeyManager{}
+		keyManager.On("ListAccessKeys", mock.Anything).Return([]entity.AccessKey{{ID: "OLD", Status: entity.KeyStatusActive}}, nil).Once()
+		keyManager.On("RotateAccessKey", mock.Anything, "OLD").Return(entity.AccessKey{ID: "NEW"}, nil).Once()
+		keyManager.On("DeleteAccessKey", mock.Anything, "NEW").Return(nil).Once()
+
+		rotatorApp := newApp(keyManager, newStore(errors.New("Upload failed")), state)
+		assert.Error(t, rotatorApp.UploadSecrets(context.TODO()))
+
+		records, err := rotatorApp.Rotations(context.TODO(), "")
+		assert.NoError(t, err)
+		assert.Equal(t, st.PhaseRolledBack, records[0].Phase)
+		assert.Contains(t, records[0].Outcome, "Upload failed")
+		assert.Contains(t, records[0].Outcome, string(TransactionRolledBack))
+		keyManager.AssertExpectations(t)
+	})
+
+	t.Run("Rotation can't be started without saving its state", func(t *testing.T) {
+		keyManager := &mocks.KeyManager{}
+		keyManager.On("ListAccessKeys", mock.Anything).Return([]entity.AccessKey{{ID: "OLD", Status: entity.KeyStatusActive}}, nil).Once()
+
+		rotatorApp := newApp(keyManager, newStore(nil), st.NewFileStateStore(filepath.Join(dir, "missing", "state.json")))
+		assert.Error(t, rotatorApp.UploadSecrets(context.TODO()))
+		keyManager.AssertNotCalled(t, "RotateAccessKey", mock.Anything, mock.Anything)
+	})
+}
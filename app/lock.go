@@ -0,0 +1,37 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	st "github.com/dorneanu/go-key-rotator/statestore"
+)
+
+// lockJob locks the principal of a job so that no one else changes its keys at the same time
+// (e.g. the Lambda and someone running the CLI). Locks are kept by the state store if it supports
+// them, otherwise a warning is logged. The returned function releases the lock.
+func (a *AccessKeyRotatorApp) lockJob(ctx context.Context, job RotationJob) (func(), error) {
+	locker, ok := a.StateStore.(st.Locker)
+	if !ok {
+		log.Printf("Warning: no state store supporting locks is configured, keys of %s aren't protected against concurrent changes\n", job.lockName())
+		return func() {}, nil
+	}
+
+	lease := a.LockLease
+	if lease <= 0 {
+		lease = st.DefaultLockLease
+	}
+	name, holder := job.lockName(), st.NewLockHolder()
+	err := locker.Lock(ctx, name, holder, lease)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't acquire lock: %s", err)
+	}
+
+	return func() {
+		err := locker.Unlock(ctx, name, holder)
+		if err != nil {
+			log.Printf("Couldn't release lock: %s\n", err)
+		}
+	}, nil
+}
@@ -0,0 +1,104 @@
+package app
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dorneanu/go-key-rotator/entity"
+	"github.com/dorneanu/go-key-rotator/mocks"
+	st "github.com/dorneanu/go-key-rotator/statestore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestLockJob(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	state := st.NewFileStateStore(filepath.Join(dir, "state.json"))
+	ctx := context.TODO()
+
+	newApp := func(keyManager *mocks.KeyManager) *AccessKeyRotatorApp {
+		return &AccessKeyRotatorApp{
+			Jobs: []RotationJob{
+				{Name: "deploy", Provider: "aws", Principal: "deploy", KeyManager: keyManager},
+				{Name: "ci", Provider: "aws", Principal: "ci", KeyManager: keyManager},
+			},
+			Policy:     RotationPolicy{MaxAge: 1000 * time.Hour},
+			StateStore: state,
+		}
+	}
+
+	t.Run("Locked principals are left alone", func(t *testing.T) {
+		assert.NoError(t, state.Lock(ctx, "aws:deploy", "lambda", time.Minute))
+		defer state.Unlock(ctx, "aws:deploy", "lambda")
+
+		keyManager := &mocks.KeyManager{}
+		keyManager.On("ListAccessKeys", mock.Anything).Return([]entity.AccessKey{
+			{ID: "KEY", Status: entity.KeyStatusActive, CreatedAt: time.Now()},
+		}, nil)
+
+		rotatorApp := newApp(keyManager)
+		results := rotatorApp.RunJobs(ctx)
+		assert.Error(t, results[0].Err)
+		assert.Contains(t, results[0].Err.Error(), "aws:deploy is locked by lambda")
+		assert.NoError(t, results[1].Err)
+		keyManager.AssertNumberOfCalls(t, "ListAccessKeys", 1)
+
+		// Keys of a locked principal can't be changed by hand either
+		err := rotatorApp.Reactivate(ctx, "KEY")
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "aws:deploy is locked by lambda")
+		keyManager.AssertNotCalled(t, "ActivateAccessKey", mock.Anything, mock.Anything)
+
+		err = rotatorApp.Rotate(ctx, "KEY")
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "aws:deploy is locked by lambda")
+		keyManager.AssertNotCalled(t, "RotateAccessKey", mock.Anything, mock.Anything)
+	})
+
+	t.Run("Manual changes hold the lock", func(t *testing.T) {
+		keyManager := &mocks.KeyManager{}
+		keyManager.On("ListAccessKeys", mock.Anything).Return([]entity.AccessKey{
+			{ID: "KEY", Status: entity.KeyStatusInactive, CreatedAt: time.Now()},
+		}, nil)
+		keyManager.On("ActivateAccessKey", mock.Anything, "KEY").Run(func(args mock.Arguments) {
+			// Someone else can't get the lock while the key is changed
+			err := state.Lock(ctx, "aws:deploy", "lambda", time.Minute)
+			assert.Error(t, err)
+			assert.IsType(t, &st.LockedError{}, err)
+		}).Return(nil).Once()
+
+		assert.NoError(t, newApp(keyManager).Reactivate(ctx, "KEY"))
+		keyManager.AssertExpectations(t)
+
+		// The lock is released afterwards
+		assert.NoError(t, state.Lock(ctx, "aws:deploy", "lambda", time.Minute))
+		assert.NoError(t, state.Unlock(ctx, "aws:deploy", "lambda"))
+	})
+
+	t.Run("Locks are released after a run", func(t *testing.T) {
+		keyManager := &mocks.KeyManager{}
+		keyManager.On("ListAccessKeys", mock.Anything).Return([]entity.AccessKey{}, nil)
+
+		results := newApp(keyManager).RunJobs(ctx)
+		assert.NoError(t, results[0].Err)
+		assert.NoError(t, results[1].Err)
+
+		for _, name := range []string{"aws:deploy", "aws:ci"} {
+			assert.NoError(t, state.Lock(ctx, name, "lambda", time.Minute))
+			assert.NoError(t, state.Unlock(ctx, name, "lambda"))
+		}
+	})
+
+	t.Run("Lock names", func(t *testing.T) {
+		assert.Equal(t, "aws:deploy", RotationJob{Name: "production", Provider: "aws", Principal: "deploy"}.lockName())
+		assert.Equal(t, "production", RotationJob{Name: "production"}.lockName())
+		assert.Equal(t, "default", RotationJob{}.lockName())
+	})
+}
@@ -0,0 +1,300 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/dorneanu/go-key-rotator/entity"
+	k "github.com/dorneanu/go-key-rotator/keymanager"
+)
+
+// ActionType describes what kind of change a PlannedAction would make
+type ActionType string
+
+const (
+	ActionCreateKey     ActionType = "create key"
+	ActionDeactivateKey ActionType = "deactivate key"
+	ActionDeleteKey     ActionType = "delete key"
+	ActionWriteSecret   ActionType = "write secret"
+	ActionSkipKey       ActionType = "skip key"
+)
+
+// PlannedAction is a single step the rotator would take
+type PlannedAction struct {
+	Job    string
+	Type   ActionType
+	Target string
+	Reason string
+}
+
+// String returns a human readable representation of the action
+func (a PlannedAction) String() string {
+	action := fmt.Sprintf("%-15s %s", a.Type, a.Target)
+	if a.Job != "" {
+		action = fmt.Sprintf("[%s] %s", a.Job, action)
+	}
+	if a.Reason == "" {
+		return action
+	}
+	return fmt.Sprintf("%s (%s)", action, a.Reason)
+}
+
+// RotationPlan lists all steps the rotator would take, in the order they would be taken
+type RotationPlan struct {
+	Actions []PlannedAction
+}
+
+func (p *RotationPlan) add(job RotationJob, t ActionType, target, reason string) {
+	p.Actions = append(p.Actions, PlannedAction{Job: job.Name, Type: t, Target: target, Reason: reason})
+}
+
+// Changes returns true if the plan contains at least one change
+func (p *RotationPlan) Changes() bool {
+	for _, a := range p.Actions {
+		if a.Type != ActionSkipKey {
+			return true
+		}
+	}
+	return false
+}
+
+// PlanUploadSecrets computes what UploadSecrets would do without changing anything
+func (a *AccessKeyRotatorApp) PlanUploadSecrets(ctx context.Context) (*RotationPlan, error) {
+	plan := &RotationPlan{}
+	for _, job := range a.jobs() {
+		err := a.planJob(ctx, plan, job)
+		if err != nil {
+			if job.Name != "" {
+				return nil, fmt.Errorf("%s: %s", job.Name, err)
+			}
+			return nil, err
+		}
+	}
+	return plan, nil
+}
+
+// planJob adds the steps of a single job to the plan
+func (a *AccessKeyRotatorApp) planJob(ctx context.Context, plan *RotationPlan, job RotationJob) error {
+	keys, err := job.KeyManager.ListAccessKeys(ctx)
+	if err != nil {
+		return fmt.Errorf("Couldn't get list of keys: %s", err)
+	}
+
+	now := time.Now()
+
+	// Rotations interrupted during previous runs
+	resumed, keys, err := a.planResumptions(ctx, plan, job, keys)
+	if err != nil {
+		return err
+	}
+
+	// Keys replaced during previous runs
+	retired, err := a.retiredKeys(ctx, job)
+	if err != nil {
+		return err
+	}
+	expired := a.expiredKeys(keys, retired, now)
+	for _, key := range expired {
+		reason := fmt.Sprintf("grace period of %s is over", a.GracePeriod)
+		if keyExpired(key, now) {
+			reason = "expired at " + key.ExpiresAt.Format(time.RFC3339)
+		}
+		plan.add(job, ActionDeleteKey, key.ID, reason)
+	}
+	remaining := withoutKeys(keys, expired)
+
+	for _, key := range withoutKeys(keys, expired) {
+		decision := a.Policy.Evaluate(key, now)
+		if resumed[key.ID] && key.IsActive() {
+			decision = RotationDecision{Key: key, Rotate: true, Reason: "destinations hold a rolled back key"}
+		}
+		if !decision.Rotate {
+			plan.add(job, ActionSkipKey, key.ID, decision.Reason)
+			continue
+		}
+
+		remaining, err = a.planRotation(plan, job, remaining, key, decision.Reason, retired, now)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// planResumptions adds the steps needed to resume interrupted rotations to the plan. The IDs of the
+// old keys which would be rotated again and the keys which would exist afterwards are returned.
+func (a *AccessKeyRotatorApp) planResumptions(ctx context.Context, plan *RotationPlan, job RotationJob, keys []entity.AccessKey) (map[string]bool, []entity.AccessKey, error) {
+	if a.StateStore == nil {
+		return nil, keys, nil
+	}
+	records, err := a.StateStore.ListRotations(ctx, job.Name)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Couldn't read rotation state: %s", err)
+	}
+
+	rotate := make(map[string]bool)
+	keys = withoutKeys(keys, nil)
+	for _, res := range a.resumptions(records, keys) {
+		if res.Rotate {
+			rotate[res.Record.OldKeyID] = true
+		}
+
+		reason := fmt.Sprintf("resumes rotation %s: %s", res.Record.ID, res.Reason)
+		switch res.Action {
+		case ActionDeleteKey:
+			keys = withoutKeys(keys, []entity.AccessKey{{ID: res.Target}})
+		case ActionDeactivateKey:
+			for i := range keys {
+				if keys[i].ID == res.Target {
+					keys[i].Status = entity.KeyStatusInactive
+				}
+			}
+		default:
+			continue
+		}
+		plan.add(job, res.Action, res.Target, reason)
+	}
+	return rotate, keys, nil
+}
+
+// PlanRotate computes what Rotate would do without changing anything
+func (a *AccessKeyRotatorApp) PlanRotate(ctx context.Context, access_key_id string) (*RotationPlan, error) {
+	if access_key_id == "" {
+		return nil, fmt.Errorf("access_key_id is empty")
+	}
+
+	job, err := a.jobForKey(ctx, access_key_id)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := job.KeyManager.ListAccessKeys(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't get list of keys: %s", err)
+	}
+
+	retired, err := a.retiredKeys(ctx, job)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range keys {
+		if key.ID != access_key_id {
+			continue
+		}
+
+		plan := &RotationPlan{}
+		_, err = a.planRotation(plan, job, keys, key, "requested", retired, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		return plan, nil
+	}
+	return nil, fmt.Errorf("Couldn't find key (id = %s)", access_key_id)
+}
+
+// planRotation adds the steps needed to replace key to the plan. remaining contains the keys which
+// would exist at that point and retired the keys retired by previous rotations. The keys which would
+// exist after the rotation are returned.
+func (a *AccessKeyRotatorApp) planRotation(plan *RotationPlan, job RotationJob, remaining []entity.AccessKey, key entity.AccessKey, reason string, retired map[string]time.Time, now time.Time) ([]entity.AccessKey, error) {
+	if len(job.Destinations) == 0 {
+		return nil, fmt.Errorf("no secrets store configured")
+	}
+
+	// The key manager might have to make room for the new key
+	victim, found, err := a.roomForKey(job, remaining, key.ID, retired, now)
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		plan.add(job, ActionDeleteKey, victim.ID, "making room for new key")
+		remaining = withoutKeys(remaining, []entity.AccessKey{victim})
+	}
+
+	owner := key.Owner
+	if owner == "" {
+		owner = "owner of " + key.ID
+	}
+	plan.add(job, ActionCreateKey, owner, fmt.Sprintf("replaces %s: %s", key.ID, reason))
+	for _, dest := range job.orderedDestinations() {
+		reason := "new key of " + owner
+		if dest.Optional {
+			reason += ", optional"
+		}
+		plan.add(job, ActionWriteSecret, dest.SecretsStore.Destination(), reason)
+	}
+
+	if a.GracePeriod > 0 {
+		plan.add(job, ActionDeactivateKey, key.ID, fmt.Sprintf("will be deleted after %s", a.GracePeriod))
+		for i := range remaining {
+			if remaining[i].ID == key.ID {
+				remaining[i].Status = entity.KeyStatusInactive
+			}
+		}
+	} else {
+		plan.add(job, ActionDeleteKey, key.ID, "replaced by new key")
+		remaining = withoutKeys(remaining, []entity.AccessKey{key})
+	}
+
+	// Placeholder for the new key
+	return append(remaining, entity.AccessKey{Owner: key.Owner, Status: entity.KeyStatusActive}), nil
+}
+
+// roomForKey returns the inactive key the key manager deletes in order to make room for the key
+// replacing id (found is false if there is enough room). Keys retired by previous rotations might
+// still be in use until their grace period is over, so the rotation fails instead of deleting them.
+func (a *AccessKeyRotatorApp) roomForKey(job RotationJob, keys []entity.AccessKey, id string, retired map[string]time.Time, now time.Time) (entity.AccessKey, bool, error) {
+	limiter, ok := job.KeyManager.(k.KeyLimiter)
+	if !ok || len(keys) < limiter.MaxAccessKeys() {
+		return entity.AccessKey{}, false, nil
+	}
+
+	victim, found := oldestInactiveKey(keys, id)
+	if !found {
+		return entity.AccessKey{}, false, fmt.Errorf("Couldn't rotate key %s: limit of %d keys reached and none of them is inactive",
+			id, limiter.MaxAccessKeys())
+	}
+	if retiredAt, ok := retired[victim.ID]; ok && now.Sub(retiredAt) < a.GracePeriod {
+		return entity.AccessKey{}, false, fmt.Errorf("Couldn't rotate key %s: limit of %d keys reached and inactive key %s is within its grace period until %s",
+			id, limiter.MaxAccessKeys(), victim.ID, retiredAt.Add(a.GracePeriod).Format(time.RFC3339))
+	}
+	return victim, true, nil
+}
+
+// oldestInactiveKey returns the oldest inactive key except the one specified by id
+func oldestInactiveKey(keys []entity.AccessKey, id string) (entity.AccessKey, bool) {
+	var inactive []entity.AccessKey
+	for _, key := range keys {
+		if !key.IsActive() && key.ID != id {
+			inactive = append(inactive, key)
+		}
+	}
+	if len(inactive) == 0 {
+		return entity.AccessKey{}, false
+	}
+
+	sort.Slice(inactive, func(i, j int) bool {
+		return inactive[i].CreatedAt.Before(inactive[j].CreatedAt)
+	})
+	return inactive[0], true
+}
+
+// withoutKeys returns a copy of keys without the ones in removed
+func withoutKeys(keys []entity.AccessKey, removed []entity.AccessKey) []entity.AccessKey {
+	var result []entity.AccessKey
+	for _, key := range keys {
+		found := false
+		for _, r := range removed {
+			if r.ID == key.ID {
+				found = true
+				break
+			}
+		}
+		if !found {
+			result = append(result, key)
+		}
+	}
+	return result
+}
@@ -0,0 +1,154 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/dorneanu/go-key-rotator/entity"
+	"github.com/dorneanu/go-key-rotator/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// limitedKeyManager is a key manager which only allows a limited number of keys
+type limitedKeyManager struct {
+	*mocks.KeyManager
+	max int
+}
+
+func (l limitedKeyManager) MaxAccessKeys() int {
+	return l.max
+}
+
+// planTypes returns the types of all actions within a plan
+func planTypes(plan *RotationPlan) []ActionType {
+	types := []ActionType{}
+	for _, a := range plan.Actions {
+		types = append(types, a.Type)
+	}
+	return types
+}
+
+func TestPlanUploadSecrets(t *testing.T) {
+	now := time.Now()
+
+	t.Run("Plan rotation without grace period", func(t *testing.T) {
+		mockGenerator := NewMockGenerator()
+		mockGenerator.NewKeyManager()
+		mockGenerator.NewSecretsStore()
+		mockGenerator.MockKeyManager.On(
+			"ListAccessKeys",
+			mock.Anything).Return([]entity.AccessKey{
+			{ID: "OLD", Owner: "deploy", Status: entity.KeyStatusActive, CreatedAt: now.Add(-240 * time.Hour)},
+		}, nil).Once()
+		mockGenerator.MockSecretsStore.On("Destination").Return("github:dorneanu/test/SECRET")
+
+		rotatorApp := mockGenerator.GetRotatorApp()
+		plan, err := rotatorApp.PlanUploadSecrets(context.TODO())
+		assert.NoError(t, err)
+		assert.True(t, plan.Changes())
+		assert.Equal(t, []ActionType{ActionCreateKey, ActionWriteSecret, ActionDeleteKey}, planTypes(plan))
+		assert.Equal(t, "github:dorneanu/test/SECRET", plan.Actions[1].Target)
+		assert.Equal(t, "OLD", plan.Actions[2].Target)
+
+		// Nothing must be changed
+		mockGenerator.MockKeyManager.AssertNotCalled(t, "RotateAccessKey", mock.Anything, mock.Anything)
+		mockGenerator.MockKeyManager.AssertNotCalled(t, "DeleteAccessKey", mock.Anything, mock.Anything)
+		mockGenerator.MockSecretsStore.AssertNotCalled(t, "CreateSecret", mock.Anything, mock.Anything)
+	})
+
+	t.Run("Plan rotation with grace period and key limit", func(t *testing.T) {
+		mockGenerator := NewMockGenerator()
+		mockGenerator.NewKeyManager()
+		mockGenerator.NewSecretsStore()
+		mockGenerator.MockKeyManager.On(
+			"ListAccessKeys",
+			mock.Anything).Return([]entity.AccessKey{
+			{ID: "INACTIVE", Status: entity.KeyStatusInactive, CreatedAt: now.Add(-480 * time.Hour)},
+			{ID: "OLD", Status: entity.KeyStatusActive, CreatedAt: now.Add(-24 * time.Hour)},
+		}, nil).Once()
+		mockGenerator.MockSecretsStore.On("Destination").Return("github:dorneanu/test/SECRET")
+
+		rotatorApp := mockGenerator.GetRotatorApp()
+		rotatorApp.KeyManager = limitedKeyManager{mockGenerator.MockKeyManager, 2}
+		rotatorApp.GracePeriod = 72 * time.Hour
+		plan, err := rotatorApp.PlanUploadSecrets(context.TODO())
+		assert.NoError(t, err)
+		assert.Equal(t, []ActionType{
+			ActionSkipKey, ActionDeleteKey, ActionCreateKey, ActionWriteSecret, ActionDeactivateKey,
+		}, planTypes(plan))
+		assert.Equal(t, "INACTIVE", plan.Actions[1].Target)
+	})
+
+	t.Run("Plan fails if key limit is reached", func(t *testing.T) {
+		mockGenerator := NewMockGenerator()
+		mockGenerator.NewKeyManager()
+		mockGenerator.NewSecretsStore()
+		mockGenerator.MockKeyManager.On(
+			"ListAccessKeys",
+			mock.Anything).Return([]entity.AccessKey{
+			{ID: "KEY1", Status: entity.KeyStatusActive},
+			{ID: "KEY2", Status: entity.KeyStatusActive},
+		}, nil).Once()
+
+		rotatorApp := mockGenerator.GetRotatorApp()
+		rotatorApp.KeyManager = limitedKeyManager{mockGenerator.MockKeyManager, 2}
+		_, err := rotatorApp.PlanUploadSecrets(context.TODO())
+		assert.Error(t, err)
+	})
+
+	t.Run("Plan without changes", func(t *testing.T) {
+		mockGenerator := NewMockGenerator()
+		mockGenerator.NewKeyManager()
+		mockGenerator.MockKeyManager.On(
+			"ListAccessKeys",
+			mock.Anything).Return([]entity.AccessKey{
+			{ID: "KEY1", Status: entity.KeyStatusActive, CreatedAt: now},
+		}, nil).Once()
+
+		rotatorApp := mockGenerator.GetRotatorApp()
+		rotatorApp.Policy = RotationPolicy{MaxAge: 24 * time.Hour}
+		plan, err := rotatorApp.PlanUploadSecrets(context.TODO())
+		assert.NoError(t, err)
+		assert.False(t, plan.Changes())
+	})
+
+	t.Run("Plan on ListAccessKeys error", func(t *testing.T) {
+		mockGenerator := NewMockGenerator()
+		mockGenerator.NewKeyManager()
+		mockGenerator.MockKeyManager.On(
+			"ListAccessKeys",
+			mock.Anything).Return(nil, errors.New("Error")).Once()
+
+		rotatorApp := mockGenerator.GetRotatorApp()
+		_, err := rotatorApp.PlanUploadSecrets(context.TODO())
+		assert.Error(t, err)
+	})
+}
+
+func TestPlanRotate(t *testing.T) {
+	mockGenerator := NewMockGenerator()
+	mockGenerator.NewKeyManager()
+	mockGenerator.NewSecretsStore()
+	mockGenerator.MockKeyManager.On(
+		"ListAccessKeys",
+		mock.Anything).Return([]entity.AccessKey{
+		{ID: "OLD", Status: entity.KeyStatusActive},
+	}, nil)
+	mockGenerator.MockSecretsStore.On("Destination").Return("github:dorneanu/test/SECRET")
+
+	rotatorApp := mockGenerator.GetRotatorApp()
+	plan, err := rotatorApp.PlanRotate(context.TODO(), "OLD")
+	assert.NoError(t, err)
+	assert.Equal(t, []ActionType{ActionCreateKey, ActionWriteSecret, ActionDeleteKey}, planTypes(plan))
+
+	_, err = rotatorApp.PlanRotate(context.TODO(), "UNKNOWN")
+	assert.Error(t, err)
+
+	// Rotate refuses to create a key which can't be published
+	rotatorApp.SecretsStore = nil
+	_, err = rotatorApp.PlanRotate(context.TODO(), "OLD")
+	assert.EqualError(t, err, "no secrets store configured")
+}
@@ -0,0 +1,93 @@
+package app
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/dorneanu/go-key-rotator/entity"
+)
+
+// RotationPolicy decides whether an access key is due for rotation.
+// Without MaxAge, every key (which isn't excluded otherwise) will be rotated.
+// Keys expiring within MinAge (or MaxAge if MinAge isn't set) are always due,
+// otherwise they would stop working before their next rotation.
+type RotationPolicy struct {
+	// MaxAge specifies the age after which a key has to be rotated
+	MaxAge time.Duration `envconfig:"ROTATION_MAX_AGE" yaml:"max_age"`
+
+	// MinAge specifies the age a key must have before it can be rotated
+	MinAge time.Duration `envconfig:"ROTATION_MIN_AGE" yaml:"min_age"`
+
+	// UnusedFor specifies how long a key must not have been used before it can be rotated
+	UnusedFor time.Duration `envconfig:"ROTATION_UNUSED_FOR" yaml:"unused_for"`
+
+	// NeverRotate contains IDs of keys (or names of their owners) which must never be rotated
+	NeverRotate []string `envconfig:"ROTATION_NEVER_ROTATE" yaml:"never_rotate"`
+}
+
+// merge returns a copy of the policy where all fields set in other take precedence
+func (p RotationPolicy) merge(other RotationPolicy) RotationPolicy {
+	if other.MaxAge != 0 {
+		p.MaxAge = other.MaxAge
+	}
+	if other.MinAge != 0 {
+		p.MinAge = other.MinAge
+	}
+	if other.UnusedFor != 0 {
+		p.UnusedFor = other.UnusedFor
+	}
+	if len(other.NeverRotate) > 0 {
+		p.NeverRotate = other.NeverRotate
+	}
+	return p
+}
+
+// RotationDecision holds the result of a RotationPolicy for a single key
+type RotationDecision struct {
+	Key    entity.AccessKey
+	Rotate bool
+	Reason string
+}
+
+// Evaluate decides whether the key is due for rotation at the given point in time
+func (p RotationPolicy) Evaluate(k entity.AccessKey, now time.Time) RotationDecision {
+	skip := func(format string, args ...interface{}) RotationDecision {
+		return RotationDecision{Key: k, Rotate: false, Reason: fmt.Sprintf(format, args...)}
+	}
+
+	if !k.IsActive() {
+		return skip("key is inactive")
+	}
+
+	for _, excluded := range p.NeverRotate {
+		if excluded == k.ID || (k.Owner != "" && excluded == k.Owner) {
+			return skip("%s is excluded from rotation", excluded)
+		}
+	}
+
+	lead := p.MinAge
+	if lead <= 0 {
+		lead = p.MaxAge
+	}
+	if !k.ExpiresAt.IsZero() && lead > 0 && k.ExpiresAt.Sub(now) < lead {
+		return RotationDecision{Key: k, Rotate: true, Reason: fmt.Sprintf("key expires within %s", lead)}
+	}
+
+	age := k.Age(now)
+	if p.MinAge > 0 && age < p.MinAge {
+		return skip("key is younger than %s", p.MinAge)
+	}
+
+	if p.UnusedFor > 0 && k.Unused(now) < p.UnusedFor {
+		return skip("key was used within the last %s", p.UnusedFor)
+	}
+
+	if p.MaxAge <= 0 {
+		return RotationDecision{Key: k, Rotate: true, Reason: "no maximum age configured"}
+	}
+
+	if age < p.MaxAge {
+		return skip("key is younger than %s", p.MaxAge)
+	}
+	return RotationDecision{Key: k, Rotate: true, Reason: fmt.Sprintf("key is older than %s", p.MaxAge)}
+}
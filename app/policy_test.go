@@ -0,0 +1,139 @@
+package app
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/dorneanu/go-key-rotator/entity"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestRotationPolicy_Evaluate(t *testing.T) {
+	now := time.Date(2021, time.July, 01, 12, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+
+	tests := []struct {
+		name   string
+		policy RotationPolicy
+		key    entity.AccessKey
+		rotate bool
+	}{
+		{
+			name:   "Without policy every active key is rotated",
+			policy: RotationPolicy{},
+			key:    entity.AccessKey{ID: "ID1", Status: entity.KeyStatusActive, CreatedAt: now.Add(-1 * time.Hour)},
+			rotate: true,
+		},
+		{
+			name:   "Inactive keys are never rotated",
+			policy: RotationPolicy{},
+			key:    entity.AccessKey{ID: "ID1", Status: entity.KeyStatusInactive, CreatedAt: now.Add(-100 * day)},
+			rotate: false,
+		},
+		{
+			name:   "Key older than max age",
+			policy: RotationPolicy{MaxAge: 90 * day},
+			key:    entity.AccessKey{ID: "ID1", Status: entity.KeyStatusActive, CreatedAt: now.Add(-91 * day)},
+			rotate: true,
+		},
+		{
+			name:   "Key younger than max age",
+			policy: RotationPolicy{MaxAge: 90 * day},
+			key:    entity.AccessKey{ID: "ID1", Status: entity.KeyStatusActive, CreatedAt: now.Add(-89 * day)},
+			rotate: false,
+		},
+		{
+			name:   "Key younger than min age",
+			policy: RotationPolicy{MinAge: day},
+			key:    entity.AccessKey{ID: "ID1", Status: entity.KeyStatusActive, CreatedAt: now.Add(-1 * time.Hour)},
+			rotate: false,
+		},
+		{
+			name:   "Key was used recently",
+			policy: RotationPolicy{UnusedFor: 2 * day},
+			key: entity.AccessKey{
+				ID: "ID1", Status: entity.KeyStatusActive, CreatedAt: now.Add(-100 * day),
+				LastUsed: entity.KeyUsage{Date: now.Add(-1 * day)},
+			},
+			rotate: false,
+		},
+		{
+			name:   "Key wasn't used for a while",
+			policy: RotationPolicy{UnusedFor: 2 * day},
+			key: entity.AccessKey{
+				ID: "ID1", Status: entity.KeyStatusActive, CreatedAt: now.Add(-100 * day),
+				LastUsed: entity.KeyUsage{Date: now.Add(-3 * day)},
+			},
+			rotate: true,
+		},
+		{
+			name:   "Key expiring within min age",
+			policy: RotationPolicy{MaxAge: 90 * day, MinAge: 7 * day, UnusedFor: 2 * day},
+			key: entity.AccessKey{
+				ID: "ID1", Status: entity.KeyStatusActive, CreatedAt: now.Add(-1 * day), ExpiresAt: now.Add(6 * day),
+				LastUsed: entity.KeyUsage{Date: now.Add(-1 * time.Hour)},
+			},
+			rotate: true,
+		},
+		{
+			name:   "Key expiring after min age",
+			policy: RotationPolicy{MaxAge: 90 * day, MinAge: 7 * day},
+			key:    entity.AccessKey{ID: "ID1", Status: entity.KeyStatusActive, CreatedAt: now.Add(-10 * day), ExpiresAt: now.Add(8 * day)},
+			rotate: false,
+		},
+		{
+			name:   "Key expiring within max age",
+			policy: RotationPolicy{MaxAge: 30 * day},
+			key:    entity.AccessKey{ID: "ID1", Status: entity.KeyStatusActive, CreatedAt: now.Add(-10 * day), ExpiresAt: now.Add(20 * day)},
+			rotate: true,
+		},
+		{
+			name:   "Expiring key is still excluded",
+			policy: RotationPolicy{MaxAge: 30 * day, NeverRotate: []string{"ID1"}},
+			key:    entity.AccessKey{ID: "ID1", Status: entity.KeyStatusActive, CreatedAt: now.Add(-10 * day), ExpiresAt: now.Add(day)},
+			rotate: false,
+		},
+		{
+			name:   "Key is excluded by ID",
+			policy: RotationPolicy{NeverRotate: []string{"ID1"}},
+			key:    entity.AccessKey{ID: "ID1", Status: entity.KeyStatusActive, CreatedAt: now.Add(-100 * day)},
+			rotate: false,
+		},
+		{
+			name:   "Key is excluded by owner",
+			policy: RotationPolicy{NeverRotate: []string{"deploy"}},
+			key:    entity.AccessKey{ID: "ID1", Owner: "deploy", Status: entity.KeyStatusActive, CreatedAt: now.Add(-100 * day)},
+			rotate: false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			decision := test.policy.Evaluate(test.key, now)
+			assert.Equal(t, test.rotate, decision.Rotate, decision.Reason)
+			assert.NotEmpty(t, decision.Reason)
+		})
+	}
+}
+
+func TestUploadSecretsPolicy(t *testing.T) {
+	t.Run("Nothing is rotated if no key is due", func(t *testing.T) {
+		mockGenerator := NewMockGenerator()
+		mockGenerator.NewKeyManager()
+		mockGenerator.NewSecretsStore()
+		mockGenerator.MockKeyManager.On(
+			"ListAccessKeys",
+			mock.Anything).Return([]entity.AccessKey{
+			{ID: "ID1", Status: entity.KeyStatusActive, CreatedAt: time.Now().Add(-24 * time.Hour)},
+		}, nil).Once()
+
+		rotatorApp := mockGenerator.GetRotatorApp()
+		rotatorApp.Policy = RotationPolicy{MaxAge: 720 * time.Hour}
+		err := rotatorApp.UploadSecrets(context.TODO())
+		assert.NoError(t, err)
+		mockGenerator.MockKeyManager.AssertNotCalled(t, "RotateAccessKey", mock.Anything, mock.Anything)
+		mockGenerator.MockSecretsStore.AssertNotCalled(t, "CreateSecret", mock.Anything, mock.Anything)
+	})
+}
@@ -0,0 +1,179 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/dorneanu/go-key-rotator/entity"
+	st "github.com/dorneanu/go-key-rotator/statestore"
+)
+
+// clockSkew is the tolerance used when comparing the creation time of a key (as reported by
+// the provider) with the start of a rotation (as seen by the rotator)
+const clockSkew = time.Minute
+
+// resumption describes how a rotation which was interrupted during a previous run is
+// finished or rolled back. Secrets are never persisted, so a new key which hasn't been
+// published to every required destination can't be published anymore and is rolled back.
+type resumption struct {
+	Record st.RotationRecord
+
+	// Phase is the final phase of the rotation once the actions have been taken
+	Phase  st.RotationPhase
+	Reason string
+
+	// Action retires the old key (finish) or deletes the new one (roll back)
+	Action ActionType
+	Target string
+
+	// Retired is true if the old key is retired, even if it was already deactivated before
+	// the run was interrupted. The grace period of the old key starts with the resumption.
+	Retired bool
+
+	// Rotate is true if some destinations hold the rolled back key. The old key is
+	// rotated again regardless of the rotation policy so that they get a valid key.
+	Rotate bool
+}
+
+// resumptions returns what has to be done for every unfinished rotation within records.
+// keys are the current keys of the job, actions are only planned for keys which still exist
+// so that resuming a rotation twice doesn't do any harm.
+func (a *AccessKeyRotatorApp) resumptions(records []st.RotationRecord, keys []entity.AccessKey) []resumption {
+	existing := make(map[string]entity.AccessKey)
+	for _, key := range keys {
+		existing[key.ID] = key
+	}
+
+	// Keys which are known to be the result of a rotation
+	known := make(map[string]bool)
+	for _, r := range records {
+		if r.NewKeyID != "" {
+			known[r.NewKeyID] = true
+		}
+	}
+
+	var resumed []resumption
+	for _, r := range st.Unfinished(records) {
+		res := resumption{Record: r}
+
+		switch r.Phase {
+		case st.PhaseStarted:
+			// The new key may have been created before its ID could be saved
+			var created []string
+			for _, key := range keys {
+				if key.ID != r.OldKeyID && !known[key.ID] && !key.CreatedAt.Before(r.StartedAt.Add(-clockSkew)) {
+					created = append(created, key.ID)
+				}
+			}
+			switch len(created) {
+			case 0:
+				res.Phase, res.Reason = st.PhaseRolledBack, "no key was created"
+			case 1:
+				r.NewKeyID = created[0]
+				res = a.rollbackNewKey(r, existing)
+			default:
+				res.Phase = st.PhaseFailed
+				res.Reason = fmt.Sprintf("several keys (%v) were created since the rotation started, delete the orphaned one by hand", created)
+			}
+
+		case st.PhaseKeyCreated, st.PhaseVerified:
+			res = a.rollbackNewKey(r, existing)
+
+		case st.PhasePublished:
+			// Consumers have the new key, retire the old one
+			res.Phase, res.Reason = st.PhaseCompleted, "new key has been published"
+			if old, ok := existing[r.OldKeyID]; ok {
+				res.Retired = true
+				if a.GracePeriod <= 0 {
+					res.Action, res.Target = ActionDeleteKey, old.ID
+				} else if old.IsActive() {
+					res.Action, res.Target = ActionDeactivateKey, old.ID
+				}
+			}
+
+		case st.PhaseRetired:
+			res.Phase, res.Reason = st.PhaseCompleted, "old key has been retired"
+
+		default:
+			res.Phase, res.Reason = st.PhaseFailed, fmt.Sprintf("unknown phase %q", r.Phase)
+		}
+		resumed = append(resumed, res)
+	}
+	return resumed
+}
+
+// rollbackNewKey returns the resumption of a rotation whose new key hasn't been published to every
+// required destination. The new key is deleted unless the old one is gone as well.
+func (a *AccessKeyRotatorApp) rollbackNewKey(r st.RotationRecord, existing map[string]entity.AccessKey) resumption {
+	res := resumption{Record: r, Phase: st.PhaseRolledBack, Reason: "new key wasn't published completely"}
+	if _, ok := existing[r.OldKeyID]; !ok {
+		res.Phase = st.PhaseFailed
+		res.Reason = fmt.Sprintf("old key %s doesn't exist anymore, new key %s is kept", r.OldKeyID, r.NewKeyID)
+		return res
+	}
+	if _, ok := existing[r.NewKeyID]; ok {
+		res.Action, res.Target = ActionDeleteKey, r.NewKeyID
+	}
+	if len(r.Published) > 0 {
+		res.Rotate = true
+		res.Reason += fmt.Sprintf(", %s will be rotated again", r.OldKeyID)
+	}
+	return res
+}
+
+// resumeRotations finishes or rolls back the rotations of a job which were interrupted during a
+// previous run. The changes are final, they are recorded by tx but never undone. The IDs of the old
+// keys which have to be rotated again are returned.
+func (a *AccessKeyRotatorApp) resumeRotations(ctx context.Context, job RotationJob, tx *RotationTransaction, now time.Time) (map[string]bool, error) {
+	if a.StateStore == nil {
+		return nil, nil
+	}
+	records, err := a.StateStore.ListRotations(ctx, job.Name)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't read rotation state: %s", err)
+	}
+	if len(st.Unfinished(records)) == 0 {
+		return nil, nil
+	}
+
+	keys, err := job.KeyManager.ListAccessKeys(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't get list of keys: %s", err)
+	}
+
+	rotate := make(map[string]bool)
+	tx.begin()
+	defer tx.savepoint()
+	for _, res := range a.resumptions(records, keys) {
+		switch res.Action {
+		case ActionDeleteKey:
+			err = job.KeyManager.DeleteAccessKey(ctx, res.Target)
+		case ActionDeactivateKey:
+			err = job.KeyManager.DeactivateAccessKey(ctx, res.Target)
+		}
+		if err != nil {
+			return rotate, fmt.Errorf("Couldn't resume rotation %s: %s", res.Record.ID, err)
+		}
+		if res.Action != "" {
+			tx.record(res.Action, res.Target, nil)
+		}
+		if res.Rotate {
+			rotate[res.Record.OldKeyID] = true
+		}
+
+		r := res.Record
+		if res.Retired {
+			r.Log(now.UTC(), st.PhaseRetired, r.OldKeyID)
+		}
+		r.Outcome = "resumed: " + res.Reason
+		r.Log(now.UTC(), res.Phase, r.Outcome)
+		err = a.StateStore.SaveRotation(ctx, r)
+		if err != nil {
+			return rotate, fmt.Errorf("Couldn't save rotation state: %s", err)
+		}
+		log.Printf("Resumed rotation %s of key %s: %s (%s)\n", r.ID, r.OldKeyID, res.Phase, res.Reason)
+	}
+	return rotate, nil
+}
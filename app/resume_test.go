@@ -0,0 +1,186 @@
+package app
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dorneanu/go-key-rotator/entity"
+	"github.com/dorneanu/go-key-rotator/mocks"
+	st "github.com/dorneanu/go-key-rotator/statestore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestResumeRotations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	now := time.Now().UTC()
+	created := now.Add(-240 * time.Hour)
+	started := now.Add(-time.Hour)
+
+	// newState returns a state store holding a single interrupted rotation of OLD
+	newState := func(name string, phase st.RotationPhase, newKeyID string, published ...string) st.StateStore {
+		state := st.NewFileStateStore(filepath.Join(dir, name+".json"))
+		r := st.RotationRecord{ID: "interrupted", Job: "aws:deploy", OldKeyID: "OLD", NewKeyID: newKeyID, Published: published, StartedAt: started}
+		r.Log(started, phase, "")
+		assert.NoError(t, state.SaveRotation(context.TODO(), r))
+		return state
+	}
+
+	newApp := func(keyManager *mocks.KeyManager, state st.StateStore) *AccessKeyRotatorApp {
+		store := &mocks.SecretsStore{}
+		store.On("Destination").Return("github:owner/app/AWS_KEY")
+		store.On("EncryptKey", mock.Anything, mock.AnythingOfType("entity.AccessKey")).Return(&entity.EncryptedKey{}, nil)
+		store.On("CreateSecret", mock.Anything, mock.AnythingOfType("entity.EncryptedKey")).Return(nil)
+
+		rotatorApp := &AccessKeyRotatorApp{
+			Jobs: []RotationJob{{Name: "aws:deploy", KeyManager: keyManager, Destinations: []Destination{{SecretsStore: store}}}},
+			// OLD isn't due for rotation
+			Policy:     RotationPolicy{MaxAge: 1000 * time.Hour},
+			StateStore: state,
+		}
+		return rotatorApp
+	}
+
+	// interrupted returns the record of the interrupted rotation
+	interrupted := func(t *testing.T, state st.StateStore) st.RotationRecord {
+		records, err := state.ListRotations(context.TODO(), "aws:deploy")
+		assert.NoError(t, err)
+		for _, r := range records {
+			if r.ID == "interrupted" {
+				return r
+			}
+		}
+		t.Fatal("interrupted rotation not found")
+		return st.RotationRecord{}
+	}
+
+	t.Run("Partially published key is rolled back and old key is rotated again", func(t *testing.T) {
+		state := newState("partially-published", st.PhaseKeyCreated, "NEW1", "github:owner/app/AWS_KEY")
+		keyManager := &mocks.KeyManager{}
+		keyManager.On("ListAccessKeys", mock.Anything).Return([]entity.AccessKey{
+			{ID: "OLD", Status: entity.KeyStatusActive, CreatedAt: created},
+			{ID: "NEW1", Status: entity.KeyStatusActive, CreatedAt: started},
+		}, nil).Once()
+		keyManager.On("DeleteAccessKey", mock.Anything, "NEW1").Return(nil).Once()
+		keyManager.On("ListAccessKeys", mock.Anything).Return([]entity.AccessKey{
+			{ID: "OLD", Status: entity.KeyStatusActive, CreatedAt: created},
+		}, nil).Once()
+		keyManager.On("RotateAccessKey", mock.Anything, "OLD").Return(entity.AccessKey{ID: "NEW2", Secret: "secret"}, nil).Once()
+		keyManager.On("DeleteAccessKey", mock.Anything, "OLD").Return(nil).Once()
+
+		rotatorApp := newApp(keyManager, state)
+		results := rotatorApp.RunJobs(context.TODO())
+		assert.NoError(t, results[0].Err)
+		assert.Equal(t, []KeyRotation{{OldKeyID: "OLD", NewKeyID: "NEW2"}}, results[0].Rotated)
+		keyManager.AssertExpectations(t)
+
+		r := interrupted(t, state)
+		assert.Equal(t, st.PhaseRolledBack, r.Phase)
+		assert.Contains(t, r.Outcome, "OLD will be rotated again")
+
+		records, err := state.ListRotations(context.TODO(), "aws:deploy")
+		assert.NoError(t, err)
+		assert.Equal(t, 2, len(records))
+		assert.Equal(t, 0, len(st.Unfinished(records)))
+	})
+
+	t.Run("Key created before its ID was saved is deleted", func(t *testing.T) {
+		state := newState("started", st.PhaseStarted, "")
+		keyManager := &mocks.KeyManager{}
+		keys := []entity.AccessKey{
+			{ID: "OLD", Status: entity.KeyStatusActive, CreatedAt: created},
+			{ID: "ORPHAN", Status: entity.KeyStatusActive, CreatedAt: started.Add(time.Second)},
+		}
+		keyManager.On("ListAccessKeys", mock.Anything).Return(keys, nil).Once()
+		keyManager.On("DeleteAccessKey", mock.Anything, "ORPHAN").Return(nil).Once()
+		keyManager.On("ListAccessKeys", mock.Anything).Return(keys[:1], nil).Once()
+
+		rotatorApp := newApp(keyManager, state)
+		results := rotatorApp.RunJobs(context.TODO())
+		assert.NoError(t, results[0].Err)
+		assert.Empty(t, results[0].Rotated)
+		keyManager.AssertExpectations(t)
+
+		r := interrupted(t, state)
+		assert.Equal(t, st.PhaseRolledBack, r.Phase)
+		assert.Equal(t, "ORPHAN", r.NewKeyID)
+	})
+
+	t.Run("Published rotation is finished once", func(t *testing.T) {
+		state := newState("published", st.PhasePublished, "NEW", "github:owner/app/AWS_KEY")
+		keyManager := &mocks.KeyManager{}
+		keys := []entity.AccessKey{
+			{ID: "OLD", Status: entity.KeyStatusActive, CreatedAt: created},
+			{ID: "NEW", Status: entity.KeyStatusActive, CreatedAt: started},
+		}
+		keyManager.On("ListAccessKeys", mock.Anything).Return(keys, nil)
+		keyManager.On("DeactivateAccessKey", mock.Anything, "OLD").Return(nil).Once()
+
+		rotatorApp := newApp(keyManager, state)
+		rotatorApp.GracePeriod = 24 * time.Hour
+
+		plan, err := rotatorApp.PlanUploadSecrets(context.TODO())
+		assert.NoError(t, err)
+		assert.Equal(t, ActionDeactivateKey, plan.Actions[0].Type)
+		assert.Equal(t, "OLD", plan.Actions[0].Target)
+		keyManager.AssertNotCalled(t, "DeactivateAccessKey", mock.Anything, mock.Anything)
+
+		for i := 0; i < 2; i++ {
+			results := rotatorApp.RunJobs(context.TODO())
+			assert.NoError(t, results[0].Err)
+		}
+		keyManager.AssertExpectations(t)
+
+		r := interrupted(t, state)
+		assert.Equal(t, st.PhaseCompleted, r.Phase)
+		assert.Equal(t, "resumed: new key has been published", r.Outcome)
+	})
+
+	t.Run("Old key deactivated before the interruption is retired", func(t *testing.T) {
+		state := newState("deactivated", st.PhasePublished, "NEW", "github:owner/app/AWS_KEY")
+		keyManager := &mocks.KeyManager{}
+		keyManager.On("ListAccessKeys", mock.Anything).Return([]entity.AccessKey{
+			{ID: "OLD", Status: entity.KeyStatusInactive, CreatedAt: created},
+			{ID: "NEW", Status: entity.KeyStatusActive, CreatedAt: started},
+		}, nil)
+
+		rotatorApp := newApp(keyManager, state)
+		rotatorApp.GracePeriod = 24 * time.Hour
+		results := rotatorApp.RunJobs(context.TODO())
+		assert.NoError(t, results[0].Err)
+		keyManager.AssertNotCalled(t, "DeactivateAccessKey", mock.Anything, mock.Anything)
+		keyManager.AssertNotCalled(t, "DeleteAccessKey", mock.Anything, mock.Anything)
+
+		r := interrupted(t, state)
+		assert.Equal(t, st.PhaseCompleted, r.Phase)
+
+		// The old key is deleted once its grace period is over
+		keys, err := keyManager.ListAccessKeys(context.TODO())
+		assert.NoError(t, err)
+		keyManager.On("DeleteAccessKey", mock.Anything, "OLD").Return(nil).Once()
+		err = rotatorApp.deleteExpiredKeys(context.TODO(), rotatorApp.Jobs[0], &RotationTransaction{}, keys, now.Add(48*time.Hour))
+		assert.NoError(t, err)
+		keyManager.AssertExpectations(t)
+	})
+
+	t.Run("New key is kept if the old one is gone", func(t *testing.T) {
+		state := newState("old-key-gone", st.PhaseKeyCreated, "NEW", "github:owner/app/AWS_KEY")
+		keyManager := &mocks.KeyManager{}
+		keyManager.On("ListAccessKeys", mock.Anything).Return([]entity.AccessKey{
+			{ID: "NEW", Status: entity.KeyStatusActive, CreatedAt: started},
+		}, nil)
+
+		rotatorApp := newApp(keyManager, state)
+		results := rotatorApp.RunJobs(context.TODO())
+		assert.NoError(t, results[0].Err)
+		keyManager.AssertNotCalled(t, "DeleteAccessKey", mock.Anything, mock.Anything)
+		assert.Equal(t, st.PhaseFailed, interrupted(t, state).Phase)
+	})
+}
@@ -4,23 +4,49 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"strings"
+	"time"
 
 	c "github.com/dorneanu/go-key-rotator/configstore"
 	"github.com/dorneanu/go-key-rotator/entity"
 	k "github.com/dorneanu/go-key-rotator/keymanager"
 	s "github.com/dorneanu/go-key-rotator/secretsstore"
+	st "github.com/dorneanu/go-key-rotator/statestore"
 	"github.com/kelseyhightower/envconfig"
 )
 
 // AccessKeyRotatorSettings holds settings for the rotator application
 type AccessKeyRotatorSettings struct {
-	CloudProvider        string `envconfig:"CLOUD_PROVIDER"`
-	IamUser              string `envconfig:"IAM_USER"`
-	SecretsStore         string `envconfig:"SECRETS_STORE"`
-	RepoOwner            string `envconfig:"REPO_OWNER"`
-	RepoName             string `envconfig:"REPO_NAME"`
-	SecretName           string `envconfig:"SECRET_NAME"`
-	ConfigStoreTokenPath string `envconfig:"TOKEN_CONFIG_STORE_PATH"`
+	CloudProvider        string        `envconfig:"CLOUD_PROVIDER"`
+	IamUser              string        `envconfig:"IAM_USER"`
+	IamUsers             []string      `envconfig:"IAM_USERS"`
+	IamUserPathPrefix    string        `envconfig:"IAM_USER_PATH_PREFIX"`
+	IamUserTag           string        `envconfig:"IAM_USER_TAG"`
+	SecretsStore         string        `envconfig:"SECRETS_STORE"`
+	RepoOwner            string        `envconfig:"REPO_OWNER"`
+	RepoName             string        `envconfig:"REPO_NAME"`
+	RepoNames            []string      `envconfig:"REPO_NAMES"`
+	SecretName           string        `envconfig:"SECRET_NAME"`
+	SecretFormat         string        `envconfig:"SECRET_FORMAT"`
+	IDSecretName         string        `envconfig:"ID_SECRET_NAME"`
+	ConfigStoreTokenPath string        `envconfig:"TOKEN_CONFIG_STORE_PATH"`
+	GitlabURL            string        `envconfig:"GITLAB_URL"`
+	GracePeriod          time.Duration `envconfig:"GRACE_PERIOD"`
+	Policy               RotationPolicy
+	Verification         VerificationPolicy
+
+	// State of the rotations is kept in a local file or a DynamoDB table (optional)
+	StateStore    string `envconfig:"STATE_STORE"`
+	StateFilePath string `envconfig:"STATE_FILE_PATH"`
+	StateTable    string `envconfig:"STATE_TABLE"`
+
+	// LockLease specifies how long a run may lock the keys of a principal (see AccessKeyRotatorApp.LockLease)
+	LockLease time.Duration `envconfig:"LOCK_LEASE"`
+
+	// Rotation config (see RotationConfig) which is either read from a file
+	// or from the config store. If specified, jobs are taken from the config.
+	ConfigFile            string `envconfig:"CONFIG_FILE"`
+	ConfigStoreConfigPath string `envconfig:"CONFIG_STORE_CONFIG_PATH"`
 }
 
 // AccessKeyRotatorApp represents the application/business logic to be used in different contexts (CLI, Lambda etc.)
@@ -28,56 +54,600 @@ type AccessKeyRotatorApp struct {
 	KeyManager   k.KeyManager
 	ConfigStore  c.ConfigStore
 	SecretsStore s.SecretsStore
+
+	// Jobs holds one job per principal whose keys should be rotated.
+	// If empty, a single job using KeyManager and SecretsStore is run.
+	Jobs []RotationJob
+
+	// GracePeriod specifies how long a replaced key stays inactive before it gets deleted.
+	// If zero, replaced keys will be deleted right away. Keys may be deleted earlier if the
+	// key manager needs room for a new key.
+	GracePeriod time.Duration
+
+	// Policy decides which keys are due for rotation
+	Policy RotationPolicy
+
+	// Verification specifies how new keys are verified by the verifiers of the jobs
+	Verification VerificationPolicy
+
+	// StateStore keeps a journal of every rotation (optional)
+	StateStore st.StateStore
+
+	// LockLease specifies how long the keys of a principal stay locked if a run doesn't release its
+	// lock (e.g. because it crashed). Locks are kept by the state store. If zero, st.DefaultLockLease is used.
+	LockLease time.Duration
 }
 
-// AccessKeyRotatorAppFactory will setup an AccessKeyRotatorApp depending on the specified cloud provider
+// principal is a key manager along with the name of the principal whose keys it manages
+type principal struct {
+	name       string
+	keyManager k.KeyManager
+	verifier   k.KeyVerifier
+}
+
+// destinationFactory creates the destination a principal's keys are published to
+type destinationFactory func(data s.SecretNameData) (Destination, error)
+
+// AccessKeyRotatorAppFactory will setup an AccessKeyRotatorApp depending on the specified cloud provider.
+// If a rotation config is specified, the jobs are taken from the config instead of the settings.
 func AccessKeyRotatorAppFactory(settings AccessKeyRotatorSettings) *AccessKeyRotatorApp {
-	var keyManager k.KeyManager
-	var configStore c.ConfigStore
-	var secretsStore s.SecretsStore
+	ctx := context.Background()
+	configStore := newConfigStore(settings.CloudProvider)
 
-	// Setup key manager
-	switch settings.CloudProvider {
+	if settings.ConfigFile != "" || settings.ConfigStoreConfigPath != "" {
+		config, err := ReadRotationConfig(ctx, configStore, settings.ConfigFile, settings.ConfigStoreConfigPath)
+		if err != nil {
+			log.Fatalf("Unable to read rotation config: %s", err)
+		}
+
+		rotatorApp, err := NewAccessKeyRotatorAppFromConfig(ctx, config, configStore)
+		if err != nil {
+			log.Fatalf("Unable to setup rotation jobs: %s", err)
+		}
+
+		// Settings take precedence over the config
+		if settings.GracePeriod != 0 {
+			rotatorApp.GracePeriod = settings.GracePeriod
+			for _, job := range rotatorApp.Jobs {
+				err = validateGracePeriod(job.Provider, settings.GracePeriod)
+				if err != nil {
+					log.Fatalf("Unable to setup rotation jobs: %s: %s", job.Name, err)
+				}
+			}
+		}
+		rotatorApp.Policy = rotatorApp.Policy.merge(settings.Policy)
+		rotatorApp.Verification = rotatorApp.Verification.merge(settings.Verification)
+		if settings.LockLease != 0 {
+			rotatorApp.LockLease = settings.LockLease
+		}
+		if settings.StateStore != "" {
+			rotatorApp.StateStore, err = newStateStore(ctx, settings.stateConfig())
+			if err != nil {
+				log.Fatalf("Unable to setup state store: %s", err)
+			}
+		}
+		return rotatorApp
+	}
+
+	err := validateGracePeriod(settings.CloudProvider, settings.GracePeriod)
+	if err != nil {
+		log.Fatalf("Invalid settings: %s", err)
+	}
+
+	// Setup key manager(s)
+	selector := k.IAMUserSelector{
+		Users:      settings.IamUsers,
+		PathPrefix: settings.IamUserPathPrefix,
+		Tag:        settings.IamUserTag,
+	}
+	if settings.IamUser != "" {
+		selector.Users = append([]string{settings.IamUser}, selector.Users...)
+	}
+	principals, err := newPrincipals(ctx, settings.CloudProvider, selector)
+	if err != nil {
+		log.Fatalf("Unable to find principals: %s", err)
+	}
+
+	// Setup secrets store (one per principal). Without a secrets store, secrets won't be uploaded.
+	var destinations []destinationFactory
+	if settings.SecretsStore != "" {
+		destinations, err = newDestinations(ctx, settings, configStore)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	jobs, err := newRotationJobs(settings.CloudProvider, settings.CloudProvider, principals, destinations)
+	if err != nil {
+		log.Fatalf("Unable to setup rotation jobs: %s", err)
+	}
+
+	rotatorApp := newAccessKeyRotatorAppWithJobs(configStore, jobs, settings.GracePeriod, settings.Policy)
+	rotatorApp.StateStore, err = newStateStore(ctx, settings.stateConfig())
+	if err != nil {
+		log.Fatalf("Unable to setup state store: %s", err)
+	}
+	rotatorApp.LockLease = settings.LockLease
+	rotatorApp.Verification = settings.Verification
+	return rotatorApp
+}
+
+// validateGracePeriod returns an error if the keys of the provider can't be deactivated during a grace period
+func validateGracePeriod(provider string, gracePeriod time.Duration) error {
+	if provider == "azure" && gracePeriod > 0 {
+		return fmt.Errorf("azure doesn't support a grace period (client secrets can't be deactivated)")
+	}
+	return nil
+}
+
+// stateConfig returns the state store specified by the settings
+func (settings AccessKeyRotatorSettings) stateConfig() StateConfig {
+	return StateConfig{Type: settings.StateStore, Path: settings.StateFilePath, Table: settings.StateTable, LockLease: settings.LockLease}
+}
+
+// newAccessKeyRotatorAppWithJobs creates an app running the specified jobs. KeyManager and SecretsStore
+// are taken from the first job.
+func newAccessKeyRotatorAppWithJobs(configStore c.ConfigStore, jobs []RotationJob, gracePeriod time.Duration, policy RotationPolicy) *AccessKeyRotatorApp {
+	rotatorApp := &AccessKeyRotatorApp{
+		KeyManager:  jobs[0].KeyManager,
+		ConfigStore: configStore,
+		Jobs:        jobs,
+		GracePeriod: gracePeriod,
+		Policy:      policy,
+	}
+	if len(jobs[0].Destinations) > 0 {
+		rotatorApp.SecretsStore = jobs[0].Destinations[0].SecretsStore
+	}
+	return rotatorApp
+}
+
+// newConfigStore returns the config store of the specified cloud provider
+func newConfigStore(provider string) c.ConfigStore {
+	switch provider {
 	case "aws":
-		keyManager = k.NewAWSKeyManager(settings.IamUser)
-		configStore = c.NewAWSConfigStore()
+		return c.NewAWSConfigStore()
 	case "gcp":
-		keyManager = k.NewGCPKeyManager()
-		configStore = c.NewGCPConfigStore()
+		return c.NewGCPConfigStore()
 	case "azure":
-		keyManager = k.NewAzureKeyManager()
-		configStore = c.NewAzureConfigStore()
+		return c.NewAzureConfigStore()
 	default:
 		panic("Unknown cloud provider")
 	}
+}
+
+// newStateStore returns the state store specified by sc. Without a type, no state is kept.
+func newStateStore(ctx context.Context, sc StateConfig) (st.StateStore, error) {
+	err := sc.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	switch sc.Type {
+	case "file":
+		return st.NewFileStateStore(sc.Path), nil
+	case "dynamodb":
+		client, err := st.NewDynamoDBClient(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return st.NewDynamoDBStateStore(client, sc.Table), nil
+	}
+	return nil, nil
+}
+
+// newPrincipals sets up a key manager for every principal of the specified cloud provider
+func newPrincipals(ctx context.Context, provider string, selector k.IAMUserSelector) ([]principal, error) {
+	var principals []principal
+	switch provider {
+	case "aws":
+		keyManagers, err := k.NewAWSKeyManagers(ctx, selector)
+		if err != nil {
+			return nil, err
+		}
+		verifier, err := k.NewAWSKeyVerifier(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, km := range keyManagers {
+			principals = append(principals, principal{name: km.User(), keyManager: km, verifier: verifier})
+		}
+	case "gcp":
+		// Service accounts have to be listed explicitly
+		keyManagers, err := k.NewGCPKeyManagers(ctx, selector.Users)
+		if err != nil {
+			return nil, err
+		}
+		verifier := k.NewGCPKeyVerifier()
+		for _, km := range keyManagers {
+			principals = append(principals, principal{name: km.ServiceAccount(), keyManager: km, verifier: verifier})
+		}
+	case "azure":
+		// Applications have to be listed explicitly by their client ID
+		var settings k.AzureSettings
+		err := envconfig.Process("", &settings)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't get ENV variables for azure settings: %s", err)
+		}
+		keyManagers, err := k.NewAzureKeyManagers(ctx, selector.Users, settings)
+		if err != nil {
+			return nil, err
+		}
+		// Client secrets are verified against the tenant of the applications
+		var verifier k.KeyVerifier
+		if settings.TenantID != "" {
+			verifier = k.NewAzureKeyVerifier(settings.TenantID)
+		} else {
+			log.Println("New client secrets won't be verified (AZURE_TENANT_ID is missing)")
+		}
+		for _, km := range keyManagers {
+			principals = append(principals, principal{name: km.AppID(), keyManager: km, verifier: verifier})
+		}
+	default:
+		return nil, fmt.Errorf("unknown cloud provider %q", provider)
+	}
+	return principals, nil
+}
 
-	// Setup secrets store
+// newDestinations sets up the destinations specified by the settings
+func newDestinations(ctx context.Context, settings AccessKeyRotatorSettings, configStore c.ConfigStore) ([]destinationFactory, error) {
+	format, err := s.ParseSecretFormat(settings.SecretFormat)
+	if err != nil {
+		return nil, err
+	}
+	layout := s.SecretLayout{Format: format, Name: settings.SecretName, IDName: settings.IDSecretName}
+	err = layout.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("Invalid secret layout: %s", err)
+	}
+
+	// The same secret is written to every repository
+	repoNames := settings.RepoNames
+	if settings.RepoName != "" {
+		repoNames = append([]string{settings.RepoName}, repoNames...)
+	}
+
+	var destinations []destinationFactory
 	switch settings.SecretsStore {
 	case "github":
-		privateKey, err := configStore.GetValue(context.Background(), settings.ConfigStoreTokenPath)
+		var targetSettings githubTargetSettings
+		err = envconfig.Process("", &targetSettings)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't get ENV variables for github settings: %s", err)
+		}
+		targets, err := targetSettings.targets(settings.RepoOwner, repoNames)
 		if err != nil {
-			log.Fatalf("Uable to get value from config store: %s", err)
+			return nil, err
 		}
 
-		var githubSettings s.GithubAppSettings
-		err = envconfig.Process("", &githubSettings)
+		githubSecretsClient, err := newGithubClient(ctx, configStore, settings.ConfigStoreTokenPath, s.GithubAppSettings{})
+		if err != nil {
+			return nil, err
+		}
+		for _, target := range targets {
+			destinations = append(destinations, githubTargetDestination(githubSecretsClient, target, layout, targetSettings.GithubSecretOptions, false))
+		}
+	case "gitlab":
+		gitlabClient, err := newGitlabClient(ctx, configStore, settings.ConfigStoreTokenPath, settings.GitlabURL)
+		if err != nil {
+			return nil, err
+		}
+		var options s.GitlabVariableOptions
+		err = envconfig.Process("", &options)
 		if err != nil {
-			log.Fatalf("Couldn't get ENV variables for github settings: %s", err)
+			return nil, fmt.Errorf("Couldn't get ENV variables for gitlab settings: %s", err)
 		}
-		githubSettings.PrivateKey = []byte(privateKey)
 
-		githubSecretsClient := s.NewGithubClientAsApp(githubSettings)
-		secretsStore = s.NewGithubSecretsStore(
-			githubSecretsClient, settings.RepoOwner, settings.RepoName, settings.SecretName)
+		// Without repositories, the variables are written to the group (REPO_OWNER)
+		var targets []s.GitlabTarget
+		for _, repoName := range repoNames {
+			targets = append(targets, s.GitlabTarget{Project: settings.RepoOwner + "/" + repoName})
+		}
+		if len(targets) == 0 {
+			targets = append(targets, s.GitlabTarget{Group: settings.RepoOwner})
+		}
+		for _, target := range targets {
+			destinations = append(destinations, gitlabDestination(gitlabClient, target, layout, options, false))
+		}
+	case "secretsmanager":
+		secretsManagerClient, err := s.NewSecretsManagerClient(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var options s.SecretsManagerOptions
+		err = envconfig.Process("", &options)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't get ENV variables for secrets manager settings: %s", err)
+		}
+		destinations = append(destinations, secretsManagerDestination(secretsManagerClient, layout, options, false))
+	case "vault":
+		var vaultSettings s.VaultSettings
+		var options s.VaultKVOptions
+		err = envconfig.Process("", &vaultSettings)
+		if err == nil {
+			err = envconfig.Process("", &options)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't get ENV variables for vault settings: %s", err)
+		}
+		vaultClient, err := newVaultClient(ctx, configStore, settings.ConfigStoreTokenPath, vaultSettings)
+		if err != nil {
+			return nil, err
+		}
+		destinations = append(destinations, vaultDestination(vaultClient, layout, options, false))
+	case "kubernetes":
+		var kubernetesSettings s.KubernetesSettings
+		var options s.KubernetesSecretOptions
+		err = envconfig.Process("", &kubernetesSettings)
+		if err == nil {
+			err = envconfig.Process("", &options)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't get ENV variables for kubernetes settings: %s", err)
+		}
+		kubernetesClient, err := newKubernetesClient(ctx, configStore, settings.ConfigStoreTokenPath, kubernetesSettings)
+		if err != nil {
+			return nil, err
+		}
+		destinations = append(destinations, kubernetesDestination(kubernetesClient, layout, options, false))
+	case "file":
+		var fileSettings s.AgeFileSettings
+		err = envconfig.Process("", &fileSettings)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't get ENV variables for file settings: %s", err)
+		}
+		file, err := s.NewAgeSecretsFile(fileSettings)
+		if err != nil {
+			return nil, err
+		}
+		destinations = append(destinations, fileDestination(file, layout, false))
 	default:
-		panic("Unknown secrets store")
+		return nil, fmt.Errorf("Unknown secrets store %q", settings.SecretsStore)
 	}
+	return destinations, nil
+}
 
-	return &AccessKeyRotatorApp{
-		KeyManager:   keyManager,
-		ConfigStore:  configStore,
-		SecretsStore: secretsStore,
+// newGithubClient authenticates as Github application using the private key stored in the config store.
+// Missing application settings are taken from the environment.
+func newGithubClient(ctx context.Context, configStore c.ConfigStore, tokenPath string, githubSettings s.GithubAppSettings) (*s.GithubClient, error) {
+	privateKey, err := configStore.GetValue(ctx, tokenPath)
+	if err != nil {
+		return nil, fmt.Errorf("Uable to get value from config store: %s", err)
+	}
+
+	if githubSettings.ApplicationID == 0 || githubSettings.InstallationID == 0 {
+		err = envconfig.Process("", &githubSettings)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't get ENV variables for github settings: %s", err)
+		}
 	}
+	githubSettings.PrivateKey = []byte(privateKey)
+
+	return s.NewGithubClientAsApp(githubSettings), nil
+}
+
+// githubDestination publishes keys as repository secret(s). The secret names may be templates.
+func githubDestination(client s.GithubSecretsService, repoOwner, repoName string, layout s.SecretLayout, optional bool) destinationFactory {
+	return func(data s.SecretNameData) (Destination, error) {
+		rendered, err := layout.Render(data)
+		if err != nil {
+			return Destination{}, err
+		}
+		return Destination{
+			SecretsStore: s.NewGithubSecretsStoreWithLayout(client, repoOwner, repoName, rendered),
+			Optional:     optional,
+		}, nil
+	}
+}
+
+// githubTargetDestination publishes keys as secret(s) of a repository environment, of an organization
+// or of Dependabot and Codespaces. Repository secrets of Actions are published by githubDestination.
+func githubTargetDestination(client *s.GithubClient, target s.GithubSecretTarget, layout s.SecretLayout, options s.GithubSecretOptions, optional bool) destinationFactory {
+	if target.Repo != "" && target.Environment == "" && (target.App == "" || target.App == s.GithubAppActions) {
+		return githubDestination(client, target.Owner, target.Repo, layout, optional)
+	}
+	return func(data s.SecretNameData) (Destination, error) {
+		rendered, err := layout.Render(data)
+		if err != nil {
+			return Destination{}, err
+		}
+		return Destination{
+			SecretsStore: s.NewGithubTargetSecretsStore(client, target, rendered, options),
+			Optional:     optional,
+		}, nil
+	}
+}
+
+// githubTargetSettings selects which kind of Github secrets are written (default: repository secrets of Actions)
+type githubTargetSettings struct {
+	App          string `envconfig:"GITHUB_SECRET_APP"`
+	Environment  string `envconfig:"GITHUB_ENVIRONMENT"`
+	Organization bool   `envconfig:"GITHUB_ORG_SECRET"`
+	s.GithubSecretOptions
+}
+
+// targets returns the targets secrets are written to. Organization secrets are written to the owner.
+func (ts githubTargetSettings) targets(owner string, repos []string) ([]s.GithubSecretTarget, error) {
+	app, err := s.ParseGithubSecretApp(ts.App)
+	if err != nil {
+		return nil, err
+	}
+
+	var targets []s.GithubSecretTarget
+	if ts.Organization {
+		targets = append(targets, s.GithubSecretTarget{Owner: owner, App: app})
+		err = ts.GithubSecretOptions.Validate()
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		for _, repo := range repos {
+			targets = append(targets, s.GithubSecretTarget{Owner: owner, Repo: repo, Environment: ts.Environment, App: app})
+		}
+	}
+
+	for _, target := range targets {
+		err = target.Validate()
+		if err != nil {
+			return nil, fmt.Errorf("Invalid github target %s: %s", target, err)
+		}
+	}
+	return targets, nil
+}
+
+// newGitlabClient authenticates against GitLab using the access token stored in the config store
+func newGitlabClient(ctx context.Context, configStore c.ConfigStore, tokenPath, gitlabURL string) (s.GitlabVariablesService, error) {
+	token, err := configStore.GetValue(ctx, tokenPath)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to get gitlab token from config store: %s", err)
+	}
+	return s.NewGitlabClient(gitlabURL, strings.TrimSpace(token)), nil
+}
+
+// newVaultClient logs in to Vault. The token (token auth) or the secret ID (AppRole auth) may be read from the config store.
+func newVaultClient(ctx context.Context, configStore c.ConfigStore, tokenPath string, settings s.VaultSettings) (s.VaultKVService, error) {
+	if tokenPath != "" {
+		value, err := configStore.GetValue(ctx, tokenPath)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to get vault credentials from config store: %s", err)
+		}
+		if settings.AuthMethod == s.VaultAuthAppRole {
+			settings.SecretID = strings.TrimSpace(value)
+		} else {
+			settings.Token = strings.TrimSpace(value)
+		}
+	}
+	return s.NewVaultClient(ctx, settings)
+}
+
+// newKubernetesClient connects to the API server. The token may be read from the config store,
+// otherwise the service account of the pod is used.
+func newKubernetesClient(ctx context.Context, configStore c.ConfigStore, tokenPath string, settings s.KubernetesSettings) (s.KubernetesService, error) {
+	if tokenPath != "" {
+		token, err := configStore.GetValue(ctx, tokenPath)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to get kubernetes token from config store: %s", err)
+		}
+		settings.Token = strings.TrimSpace(token)
+	}
+	return s.NewKubernetesClient(settings)
+}
+
+// gitlabDestination publishes keys as CI/CD variable(s) of a project or group. The variable names may be templates.
+func gitlabDestination(client s.GitlabVariablesService, target s.GitlabTarget, layout s.SecretLayout, options s.GitlabVariableOptions, optional bool) destinationFactory {
+	return func(data s.SecretNameData) (Destination, error) {
+		rendered, err := layout.Render(data)
+		if err != nil {
+			return Destination{}, err
+		}
+		return Destination{
+			SecretsStore: s.NewGitlabSecretsStore(client, target, rendered, options),
+			Optional:     optional,
+		}, nil
+	}
+}
+
+// vaultDestination publishes keys as KV v2 secret of Vault. The path may be a template.
+func vaultDestination(client s.VaultKVService, layout s.SecretLayout, options s.VaultKVOptions, optional bool) destinationFactory {
+	return func(data s.SecretNameData) (Destination, error) {
+		rendered, err := layout.Render(data)
+		if err != nil {
+			return Destination{}, err
+		}
+		return Destination{
+			SecretsStore: s.NewVaultSecretsStore(client, rendered, options),
+			Optional:     optional,
+		}, nil
+	}
+}
+
+// kubernetesDestination publishes keys as Kubernetes secret. The name of the secret may be a template.
+func kubernetesDestination(client s.KubernetesService, layout s.SecretLayout, options s.KubernetesSecretOptions, optional bool) destinationFactory {
+	return func(data s.SecretNameData) (Destination, error) {
+		rendered, err := layout.Render(data)
+		if err != nil {
+			return Destination{}, err
+		}
+		return Destination{
+			SecretsStore: s.NewKubernetesSecretsStore(client, rendered, options),
+			Optional:     optional,
+		}, nil
+	}
+}
+
+// fileDestination publishes keys to a local file encrypted with age. The secret names may be templates.
+func fileDestination(file s.SecretsFile, layout s.SecretLayout, optional bool) destinationFactory {
+	return func(data s.SecretNameData) (Destination, error) {
+		rendered, err := layout.Render(data)
+		if err != nil {
+			return Destination{}, err
+		}
+		return Destination{
+			SecretsStore: s.NewFileSecretsStore(file, rendered),
+			Optional:     optional,
+		}, nil
+	}
+}
+
+// secretsManagerDestination publishes keys as AWS Secrets Manager secret(s). The secret names may be templates.
+func secretsManagerDestination(client s.SecretsManagerService, layout s.SecretLayout, options s.SecretsManagerOptions, optional bool) destinationFactory {
+	return func(data s.SecretNameData) (Destination, error) {
+		rendered, err := layout.Render(data)
+		if err != nil {
+			return Destination{}, err
+		}
+		return Destination{
+			SecretsStore: s.NewSecretsManagerSecretsStore(client, rendered, options),
+			Optional:     optional,
+		}, nil
+	}
+}
+
+// newRotationJobs creates one job per principal named after the job and the principal (e.g. aws:deploy-user).
+// Every principal gets its own secrets stores which must not be shared with any other principal.
+func newRotationJobs(name, provider string, principals []principal, destinations []destinationFactory) ([]RotationJob, error) {
+	if len(principals) == 0 {
+		return nil, fmt.Errorf("no principals found")
+	}
+
+	jobs := make([]RotationJob, 0, len(principals))
+	for _, p := range principals {
+		job := RotationJob{Name: name, KeyManager: p.keyManager, Provider: provider, Principal: p.name, Verifier: p.verifier}
+		if p.name != "" {
+			job.Name = name + ":" + p.name
+		}
+
+		for _, dest := range destinations {
+			d, err := dest(s.SecretNameData{Principal: p.name, Provider: provider})
+			if err != nil {
+				return nil, err
+			}
+			job.Destinations = append(job.Destinations, d)
+		}
+		jobs = append(jobs, job)
+	}
+
+	err := checkDestinations(jobs)
+	if err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+// checkDestinations makes sure that no secret is written by more than one job
+// (or more than once by the same job)
+func checkDestinations(jobs []RotationJob) error {
+	owners := make(map[string]string)
+	for _, job := range jobs {
+		for _, dest := range job.Destinations {
+			target := dest.SecretsStore.Destination()
+			if other, ok := owners[target]; ok {
+				return fmt.Errorf("%s and %s would both write to %s, use a secret name template like %q",
+					other, job.Name, target, "AWS_KEY_{{ .Principal | sanitize | upper }}")
+			}
+			owners[target] = job.Name
+		}
+	}
+	return nil
 }
 
 func NewAccessKeyRotatorApp(key_manager k.KeyManager, secrets_store s.SecretsStore, config_store c.ConfigStore) *AccessKeyRotatorApp {
@@ -88,51 +658,491 @@ func NewAccessKeyRotatorApp(key_manager k.KeyManager, secrets_store s.SecretsSto
 	}
 }
 
+// jobs returns the rotation jobs to be run
+func (a *AccessKeyRotatorApp) jobs() []RotationJob {
+	if len(a.Jobs) > 0 {
+		return a.Jobs
+	}
+	job := RotationJob{KeyManager: a.KeyManager}
+	if a.SecretsStore != nil {
+		job.Destinations = []Destination{{SecretsStore: a.SecretsStore}}
+	}
+	return []RotationJob{job}
+}
+
+// jobForKey returns the job whose key manager owns the specified key
+func (a *AccessKeyRotatorApp) jobForKey(ctx context.Context, access_key_id string) (RotationJob, error) {
+	jobs := a.jobs()
+	if len(jobs) == 1 {
+		return jobs[0], nil
+	}
+
+	for _, job := range jobs {
+		keys, err := job.KeyManager.ListAccessKeys(ctx)
+		if err != nil {
+			return RotationJob{}, fmt.Errorf("Couldn't fetch access keys of %s: %s", job.Name, err)
+		}
+		for _, key := range keys {
+			if key.ID == access_key_id {
+				return job, nil
+			}
+		}
+	}
+	return RotationJob{}, fmt.Errorf("Couldn't find key (id = %s)", access_key_id)
+}
+
 // Rotate will rotate a specified access key
 func (a *AccessKeyRotatorApp) Rotate(ctx context.Context, access_key_id string) error {
 	if access_key_id == "" {
 		return fmt.Errorf("access_key_id is empty")
 	}
 
-	_, err := a.KeyManager.RotateAccessKey(ctx, access_key_id)
+	job, err := a.jobForKey(ctx, access_key_id)
 	if err != nil {
-		return fmt.Errorf("Key rotation failed: %s", err)
+		return err
 	}
+	unlock, err := a.lockJob(ctx, job)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// Same as a scheduled rotation, the new key is published before the old one is retired
+	tx := &RotationTransaction{}
+	journal := a.newJournal(job)
+	_, err = a.rotateKey(ctx, job, tx, journal, access_key_id)
+	if err != nil {
+		rollbackErr := tx.rollback(ctx)
+		if rollbackErr != nil {
+			err = fmt.Errorf("%s (rollback failed: %s)", err, rollbackErr)
+		}
+		journal.finish(ctx, tx, err)
+		return err
+	}
+	tx.commit()
 	return nil
 }
 
-// ListKeys will list all available keys within the key manager
-func (a *AccessKeyRotatorApp) ListKeys(ctx context.Context) ([]entity.AccessKey, error) {
-	keys, err := a.KeyManager.ListAccessKeys(ctx)
+// Reactivate will activate a key which has been deactivated during rotation
+func (a *AccessKeyRotatorApp) Reactivate(ctx context.Context, access_key_id string) error {
+	if access_key_id == "" {
+		return fmt.Errorf("access_key_id is empty")
+	}
+
+	job, err := a.jobForKey(ctx, access_key_id)
 	if err != nil {
-		return []entity.AccessKey{}, fmt.Errorf("Couldn't fetch access keys: %s", err)
+		return err
+	}
+	unlock, err := a.lockJob(ctx, job)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	err = job.KeyManager.ActivateAccessKey(ctx, access_key_id)
+	if err != nil {
+		return fmt.Errorf("Couldn't activate key (id = %s): %s", access_key_id, err)
+	}
+	return nil
+}
+
+// ListKeys will list all available keys within the key manager(s)
+func (a *AccessKeyRotatorApp) ListKeys(ctx context.Context) ([]entity.AccessKey, error) {
+	var keys []entity.AccessKey
+	for _, job := range a.jobs() {
+		jobKeys, err := job.KeyManager.ListAccessKeys(ctx)
+		if err != nil {
+			return []entity.AccessKey{}, fmt.Errorf("Couldn't fetch access keys: %s", err)
+		}
+		keys = append(keys, jobKeys...)
 	}
 	return keys, nil
 }
 
+// UploadSecrets runs all rotation jobs and returns an error if at least one of them failed.
+// A failing job doesn't stop the other ones from being run.
 func (a *AccessKeyRotatorApp) UploadSecrets(ctx context.Context) error {
+	results := a.RunJobs(ctx)
+	for _, r := range results {
+		log.Println(r)
+	}
+	return jobsError(results)
+}
+
+// RunJobs runs all rotation jobs and reports the result of each one. Jobs whose principal is
+// locked by someone else fail without changing anything.
+func (a *AccessKeyRotatorApp) RunJobs(ctx context.Context) []JobResult {
+	jobs := a.jobs()
+	results := make([]JobResult, 0, len(jobs))
+	for _, job := range jobs {
+		tx := &RotationTransaction{}
+		unlock, err := a.lockJob(ctx, job)
+		if err != nil {
+			results = append(results, JobResult{Job: job.Name, Err: err, Transaction: tx})
+			continue
+		}
+		rotated, err := a.runJob(ctx, job, tx)
+		unlock()
+		results = append(results, JobResult{Job: job.Name, Rotated: rotated, Err: err, Transaction: tx})
+	}
+	return results
+}
+
+// runJob rotates all keys of a job which are due according to the rotation policy and uploads
+// the new ones to the secrets store. Every change is recorded by the transaction and every rotation
+// by the journal. If the job fails, the changes are undone (see RotationTransaction) and only the
+// rotations which were kept are returned.
+func (a *AccessKeyRotatorApp) runJob(ctx context.Context, job RotationJob, tx *RotationTransaction) ([]KeyRotation, error) {
+	journal := a.newJournal(job)
+	rotated, err := a.rotateKeys(ctx, job, tx, journal)
+	if err == nil {
+		tx.commit()
+		return rotated, nil
+	}
+
+	rollbackErr := tx.rollback(ctx)
+	if rollbackErr != nil {
+		err = fmt.Errorf("%s (rollback failed: %s)", err, rollbackErr)
+	}
+	journal.finish(ctx, tx, err)
+
+	var kept []KeyRotation
+	for _, rot := range rotated {
+		for _, step := range tx.Steps {
+			if step.Type == ActionCreateKey && step.Target == rot.NewKeyID && step.State == StepKept {
+				kept = append(kept, rot)
+			}
+		}
+	}
+	return kept, err
+}
+
+// rotateKeys does the actual work of runJob. The new key is created and verified first and the old
+// one is only retired after the new one has been published.
+func (a *AccessKeyRotatorApp) rotateKeys(ctx context.Context, job RotationJob, tx *RotationTransaction, journal *rotationJournal) ([]KeyRotation, error) {
+	var rotated []KeyRotation
+
+	// Finish what previous runs left behind
+	now := time.Now()
+	resumed, err := a.resumeRotations(ctx, job, tx, now)
+	if err != nil {
+		return nil, err
+	}
+
 	// First get list of keys
-	keys, err := a.ListKeys(ctx)
+	keys, err := job.KeyManager.ListAccessKeys(ctx)
 	if err != nil {
-		return fmt.Errorf("Couldn't get list of keys: %s", err)
+		return nil, fmt.Errorf("Couldn't get list of keys: %s", err)
+	}
+
+	// Get rid of keys replaced during previous runs
+	err = a.deleteExpiredKeys(ctx, job, tx, keys, now)
+	if err != nil {
+		return nil, err
 	}
 
-	// Encrypt each key and upload to secrets store
 	for _, k := range keys {
-		newKey, err := a.KeyManager.RotateAccessKey(ctx, k.ID)
+		decision := a.Policy.Evaluate(k, now)
+		if resumed[k.ID] && k.IsActive() {
+			decision.Rotate = true
+		}
+		if !decision.Rotate {
+			log.Printf("Skipping key %s: %s\n", k.ID, decision.Reason)
+			continue
+		}
+
+		rotation, err := a.rotateKey(ctx, job, tx, journal, k.ID)
+		if rotation.NewKeyID != "" {
+			rotated = append(rotated, rotation)
+		}
 		if err != nil {
-			return fmt.Errorf("Couldn't rotate key: %s", err)
+			return rotated, err
 		}
+	}
+	return rotated, nil
+}
 
-		encryptedKey, err := a.SecretsStore.EncryptKey(ctx, newKey)
+// rotateKey replaces a single key: the new key is created, verified and published before the old one
+// is retired. The returned rotation is only set once the new key has been published.
+func (a *AccessKeyRotatorApp) rotateKey(ctx context.Context, job RotationJob, tx *RotationTransaction, journal *rotationJournal, oldKeyID string) (KeyRotation, error) {
+	// Without a destination the new key could never be used
+	if len(job.Destinations) == 0 {
+		return KeyRotation{}, fmt.Errorf("no secrets store configured")
+	}
+	err := a.checkRoomForKey(ctx, job, oldKeyID)
+	if err != nil {
+		return KeyRotation{}, err
+	}
+
+	tx.begin()
+	err = journal.start(ctx, tx, oldKeyID)
+	if err != nil {
+		return KeyRotation{}, err
+	}
+
+	newKey, err := job.KeyManager.RotateAccessKey(ctx, oldKeyID)
+	if err != nil {
+		return KeyRotation{}, fmt.Errorf("Couldn't rotate key: %s", err)
+	}
+	tx.record(ActionCreateKey, newKey.ID, func(ctx context.Context) error {
+		return job.KeyManager.DeleteAccessKey(ctx, newKey.ID)
+	})
+	err = journal.keyCreated(ctx, newKey.ID)
+	if err != nil {
+		return KeyRotation{}, err
+	}
+
+	// Only keys which actually work are published
+	if a.verifies(job) {
+		err = a.verifyKey(ctx, job, newKey)
+		if err == nil {
+			err = journal.log(ctx, st.PhaseVerified, "")
+		}
 		if err != nil {
-			return fmt.Errorf("Couldn't encrypt key: %s\n", err)
+			return KeyRotation{}, err
 		}
+	}
+
+	// Encrypt new key and upload to secrets store
+	err = a.publishKey(ctx, job, tx, journal, oldKeyID, newKey)
+	if err != nil {
+		return KeyRotation{}, err
+	}
+	rotation := KeyRotation{OldKeyID: oldKeyID, NewKeyID: newKey.ID}
+	tx.savepoint()
+	err = journal.log(ctx, st.PhasePublished, "")
+	if err != nil {
+		return rotation, err
+	}
+
+	// Consumers have the new key now, retire the old one
+	err = a.retireKey(ctx, job, tx, oldKeyID)
+	if err != nil {
+		return rotation, err
+	}
+	tx.savepoint()
+	err = journal.log(ctx, st.PhaseRetired, oldKeyID)
+	if err == nil {
+		err = journal.log(ctx, st.PhaseCompleted, "")
+	}
+	return rotation, err
+}
+
+// retireKey deactivates a replaced key. If there is no grace period, the key will be deleted right away.
+func (a *AccessKeyRotatorApp) retireKey(ctx context.Context, job RotationJob, tx *RotationTransaction, id string) error {
+	if a.GracePeriod <= 0 {
+		err := job.KeyManager.DeleteAccessKey(ctx, id)
+		if err != nil {
+			return fmt.Errorf("Couldn't delete old key (id = %s): %s", id, err)
+		}
+		tx.record(ActionDeleteKey, id, nil)
+		return nil
+	}
 
-		err = a.SecretsStore.CreateSecret(ctx, *encryptedKey)
+	err := job.KeyManager.DeactivateAccessKey(ctx, id)
+	if err != nil {
+		return fmt.Errorf("Couldn't deactivate old key (id = %s): %s", id, err)
+	}
+	tx.record(ActionDeactivateKey, id, func(ctx context.Context) error {
+		return job.KeyManager.ActivateAccessKey(ctx, id)
+	})
+	return nil
+}
+
+// deleteExpiredKeys deletes inactive keys which have expired or whose grace period is over
+func (a *AccessKeyRotatorApp) deleteExpiredKeys(ctx context.Context, job RotationJob, tx *RotationTransaction, keys []entity.AccessKey, now time.Time) error {
+	retired, err := a.retiredKeys(ctx, job)
+	if err != nil {
+		return err
+	}
+	for _, k := range a.expiredKeys(keys, retired, now) {
+		err := job.KeyManager.DeleteAccessKey(ctx, k.ID)
 		if err != nil {
-			return fmt.Errorf("Couldn't upload secrets: %s", err)
+			return fmt.Errorf("Couldn't delete expired key (id = %s): %s", k.ID, err)
+		}
+		tx.record(ActionDeleteKey, k.ID, nil)
+	}
+	tx.savepoint()
+	return nil
+}
+
+// retiredKeys returns when the keys of a job have been retired by a rotation according to the journal.
+// Without a state store, nil is returned.
+func (a *AccessKeyRotatorApp) retiredKeys(ctx context.Context, job RotationJob) (map[string]time.Time, error) {
+	if a.StateStore == nil {
+		return nil, nil
+	}
+	records, err := a.StateStore.ListRotations(ctx, job.Name)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't read rotation state: %s", err)
+	}
+
+	retired := make(map[string]time.Time)
+	for _, r := range records {
+		for _, entry := range r.Journal {
+			if entry.Phase == st.PhaseRetired {
+				retired[r.OldKeyID] = entry.At
+			}
+		}
+	}
+	return retired, nil
+}
+
+// checkRoomForKey makes sure the key manager doesn't delete a key within its grace period
+// in order to make room for the key replacing oldKeyID
+func (a *AccessKeyRotatorApp) checkRoomForKey(ctx context.Context, job RotationJob, oldKeyID string) error {
+	if _, ok := job.KeyManager.(k.KeyLimiter); !ok {
+		return nil
+	}
+	keys, err := job.KeyManager.ListAccessKeys(ctx)
+	if err != nil {
+		return fmt.Errorf("Couldn't get list of keys: %s", err)
+	}
+	retired, err := a.retiredKeys(ctx, job)
+	if err != nil {
+		return err
+	}
+	_, _, err = a.roomForKey(job, keys, oldKeyID, retired, time.Now())
+	return err
+}
+
+// expiredKeys returns the inactive keys which aren't valid anymore (e.g. Azure client secrets past
+// their end date) and the ones whose grace period is over. Keys deactivated by hand are
+// kept: with a journal (retired isn't nil) only keys retired by a rotation are deleted, once their
+// grace period is over. Without a journal, key managers don't track when a key was deactivated, so
+// the grace period starts with the creation of the newest active key (the one which replaced the
+// inactive ones). Without a grace period, replaced keys are deleted right away, so inactive keys
+// weren't deactivated by us.
+func (a *AccessKeyRotatorApp) expiredKeys(keys []entity.AccessKey, retired map[string]time.Time, now time.Time) []entity.AccessKey {
+	replaced := make(map[string]bool)
+	for _, k := range a.replacedKeys(keys, retired, now) {
+		replaced[k.ID] = true
+	}
+
+	var expired []entity.AccessKey
+	for _, k := range keys {
+		if keyExpired(k, now) || replaced[k.ID] {
+			expired = append(expired, k)
+		}
+	}
+	return expired
+}
+
+// keyExpired checks whether an inactive key has passed its expiry date. Nobody is able to use it anymore.
+func keyExpired(k entity.AccessKey, now time.Time) bool {
+	return !k.IsActive() && !k.ExpiresAt.IsZero() && !now.Before(k.ExpiresAt)
+}
+
+// replacedKeys returns the inactive keys replaced by a rotation whose grace period is over
+func (a *AccessKeyRotatorApp) replacedKeys(keys []entity.AccessKey, retired map[string]time.Time, now time.Time) []entity.AccessKey {
+	var expired []entity.AccessKey
+	if retired != nil {
+		for _, k := range keys {
+			retiredAt, ok := retired[k.ID]
+			if !k.IsActive() && ok && now.Sub(retiredAt) >= a.GracePeriod {
+				expired = append(expired, k)
+			}
+		}
+		return expired
+	}
+	if a.GracePeriod <= 0 {
+		return nil
+	}
+
+	var replacedAt time.Time
+	for _, k := range keys {
+		if k.IsActive() && k.CreatedAt.After(replacedAt) {
+			replacedAt = k.CreatedAt
+		}
+	}
+
+	// Without an active key the inactive ones weren't replaced by us
+	if replacedAt.IsZero() || now.Sub(replacedAt) < a.GracePeriod {
+		return nil
+	}
+
+	for _, k := range keys {
+		if !k.IsActive() {
+			expired = append(expired, k)
+		}
+	}
+	return expired
+}
+
+// publishKey encrypts a key and uploads it to every destination of the job. Required destinations
+// are updated first. If one of them fails, the remaining ones are left untouched and an error is
+// returned so that the new key gets rolled back. Once the key has been written to a destination which
+// can't be restored, it is kept though (savepoint): rolling it back would leave that destination with
+// a key which doesn't work. Failing optional destinations are only logged.
+func (a *AccessKeyRotatorApp) publishKey(ctx context.Context, job RotationJob, tx *RotationTransaction, journal *rotationJournal, oldKeyID string, key entity.AccessKey) error {
+	var published []string
+	final := false
+	destinations := job.orderedDestinations()
+	for i, dest := range destinations {
+		restore, err := uploadKey(ctx, dest.SecretsStore, key)
+		if err == nil {
+			published = append(published, dest.SecretsStore.Destination())
+			tx.record(ActionWriteSecret, dest.SecretsStore.Destination(), restore)
+			if restore == nil {
+				tx.savepoint()
+				final = true
+			}
+			err = journal.published(ctx, dest.SecretsStore.Destination())
+			if err != nil {
+				return err
+			}
+			continue
 		}
+		if restore != nil {
+			// Some of the secrets might have been written before the store failed
+			tx.record(ActionWriteSecret, dest.SecretsStore.Destination(), restore)
+		}
+
+		if dest.Optional {
+			log.Printf("Couldn't publish key %s to optional destination %s: %s\n", key.ID, dest.SecretsStore.Destination(), err)
+			continue
+		}
+		if final {
+			// The new key stays, the old one isn't retired until every destination has the new one
+			var remaining []string
+			for _, d := range destinations[i:] {
+				remaining = append(remaining, d.SecretsStore.Destination())
+			}
+			return fmt.Errorf("%s: %s (new key %s is kept, it is published to: %s; old key %s is still published to: %s)",
+				dest.SecretsStore.Destination(), err, key.ID, strings.Join(published, ", "), oldKeyID, strings.Join(remaining, ", "))
+		}
+		if len(published) > 0 {
+			// These destinations will be restored
+			return fmt.Errorf("%s: %s (already updated: %s)", dest.SecretsStore.Destination(), err, strings.Join(published, ", "))
+		}
+		return fmt.Errorf("%s: %s", dest.SecretsStore.Destination(), err)
 	}
 	return nil
 }
+
+// uploadKey encrypts a key and uploads it to a secrets store. If the store is able to read
+// its secrets, the returned function restores the previous ones. Otherwise it is nil. The
+// function is returned as well if the upload fails since the store might be partially written.
+func uploadKey(ctx context.Context, store s.SecretsStore, key entity.AccessKey) (func(ctx context.Context) error, error) {
+	var restore func(ctx context.Context) error
+	if restorable, ok := store.(s.RestorableSecretsStore); ok {
+		snapshot, err := restorable.SnapshotSecrets(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't read previous secrets: %s", err)
+		}
+		restore = func(ctx context.Context) error {
+			return restorable.RestoreSecrets(ctx, snapshot)
+		}
+	}
+
+	encryptedKey, err := store.EncryptKey(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't encrypt key: %s", err)
+	}
+
+	err = store.CreateSecret(ctx, *encryptedKey)
+	if err != nil {
+		return restore, fmt.Errorf("Couldn't upload secrets: %s", err)
+	}
+	return restore, nil
+}
@@ -4,10 +4,17 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"filippo.io/age"
 	"github.com/dorneanu/go-key-rotator/entity"
 	"github.com/dorneanu/go-key-rotator/mocks"
+	s "github.com/dorneanu/go-key-rotator/secretsstore"
+	st "github.com/dorneanu/go-key-rotator/statestore"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 )
@@ -68,6 +75,9 @@ func (m *MockGenerator) InitDefaultSecretsStore() {
 		mock.AnythingOfType("entity.AccessKey"),
 	).Return(&entity.EncryptedKey{ID: "ID1", Secret: []byte{0x1, 0x2, 0x3}}, nil).Once()
 
+	// Destination mock
+	mockSecretsStore.On("Destination").Return("github:dorneanu/test/SECRET").Maybe()
+
 	m.MockSecretsStore = mockSecretsStore
 }
 
@@ -115,10 +125,61 @@ func TestRotate(t *testing.T) {
 		mock_key_manager.On(
 			"RotateAccessKey",
 			mock.Anything,
-			mock.AnythingOfType("string")).Return(entity.AccessKey{}, nil).Once()
+			mock.AnythingOfType("string")).Return(entity.AccessKey{ID: "NEW"}, nil).Once()
+
+		mock_key_manager.On(
+			"DeleteAccessKey",
+			mock.Anything,
+			"SECRET").Return(nil).Once()
+		mock_secrets_store.On("Destination").Return("github:dorneanu/test/SECRET")
+		mock_secrets_store.On(
+			"EncryptKey",
+			mock.Anything,
+			mock.AnythingOfType("entity.AccessKey")).Return(&entity.EncryptedKey{}, nil).Once()
+		mock_secrets_store.On(
+			"CreateSecret",
+			mock.Anything,
+			mock.AnythingOfType("entity.EncryptedKey")).Return(nil).Once()
 
 		err := app.Rotate(context.TODO(), "SECRET")
 		assert.Nil(t, err)
+		mock_key_manager.AssertExpectations(t)
+		mock_secrets_store.AssertExpectations(t)
+	})
+
+	t.Run("Check for CreateSecret error", func(t *testing.T) {
+		mock_key_manager := &mocks.KeyManager{}
+		mock_secrets_store := &mocks.SecretsStore{}
+		mock_config_store := &mocks.ConfigStore{}
+
+		app := &AccessKeyRotatorApp{
+			KeyManager:   mock_key_manager,
+			SecretsStore: mock_secrets_store,
+			ConfigStore:  mock_config_store,
+		}
+
+		mock_key_manager.On(
+			"RotateAccessKey",
+			mock.Anything,
+			mock.AnythingOfType("string")).Return(entity.AccessKey{ID: "NEW"}, nil).Once()
+		mock_key_manager.On(
+			"DeleteAccessKey",
+			mock.Anything,
+			"NEW").Return(nil).Once()
+		mock_secrets_store.On("Destination").Return("github:dorneanu/test/SECRET")
+		mock_secrets_store.On(
+			"EncryptKey",
+			mock.Anything,
+			mock.AnythingOfType("entity.AccessKey")).Return(&entity.EncryptedKey{}, nil).Once()
+		mock_secrets_store.On(
+			"CreateSecret",
+			mock.Anything,
+			mock.AnythingOfType("entity.EncryptedKey")).Return(errors.New("CREATE")).Once()
+
+		err := app.Rotate(context.TODO(), "SECRET")
+		assert.Error(t, err)
+		mock_key_manager.AssertExpectations(t)
+		mock_key_manager.AssertNotCalled(t, "DeleteAccessKey", mock.Anything, "SECRET")
 	})
 
 	t.Run("Check for empty access key id", func(t *testing.T) {
@@ -161,6 +222,49 @@ func TestRotate(t *testing.T) {
 		err := app.Rotate(context.TODO(), "SECRET")
 		assert.Error(t, err)
 	})
+
+	t.Run("Check for DeleteAccessKey error", func(t *testing.T) {
+		mock_key_manager := &mocks.KeyManager{}
+		mock_secrets_store := &mocks.SecretsStore{}
+		mock_config_store := &mocks.ConfigStore{}
+
+		app := &AccessKeyRotatorApp{
+			KeyManager:   mock_key_manager,
+			SecretsStore: mock_secrets_store,
+			ConfigStore:  mock_config_store,
+		}
+
+		mock_key_manager.On(
+			"RotateAccessKey",
+			mock.Anything,
+			mock.AnythingOfType("string")).Return(entity.AccessKey{ID: "NEW"}, nil).Once()
+
+		mock_key_manager.On(
+			"DeleteAccessKey",
+			mock.Anything,
+			"SECRET").Return(errors.New("DELETE")).Once()
+		mock_secrets_store.On("Destination").Return("github:dorneanu/test/SECRET")
+		mock_secrets_store.On(
+			"EncryptKey",
+			mock.Anything,
+			mock.AnythingOfType("entity.AccessKey")).Return(&entity.EncryptedKey{}, nil).Once()
+		mock_secrets_store.On(
+			"CreateSecret",
+			mock.Anything,
+			mock.AnythingOfType("entity.EncryptedKey")).Return(nil).Once()
+
+		err := app.Rotate(context.TODO(), "SECRET")
+		assert.Error(t, err)
+	})
+
+	t.Run("Check for missing secrets store", func(t *testing.T) {
+		mock_key_manager := &mocks.KeyManager{}
+		app := &AccessKeyRotatorApp{KeyManager: mock_key_manager}
+
+		err := app.Rotate(context.TODO(), "SECRET")
+		assert.EqualError(t, err, "no secrets store configured")
+		mock_key_manager.AssertNotCalled(t, "RotateAccessKey", mock.Anything, mock.Anything)
+	})
 }
 func TestListKeys(t *testing.T) {
 	t.Run("ListKeys non empty", func(t *testing.T) {
@@ -228,4 +332,305 @@ func TestUploadSecrets(t *testing.T) {
 		err := rotatorApp.UploadSecrets(context.TODO())
 		assert.Error(t, err)
 	})
+
+	t.Run("Test old key is deleted after upload", func(t *testing.T) {
+		mockGenerator := NewMockGenerator()
+		mockGenerator.NewKeyManager()
+		mockGenerator.MockKeyManager.On(
+			"ListAccessKeys",
+			mock.Anything).Return([]entity.AccessKey{
+			{ID: "OLD", Status: entity.KeyStatusActive},
+		}, nil).Once()
+		mockGenerator.MockKeyManager.On(
+			"RotateAccessKey",
+			mock.Anything,
+			"OLD").Return(entity.AccessKey{ID: "NEW", Secret: "secret"}, nil).Once()
+		mockGenerator.MockKeyManager.On(
+			"DeleteAccessKey",
+			mock.Anything,
+			"OLD").Return(nil).Once()
+
+		rotatorApp := mockGenerator.GetRotatorApp()
+		err := rotatorApp.UploadSecrets(context.TODO())
+		assert.NoError(t, err)
+		mockGenerator.MockKeyManager.AssertExpectations(t)
+		mockGenerator.MockSecretsStore.AssertExpectations(t)
+	})
+
+	t.Run("Test new key is rolled back if upload fails", func(t *testing.T) {
+		mockGenerator := NewMockGenerator()
+		mockGenerator.NewKeyManager()
+		mockGenerator.NewSecretsStore()
+		mockGenerator.MockKeyManager.On(
+			"ListAccessKeys",
+			mock.Anything).Return([]entity.AccessKey{{ID: "OLD"}}, nil).Once()
+		mockGenerator.MockKeyManager.On(
+			"RotateAccessKey",
+			mock.Anything,
+			"OLD").Return(entity.AccessKey{ID: "NEW", Secret: "secret"}, nil).Once()
+		mockGenerator.MockKeyManager.On(
+			"DeleteAccessKey",
+			mock.Anything,
+			"NEW").Return(nil).Once()
+		mockGenerator.MockSecretsStore.On(
+			"EncryptKey",
+			mock.Anything,
+			mock.AnythingOfType("entity.AccessKey"),
+		).Return(&entity.EncryptedKey{ID: "NEW", Secret: []byte{0x1}}, nil).Once()
+		mockGenerator.MockSecretsStore.On(
+			"CreateSecret",
+			mock.Anything,
+			mock.AnythingOfType("entity.EncryptedKey"),
+		).Return(errors.New("Upload failed")).Once()
+		mockGenerator.MockSecretsStore.On("Destination").Return("github:dorneanu/test/SECRET")
+
+		rotatorApp := mockGenerator.GetRotatorApp()
+		err := rotatorApp.UploadSecrets(context.TODO())
+		assert.Error(t, err)
+		mockGenerator.MockKeyManager.AssertExpectations(t)
+		mockGenerator.MockKeyManager.AssertNotCalled(t, "DeleteAccessKey", mock.Anything, "OLD")
+	})
+}
+
+func TestUploadSecretsGracePeriod(t *testing.T) {
+	now := time.Now()
+
+	t.Run("Old key is deactivated during grace period", func(t *testing.T) {
+		mockGenerator := NewMockGenerator()
+		mockGenerator.NewKeyManager()
+		mockGenerator.MockKeyManager.On(
+			"ListAccessKeys",
+			mock.Anything).Return([]entity.AccessKey{
+			{ID: "OLD", Status: entity.KeyStatusActive, CreatedAt: now.Add(-240 * time.Hour)},
+		}, nil).Once()
+		mockGenerator.MockKeyManager.On(
+			"RotateAccessKey",
+			mock.Anything,
+			"OLD").Return(entity.AccessKey{ID: "NEW", Secret: "secret"}, nil).Once()
+		mockGenerator.MockKeyManager.On(
+			"DeactivateAccessKey",
+			mock.Anything,
+			"OLD").Return(nil).Once()
+
+		rotatorApp := mockGenerator.GetRotatorApp()
+		rotatorApp.GracePeriod = 72 * time.Hour
+		err := rotatorApp.UploadSecrets(context.TODO())
+		assert.NoError(t, err)
+		mockGenerator.MockKeyManager.AssertExpectations(t)
+		mockGenerator.MockKeyManager.AssertNotCalled(t, "DeleteAccessKey", mock.Anything, "OLD")
+	})
+
+	t.Run("Inactive key is kept until grace period is over", func(t *testing.T) {
+		mockGenerator := NewMockGenerator()
+		mockGenerator.NewKeyManager()
+
+		keys := []entity.AccessKey{
+			{ID: "OLD", Status: entity.KeyStatusInactive, CreatedAt: now.Add(-240 * time.Hour)},
+			{ID: "CURRENT", Status: entity.KeyStatusActive, CreatedAt: now.Add(-24 * time.Hour)},
+		}
+
+		rotatorApp := mockGenerator.GetRotatorApp()
+		rotatorApp.GracePeriod = 72 * time.Hour
+		err := rotatorApp.deleteExpiredKeys(context.TODO(), rotatorApp.jobs()[0], &RotationTransaction{}, keys, now)
+		assert.NoError(t, err)
+		mockGenerator.MockKeyManager.AssertNotCalled(t, "DeleteAccessKey", mock.Anything, mock.Anything)
+	})
+
+	t.Run("Inactive key is deleted after grace period", func(t *testing.T) {
+		mockGenerator := NewMockGenerator()
+		mockGenerator.NewKeyManager()
+		mockGenerator.MockKeyManager.On(
+			"DeleteAccessKey",
+			mock.Anything,
+			"OLD").Return(nil).Once()
+
+		keys := []entity.AccessKey{
+			{ID: "OLD", Status: entity.KeyStatusInactive, CreatedAt: now.Add(-240 * time.Hour)},
+			{ID: "CURRENT", Status: entity.KeyStatusActive, CreatedAt: now.Add(-96 * time.Hour)},
+		}
+
+		rotatorApp := mockGenerator.GetRotatorApp()
+		rotatorApp.GracePeriod = 72 * time.Hour
+		err := rotatorApp.deleteExpiredKeys(context.TODO(), rotatorApp.jobs()[0], &RotationTransaction{}, keys, now)
+		assert.NoError(t, err)
+		mockGenerator.MockKeyManager.AssertExpectations(t)
+	})
+
+	t.Run("Inactive keys without replacement are kept", func(t *testing.T) {
+		mockGenerator := NewMockGenerator()
+		mockGenerator.NewKeyManager()
+
+		keys := []entity.AccessKey{
+			{ID: "OLD", Status: entity.KeyStatusInactive, CreatedAt: now.Add(-240 * time.Hour)},
+		}
+
+		rotatorApp := mockGenerator.GetRotatorApp()
+		err := rotatorApp.deleteExpiredKeys(context.TODO(), rotatorApp.jobs()[0], &RotationTransaction{}, keys, now)
+		assert.NoError(t, err)
+		mockGenerator.MockKeyManager.AssertNotCalled(t, "DeleteAccessKey", mock.Anything, mock.Anything)
+	})
+
+	t.Run("Keys deactivated by hand are kept without grace period", func(t *testing.T) {
+		mockGenerator := NewMockGenerator()
+		mockGenerator.NewKeyManager()
+
+		keys := []entity.AccessKey{
+			{ID: "MANUAL", Status: entity.KeyStatusInactive, CreatedAt: now.Add(-240 * time.Hour)},
+			{ID: "CURRENT", Status: entity.KeyStatusActive, CreatedAt: now.Add(-96 * time.Hour)},
+		}
+
+		rotatorApp := mockGenerator.GetRotatorApp()
+		err := rotatorApp.deleteExpiredKeys(context.TODO(), rotatorApp.jobs()[0], &RotationTransaction{}, keys, now)
+		assert.NoError(t, err)
+		mockGenerator.MockKeyManager.AssertNotCalled(t, "DeleteAccessKey", mock.Anything, mock.Anything)
+	})
+
+	t.Run("Expired keys are deleted without grace period", func(t *testing.T) {
+		mockGenerator := NewMockGenerator()
+		mockGenerator.NewKeyManager()
+		mockGenerator.MockKeyManager.On(
+			"DeleteAccessKey",
+			mock.Anything,
+			"EXPIRED").Return(nil).Once()
+
+		// Azure reports client secrets past their end date as inactive
+		keys := []entity.AccessKey{
+			{ID: "EXPIRED", Status: entity.KeyStatusInactive, CreatedAt: now.Add(-480 * time.Hour), ExpiresAt: now.Add(-time.Hour)},
+			{ID: "MANUAL", Status: entity.KeyStatusInactive, CreatedAt: now.Add(-240 * time.Hour), ExpiresAt: now.Add(240 * time.Hour)},
+			{ID: "CURRENT", Status: entity.KeyStatusActive, CreatedAt: now.Add(-96 * time.Hour), ExpiresAt: now.Add(-time.Minute)},
+		}
+
+		rotatorApp := mockGenerator.GetRotatorApp()
+		err := rotatorApp.deleteExpiredKeys(context.TODO(), rotatorApp.jobs()[0], &RotationTransaction{}, keys, now)
+		assert.NoError(t, err)
+		mockGenerator.MockKeyManager.AssertExpectations(t)
+		mockGenerator.MockKeyManager.AssertNotCalled(t, "DeleteAccessKey", mock.Anything, "MANUAL")
+		mockGenerator.MockKeyManager.AssertNotCalled(t, "DeleteAccessKey", mock.Anything, "CURRENT")
+	})
+
+	t.Run("Only keys retired by a rotation are deleted", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "state")
+		assert.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		mockGenerator := NewMockGenerator()
+		mockGenerator.NewKeyManager()
+		mockGenerator.MockKeyManager.On(
+			"DeleteAccessKey",
+			mock.Anything,
+			"OLD").Return(nil).Once()
+
+		rotatorApp := mockGenerator.GetRotatorApp()
+		rotatorApp.GracePeriod = 72 * time.Hour
+		rotatorApp.StateStore = st.NewFileStateStore(filepath.Join(dir, "state.json"))
+
+		r := st.RotationRecord{ID: "1", OldKeyID: "OLD", NewKeyID: "CURRENT", StartedAt: now.Add(-96 * time.Hour)}
+		r.Log(now.Add(-96*time.Hour), st.PhaseRetired, "OLD")
+		r.Log(now.Add(-96*time.Hour), st.PhaseCompleted, "")
+		assert.NoError(t, rotatorApp.StateStore.SaveRotation(context.TODO(), r))
+
+		// MANUAL is older than CURRENT but has been deactivated by hand
+		keys := []entity.AccessKey{
+			{ID: "MANUAL", Status: entity.KeyStatusInactive, CreatedAt: now.Add(-480 * time.Hour)},
+			{ID: "OLD", Status: entity.KeyStatusInactive, CreatedAt: now.Add(-240 * time.Hour)},
+			{ID: "CURRENT", Status: entity.KeyStatusActive, CreatedAt: now.Add(-96 * time.Hour)},
+		}
+		err = rotatorApp.deleteExpiredKeys(context.TODO(), rotatorApp.jobs()[0], &RotationTransaction{}, keys, now)
+		assert.NoError(t, err)
+		mockGenerator.MockKeyManager.AssertExpectations(t)
+		mockGenerator.MockKeyManager.AssertNotCalled(t, "DeleteAccessKey", mock.Anything, "MANUAL")
+	})
+
+	t.Run("Keys within grace period aren't deleted to make room", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "state")
+		assert.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		mockGenerator := NewMockGenerator()
+		mockGenerator.NewKeyManager()
+		mockGenerator.NewSecretsStore()
+		mockGenerator.MockKeyManager.On(
+			"ListAccessKeys",
+			mock.Anything).Return([]entity.AccessKey{
+			{ID: "OLD", Status: entity.KeyStatusInactive, CreatedAt: now.Add(-240 * time.Hour)},
+			{ID: "CURRENT", Status: entity.KeyStatusActive, CreatedAt: now.Add(-24 * time.Hour)},
+		}, nil)
+		mockGenerator.MockSecretsStore.On("Destination").Return("github:dorneanu/test/SECRET")
+
+		rotatorApp := mockGenerator.GetRotatorApp()
+		rotatorApp.KeyManager = limitedKeyManager{mockGenerator.MockKeyManager, 2}
+		rotatorApp.GracePeriod = 72 * time.Hour
+		rotatorApp.StateStore = st.NewFileStateStore(filepath.Join(dir, "state.json"))
+
+		r := st.RotationRecord{ID: "1", OldKeyID: "OLD", NewKeyID: "CURRENT", StartedAt: now.Add(-24 * time.Hour)}
+		r.Log(now.Add(-24*time.Hour), st.PhaseRetired, "OLD")
+		r.Log(now.Add(-24*time.Hour), st.PhaseCompleted, "")
+		assert.NoError(t, rotatorApp.StateStore.SaveRotation(context.TODO(), r))
+
+		_, err = rotatorApp.PlanRotate(context.TODO(), "CURRENT")
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "inactive key OLD is within its grace period")
+
+		err = rotatorApp.Rotate(context.TODO(), "CURRENT")
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "inactive key OLD is within its grace period")
+		mockGenerator.MockKeyManager.AssertNotCalled(t, "RotateAccessKey", mock.Anything, mock.Anything)
+	})
+}
+
+func TestReactivate(t *testing.T) {
+	mockGenerator := NewMockGenerator()
+	mockGenerator.NewKeyManager()
+	mockGenerator.MockKeyManager.On(
+		"ActivateAccessKey",
+		mock.Anything,
+		"OLD").Return(nil).Once()
+
+	rotatorApp := mockGenerator.GetRotatorApp()
+	assert.NoError(t, rotatorApp.Reactivate(context.TODO(), "OLD"))
+	assert.Error(t, rotatorApp.Reactivate(context.TODO(), ""))
+	mockGenerator.MockKeyManager.AssertExpectations(t)
+}
+
+// TestUploadSecretsToFile runs the whole rotation against an age encrypted file
+func TestUploadSecretsToFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rotator")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	identity, err := age.GenerateX25519Identity()
+	assert.NoError(t, err)
+	identityFile := filepath.Join(dir, "rotator.key")
+	assert.NoError(t, ioutil.WriteFile(identityFile, []byte(identity.String()+"\n"), 0600))
+
+	file, err := s.NewAgeSecretsFile(s.AgeFileSettings{Path: filepath.Join(dir, "secrets.age"), IdentityFile: identityFile})
+	assert.NoError(t, err)
+
+	keyManagers := make(map[string]*mocks.KeyManager)
+	var principals []principal
+	for _, name := range []string{"deploy", "backup"} {
+		keyManager := &mocks.KeyManager{}
+		keyManager.On("ListAccessKeys", mock.Anything).Return([]entity.AccessKey{{ID: name + "-OLD", Status: entity.KeyStatusActive}}, nil).Once()
+		keyManager.On("RotateAccessKey", mock.Anything, name+"-OLD").Return(entity.AccessKey{ID: name + "-NEW", Secret: name + "-secret", Provider: "aws"}, nil).Once()
+		keyManager.On("DeleteAccessKey", mock.Anything, name+"-OLD").Return(nil).Once()
+		keyManagers[name] = keyManager
+		principals = append(principals, principal{name: name, keyManager: keyManager})
+	}
+
+	layout := s.SecretLayout{Format: s.SecretFormatJSON, Name: "aws/{{ .Principal }}"}
+	jobs, err := newRotationJobs("aws", "aws", principals, []destinationFactory{fileDestination(file, layout, false)})
+	assert.NoError(t, err)
+
+	rotatorApp := newAccessKeyRotatorAppWithJobs(&mocks.ConfigStore{}, jobs, 0, RotationPolicy{})
+	assert.NoError(t, rotatorApp.UploadSecrets(context.TODO()))
+	for _, keyManager := range keyManagers {
+		keyManager.AssertExpectations(t)
+	}
+
+	secrets, err := file.Read()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(secrets))
+	assert.Equal(t, `{"AccessKeyId":"deploy-NEW","SecretAccessKey":"deploy-secret"}`, secrets["aws/deploy"].Value)
+	assert.Equal(t, `{"AccessKeyId":"backup-NEW","SecretAccessKey":"backup-secret"}`, secrets["aws/backup"].Value)
+	assert.Equal(t, "backup-NEW", secrets["aws/backup"].Metadata[s.FileMetadataKeyID])
 }
@@ -0,0 +1,161 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// TransactionState describes how a rotation transaction ended
+type TransactionState string
+
+const (
+	// TransactionCommitted means every step succeeded
+	TransactionCommitted TransactionState = "committed"
+
+	// TransactionRolledBack means every step has been undone
+	TransactionRolledBack TransactionState = "rolled back"
+
+	// TransactionPartiallyRolledBack means the failed rotation has been undone as far as possible,
+	// but some steps couldn't be undone (e.g. secrets which can't be read back or deleted keys)
+	TransactionPartiallyRolledBack TransactionState = "partially rolled back"
+
+	// TransactionRollbackFailed means at least one compensating action failed. The steps
+	// tell what has to be fixed by hand.
+	TransactionRollbackFailed TransactionState = "rollback failed"
+)
+
+// StepState describes what happened to a step of a transaction
+type StepState string
+
+const (
+	StepDone               StepState = "done"
+	StepUndone             StepState = "undone"
+	StepNotUndoable        StepState = "can't be undone"
+	StepKept               StepState = "kept"
+	StepCompensationFailed StepState = "compensation failed"
+)
+
+// TransactionStep is a single change made during a rotation along with the
+// action compensating it (if there is one)
+type TransactionStep struct {
+	Type   ActionType
+	Target string
+	State  StepState
+
+	// Err is the error of the compensating action (if it failed)
+	Err error
+
+	compensate func(ctx context.Context) error
+}
+
+// String returns a human readable representation of the step
+func (s TransactionStep) String() string {
+	step := fmt.Sprintf("%s %s: %s", s.Type, s.Target, s.State)
+	if s.Err != nil {
+		step += fmt.Sprintf(" (%s)", s.Err)
+	}
+	return step
+}
+
+// RotationTransaction records every change made by a rotation job. If the job fails, the
+// changes are undone in reverse order using compensating actions (saga).
+type RotationTransaction struct {
+	Steps []TransactionStep
+	State TransactionState
+
+	// final is the number of steps which are kept even if the transaction is rolled back
+	final int
+
+	// begun is the index of the first step of the current unit (e.g. the rotation of a single key)
+	begun int
+}
+
+// begin starts a new unit of steps which are either all kept or undone together (see savepoint)
+func (t *RotationTransaction) begin() {
+	t.begun = len(t.Steps)
+}
+
+// record adds a step which has been completed. Without a compensating action the step can't be undone.
+func (t *RotationTransaction) record(actionType ActionType, target string, compensate func(ctx context.Context) error) {
+	t.Steps = append(t.Steps, TransactionStep{Type: actionType, Target: target, State: StepDone, compensate: compensate})
+}
+
+// savepoint makes all steps recorded so far final if one of the steps of the current unit can't be
+// undone. Undoing the other ones would leave consumers with a key which doesn't exist anymore (e.g.
+// a deleted old key or a new key published to a secrets store which can't be restored).
+func (t *RotationTransaction) savepoint() {
+	for _, step := range t.Steps[t.begun:] {
+		if step.compensate == nil {
+			t.final = len(t.Steps)
+			return
+		}
+	}
+}
+
+// keep makes all steps recorded so far final
+func (t *RotationTransaction) keep() {
+	t.final = len(t.Steps)
+}
+
+// commit marks the transaction as successful
+func (t *RotationTransaction) commit() {
+	t.State = TransactionCommitted
+}
+
+// rollback runs the compensating actions of all steps since the last savepoint in reverse order.
+// A failing compensation doesn't stop the remaining ones. The returned error lists the failed ones.
+func (t *RotationTransaction) rollback(ctx context.Context) error {
+	var failed []string
+	for i := len(t.Steps) - 1; i >= t.final; i-- {
+		step := &t.Steps[i]
+		if step.compensate == nil {
+			step.State = StepNotUndoable
+			continue
+		}
+
+		step.Err = step.compensate(ctx)
+		if step.Err != nil {
+			step.State = StepCompensationFailed
+			failed = append(failed, fmt.Sprintf("%s %s: %s", step.Type, step.Target, step.Err))
+			continue
+		}
+		step.State = StepUndone
+	}
+	for i := 0; i < t.final; i++ {
+		t.Steps[i].State = StepKept
+	}
+
+	switch {
+	case len(failed) > 0:
+		t.State = TransactionRollbackFailed
+		return fmt.Errorf("%s", strings.Join(failed, "; "))
+	case t.undone():
+		t.State = TransactionRolledBack
+	default:
+		t.State = TransactionPartiallyRolledBack
+	}
+	return nil
+}
+
+// undone returns true if every step has been undone
+func (t *RotationTransaction) undone() bool {
+	for _, step := range t.Steps {
+		if step.State != StepUndone {
+			return false
+		}
+	}
+	return true
+}
+
+// String returns the state of the transaction followed by its steps
+func (t *RotationTransaction) String() string {
+	steps := make([]string, 0, len(t.Steps))
+	for _, step := range t.Steps {
+		steps = append(steps, step.String())
+	}
+	if len(steps) == 0 {
+		return string(t.State)
+	}
+	return fmt.Sprintf("%s: %s", t.State, strings.Join(steps, ", "))
+}
@@ -0,0 +1,173 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/dorneanu/go-key-rotator/entity"
+	"github.com/dorneanu/go-key-rotator/mocks"
+	s "github.com/dorneanu/go-key-rotator/secretsstore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// memorySecretsFile implements SecretsFile without touching the disk
+type memorySecretsFile struct {
+	secrets map[string]s.FileSecret
+}
+
+func (f *memorySecretsFile) Path() string {
+	return "memory"
+}
+
+func (f *memorySecretsFile) Read() (map[string]s.FileSecret, error) {
+	secrets := make(map[string]s.FileSecret)
+	for name, secret := range f.secrets {
+		secrets[name] = secret
+	}
+	return secrets, nil
+}
+
+func (f *memorySecretsFile) Write(secrets map[string]s.FileSecret) error {
+	f.secrets = secrets
+	return nil
+}
+
+// partialSecretsFile keeps the secrets of the first write but reports an error like a store
+// which fails after writing some of its secrets
+type partialSecretsFile struct {
+	memorySecretsFile
+	failed bool
+}
+
+func (f *partialSecretsFile) Write(secrets map[string]s.FileSecret) error {
+	f.secrets = secrets
+	if !f.failed {
+		f.failed = true
+		return errors.New("Connection reset")
+	}
+	return nil
+}
+
+// transactionStates returns the state of every step
+func transactionStates(tx *RotationTransaction) []StepState {
+	var states []StepState
+	for _, step := range tx.Steps {
+		states = append(states, step.State)
+	}
+	return states
+}
+
+func TestRunJobRollback(t *testing.T) {
+	created := time.Now().Add(-240 * time.Hour)
+	keys := []entity.AccessKey{
+		{ID: "OLD1", Status: entity.KeyStatusActive, CreatedAt: created},
+		{ID: "OLD2", Status: entity.KeyStatusActive, CreatedAt: created},
+	}
+
+	t.Run("Previous secret and old key are restored", func(t *testing.T) {
+		keyManager := &mocks.KeyManager{}
+		keyManager.On("ListAccessKeys", mock.Anything).Return(keys, nil).Once()
+		keyManager.On("RotateAccessKey", mock.Anything, "OLD1").Return(entity.AccessKey{ID: "NEW1", Secret: "secret"}, nil).Once()
+		keyManager.On("DeactivateAccessKey", mock.Anything, "OLD1").Return(nil).Once()
+		keyManager.On("RotateAccessKey", mock.Anything, "OLD2").Return(entity.AccessKey{}, errors.New("LimitExceeded")).Once()
+
+		// Compensating actions
+		keyManager.On("ActivateAccessKey", mock.Anything, "OLD1").Return(nil).Once()
+		keyManager.On("DeleteAccessKey", mock.Anything, "NEW1").Return(nil).Once()
+
+		file := &memorySecretsFile{secrets: map[string]s.FileSecret{"AWS_KEY": {Value: "previous"}}}
+		store := s.NewFileSecretsStore(file, s.SecretLayout{Format: s.SecretFormatJSON, Name: "AWS_KEY"})
+		rotatorApp := &AccessKeyRotatorApp{
+			Jobs:        []RotationJob{{Name: "aws:deploy", KeyManager: keyManager, Destinations: []Destination{{SecretsStore: store}}}},
+			GracePeriod: 72 * time.Hour,
+		}
+
+		results := rotatorApp.RunJobs(context.TODO())
+		assert.Error(t, results[0].Err)
+		assert.Empty(t, results[0].Rotated)
+		assert.Equal(t, TransactionRolledBack, results[0].Transaction.State)
+		assert.Equal(t, []StepState{StepUndone, StepUndone, StepUndone}, transactionStates(results[0].Transaction))
+		assert.Equal(t, "previous", file.secrets["AWS_KEY"].Value)
+		keyManager.AssertExpectations(t)
+	})
+
+	t.Run("Partially written secrets are restored", func(t *testing.T) {
+		keyManager := &mocks.KeyManager{}
+		keyManager.On("ListAccessKeys", mock.Anything).Return(keys[:1], nil).Once()
+		keyManager.On("RotateAccessKey", mock.Anything, "OLD1").Return(entity.AccessKey{ID: "NEW1", Secret: "secret"}, nil).Once()
+		keyManager.On("DeleteAccessKey", mock.Anything, "NEW1").Return(nil).Once()
+
+		file := &partialSecretsFile{memorySecretsFile: memorySecretsFile{secrets: map[string]s.FileSecret{"AWS_KEY": {Value: "previous"}}}}
+		store := s.NewFileSecretsStore(file, s.SecretLayout{Format: s.SecretFormatJSON, Name: "AWS_KEY"})
+		rotatorApp := &AccessKeyRotatorApp{
+			Jobs: []RotationJob{{Name: "aws:deploy", KeyManager: keyManager, Destinations: []Destination{{SecretsStore: store}}}},
+		}
+
+		results := rotatorApp.RunJobs(context.TODO())
+		assert.Error(t, results[0].Err)
+		assert.Contains(t, results[0].Err.Error(), "Connection reset")
+		assert.Equal(t, TransactionRolledBack, results[0].Transaction.State)
+		assert.Equal(t, []StepState{StepUndone, StepUndone}, transactionStates(results[0].Transaction))
+		assert.Equal(t, "previous", file.secrets["AWS_KEY"].Value)
+		keyManager.AssertExpectations(t)
+	})
+
+	t.Run("Completed rotations are kept once the old key is deleted", func(t *testing.T) {
+		keyManager := &mocks.KeyManager{}
+		keyManager.On("ListAccessKeys", mock.Anything).Return(keys, nil).Once()
+		keyManager.On("RotateAccessKey", mock.Anything, "OLD1").Return(entity.AccessKey{ID: "NEW1"}, nil).Once()
+		keyManager.On("DeleteAccessKey", mock.Anything, "OLD1").Return(nil).Once()
+		keyManager.On("RotateAccessKey", mock.Anything, "OLD2").Return(entity.AccessKey{ID: "NEW2"}, nil).Once()
+		keyManager.On("DeleteAccessKey", mock.Anything, "NEW2").Return(nil).Once()
+
+		store := &mocks.SecretsStore{}
+		store.On("Destination").Return("github:owner/app/AWS_KEY")
+		store.On("EncryptKey", mock.Anything, mock.AnythingOfType("entity.AccessKey")).Return(&entity.EncryptedKey{}, nil)
+		store.On("CreateSecret", mock.Anything, mock.AnythingOfType("entity.EncryptedKey")).Return(nil).Once()
+		store.On("CreateSecret", mock.Anything, mock.AnythingOfType("entity.EncryptedKey")).Return(errors.New("Upload failed")).Once()
+
+		rotatorApp := &AccessKeyRotatorApp{
+			Jobs: []RotationJob{{Name: "aws:deploy", KeyManager: keyManager, Destinations: []Destination{{SecretsStore: store}}}},
+		}
+
+		results := rotatorApp.RunJobs(context.TODO())
+		assert.Error(t, results[0].Err)
+		assert.Equal(t, []KeyRotation{{OldKeyID: "OLD1", NewKeyID: "NEW1"}}, results[0].Rotated)
+		assert.Equal(t, TransactionPartiallyRolledBack, results[0].Transaction.State)
+		assert.Equal(t, []StepState{StepKept, StepKept, StepKept, StepUndone}, transactionStates(results[0].Transaction))
+		keyManager.AssertExpectations(t)
+	})
+
+	t.Run("Failing compensation is reported", func(t *testing.T) {
+		keyManager := &mocks.KeyManager{}
+		keyManager.On("ListAccessKeys", mock.Anything).Return(keys[:1], nil).Once()
+		keyManager.On("RotateAccessKey", mock.Anything, "OLD1").Return(entity.AccessKey{ID: "NEW1"}, nil).Once()
+		keyManager.On("DeleteAccessKey", mock.Anything, "NEW1").Return(errors.New("Access denied")).Once()
+
+		file := &memorySecretsFile{secrets: map[string]s.FileSecret{"AWS_KEY": {Value: "previous"}}}
+		first := s.NewFileSecretsStore(file, s.SecretLayout{Format: s.SecretFormatJSON, Name: "AWS_KEY"})
+		failing := &mocks.SecretsStore{}
+		failing.On("Destination").Return("github:owner/infra/AWS_KEY")
+		failing.On("EncryptKey", mock.Anything, mock.AnythingOfType("entity.AccessKey")).Return(nil, errors.New("No public key"))
+
+		rotatorApp := &AccessKeyRotatorApp{
+			Jobs: []RotationJob{{
+				Name:         "aws:deploy",
+				KeyManager:   keyManager,
+				Destinations: []Destination{{SecretsStore: first}, {SecretsStore: failing}},
+			}},
+		}
+
+		results := rotatorApp.RunJobs(context.TODO())
+		assert.Error(t, results[0].Err)
+		assert.Contains(t, results[0].Err.Error(), "rollback failed: create key NEW1: Access denied")
+		assert.Equal(t, TransactionRollbackFailed, results[0].Transaction.State)
+		assert.Equal(t, []StepState{StepCompensationFailed, StepUndone}, transactionStates(results[0].Transaction))
+		assert.Contains(t, results[0].String(), "create key NEW1: compensation failed (Access denied)")
+		assert.Equal(t, "previous", file.secrets["AWS_KEY"].Value)
+		keyManager.AssertExpectations(t)
+	})
+}
@@ -0,0 +1,86 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/dorneanu/go-key-rotator/entity"
+)
+
+// Defaults of the VerificationPolicy
+const (
+	defaultVerifyAttempts = 6
+	defaultVerifyDelay    = 2 * time.Second
+	maxVerifyDelay        = 30 * time.Second
+)
+
+// VerificationPolicy specifies how new keys are verified before they are published. Providers
+// are eventually consistent, so verification is retried for a while before a key is given up.
+type VerificationPolicy struct {
+	// Skip disables the verification of new keys
+	Skip bool `envconfig:"VERIFY_SKIP" yaml:"skip"`
+
+	// Attempts is the number of times a key is tried (default: 6)
+	Attempts int `envconfig:"VERIFY_ATTEMPTS" yaml:"attempts"`
+
+	// Delay is the time to wait before the first retry (default: 2s). It is doubled after every
+	// failed attempt, up to 30s.
+	Delay time.Duration `envconfig:"VERIFY_DELAY" yaml:"delay"`
+}
+
+// merge returns a copy of the policy where all fields set in other take precedence
+func (p VerificationPolicy) merge(other VerificationPolicy) VerificationPolicy {
+	if other.Skip {
+		p.Skip = true
+	}
+	if other.Attempts != 0 {
+		p.Attempts = other.Attempts
+	}
+	if other.Delay != 0 {
+		p.Delay = other.Delay
+	}
+	return p
+}
+
+// verifies returns true if the new keys of a job are verified
+func (a *AccessKeyRotatorApp) verifies(job RotationJob) bool {
+	return job.Verifier != nil && !a.Verification.Skip
+}
+
+// verifyKey authenticates with a new key using the verifier of the job. Failed attempts are retried
+// as specified by the verification policy.
+func (a *AccessKeyRotatorApp) verifyKey(ctx context.Context, job RotationJob, key entity.AccessKey) error {
+
+	attempts, delay := a.Verification.Attempts, a.Verification.Delay
+	if attempts <= 0 {
+		attempts = defaultVerifyAttempts
+	}
+	if delay <= 0 {
+		delay = defaultVerifyDelay
+	}
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = job.Verifier.VerifyAccessKey(ctx, key)
+		if err == nil || attempt == attempts {
+			break
+		}
+		log.Printf("Verification of key %s failed (attempt %d of %d), retrying in %s: %s\n", key.ID, attempt, attempts, delay, err)
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("Couldn't verify new key %s: %s", key.ID, ctx.Err())
+		case <-time.After(delay):
+		}
+		delay *= 2
+		if delay > maxVerifyDelay {
+			delay = maxVerifyDelay
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("Couldn't verify new key %s: %s", key.ID, err)
+	}
+	return nil
+}
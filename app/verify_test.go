@@ -0,0 +1,117 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/dorneanu/go-key-rotator/entity"
+	"github.com/dorneanu/go-key-rotator/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// fakeVerifier rejects keys until they have been tried a number of times
+type fakeVerifier struct {
+	failures int
+	calls    int
+}
+
+func (v *fakeVerifier) VerifyAccessKey(ctx context.Context, key entity.AccessKey) error {
+	v.calls++
+	if v.calls <= v.failures {
+		return errors.New("InvalidClientTokenId")
+	}
+	return nil
+}
+
+func TestVerifyKey(t *testing.T) {
+	keys := []entity.AccessKey{{ID: "OLD", Status: entity.KeyStatusActive, CreatedAt: time.Now().Add(-240 * time.Hour)}}
+
+	newApp := func(keyManager *mocks.KeyManager, store *mocks.SecretsStore, verifier *fakeVerifier) *AccessKeyRotatorApp {
+		return &AccessKeyRotatorApp{
+			Jobs:         []RotationJob{{Name: "aws:deploy", KeyManager: keyManager, Destinations: []Destination{{SecretsStore: store}}, Verifier: verifier}},
+			Verification: VerificationPolicy{Attempts: 3, Delay: time.Millisecond},
+		}
+	}
+
+	newStore := func() *mocks.SecretsStore {
+		store := &mocks.SecretsStore{}
+		store.On("Destination").Return("github:owner/app/AWS_KEY")
+		store.On("EncryptKey", mock.Anything, mock.AnythingOfType("entity.AccessKey")).Return(&entity.EncryptedKey{}, nil)
+		store.On("CreateSecret", mock.Anything, mock.AnythingOfType("entity.EncryptedKey")).Return(nil)
+		return store
+	}
+
+	t.Run("Key is published once it works", func(t *testing.T) {
+		keyManager := &mocks.KeyManager{}
+		keyManager.On("ListAccessKeys", mock.Anything).Return(keys, nil).Once()
+		keyManager.On("RotateAccessKey", mock.Anything, "OLD").Return(entity.AccessKey{ID: "NEW", Secret: "secret"}, nil).Once()
+		keyManager.On("DeleteAccessKey", mock.Anything, "OLD").Return(nil).Once()
+		store := newStore()
+		verifier := &fakeVerifier{failures: 2}
+
+		results := newApp(keyManager, store, verifier).RunJobs(context.TODO())
+		assert.NoError(t, results[0].Err)
+		assert.Equal(t, 3, verifier.calls)
+		store.AssertNumberOfCalls(t, "CreateSecret", 1)
+		keyManager.AssertExpectations(t)
+	})
+
+	t.Run("Broken key is rolled back", func(t *testing.T) {
+		keyManager := &mocks.KeyManager{}
+		keyManager.On("ListAccessKeys", mock.Anything).Return(keys, nil).Once()
+		keyManager.On("RotateAccessKey", mock.Anything, "OLD").Return(entity.AccessKey{ID: "NEW", Secret: "secret"}, nil).Once()
+		keyManager.On("DeleteAccessKey", mock.Anything, "NEW").Return(nil).Once()
+		store := newStore()
+		verifier := &fakeVerifier{failures: 3}
+
+		results := newApp(keyManager, store, verifier).RunJobs(context.TODO())
+		assert.Error(t, results[0].Err)
+		assert.Contains(t, results[0].Err.Error(), "Couldn't verify new key NEW: InvalidClientTokenId")
+		assert.Equal(t, TransactionRolledBack, results[0].Transaction.State)
+		assert.Equal(t, 3, verifier.calls)
+		store.AssertNotCalled(t, "CreateSecret", mock.Anything, mock.Anything)
+		keyManager.AssertNotCalled(t, "DeleteAccessKey", mock.Anything, "OLD")
+		keyManager.AssertExpectations(t)
+	})
+
+	t.Run("Verification can be skipped", func(t *testing.T) {
+		keyManager := &mocks.KeyManager{}
+		keyManager.On("ListAccessKeys", mock.Anything).Return(keys, nil).Once()
+		keyManager.On("RotateAccessKey", mock.Anything, "OLD").Return(entity.AccessKey{ID: "NEW", Secret: "secret"}, nil).Once()
+		keyManager.On("DeleteAccessKey", mock.Anything, "OLD").Return(nil).Once()
+		verifier := &fakeVerifier{failures: 3}
+
+		rotatorApp := newApp(keyManager, newStore(), verifier)
+		rotatorApp.Verification.Skip = true
+		results := rotatorApp.RunJobs(context.TODO())
+		assert.NoError(t, results[0].Err)
+		assert.Equal(t, 0, verifier.calls)
+	})
+
+	t.Run("Broken key isn't kept by a manual rotation", func(t *testing.T) {
+		keyManager := &mocks.KeyManager{}
+		keyManager.On("RotateAccessKey", mock.Anything, "OLD").Return(entity.AccessKey{ID: "NEW", Secret: "secret"}, nil).Once()
+		keyManager.On("DeleteAccessKey", mock.Anything, "NEW").Return(nil).Once()
+
+		err := newApp(keyManager, newStore(), &fakeVerifier{failures: 3}).Rotate(context.TODO(), "OLD")
+		assert.Error(t, err)
+		keyManager.AssertNotCalled(t, "DeactivateAccessKey", mock.Anything, mock.Anything)
+		keyManager.AssertNotCalled(t, "DeleteAccessKey", mock.Anything, "OLD")
+		keyManager.AssertExpectations(t)
+	})
+
+	t.Run("Verification is stopped with the context", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.TODO())
+		cancel()
+		verifier := &fakeVerifier{failures: 3}
+		rotatorApp := newApp(&mocks.KeyManager{}, newStore(), verifier)
+		rotatorApp.Verification.Delay = time.Hour
+
+		err := rotatorApp.verifyKey(ctx, rotatorApp.Jobs[0], entity.AccessKey{ID: "NEW"})
+		assert.Error(t, err)
+		assert.Equal(t, 1, verifier.calls)
+	})
+}
@@ -0,0 +1,125 @@
+// Package azureauth provides HTTP clients authenticated against Entra ID (Azure AD)
+// either by client credentials or by the managed identity of the environment.
+package azureauth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+	"golang.org/x/oauth2/microsoft"
+)
+
+// Credentials specifies how to authenticate. Without a client secret, a token is requested
+// from the managed identity of the environment (the client ID selects a user-assigned identity).
+type Credentials struct {
+	TenantID     string `envconfig:"AZURE_TENANT_ID"`
+	ClientID     string `envconfig:"AZURE_CLIENT_ID"`
+	ClientSecret string `envconfig:"AZURE_CLIENT_SECRET"`
+}
+
+// NewHTTPClient returns a client which adds tokens for the specified resource (e.g. https://graph.microsoft.com/) to every request
+func NewHTTPClient(ctx context.Context, credentials Credentials, resource string) (*http.Client, error) {
+	if credentials.ClientSecret != "" {
+		if credentials.TenantID == "" || credentials.ClientID == "" {
+			return nil, fmt.Errorf("AZURE_TENANT_ID and AZURE_CLIENT_ID are required for client credentials")
+		}
+		config := clientcredentials.Config{
+			ClientID:     credentials.ClientID,
+			ClientSecret: credentials.ClientSecret,
+			TokenURL:     microsoft.AzureADEndpoint(credentials.TenantID).TokenURL,
+			Scopes:       []string{strings.TrimSuffix(resource, "/") + "/.default"},
+		}
+		return config.Client(ctx), nil
+	}
+
+	identity := newManagedIdentity(credentials.ClientID, resource)
+	return oauth2.NewClient(ctx, oauth2.ReuseTokenSource(nil, identity)), nil
+}
+
+// imdsEndpoint is the token endpoint of the instance metadata service of Azure VMs
+const imdsEndpoint = "http://169.254.169.254/metadata/identity/oauth2/token"
+
+// managedIdentity requests tokens from the managed identity of the environment.
+// App Service and Azure Functions announce their token endpoint by IDENTITY_ENDPOINT and IDENTITY_HEADER,
+// everywhere else the instance metadata service is used.
+type managedIdentity struct {
+	endpoint   string
+	apiVersion string
+	header     http.Header
+	clientID   string
+	resource   string
+	httpClient *http.Client
+}
+
+func newManagedIdentity(clientID, resource string) *managedIdentity {
+	identity := &managedIdentity{
+		endpoint:   imdsEndpoint,
+		apiVersion: "2018-02-01",
+		header:     http.Header{"Metadata": []string{"true"}},
+		clientID:   clientID,
+		resource:   resource,
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+	}
+	if endpoint := os.Getenv("IDENTITY_ENDPOINT"); endpoint != "" {
+		identity.endpoint = endpoint
+		identity.apiVersion = "2019-08-01"
+		identity.header = http.Header{"X-Identity-Header": []string{os.Getenv("IDENTITY_HEADER")}}
+	}
+	return identity
+}
+
+// Token implements oauth2.TokenSource
+func (m *managedIdentity) Token() (*oauth2.Token, error) {
+	query := url.Values{"api-version": {m.apiVersion}, "resource": {m.resource}}
+	if m.clientID != "" {
+		query.Set("client_id", m.clientID)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, m.endpoint+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = m.header.Clone()
+
+	resp, err := m.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't get token of managed identity: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("Couldn't get token of managed identity: %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresOn   string `json:"expires_on"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&token)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't decode token of managed identity: %s", err)
+	}
+
+	expiresOn, err := strconv.ParseInt(token.ExpiresOn, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't parse expiry of managed identity token: %s", err)
+	}
+	return &oauth2.Token{
+		AccessToken: token.AccessToken,
+		TokenType:   token.TokenType,
+		Expiry:      time.Unix(expiresOn, 0),
+	}, nil
+}
@@ -0,0 +1,41 @@
+package azureauth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert"
+)
+
+func TestManagedIdentity(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata") != "true" || r.URL.Query().Get("resource") != "https://vault.azure.net" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`{"access_token":"TOKEN","token_type":"Bearer","expires_on":"1625140800"}`))
+	}))
+	defer server.Close()
+
+	identity := newManagedIdentity("", "https://vault.azure.net")
+	identity.endpoint = server.URL
+	token, err := identity.Token()
+	assert.Nil(t, err)
+	assert.Equal(t, "TOKEN", token.AccessToken)
+	assert.Equal(t, time.Unix(1625140800, 0), token.Expiry)
+
+	identity.header = http.Header{}
+	_, err = identity.Token()
+	assert.Error(t, err)
+}
+
+func TestNewHTTPClient(t *testing.T) {
+	_, err := NewHTTPClient(context.TODO(), Credentials{ClientSecret: "secret"}, "https://vault.azure.net")
+	assert.Error(t, err)
+
+	_, err = NewHTTPClient(context.TODO(), Credentials{TenantID: "tenant", ClientID: "client", ClientSecret: "secret"}, "https://vault.azure.net")
+	assert.Nil(t, err)
+}
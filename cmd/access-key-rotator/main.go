@@ -5,9 +5,13 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
+	"text/tabwriter"
 	"time"
 
 	"github.com/dorneanu/go-key-rotator/app"
+	"github.com/dorneanu/go-key-rotator/entity"
+	"github.com/dorneanu/go-key-rotator/statestore"
 	"github.com/urfave/cli/v2"
 )
 
@@ -15,14 +19,44 @@ var (
 	cloudProvider string
 	secretsStore  string
 	iamUser       string
+	iamUsers      cli.StringSlice
+	iamPathPrefix string
+	iamUserTag    string
 	accessKeyID   string
 	repoOwner     string
 	repoName      string
+	repoNames     cli.StringSlice
 	tokenPath     string
 	secretName    string
+	secretFormat  string
+	idSecretName  string
+	gitlabURL     string
+	gracePeriod   time.Duration
+	policy        app.RotationPolicy
+	verification  app.VerificationPolicy
+	neverRotate   cli.StringSlice
+	dryRun        bool
+	configFile    string
+	configPath    string
+	stateStore    string
+	stateFile     string
+	stateTable    string
+	lockLease     time.Duration
+	historyJob    string
 )
 
+// newRotatorApp creates the rotator app used by the sub-commands
+var newRotatorApp = app.AccessKeyRotatorAppFactory
+
 func main() {
+	err := newCLI().Run(os.Args)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// newCLI creates the cli app along with all sub-commands
+func newCLI() *cli.App {
 	globalFlags := []cli.Flag{
 		&cli.StringFlag{
 			Name:        "cp",
@@ -33,15 +67,158 @@ func main() {
 		},
 		&cli.StringFlag{
 			Name:        "secrets-store",
-			Required:    true,
-			Usage:       "Which secrets store should be used (github, gitlab)",
+			Usage:       "Which secrets store should be used (github, gitlab, secretsmanager, vault, kubernetes, file)",
 			Destination: &secretsStore,
 			EnvVars:     []string{"SECRETS_STORE"},
 		},
+		&cli.StringFlag{
+			Name:        "config",
+			Usage:       "Rotation config file (YAML or JSON) describing the jobs to be run",
+			Destination: &configFile,
+			EnvVars:     []string{"CONFIG_FILE"},
+		},
+		&cli.StringFlag{
+			Name:        "config-store-path",
+			Usage:       "Path of the rotation config within the config store",
+			Destination: &configPath,
+			EnvVars:     []string{"CONFIG_STORE_CONFIG_PATH"},
+		},
+	}
+
+	iamUserFlags := []cli.Flag{
+		&cli.StringFlag{
+			Name:        "iam-user",
+			Usage:       "Name of the IAM user (email of the service account for gcp, application client ID for azure)",
+			Destination: &iamUser,
+			EnvVars:     []string{"IAM_USER"},
+		},
+		&cli.StringSliceFlag{
+			Name:        "iam-users",
+			Usage:       "Names of multiple IAM users (emails of service accounts for gcp, application client IDs for azure)",
+			Destination: &iamUsers,
+			EnvVars:     []string{"IAM_USERS"},
+		},
+		&cli.StringFlag{
+			Name:        "iam-user-path-prefix",
+			Usage:       "Select all IAM users with this path prefix (e.g. /deploy/)",
+			Destination: &iamPathPrefix,
+			EnvVars:     []string{"IAM_USER_PATH_PREFIX"},
+		},
+		&cli.StringFlag{
+			Name:        "iam-user-tag",
+			Usage:       "Select all IAM users with this tag (key or key=value)",
+			Destination: &iamUserTag,
+			EnvVars:     []string{"IAM_USER_TAG"},
+		},
+	}
+
+	stateFlags := []cli.Flag{
+		&cli.StringFlag{
+			Name:        "state-store",
+			Usage:       "Where the journal of all rotations and the locks are kept (file, dynamodb)",
+			Destination: &stateStore,
+			EnvVars:     []string{"STATE_STORE"},
+		},
+		&cli.StringFlag{
+			Name:        "state-file",
+			Usage:       "Path of the state file (file state store)",
+			Destination: &stateFile,
+			EnvVars:     []string{"STATE_FILE_PATH"},
+		},
+		&cli.StringFlag{
+			Name:        "state-table",
+			Usage:       "Name of the DynamoDB table (dynamodb state store)",
+			Destination: &stateTable,
+			EnvVars:     []string{"STATE_TABLE"},
+		},
+		&cli.DurationFlag{
+			Name:        "lock-lease",
+			Usage:       "How long the keys of a principal stay locked if a run doesn't release its lock (default: 15m)",
+			Destination: &lockLease,
+			EnvVars:     []string{"LOCK_LEASE"},
+		},
+	}
+
+	verificationFlags := []cli.Flag{
+		&cli.BoolFlag{
+			Name:        "skip-verification",
+			Usage:       "Publish new keys without authenticating with them first",
+			Destination: &verification.Skip,
+			EnvVars:     []string{"VERIFY_SKIP"},
+		},
+		&cli.IntFlag{
+			Name:        "verify-attempts",
+			Usage:       "How often a new key is tried before it is rolled back (default: 6)",
+			Destination: &verification.Attempts,
+			EnvVars:     []string{"VERIFY_ATTEMPTS"},
+		},
+		&cli.DurationFlag{
+			Name:        "verify-delay",
+			Usage:       "Delay before the first retry of the verification, doubled after every attempt (default: 2s)",
+			Destination: &verification.Delay,
+			EnvVars:     []string{"VERIFY_DELAY"},
+		},
+	}
+
+	secretsStoreFlags := []cli.Flag{
+		&cli.StringFlag{
+			Name:        "repo-owner",
+			Usage:       "Repository owner (GitLab: namespace or group)",
+			Destination: &repoOwner,
+			EnvVars:     []string{"REPO_OWNER"},
+		},
+		&cli.StringFlag{
+			Name:        "repo-name",
+			Usage:       "Repository name",
+			Destination: &repoName,
+			EnvVars:     []string{"REPO_NAME"},
+		},
+		&cli.StringSliceFlag{
+			Name:        "repo-names",
+			Usage:       "Names of multiple repositories the secret should be written to",
+			Destination: &repoNames,
+			EnvVars:     []string{"REPO_NAMES"},
+		},
+		&cli.StringFlag{
+			Name:        "gitlab-url",
+			Usage:       "URL of the GitLab instance (default: https://gitlab.com)",
+			Destination: &gitlabURL,
+			EnvVars:     []string{"GITLAB_URL"},
+		},
+		&cli.StringFlag{
+			Name:        "token-path",
+			Usage:       "Token path in the config store (SSM parameter or Secrets Manager reference for aws, Secret Manager secret for gcp, Key Vault secret for azure)",
+			Destination: &tokenPath,
+			EnvVars:     []string{"TOKEN_CONFIG_STORE_PATH"},
+		},
+		&cli.StringFlag{
+			Name:        "secret-name",
+			Usage:       "Name of the secret to be created/updated",
+			Destination: &secretName,
+			EnvVars:     []string{"SECRET_NAME"},
+		},
+		&cli.StringFlag{
+			Name:        "secret-format",
+			Usage:       "How the key is stored: secret (default), separate, json or env",
+			Destination: &secretFormat,
+			EnvVars:     []string{"SECRET_FORMAT"},
+		},
+		&cli.StringFlag{
+			Name:        "id-secret-name",
+			Usage:       "Name of the secret holding the access key ID (separate format)",
+			Destination: &idSecretName,
+			EnvVars:     []string{"ID_SECRET_NAME"},
+		},
+	}
+
+	dryRunFlag := &cli.BoolFlag{
+		Name:        "dry-run",
+		Usage:       "Only print what would be done without changing anything",
+		Destination: &dryRun,
 	}
 
 	// Create new cli app
-	app := &cli.App{
+	return &cli.App{
 		// Flags: globalFlags,
 		Authors: []*cli.Author{
 			&cli.Author{
@@ -56,30 +233,24 @@ func main() {
 				// list sub-command
 				Name:    "list",
 				Aliases: []string{"l"},
-				Flags: append([]cli.Flag{
-					&cli.StringFlag{
-						Name:        "iam-user",
-						Usage:       "Name of the IAM user",
-						Destination: &iamUser,
-						EnvVars:     []string{"IAM_USER"},
-					},
-				}, globalFlags...),
-				Usage: "List available access keys",
+				Flags:   append(iamUserFlags, globalFlags...),
+				Usage:   "List available access keys",
 				Action: func(c *cli.Context) error {
-					rotatorApp := app.AccessKeyRotatorAppFactory(app.AccessKeyRotatorSettings{
-						CloudProvider: cloudProvider,
-						IamUser:       iamUser,
-						SecretsStore:  "github",
+					rotatorApp := newRotatorApp(app.AccessKeyRotatorSettings{
+						CloudProvider:         cloudProvider,
+						IamUser:               iamUser,
+						IamUsers:              iamUsers.Value(),
+						IamUserPathPrefix:     iamPathPrefix,
+						IamUserTag:            iamUserTag,
+						ConfigFile:            configFile,
+						ConfigStoreConfigPath: configPath,
 					})
 
 					keys, err := rotatorApp.ListKeys(context.Background())
 					if err != nil {
 						return err
 					}
-					// Print keys
-					for _, k := range keys {
-						fmt.Printf("Id: %s\n", k.ID)
-					}
+					printKeys(keys)
 					return nil
 				},
 			},
@@ -87,93 +258,256 @@ func main() {
 				// rotate subcommand
 				Name:    "rotate",
 				Aliases: []string{"r"},
-				Flags: append([]cli.Flag{
-					&cli.StringFlag{
-						Name:        "iam-user",
-						Usage:       "Name of the IAM user",
-						Destination: &iamUser,
-						EnvVars:     []string{"IAM_USER"},
-					},
+				Flags: append(append([]cli.Flag{
 					&cli.StringFlag{
 						Name:        "access-key-id",
 						Usage:       "Access Key ID",
 						Destination: &accessKeyID,
 					},
-				}, globalFlags...),
+					&cli.DurationFlag{
+						Name:        "grace-period",
+						Usage:       "How long replaced keys stay inactive before they get deleted (e.g. 72h)",
+						Destination: &gracePeriod,
+						EnvVars:     []string{"GRACE_PERIOD"},
+					},
+					dryRunFlag,
+				}, append(append(append(secretsStoreFlags, stateFlags...), verificationFlags...), iamUserFlags...)...), globalFlags...),
 				Usage: "Rotate access key (per default all will be rotated)",
 				Action: func(c *cli.Context) error {
-					rotatorApp := app.AccessKeyRotatorAppFactory(
+					if secretsStore == "" && configFile == "" && configPath == "" {
+						return fmt.Errorf("either --secrets-store or a rotation config (--config, --config-store-path) is required")
+					}
+
+					rotatorApp := newRotatorApp(
 						app.AccessKeyRotatorSettings{
-							CloudProvider: cloudProvider,
-							IamUser:       iamUser,
-							SecretsStore:  "github",
+							CloudProvider:         cloudProvider,
+							SecretsStore:          secretsStore,
+							IamUser:               iamUser,
+							IamUsers:              iamUsers.Value(),
+							IamUserPathPrefix:     iamPathPrefix,
+							IamUserTag:            iamUserTag,
+							RepoOwner:             repoOwner,
+							RepoName:              repoName,
+							RepoNames:             repoNames.Value(),
+							SecretName:            secretName,
+							SecretFormat:          secretFormat,
+							IDSecretName:          idSecretName,
+							ConfigStoreTokenPath:  tokenPath,
+							GitlabURL:             gitlabURL,
+							GracePeriod:           gracePeriod,
+							Verification:          verification,
+							StateStore:            stateStore,
+							StateFilePath:         stateFile,
+							StateTable:            stateTable,
+							LockLease:             lockLease,
+							ConfigFile:            configFile,
+							ConfigStoreConfigPath: configPath,
 						})
+					if dryRun {
+						plan, err := rotatorApp.PlanRotate(context.Background(), accessKeyID)
+						if err != nil {
+							return err
+						}
+						printPlan(plan)
+						return nil
+					}
 					err := rotatorApp.Rotate(context.Background(), accessKeyID)
 					return err
 				},
 			},
+			{
+				// reactivate subcommand
+				Name:  "reactivate",
+				Usage: "Activate an access key which has been deactivated during rotation",
+				Flags: append(append([]cli.Flag{
+					&cli.StringFlag{
+						Name:        "access-key-id",
+						Usage:       "Access Key ID",
+						Required:    true,
+						Destination: &accessKeyID,
+					},
+				}, append(stateFlags, iamUserFlags...)...), globalFlags...),
+				Action: func(c *cli.Context) error {
+					rotatorApp := newRotatorApp(
+						app.AccessKeyRotatorSettings{
+							CloudProvider:         cloudProvider,
+							IamUser:               iamUser,
+							IamUsers:              iamUsers.Value(),
+							IamUserPathPrefix:     iamPathPrefix,
+							IamUserTag:            iamUserTag,
+							StateStore:            stateStore,
+							StateFilePath:         stateFile,
+							StateTable:            stateTable,
+							LockLease:             lockLease,
+							ConfigFile:            configFile,
+							ConfigStoreConfigPath: configPath,
+						})
+					return rotatorApp.Reactivate(context.Background(), accessKeyID)
+				},
+			},
 			{
 				// upload subcommand
 				Name:    "upload",
 				Aliases: []string{"u"},
-				Flags: append([]cli.Flag{
-					&cli.StringFlag{
-						Name:        "iam-user",
-						Usage:       "Name of the IAM user",
-						Destination: &iamUser,
-						EnvVars:     []string{"IAM_USER"},
-					},
+				Flags: append(append([]cli.Flag{
 					&cli.StringFlag{
 						Name:        "access-key-id",
 						Usage:       "Access Key ID",
 						Destination: &accessKeyID,
 					},
-					&cli.StringFlag{
-						Name:        "repo-owner",
-						Usage:       "Repository owner",
-						Destination: &repoOwner,
-						EnvVars:     []string{"REPO_OWNER"},
+					&cli.DurationFlag{
+						Name:        "grace-period",
+						Usage:       "How long replaced keys stay inactive before they get deleted (e.g. 72h)",
+						Destination: &gracePeriod,
+						EnvVars:     []string{"GRACE_PERIOD"},
 					},
-					&cli.StringFlag{
-						Name:        "repo-name",
-						Usage:       "Repository name",
-						Destination: &repoName,
-						EnvVars:     []string{"REPO_NAME"},
+					&cli.DurationFlag{
+						Name:        "max-age",
+						Usage:       "Only rotate keys older than this (e.g. 720h)",
+						Destination: &policy.MaxAge,
+						EnvVars:     []string{"ROTATION_MAX_AGE"},
 					},
-					&cli.StringFlag{
-						Name:        "token-path",
-						Usage:       "Token path in the config store",
-						Destination: &tokenPath,
-						EnvVars:     []string{"TOKEN_CONFIG_STORE_PATH"},
+					&cli.DurationFlag{
+						Name:        "min-age",
+						Usage:       "Never rotate keys younger than this (e.g. 24h)",
+						Destination: &policy.MinAge,
+						EnvVars:     []string{"ROTATION_MIN_AGE"},
 					},
-					&cli.StringFlag{
-						Name:        "secret-name",
-						Usage:       "Name of the secret to be created/updated",
-						Destination: &secretName,
-						EnvVars:     []string{"SECRET_NAME"},
+					&cli.DurationFlag{
+						Name:        "unused-for",
+						Usage:       "Only rotate keys which weren't used for this long (e.g. 48h)",
+						Destination: &policy.UnusedFor,
+						EnvVars:     []string{"ROTATION_UNUSED_FOR"},
+					},
+					&cli.StringSliceFlag{
+						Name:        "never-rotate",
+						Usage:       "Key IDs or owners which must never be rotated",
+						Destination: &neverRotate,
+						EnvVars:     []string{"ROTATION_NEVER_ROTATE"},
 					},
-				}, globalFlags...),
+					dryRunFlag,
+				}, append(append(append(secretsStoreFlags, stateFlags...), verificationFlags...), iamUserFlags...)...), globalFlags...),
 				Usage: "Upload access key to repo store",
 				Action: func(c *cli.Context) error {
-					rotatorApp := app.AccessKeyRotatorAppFactory(
+					if secretsStore == "" && configFile == "" && configPath == "" {
+						return fmt.Errorf("either --secrets-store or a rotation config (--config, --config-store-path) is required")
+					}
+
+					policy.NeverRotate = neverRotate.Value()
+					rotatorApp := newRotatorApp(
 						app.AccessKeyRotatorSettings{
-							CloudProvider:        cloudProvider,
-							SecretsStore:         secretsStore,
-							IamUser:              iamUser,
-							RepoOwner:            repoOwner,
-							RepoName:             repoName,
-							SecretName:           secretName,
-							ConfigStoreTokenPath: tokenPath,
+							CloudProvider:         cloudProvider,
+							SecretsStore:          secretsStore,
+							IamUser:               iamUser,
+							IamUsers:              iamUsers.Value(),
+							IamUserPathPrefix:     iamPathPrefix,
+							IamUserTag:            iamUserTag,
+							RepoOwner:             repoOwner,
+							RepoName:              repoName,
+							RepoNames:             repoNames.Value(),
+							SecretName:            secretName,
+							SecretFormat:          secretFormat,
+							IDSecretName:          idSecretName,
+							ConfigStoreTokenPath:  tokenPath,
+							GitlabURL:             gitlabURL,
+							GracePeriod:           gracePeriod,
+							Policy:                policy,
+							Verification:          verification,
+							StateStore:            stateStore,
+							StateFilePath:         stateFile,
+							StateTable:            stateTable,
+							LockLease:             lockLease,
+							ConfigFile:            configFile,
+							ConfigStoreConfigPath: configPath,
 						})
+					if dryRun {
+						plan, err := rotatorApp.PlanUploadSecrets(context.Background())
+						if err != nil {
+							return err
+						}
+						printPlan(plan)
+						return nil
+					}
 					err := rotatorApp.UploadSecrets(context.Background())
 					return err
 				},
 			},
+			{
+				// history subcommand
+				Name:  "history",
+				Usage: "Show the journal of previous rotations",
+				Flags: append(append([]cli.Flag{
+					&cli.StringFlag{
+						Name:        "job",
+						Usage:       "Only show the rotations of this job (e.g. aws:deploy-user)",
+						Destination: &historyJob,
+					},
+				}, append(stateFlags, iamUserFlags...)...), globalFlags...),
+				Action: func(c *cli.Context) error {
+					if stateStore == "" && configFile == "" && configPath == "" {
+						return fmt.Errorf("either --state-store or a rotation config (--config, --config-store-path) is required")
+					}
+					rotatorApp := newRotatorApp(
+						app.AccessKeyRotatorSettings{
+							CloudProvider:         cloudProvider,
+							IamUser:               iamUser,
+							IamUsers:              iamUsers.Value(),
+							IamUserPathPrefix:     iamPathPrefix,
+							IamUserTag:            iamUserTag,
+							StateStore:            stateStore,
+							StateFilePath:         stateFile,
+							StateTable:            stateTable,
+							LockLease:             lockLease,
+							ConfigFile:            configFile,
+							ConfigStoreConfigPath: configPath,
+						})
+					records, err := rotatorApp.Rotations(context.Background(), historyJob)
+					if err != nil {
+						return err
+					}
+					printRotations(records)
+					return nil
+				},
+			},
 		},
 	}
+}
 
-	err := app.Run(os.Args)
-	if err != nil {
-		log.Fatal(err)
+// printKeys prints access keys along with their metadata as a table
+func printKeys(keys []entity.AccessKey) {
+	now := time.Now()
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tOWNER\tSTATUS\tCREATED\tAGE (DAYS)\tLAST USED\tSERVICE\tREGION")
+	for _, k := range keys {
+		lastUsed := "never"
+		if !k.LastUsed.Date.IsZero() {
+			lastUsed = k.LastUsed.Date.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\t%s\t%s\n",
+			k.ID, k.Owner, k.Status, k.CreatedAt.Format(time.RFC3339),
+			int(k.Age(now).Hours()/24), lastUsed, k.LastUsed.Service, k.LastUsed.Region)
+	}
+	w.Flush()
+}
+
+// printRotations prints the journal of rotations as a table
+func printRotations(records []statestore.RotationRecord) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "STARTED\tJOB\tOLD KEY\tNEW KEY\tPHASE\tPUBLISHED TO\tOUTCOME")
+	for _, r := range records {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			r.StartedAt.Format(time.RFC3339), r.Job, r.OldKeyID, r.NewKeyID, r.Phase,
+			strings.Join(r.Published, ", "), r.Outcome)
+	}
+	w.Flush()
+}
+
+// printPlan prints the steps of a rotation plan
+func printPlan(plan *app.RotationPlan) {
+	if !plan.Changes() {
+		fmt.Println("Nothing to do.")
+	}
+	for _, a := range plan.Actions {
+		fmt.Println(a)
 	}
 }
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/dorneanu/go-key-rotator/app"
+	"github.com/dorneanu/go-key-rotator/entity"
+	"github.com/dorneanu/go-key-rotator/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// fakeRotatorApp replaces the factory of the sub-commands and records the settings it got
+func fakeRotatorApp(t *testing.T, keyManager *mocks.KeyManager) *[]app.AccessKeyRotatorSettings {
+	var created []app.AccessKeyRotatorSettings
+	previous := newRotatorApp
+	newRotatorApp = func(settings app.AccessKeyRotatorSettings) *app.AccessKeyRotatorApp {
+		created = append(created, settings)
+		return &app.AccessKeyRotatorApp{KeyManager: keyManager}
+	}
+	t.Cleanup(func() { newRotatorApp = previous })
+	return &created
+}
+
+func TestRotateCommand(t *testing.T) {
+	t.Run("Secrets store settings are passed", func(t *testing.T) {
+		created := fakeRotatorApp(t, &mocks.KeyManager{})
+
+		err := newCLI().Run([]string{"access-key-rotator", "rotate", "--cp", "aws",
+			"--access-key-id", "OLD", "--secrets-store", "github", "--repo-owner", "dorneanu",
+			"--repo-name", "test", "--secret-name", "SECRET", "--secret-format", "separate",
+			"--id-secret-name", "SECRET_ID", "--token-path", "/github/token"})
+		assert.Error(t, err)
+
+		if assert.Len(t, *created, 1) {
+			settings := (*created)[0]
+			assert.Equal(t, "github", settings.SecretsStore)
+			assert.Equal(t, "dorneanu", settings.RepoOwner)
+			assert.Equal(t, "test", settings.RepoName)
+			assert.Equal(t, "SECRET", settings.SecretName)
+			assert.Equal(t, "separate", settings.SecretFormat)
+			assert.Equal(t, "SECRET_ID", settings.IDSecretName)
+			assert.Equal(t, "/github/token", settings.ConfigStoreTokenPath)
+		}
+	})
+
+	t.Run("No key is created without secrets store", func(t *testing.T) {
+		keyManager := &mocks.KeyManager{}
+		keyManager.On("ListAccessKeys", mock.Anything).Return([]entity.AccessKey{
+			{ID: "OLD", Status: entity.KeyStatusActive},
+		}, nil)
+		created := fakeRotatorApp(t, keyManager)
+
+		err := newCLI().Run([]string{"access-key-rotator", "rotate", "--cp", "aws", "--access-key-id", "OLD"})
+		assert.EqualError(t, err, "either --secrets-store or a rotation config (--config, --config-store-path) is required")
+		assert.Empty(t, *created)
+
+		// The app refuses to rotate if none of the jobs has a destination
+		err = newCLI().Run([]string{"access-key-rotator", "rotate", "--cp", "aws", "--access-key-id", "OLD",
+			"--config", "rotation.yaml"})
+		assert.EqualError(t, err, "no secrets store configured")
+
+		err = newCLI().Run([]string{"access-key-rotator", "rotate", "--cp", "aws", "--access-key-id", "OLD",
+			"--config", "rotation.yaml", "--dry-run"})
+		assert.EqualError(t, err, "no secrets store configured")
+		keyManager.AssertNotCalled(t, "RotateAccessKey", mock.Anything, mock.Anything)
+	})
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"log"
+	"time"
 
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/dorneanu/go-key-rotator/app"
@@ -11,13 +12,34 @@ import (
 
 // Config for this lambda
 type Config struct {
-	CloudProvider        string `envconfig:"CLOUD_PROVIDER" required:"true"`
-	IamUser              string `envconfig:"IAM_USER" required:"true"`
-	SecretsStore         string `envconfig:"SECRETS_STORE" required:"true"`
-	SecretName           string `envconfig:"SECRET_NAME" required:"true"`
-	RepoOwner            string `envconfig:"REPO_OWNER" required:"true"`
-	RepoName             string `envconfig:"REPO_NAME" required:"true"`
-	ConfigStoreTokenPath string `envconfig:"TOKEN_CONFIG_STORE_PATH" required:"true"`
+	CloudProvider        string        `envconfig:"CLOUD_PROVIDER" required:"true"`
+	IamUser              string        `envconfig:"IAM_USER"`
+	IamUsers             []string      `envconfig:"IAM_USERS"`
+	IamUserPathPrefix    string        `envconfig:"IAM_USER_PATH_PREFIX"`
+	IamUserTag           string        `envconfig:"IAM_USER_TAG"`
+	SecretsStore         string        `envconfig:"SECRETS_STORE"`
+	SecretName           string        `envconfig:"SECRET_NAME"`
+	SecretFormat         string        `envconfig:"SECRET_FORMAT"`
+	IDSecretName         string        `envconfig:"ID_SECRET_NAME"`
+	RepoOwner            string        `envconfig:"REPO_OWNER"`
+	RepoName             string        `envconfig:"REPO_NAME"`
+	RepoNames            []string      `envconfig:"REPO_NAMES"`
+	ConfigStoreTokenPath string        `envconfig:"TOKEN_CONFIG_STORE_PATH"`
+	GitlabURL            string        `envconfig:"GITLAB_URL"`
+	GithubOrgSecret      bool          `envconfig:"GITHUB_ORG_SECRET"`
+	GracePeriod          time.Duration `envconfig:"GRACE_PERIOD"`
+	app.RotationPolicy
+	app.VerificationPolicy
+
+	// The journal of all rotations and the locks of the principals are kept within
+	// a DynamoDB table (STATE_STORE=dynamodb)
+	StateStore string        `envconfig:"STATE_STORE"`
+	StateTable string        `envconfig:"STATE_TABLE"`
+	LockLease  time.Duration `envconfig:"LOCK_LEASE"`
+
+	// Jobs can be described by a rotation config instead of the settings above
+	ConfigFile            string `envconfig:"CONFIG_FILE"`
+	ConfigStoreConfigPath string `envconfig:"CONFIG_STORE_CONFIG_PATH"`
 }
 
 var conf Config
@@ -27,23 +49,72 @@ func init() {
 	if err != nil {
 		log.Panicf("Could not find all required ENV variables: %s", err)
 	}
+
+	// Without a rotation config the secrets store has to be specified by ENV variables
+	if conf.ConfigFile == "" && conf.ConfigStoreConfigPath == "" {
+		repoName := conf.RepoName
+		if repoName == "" && len(conf.RepoNames) > 0 {
+			repoName = conf.RepoNames[0]
+		}
+		required := map[string]string{
+			"SECRETS_STORE": conf.SecretsStore,
+			"SECRET_NAME":   conf.SecretName,
+		}
+		// AWS Secrets Manager is accessed using the role of the lambda, Vault
+		// and Kubernetes credentials may be specified by VAULT_* and KUBERNETES_*
+		// variables as well
+		switch conf.SecretsStore {
+		case "github":
+			// Organization secrets are written to REPO_OWNER
+			required["REPO_OWNER"] = conf.RepoOwner
+			if !conf.GithubOrgSecret {
+				required["REPO_NAME (or REPO_NAMES)"] = repoName
+			}
+			required["TOKEN_CONFIG_STORE_PATH"] = conf.ConfigStoreTokenPath
+		case "gitlab":
+			// GitLab variables may be written to the group (REPO_OWNER) instead
+			required["REPO_OWNER"] = conf.RepoOwner
+			required["TOKEN_CONFIG_STORE_PATH"] = conf.ConfigStoreTokenPath
+		}
+		for name, value := range required {
+			if value == "" {
+				log.Panicf("Could not find all required ENV variables: %s is required without CONFIG_FILE or CONFIG_STORE_CONFIG_PATH", name)
+			}
+		}
+	}
 }
 
 // handler implements the business logic to be executed during Lambda invocation
 func handler(ctx context.Context) error {
 	rotatorApp := app.AccessKeyRotatorAppFactory(app.AccessKeyRotatorSettings{
-		CloudProvider:        conf.CloudProvider,
-		SecretsStore:         conf.SecretsStore,
-		SecretName:           conf.SecretName,
-		IamUser:              conf.IamUser,
-		RepoOwner:            conf.RepoOwner,
-		RepoName:             conf.RepoName,
-		ConfigStoreTokenPath: conf.ConfigStoreTokenPath,
+		CloudProvider:         conf.CloudProvider,
+		SecretsStore:          conf.SecretsStore,
+		SecretName:            conf.SecretName,
+		SecretFormat:          conf.SecretFormat,
+		IDSecretName:          conf.IDSecretName,
+		IamUser:               conf.IamUser,
+		IamUsers:              conf.IamUsers,
+		IamUserPathPrefix:     conf.IamUserPathPrefix,
+		IamUserTag:            conf.IamUserTag,
+		RepoOwner:             conf.RepoOwner,
+		RepoName:              conf.RepoName,
+		RepoNames:             conf.RepoNames,
+		ConfigStoreTokenPath:  conf.ConfigStoreTokenPath,
+		GitlabURL:             conf.GitlabURL,
+		GracePeriod:           conf.GracePeriod,
+		Policy:                conf.RotationPolicy,
+		Verification:          conf.VerificationPolicy,
+		StateStore:            conf.StateStore,
+		StateTable:            conf.StateTable,
+		LockLease:             conf.LockLease,
+		ConfigFile:            conf.ConfigFile,
+		ConfigStoreConfigPath: conf.ConfigStoreConfigPath,
 	})
-	err := rotatorApp.UploadSecrets(context.Background())
+	// Results of every job are logged by UploadSecrets. Waiting for new keys to become
+	// valid stops once the Lambda is about to time out.
+	err := rotatorApp.UploadSecrets(ctx)
 	if err == nil {
-		log.Printf("Secret(s) of %s (%s) were successfully rotated and uploaded to %s\n",
-			conf.IamUser, conf.CloudProvider, conf.SecretsStore)
+		log.Printf("Secret(s) (%s) were successfully rotated and uploaded\n", conf.CloudProvider)
 	}
 	return err
 }
@@ -2,8 +2,12 @@ package configstore
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
 
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
 	"github.com/aws/aws-sdk-go-v2/service/ssm"
 )
 
@@ -11,9 +15,22 @@ type SSMParameterAPI interface {
 	GetParameter(ctx context.Context, params *ssm.GetParameterInput, optFns ...func(*ssm.Options)) (*ssm.GetParameterOutput, error)
 }
 
+// SecretsManagerAPI defines the Secrets Manager methods needed for reading secrets
+type SecretsManagerAPI interface {
+	GetSecretValue(ctx context.Context, params *secretsmanager.GetSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error)
+}
+
+const (
+	// secretsManagerARNPrefix is the prefix of ARNs of Secrets Manager secrets
+	secretsManagerARNPrefix = "arn:aws:secretsmanager:"
+	// secretsManagerPrefix references a Secrets Manager secret by its name
+	secretsManagerPrefix = "secretsmanager://"
+)
+
 // AWSConfigStore implements a ConfigStore
 type AWSConfigStore struct {
-	ssm_client SSMParameterAPI
+	ssm_client     SSMParameterAPI
+	secrets_client SecretsManagerAPI
 }
 
 func NewAWSConfigStore() *AWSConfigStore {
@@ -26,13 +43,25 @@ func NewAWSConfigStore() *AWSConfigStore {
 	ssm_client := ssm.NewFromConfig(cfg)
 
 	return &AWSConfigStore{
-		ssm_client: ssm_client,
+		ssm_client:     ssm_client,
+		secrets_client: secretsmanager.NewFromConfig(cfg),
 	}
 }
 
-// GetValue fetches a value from the SSM parameter store
+// GetValue fetches a value from the SSM parameter store. SecureString parameters are decrypted.
+//
+// Keys referencing a Secrets Manager secret are read from Secrets Manager instead. If the secret
+// holds a JSON object, a single field can be selected by appending #<field>:
+//
+//	/github/private-key
+//	secretsmanager://github-app#private_key
+//	arn:aws:secretsmanager:eu-central-1:123456789012:secret:github-app-AbCdEf#private_key
 func (s *AWSConfigStore) GetValue(ctx context.Context, key string) (string, error) {
-	input := &ssm.GetParameterInput{Name: &key}
+	if strings.HasPrefix(key, secretsManagerARNPrefix) || strings.HasPrefix(key, secretsManagerPrefix) {
+		return s.getSecretValue(ctx, key)
+	}
+
+	input := &ssm.GetParameterInput{Name: &key, WithDecryption: true}
 	results, err := s.ssm_client.GetParameter(ctx, input)
 	if err != nil {
 		return "", err
@@ -40,3 +69,54 @@ func (s *AWSConfigStore) GetValue(ctx context.Context, key string) (string, erro
 
 	return *results.Parameter.Value, nil
 }
+
+// getSecretValue fetches the current version of a Secrets Manager secret
+func (s *AWSConfigStore) getSecretValue(ctx context.Context, key string) (string, error) {
+	secretID, field := key, ""
+	if i := strings.LastIndex(key, "#"); i >= 0 {
+		secretID, field = key[:i], key[i+1:]
+	}
+	secretID = strings.TrimPrefix(secretID, secretsManagerPrefix)
+	if secretID == "" {
+		return "", fmt.Errorf("Invalid secret reference %q", key)
+	}
+
+	results, err := s.secrets_client.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{SecretId: &secretID})
+	if err != nil {
+		return "", err
+	}
+
+	var value string
+	switch {
+	case results.SecretString != nil:
+		value = *results.SecretString
+	case results.SecretBinary != nil:
+		value = string(results.SecretBinary)
+	default:
+		return "", fmt.Errorf("Secret %s has no value", secretID)
+	}
+
+	if field == "" {
+		return value, nil
+	}
+	return jsonField(secretID, value, field)
+}
+
+// jsonField returns a string field of a secret holding a JSON object
+func jsonField(secretID, value, field string) (string, error) {
+	var fields map[string]interface{}
+	err := json.Unmarshal([]byte(value), &fields)
+	if err != nil {
+		return "", fmt.Errorf("Secret %s doesn't hold a JSON object: %s", secretID, err)
+	}
+
+	fieldValue, ok := fields[field]
+	if !ok {
+		return "", fmt.Errorf("Secret %s has no field %q", secretID, field)
+	}
+	str, ok := fieldValue.(string)
+	if !ok {
+		return "", fmt.Errorf("Field %q of secret %s is not a string", field, secretID)
+	}
+	return str, nil
+}
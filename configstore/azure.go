@@ -1,12 +1,139 @@
 package configstore
 
-import "context"
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
 
-type AzureConfigStore struct{}
+	"github.com/dorneanu/go-key-rotator/azureauth"
+	"github.com/kelseyhightower/envconfig"
+)
+
+// KeyVaultAPI wraps the Azure Key Vault secrets API in order to make testing easy
+type KeyVaultAPI interface {
+	// GetSecret returns the value of a secret. Without a version the latest one is returned.
+	GetSecret(ctx context.Context, vaultURL, name, version string) (string, error)
+}
+
+// AzureConfigStore implements a ConfigStore using Azure Key Vault
+type AzureConfigStore struct {
+	vault_url        string
+	key_vault_client KeyVaultAPI
+}
+
+// keyVaultResource is the resource tokens are requested for
+const keyVaultResource = "https://vault.azure.net"
 
 func NewAzureConfigStore() *AzureConfigStore {
-	return &AzureConfigStore{}
+	var credentials azureauth.Credentials
+	err := envconfig.Process("", &credentials)
+	if err != nil {
+		panic("configuration error, " + err.Error())
+	}
+
+	httpClient, err := azureauth.NewHTTPClient(context.TODO(), credentials, keyVaultResource)
+	if err != nil {
+		panic("configuration error, " + err.Error())
+	}
+
+	// Short secret names are resolved within the default vault
+	vault_url := os.Getenv("AZURE_KEY_VAULT_URL")
+	if vault_url == "" && os.Getenv("AZURE_KEY_VAULT_NAME") != "" {
+		vault_url = fmt.Sprintf("https://%s.vault.azure.net", os.Getenv("AZURE_KEY_VAULT_NAME"))
+	}
+
+	return &AzureConfigStore{
+		vault_url:        strings.TrimSuffix(vault_url, "/"),
+		key_vault_client: &KeyVaultClient{httpClient: httpClient},
+	}
 }
-func (f *AzureConfigStore) GetValue(ctx context.Context, key string) (string, error) {
-	panic("not implemented") // TODO: Implement
+
+// GetValue fetches a secret from Key Vault. The key is either the identifier of a secret
+// (version) or the name of a secret within the default vault. Without a version the
+// latest one is used:
+//
+//	github-key                                                -> latest version within the default vault
+//	github-key/<version>                                      -> specific version within the default vault
+//	https://my-vault.vault.azure.net/secrets/github-key[/<version>]
+func (s *AzureConfigStore) GetValue(ctx context.Context, key string) (string, error) {
+	vault_url, name, version, err := s.parseKey(key)
+	if err != nil {
+		return "", err
+	}
+	return s.key_vault_client.GetSecret(ctx, vault_url, name, version)
+}
+
+// parseKey splits a key into the vault URL, the name and the (optional) version of a secret
+func (s *AzureConfigStore) parseKey(key string) (string, string, string, error) {
+	vault_url := s.vault_url
+	path := key
+	if strings.HasPrefix(key, "https://") {
+		u, err := url.Parse(key)
+		if err != nil {
+			return "", "", "", fmt.Errorf("Invalid secret identifier %q: %s", key, err)
+		}
+		if !strings.HasPrefix(u.Path, "/secrets/") {
+			return "", "", "", fmt.Errorf("Invalid secret identifier %q (expected https://<vault>/secrets/<name>[/<version>])", key)
+		}
+		vault_url = "https://" + u.Host
+		path = strings.TrimPrefix(u.Path, "/secrets/")
+	} else if vault_url == "" {
+		return "", "", "", fmt.Errorf("Couldn't resolve secret %q: no vault specified (set AZURE_KEY_VAULT_URL or AZURE_KEY_VAULT_NAME)", key)
+	}
+
+	parts := strings.Split(strings.TrimSuffix(path, "/"), "/")
+	if len(parts) > 2 || parts[0] == "" {
+		return "", "", "", fmt.Errorf("Invalid secret name %q (expected <name>[/<version>])", key)
+	}
+	if len(parts) == 1 {
+		return vault_url, parts[0], "", nil
+	}
+	return vault_url, parts[0], parts[1], nil
+}
+
+// keyVaultAPIVersion is the version of the Key Vault REST API
+const keyVaultAPIVersion = "7.2"
+
+// KeyVaultClient implements KeyVaultAPI using the Key Vault REST API
+type KeyVaultClient struct {
+	httpClient *http.Client
+}
+
+// GetSecret returns the value of a secret (version)
+func (c *KeyVaultClient) GetSecret(ctx context.Context, vaultURL, name, version string) (string, error) {
+	path := "/secrets/" + url.PathEscape(name)
+	if version != "" {
+		path += "/" + url.PathEscape(version)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, vaultURL+path+"?api-version="+keyVaultAPIVersion, nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("Couldn't get secret %s: %s: %s", name, resp.Status, strings.TrimSpace(string(message)))
+	}
+
+	var result struct {
+		Value string `json:"value"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return "", fmt.Errorf("Couldn't decode secret %s: %s", name, err)
+	}
+	return result.Value, nil
 }
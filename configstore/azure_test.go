@@ -0,0 +1,89 @@
+package configstore
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dorneanu/go-key-rotator/mocks"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAzureConfigStore(t *testing.T) {
+	t.Run("Resolve secret names", func(t *testing.T) {
+		for key, expected := range map[string][3]string{
+			"github-key":         {"https://default.vault.azure.net", "github-key", ""},
+			"github-key/0123abc": {"https://default.vault.azure.net", "github-key", "0123abc"},
+			"https://other.vault.azure.net/secrets/github-key":          {"https://other.vault.azure.net", "github-key", ""},
+			"https://other.vault.azure.net/secrets/github-key/0123abc/": {"https://other.vault.azure.net", "github-key", "0123abc"},
+		} {
+			mock_kv := mocks.KeyVaultAPI{}
+			azure_config := AzureConfigStore{vault_url: "https://default.vault.azure.net", key_vault_client: &mock_kv}
+
+			mock_kv.On("GetSecret", context.TODO(), expected[0], expected[1], expected[2]).Return("some-value", nil).Once()
+			value, err := azure_config.GetValue(context.TODO(), key)
+			assert.Nil(t, err, key)
+			assert.Equal(t, "some-value", value)
+			mock_kv.AssertExpectations(t)
+		}
+	})
+
+	t.Run("Invalid secret names", func(t *testing.T) {
+		mock_kv := mocks.KeyVaultAPI{}
+		azure_config := AzureConfigStore{key_vault_client: &mock_kv}
+
+		for _, key := range []string{
+			"github-key", // no default vault
+			"https://other.vault.azure.net/keys/github-key",
+			"https://other.vault.azure.net/secrets/github-key/0123abc/extra",
+		} {
+			_, err := azure_config.GetValue(context.TODO(), key)
+			assert.Error(t, err, key)
+		}
+		mock_kv.AssertNotCalled(t, "GetSecret")
+	})
+
+	t.Run("Get non-existant value", func(t *testing.T) {
+		mock_kv := mocks.KeyVaultAPI{}
+		azure_config := AzureConfigStore{vault_url: "https://default.vault.azure.net", key_vault_client: &mock_kv}
+
+		mock_kv.On("GetSecret", context.TODO(), "https://default.vault.azure.net", "missing", "").
+			Return("", errors.New("Not found"))
+		_, err := azure_config.GetValue(context.TODO(), "missing")
+		assert.Error(t, err)
+	})
+}
+
+func TestKeyVaultClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("api-version") != keyVaultAPIVersion {
+			http.Error(w, `{"error": {"code": "BadParameter"}}`, http.StatusBadRequest)
+			return
+		}
+		switch r.URL.Path {
+		case "/secrets/github-key":
+			w.Write([]byte(`{"value": "latest-value", "id": "https://vault/secrets/github-key/2"}`))
+		case "/secrets/github-key/1":
+			w.Write([]byte(`{"value": "old-value", "id": "https://vault/secrets/github-key/1"}`))
+		default:
+			http.Error(w, `{"error": {"code": "SecretNotFound"}}`, http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	client := &KeyVaultClient{httpClient: server.Client()}
+
+	value, err := client.GetSecret(context.TODO(), server.URL, "github-key", "")
+	assert.Nil(t, err)
+	assert.Equal(t, "latest-value", value)
+
+	value, err = client.GetSecret(context.TODO(), server.URL, "github-key", "1")
+	assert.Nil(t, err)
+	assert.Equal(t, "old-value", value)
+
+	_, err = client.GetSecret(context.TODO(), server.URL, "missing", "")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "SecretNotFound")
+}
@@ -1,13 +1,151 @@
 package configstore
 
-import "context"
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
 
-type GCPConfigStore struct{}
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// SecretManagerAPI wraps the GCP Secret Manager API in order to make testing easy
+type SecretManagerAPI interface {
+	// AccessSecretVersion returns the payload of a secret version (projects/*/secrets/*/versions/*)
+	AccessSecretVersion(ctx context.Context, name string) ([]byte, error)
+}
+
+// GCPConfigStore implements a ConfigStore using GCP Secret Manager
+type GCPConfigStore struct {
+	project               string
+	secret_manager_client SecretManagerAPI
+}
 
 func NewGCPConfigStore() *GCPConfigStore {
-	return &GCPConfigStore{}
+	ctx := context.TODO()
+	credentials, err := google.FindDefaultCredentials(ctx, "https://www.googleapis.com/auth/cloud-platform")
+	if err != nil {
+		panic("configuration error, " + err.Error())
+	}
+
+	// Short secret names are resolved within the project of the credentials
+	// unless a project is specified explicitly
+	project := os.Getenv("GOOGLE_CLOUD_PROJECT")
+	if project == "" {
+		project = credentials.ProjectID
+	}
+
+	return &GCPConfigStore{
+		project: project,
+		secret_manager_client: &SecretManagerClient{
+			endpoint:   secretManagerEndpoint,
+			httpClient: oauth2.NewClient(ctx, credentials.TokenSource),
+		},
+	}
+}
+
+// GetValue fetches a secret from Secret Manager. The key is either the resource name of a secret
+// (version) or the short name of a secret within the default project. Without a version the
+// latest one is used:
+//
+//	github-token                                      -> projects/<default>/secrets/github-token/versions/latest
+//	github-token/versions/3                           -> projects/<default>/secrets/github-token/versions/3
+//	projects/my-project/secrets/github-token          -> projects/my-project/secrets/github-token/versions/latest
+//	projects/my-project/secrets/github-token/versions/3
+func (s *GCPConfigStore) GetValue(ctx context.Context, key string) (string, error) {
+	name, err := s.secretVersionName(key)
+	if err != nil {
+		return "", err
+	}
+
+	value, err := s.secret_manager_client.AccessSecretVersion(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	return string(value), nil
+}
+
+// secretVersionName resolves a key to the resource name of a secret version
+func (s *GCPConfigStore) secretVersionName(key string) (string, error) {
+	parts := strings.Split(key, "/")
+	if parts[0] != "projects" {
+		if s.project == "" {
+			return "", fmt.Errorf("Couldn't resolve secret %q: no project specified (set GOOGLE_CLOUD_PROJECT or use projects/<project>/secrets/<name>)", key)
+		}
+		parts = append([]string{"projects", s.project, "secrets"}, parts...)
+	}
+
+	if len(parts) == 4 {
+		parts = append(parts, "versions", "latest")
+	}
+	if len(parts) != 6 || parts[2] != "secrets" || parts[4] != "versions" {
+		return "", fmt.Errorf("Invalid secret name %q (expected projects/<project>/secrets/<name>[/versions/<version>] or <name>[/versions/<version>])", key)
+	}
+	for _, part := range parts {
+		if part == "" {
+			return "", fmt.Errorf("Invalid secret name %q", key)
+		}
+	}
+	return strings.Join(parts, "/"), nil
+}
+
+// secretManagerEndpoint is the base URL of the Secret Manager API
+const secretManagerEndpoint = "https://secretmanager.googleapis.com/v1/"
+
+// SecretManagerClient implements SecretManagerAPI using the Secret Manager REST API
+type SecretManagerClient struct {
+	endpoint   string
+	httpClient *http.Client
 }
 
-func (f *GCPConfigStore) GetValue(ctx context.Context, key string) (string, error) {
-	panic("not implemented") // TODO: Implement
+// AccessSecretVersion returns the payload of a secret version after verifying its checksum
+func (c *SecretManagerClient) AccessSecretVersion(ctx context.Context, name string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.endpoint+name+":access", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("Couldn't access secret %s: %s: %s", name, resp.Status, strings.TrimSpace(string(message)))
+	}
+
+	var result struct {
+		Payload struct {
+			Data       string `json:"data"`
+			DataCrc32c string `json:"dataCrc32c"`
+		} `json:"payload"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't decode secret %s: %s", name, err)
+	}
+
+	data, err := base64.StdEncoding.DecodeString(result.Payload.Data)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't decode secret %s: %s", name, err)
+	}
+
+	// The checksum is optional
+	if result.Payload.DataCrc32c != "" {
+		checksum, err := strconv.ParseUint(result.Payload.DataCrc32c, 10, 32)
+		if err != nil || uint32(checksum) != crc32.Checksum(data, crc32.MakeTable(crc32.Castagnoli)) {
+			return nil, fmt.Errorf("Secret %s is corrupted (checksum mismatch)", name)
+		}
+	}
+	return data, nil
 }
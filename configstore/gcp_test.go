@@ -0,0 +1,93 @@
+package configstore
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dorneanu/go-key-rotator/mocks"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGCPConfigStore(t *testing.T) {
+	t.Run("Resolve secret names", func(t *testing.T) {
+		for key, name := range map[string]string{
+			"github-token":                                      "projects/default/secrets/github-token/versions/latest",
+			"github-token/versions/3":                           "projects/default/secrets/github-token/versions/3",
+			"projects/other/secrets/github-token":               "projects/other/secrets/github-token/versions/latest",
+			"projects/other/secrets/github-token/versions/3":    "projects/other/secrets/github-token/versions/3",
+			"projects/other/secrets/github-token/versions/true": "projects/other/secrets/github-token/versions/true",
+		} {
+			mock_sm := mocks.SecretManagerAPI{}
+			gcp_config := GCPConfigStore{project: "default", secret_manager_client: &mock_sm}
+
+			mock_sm.On("AccessSecretVersion", context.TODO(), name).Return([]byte("some-value"), nil).Once()
+			value, err := gcp_config.GetValue(context.TODO(), key)
+			assert.Nil(t, err, key)
+			assert.Equal(t, "some-value", value)
+			mock_sm.AssertExpectations(t)
+		}
+	})
+
+	t.Run("Invalid secret names", func(t *testing.T) {
+		mock_sm := mocks.SecretManagerAPI{}
+		gcp_config := GCPConfigStore{secret_manager_client: &mock_sm}
+
+		for _, key := range []string{
+			"/github/token",
+			"projects/other/github-token",
+			"projects/other/secrets/github-token/latest",
+			"github-token", // no default project
+		} {
+			_, err := gcp_config.GetValue(context.TODO(), key)
+			assert.Error(t, err, key)
+		}
+		mock_sm.AssertNotCalled(t, "AccessSecretVersion")
+	})
+
+	t.Run("Get non-existant value", func(t *testing.T) {
+		mock_sm := mocks.SecretManagerAPI{}
+		gcp_config := GCPConfigStore{project: "default", secret_manager_client: &mock_sm}
+
+		mock_sm.On("AccessSecretVersion", context.TODO(), "projects/default/secrets/missing/versions/latest").
+			Return(nil, errors.New("Not found"))
+		_, err := gcp_config.GetValue(context.TODO(), "missing")
+		assert.Error(t, err)
+	})
+}
+
+func TestSecretManagerClient(t *testing.T) {
+	data := []byte("some-value")
+	checksum := crc32.Checksum(data, crc32.MakeTable(crc32.Castagnoli))
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/projects/p/secrets/token/versions/latest:access":
+			fmt.Fprintf(w, `{"payload": {"data": %q, "dataCrc32c": "%d"}}`, base64.StdEncoding.EncodeToString(data), checksum)
+		case "/v1/projects/p/secrets/corrupted/versions/latest:access":
+			fmt.Fprintf(w, `{"payload": {"data": %q, "dataCrc32c": "%d"}}`, base64.StdEncoding.EncodeToString(data), checksum+1)
+		default:
+			http.Error(w, `{"error": {"code": 404, "status": "NOT_FOUND"}}`, http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	client := &SecretManagerClient{endpoint: server.URL + "/v1/", httpClient: server.Client()}
+
+	value, err := client.AccessSecretVersion(context.TODO(), "projects/p/secrets/token/versions/latest")
+	assert.Nil(t, err)
+	assert.Equal(t, data, value)
+
+	_, err = client.AccessSecretVersion(context.TODO(), "projects/p/secrets/corrupted/versions/latest")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "checksum")
+
+	_, err = client.AccessSecretVersion(context.TODO(), "projects/p/secrets/missing/versions/latest")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "404")
+}
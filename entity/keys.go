@@ -1,13 +1,79 @@
 package entity
 
+import "time"
+
+// KeyStatus describes whether an AccessKey can be used for authentication
+type KeyStatus string
+
+const (
+	KeyStatusActive   KeyStatus = "Active"
+	KeyStatusInactive KeyStatus = "Inactive"
+)
+
 // AccessKey represents a key/credential/passwort used to authenticate against APIs/services
 type AccessKey struct {
 	ID     string
 	Secret string
+	// Name is a human readable name of the key (if the provider supports one)
+	Name      string
+	Status    KeyStatus
+	CreatedAt time.Time
+
+	// Owner is the user/principal the key belongs to
+	Owner string
+	// Provider is the name of the cloud provider which issued the key (e.g. aws)
+	Provider string
+	// Type is the kind of key as reported by the provider (e.g. USER_MANAGED)
+	Type string
+	// ExpiresAt is the point in time the key stops being valid (zero if it doesn't expire)
+	ExpiresAt time.Time
+
+	// LastUsed holds information about the last time the key was used (if any)
+	LastUsed KeyUsage
+}
+
+// KeyUsage describes when and where an AccessKey was used for the last time
+type KeyUsage struct {
+	Date    time.Time
+	Service string
+	Region  string
+}
+
+// Age returns the time passed since the key was created
+func (k AccessKey) Age(now time.Time) time.Duration {
+	return now.Sub(k.CreatedAt)
+}
+
+// Unused returns the time passed since the key was used for the last time.
+// For keys which were never used, the time since creation is returned.
+func (k AccessKey) Unused(now time.Time) time.Duration {
+	if k.LastUsed.Date.IsZero() {
+		return k.Age(now)
+	}
+	return now.Sub(k.LastUsed.Date)
+}
+
+// IsActive returns true unless the key has been deactivated
+func (k AccessKey) IsActive() bool {
+	return k.Status != KeyStatusInactive
 }
 
 // EncryptedKey holds an encrypted representation of an AccessKey
 type EncryptedKey struct {
 	ID     string
 	Secret []byte
+
+	// Secrets holds the named secrets to be written if a key is stored as several
+	// secrets (e.g. ID and secret separately) or in a structured format
+	Secrets []EncryptedSecret
+
+	// Metadata holds information about the key which may be attached to the secret
+	// (e.g. as custom metadata of a Vault secret)
+	Metadata map[string]string
+}
+
+// EncryptedSecret is a single named secret holding (a part of) an AccessKey
+type EncryptedSecret struct {
+	Name  string
+	Value []byte
 }
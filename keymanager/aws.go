@@ -3,10 +3,13 @@ package keymanager
 import (
 	"context"
 	"fmt"
+	"strings"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/iam"
+	"github.com/aws/aws-sdk-go-v2/service/iam/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
 	"github.com/dorneanu/go-key-rotator/entity"
 )
 
@@ -16,8 +19,18 @@ type IAMAPI interface {
 	CreateAccessKey(ctx context.Context, params *iam.CreateAccessKeyInput, optFns ...func(*iam.Options)) (*iam.CreateAccessKeyOutput, error)
 	ListAccessKeys(ctx context.Context, params *iam.ListAccessKeysInput, optFns ...func(*iam.Options)) (*iam.ListAccessKeysOutput, error)
 	DeleteAccessKey(ctx context.Context, params *iam.DeleteAccessKeyInput, optFns ...func(*iam.Options)) (*iam.DeleteAccessKeyOutput, error)
+	UpdateAccessKey(ctx context.Context, params *iam.UpdateAccessKeyInput, optFns ...func(*iam.Options)) (*iam.UpdateAccessKeyOutput, error)
+	GetAccessKeyLastUsed(ctx context.Context, params *iam.GetAccessKeyLastUsedInput, optFns ...func(*iam.Options)) (*iam.GetAccessKeyLastUsedOutput, error)
+	ListUsers(ctx context.Context, params *iam.ListUsersInput, optFns ...func(*iam.Options)) (*iam.ListUsersOutput, error)
+	ListUserTags(ctx context.Context, params *iam.ListUserTagsInput, optFns ...func(*iam.Options)) (*iam.ListUserTagsOutput, error)
 }
 
+// maxAccessKeysPerUser is the maximum number of access keys IAM allows per user
+const maxAccessKeysPerUser = 2
+
+// awsProvider is the provider name used for keys managed by AWS IAM
+const awsProvider = "aws"
+
 type AWSKeyManager struct {
 	iam_user   string
 	iam_client IAMAPI
@@ -38,12 +51,144 @@ func NewAWSKeyManager(iam_user string) *AWSKeyManager {
 	}
 }
 
+// IAMUserSelector specifies a set of IAM users. Users can be listed explicitly
+// or looked up by their path prefix and/or a tag ("key" or "key=value").
+type IAMUserSelector struct {
+	Users      []string
+	PathPrefix string
+	Tag        string
+}
+
+// NewAWSKeyManagers returns a key manager for every IAM user matching the selector
+func NewAWSKeyManagers(ctx context.Context, selector IAMUserSelector) ([]*AWSKeyManager, error) {
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("configuration error, %s", err)
+	}
+
+	// Create new IAM client
+	iam_client := iam.NewFromConfig(cfg)
+
+	users, err := FindIAMUsers(ctx, iam_client, selector)
+	if err != nil {
+		return nil, err
+	}
+
+	managers := make([]*AWSKeyManager, 0, len(users))
+	for _, user := range users {
+		managers = append(managers, &AWSKeyManager{
+			iam_user:   user,
+			iam_client: iam_client,
+		})
+	}
+	return managers, nil
+}
+
+// FindIAMUsers returns the names of all IAM users matching the selector. Without any users, path
+// prefix or tag, the keys of the caller are managed (empty user name).
+func FindIAMUsers(ctx context.Context, iam_client IAMAPI, selector IAMUserSelector) ([]string, error) {
+	if len(selector.Users) == 0 && selector.PathPrefix == "" && selector.Tag == "" {
+		return []string{""}, nil
+	}
+
+	users := make([]string, 0, len(selector.Users))
+	seen := make(map[string]bool)
+	for _, user := range selector.Users {
+		if !seen[user] {
+			users = append(users, user)
+			seen[user] = true
+		}
+	}
+
+	// Explicitly listed users only
+	if selector.PathPrefix == "" && selector.Tag == "" {
+		return users, nil
+	}
+
+	input := &iam.ListUsersInput{}
+	if selector.PathPrefix != "" {
+		input.PathPrefix = aws.String(selector.PathPrefix)
+	}
+
+	for {
+		res, err := iam_client.ListUsers(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't list IAM users: %s", err)
+		}
+
+		for _, user := range res.Users {
+			name := aws.ToString(user.UserName)
+			if seen[name] {
+				continue
+			}
+
+			if selector.Tag != "" {
+				tagged, err := hasIAMUserTag(ctx, iam_client, name, selector.Tag)
+				if err != nil {
+					return nil, fmt.Errorf("Couldn't get tags of IAM user %s: %s", name, err)
+				}
+				if !tagged {
+					continue
+				}
+			}
+			users = append(users, name)
+			seen[name] = true
+		}
+
+		if !res.IsTruncated {
+			break
+		}
+		input.Marker = res.Marker
+	}
+	return users, nil
+}
+
+// hasIAMUserTag checks if an IAM user has a tag ("key" or "key=value")
+func hasIAMUserTag(ctx context.Context, iam_client IAMAPI, user, tag string) (bool, error) {
+	key, value, matchValue := tag, "", false
+	if i := strings.Index(tag, "="); i >= 0 {
+		key, value, matchValue = tag[:i], tag[i+1:], true
+	}
+
+	input := &iam.ListUserTagsInput{UserName: aws.String(user)}
+	for {
+		res, err := iam_client.ListUserTags(ctx, input)
+		if err != nil {
+			return false, err
+		}
+
+		for _, t := range res.Tags {
+			if aws.ToString(t.Key) == key && (!matchValue || aws.ToString(t.Value) == value) {
+				return true, nil
+			}
+		}
+
+		if !res.IsTruncated {
+			return false, nil
+		}
+		input.Marker = res.Marker
+	}
+}
+
+// User returns the name of the IAM user whose keys are managed
+func (m *AWSKeyManager) User() string {
+	return m.iam_user
+}
+
+// userName returns the user name passed to IAM. IAM falls back to the caller if it is missing.
+func (m *AWSKeyManager) userName() *string {
+	if m.iam_user == "" {
+		return nil
+	}
+	return &m.iam_user
+}
+
 // ListAccessKeys retrieves the IAM access keys for an user
 func (m *AWSKeyManager) ListAccessKeys(ctx context.Context) ([]entity.AccessKey, error) {
 	var keys []entity.AccessKey
 	input := &iam.ListAccessKeysInput{
 		MaxItems: aws.Int32(int32(10)),
-		UserName: &m.iam_user,
+		UserName: m.userName(),
 	}
 
 	res, err := m.iam_client.ListAccessKeys(ctx, input)
@@ -54,8 +199,18 @@ func (m *AWSKeyManager) ListAccessKeys(ctx context.Context) ([]entity.AccessKey,
 	// Create slice of AccessKey
 	for _, key := range res.AccessKeyMetadata {
 		k := entity.AccessKey{
-			ID:     *key.AccessKeyId,
-			Secret: "",
+			ID:        *key.AccessKeyId,
+			Secret:    "",
+			Status:    entity.KeyStatus(key.Status),
+			CreatedAt: aws.ToTime(key.CreateDate),
+			Owner:     aws.ToString(key.UserName),
+			Provider:  awsProvider,
+		}
+
+		// Find out when the key was used for the last time
+		k.LastUsed, err = m.getLastUsed(ctx, k.ID)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't get last usage of key (id = %s): %s", k.ID, err)
 		}
 		keys = append(keys, k)
 	}
@@ -63,10 +218,41 @@ func (m *AWSKeyManager) ListAccessKeys(ctx context.Context) ([]entity.AccessKey,
 	return keys, nil
 }
 
+// getLastUsed retrieves information about the last usage of an access key
+func (m *AWSKeyManager) getLastUsed(ctx context.Context, id string) (entity.KeyUsage, error) {
+	input := &iam.GetAccessKeyLastUsedInput{
+		AccessKeyId: &id,
+	}
+	res, err := m.iam_client.GetAccessKeyLastUsed(ctx, input)
+	if err != nil {
+		return entity.KeyUsage{}, err
+	}
+
+	// Keys which were never used don't have any usage information
+	if res.AccessKeyLastUsed == nil {
+		return entity.KeyUsage{}, nil
+	}
+
+	usage := entity.KeyUsage{
+		Date:    aws.ToTime(res.AccessKeyLastUsed.LastUsedDate),
+		Service: aws.ToString(res.AccessKeyLastUsed.ServiceName),
+		Region:  aws.ToString(res.AccessKeyLastUsed.Region),
+	}
+
+	// IAM reports "N/A" for keys which were never used
+	if usage.Service == "N/A" {
+		usage.Service = ""
+	}
+	if usage.Region == "N/A" {
+		usage.Region = ""
+	}
+	return usage, nil
+}
+
 // CreateAccessKey
 func (m *AWSKeyManager) CreateAccessKey(ctx context.Context) (entity.AccessKey, error) {
 	input := &iam.CreateAccessKeyInput{
-		UserName: &m.iam_user,
+		UserName: m.userName(),
 	}
 	key, err := m.iam_client.CreateAccessKey(ctx, input)
 
@@ -75,17 +261,23 @@ func (m *AWSKeyManager) CreateAccessKey(ctx context.Context) (entity.AccessKey,
 	}
 
 	return entity.AccessKey{
-		ID:     *key.AccessKey.AccessKeyId,
-		Secret: *key.AccessKey.SecretAccessKey,
+		ID:        *key.AccessKey.AccessKeyId,
+		Secret:    *key.AccessKey.SecretAccessKey,
+		Status:    entity.KeyStatus(key.AccessKey.Status),
+		CreatedAt: aws.ToTime(key.AccessKey.CreateDate),
+		Owner:     aws.ToString(key.AccessKey.UserName),
+		Provider:  awsProvider,
 	}, nil
 }
 
-// RotateAccessKey
+// RotateAccessKey creates a new access key which is meant to replace the one specified by id.
+// The old key is left untouched so it keeps working until the new one has been published.
+// If the user already owns the maximum number of keys, the oldest inactive one will be deleted.
 func (m *AWSKeyManager) RotateAccessKey(ctx context.Context, id string) (entity.AccessKey, error) {
-	// First delete access key specified by id
-	err := m.DeleteAccessKey(ctx, id)
+	// First make room for the new key
+	err := m.deleteOldestInactiveKey(ctx, id)
 	if err != nil {
-		return entity.AccessKey{}, fmt.Errorf("Couldn't delete key (id = %s): %s", id, err)
+		return entity.AccessKey{}, fmt.Errorf("Couldn't make room for new key: %s", err)
 	}
 
 	// Create new one
@@ -96,12 +288,116 @@ func (m *AWSKeyManager) RotateAccessKey(ctx context.Context, id string) (entity.
 	return newKey, nil
 }
 
+// deleteOldestInactiveKey deletes the oldest inactive key (except the one specified by id)
+// if the IAM limit of access keys per user has been reached
+func (m *AWSKeyManager) deleteOldestInactiveKey(ctx context.Context, id string) error {
+	input := &iam.ListAccessKeysInput{
+		MaxItems: aws.Int32(int32(10)),
+		UserName: m.userName(),
+	}
+	res, err := m.iam_client.ListAccessKeys(ctx, input)
+	if err != nil {
+		return err
+	}
+
+	if len(res.AccessKeyMetadata) < maxAccessKeysPerUser {
+		return nil
+	}
+
+	// Find oldest inactive key
+	var oldest *types.AccessKeyMetadata
+	for i, key := range res.AccessKeyMetadata {
+		if key.Status != types.StatusTypeInactive || aws.ToString(key.AccessKeyId) == id {
+			continue
+		}
+		if oldest == nil || aws.ToTime(key.CreateDate).Before(aws.ToTime(oldest.CreateDate)) {
+			oldest = &res.AccessKeyMetadata[i]
+		}
+	}
+	if oldest == nil {
+		return fmt.Errorf("user %s already has %d access keys and none of them is inactive", m.iam_user, len(res.AccessKeyMetadata))
+	}
+
+	return m.DeleteAccessKey(ctx, aws.ToString(oldest.AccessKeyId))
+}
+
 // DeleteAccessKey
 func (m *AWSKeyManager) DeleteAccessKey(ctx context.Context, id string) error {
 	input := &iam.DeleteAccessKeyInput{
 		AccessKeyId: &id,
-		UserName:    &m.iam_user,
+		UserName:    m.userName(),
 	}
 	_, err := m.iam_client.DeleteAccessKey(ctx, input)
 	return err
 }
+
+// MaxAccessKeys returns the number of access keys IAM allows per user
+func (m *AWSKeyManager) MaxAccessKeys() int {
+	return maxAccessKeysPerUser
+}
+
+// ActivateAccessKey sets the status of an access key to Active
+func (m *AWSKeyManager) ActivateAccessKey(ctx context.Context, id string) error {
+	return m.updateAccessKeyStatus(ctx, id, types.StatusTypeActive)
+}
+
+// DeactivateAccessKey sets the status of an access key to Inactive.
+// The key can't be used anymore but it can still be activated again.
+func (m *AWSKeyManager) DeactivateAccessKey(ctx context.Context, id string) error {
+	return m.updateAccessKeyStatus(ctx, id, types.StatusTypeInactive)
+}
+
+func (m *AWSKeyManager) updateAccessKeyStatus(ctx context.Context, id string, status types.StatusType) error {
+	input := &iam.UpdateAccessKeyInput{
+		AccessKeyId: &id,
+		Status:      status,
+		UserName:    m.userName(),
+	}
+	_, err := m.iam_client.UpdateAccessKey(ctx, input)
+	return err
+}
+
+// STSAPI defines the STS method used for verifying keys
+type STSAPI interface {
+	GetCallerIdentity(ctx context.Context, params *sts.GetCallerIdentityInput, optFns ...func(*sts.Options)) (*sts.GetCallerIdentityOutput, error)
+}
+
+// AWSKeyVerifier verifies a key by calling GetCallerIdentity with it. No permissions are needed for that.
+type AWSKeyVerifier struct {
+	newClient func(key entity.AccessKey) STSAPI
+}
+
+// NewAWSKeyVerifier returns a verifier using the region of the default AWS configuration (if any)
+func NewAWSKeyVerifier(ctx context.Context) (*AWSKeyVerifier, error) {
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("configuration error, %s", err)
+	}
+	region := cfg.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	return &AWSKeyVerifier{newClient: func(key entity.AccessKey) STSAPI {
+		return sts.New(sts.Options{
+			Region: region,
+			Credentials: aws.CredentialsProviderFunc(func(ctx context.Context) (aws.Credentials, error) {
+				return aws.Credentials{AccessKeyID: key.ID, SecretAccessKey: key.Secret, Source: "access-key-rotator"}, nil
+			}),
+		})
+	}}, nil
+}
+
+// VerifyAccessKey authenticates with the key and makes sure that it belongs to its owner
+func (v *AWSKeyVerifier) VerifyAccessKey(ctx context.Context, key entity.AccessKey) error {
+	identity, err := v.newClient(key).GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		return err
+	}
+
+	arn := aws.ToString(identity.Arn)
+	if key.Owner != "" && !strings.HasSuffix(arn, "/"+key.Owner) {
+		return fmt.Errorf("key belongs to %s instead of %s", arn, key.Owner)
+	}
+	return nil
+}
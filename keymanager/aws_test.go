@@ -4,11 +4,13 @@ import (
 	"context"
 	"errors"
 	"testing"
+	"time"
 
 	"github.com/alecthomas/assert"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/iam"
 	"github.com/aws/aws-sdk-go-v2/service/iam/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
 	"github.com/dorneanu/go-key-rotator/entity"
 	"github.com/dorneanu/go-key-rotator/mocks"
 	"github.com/stretchr/testify/mock"
@@ -23,12 +25,27 @@ func TestAWSKeyManager_ListAccessKeys(t *testing.T) {
 		iam_client: &mock_iam,
 	}
 
+	created := time.Date(2021, time.January, 02, 15, 04, 05, 0, time.UTC)
+	last_used := time.Date(2021, time.June, 02, 15, 04, 05, 0, time.UTC)
 	expected_keys := []entity.AccessKey{
 		{
-			ID: "access1",
+			ID:        "access1",
+			Status:    entity.KeyStatusActive,
+			CreatedAt: created,
+			Owner:     "test",
+			Provider:  "aws",
+			LastUsed: entity.KeyUsage{
+				Date:    last_used,
+				Service: "s3",
+				Region:  "eu-central-1",
+			},
 		},
 		{
-			ID: "access2",
+			ID:        "access2",
+			Status:    entity.KeyStatusInactive,
+			CreatedAt: created,
+			Owner:     "test",
+			Provider:  "aws",
 		},
 	}
 
@@ -42,10 +59,14 @@ func TestAWSKeyManager_ListAccessKeys(t *testing.T) {
 				{
 					AccessKeyId: aws.String(expected_keys[0].ID),
 					Status:      types.StatusTypeActive,
+					CreateDate:  aws.Time(created),
+					UserName:    aws.String("test"),
 				},
 				{
 					AccessKeyId: aws.String(expected_keys[1].ID),
 					Status:      types.StatusTypeInactive,
+					CreateDate:  aws.Time(created),
+					UserName:    aws.String("test"),
 				},
 			}
 
@@ -60,6 +81,33 @@ func TestAWSKeyManager_ListAccessKeys(t *testing.T) {
 		},
 	)
 
+	mock_iam.On(
+		"GetAccessKeyLastUsed",
+		mock.Anything,
+		mock.MatchedBy(func(input *iam.GetAccessKeyLastUsedInput) bool {
+			return *input.AccessKeyId == "access1"
+		}),
+		mock.Anything).Return(&iam.GetAccessKeyLastUsedOutput{
+		AccessKeyLastUsed: &types.AccessKeyLastUsed{
+			LastUsedDate: aws.Time(last_used),
+			ServiceName:  aws.String("s3"),
+			Region:       aws.String("eu-central-1"),
+		},
+	}, nil).Once()
+
+	mock_iam.On(
+		"GetAccessKeyLastUsed",
+		mock.Anything,
+		mock.MatchedBy(func(input *iam.GetAccessKeyLastUsedInput) bool {
+			return *input.AccessKeyId == "access2"
+		}),
+		mock.Anything).Return(&iam.GetAccessKeyLastUsedOutput{
+		AccessKeyLastUsed: &types.AccessKeyLastUsed{
+			ServiceName: aws.String("N/A"),
+			Region:      aws.String("N/A"),
+		},
+	}, nil).Once()
+
 	keys, err := km.ListAccessKeys(context.TODO())
 	assert.Nil(t, err)
 	assert.Equal(t, 2, len(keys))
@@ -77,8 +125,9 @@ func TestAWSKeyManager_CreateAccessKey(t *testing.T) {
 	}
 
 	expected_key := entity.AccessKey{
-		ID:     "SECRET",
-		Secret: "SECRET VALUE",
+		ID:       "SECRET",
+		Secret:   "SECRET VALUE",
+		Provider: "aws",
 	}
 	access_key := &iam.CreateAccessKeyOutput{
 		AccessKey: &types.AccessKey{
@@ -107,6 +156,11 @@ func TestAWSKeyManager_RotateAccessKey(t *testing.T) {
 			SecretAccessKey: aws.String("SECRET VALUE"),
 		},
 	}
+	single_key := &iam.ListAccessKeysOutput{
+		AccessKeyMetadata: []types.AccessKeyMetadata{
+			{AccessKeyId: aws.String("OLD"), Status: types.StatusTypeActive},
+		},
+	}
 
 	t.Run("RotateAccessKey without errors", func(t *testing.T) {
 		mock_iam := mocks.IAMAPI{}
@@ -117,23 +171,68 @@ func TestAWSKeyManager_RotateAccessKey(t *testing.T) {
 			iam_client: &mock_iam,
 		}
 
+		mock_iam.On(
+			"ListAccessKeys",
+			mock.Anything,
+			mock.AnythingOfType("*iam.ListAccessKeysInput"),
+			mock.Anything).Return(single_key, nil).Once()
+
 		mock_iam.On(
 			"CreateAccessKey",
 			mock.Anything,
 			mock.AnythingOfType("*iam.CreateAccessKeyInput"),
 			mock.Anything).Return(access_key, nil).Once()
 
+		key, err := km.RotateAccessKey(context.TODO(), "OLD")
+		assert.Nil(t, err)
+		assert.Equal(t, "SECRET", key.ID)
+
+		// The old key must not be deleted before the new one was published
+		mock_iam.AssertNotCalled(t, "DeleteAccessKey", mock.Anything, mock.Anything, mock.Anything)
+		mock_iam.AssertExpectations(t)
+	})
+
+	t.Run("RotateAccessKey deletes oldest inactive key", func(t *testing.T) {
+		mock_iam := mocks.IAMAPI{}
+
+		// Create key manager
+		km := AWSKeyManager{
+			iam_user:   "test",
+			iam_client: &mock_iam,
+		}
+
+		now := time.Now()
+		mock_iam.On(
+			"ListAccessKeys",
+			mock.Anything,
+			mock.AnythingOfType("*iam.ListAccessKeysInput"),
+			mock.Anything).Return(&iam.ListAccessKeysOutput{
+			AccessKeyMetadata: []types.AccessKeyMetadata{
+				{AccessKeyId: aws.String("OLD"), Status: types.StatusTypeActive, CreateDate: aws.Time(now.Add(-72 * time.Hour))},
+				{AccessKeyId: aws.String("INACTIVE"), Status: types.StatusTypeInactive, CreateDate: aws.Time(now.Add(-96 * time.Hour))},
+			},
+		}, nil).Once()
+
 		mock_iam.On(
 			"DeleteAccessKey",
 			mock.Anything,
-			mock.AnythingOfType("*iam.DeleteAccessKeyInput"),
+			mock.MatchedBy(func(input *iam.DeleteAccessKeyInput) bool {
+				return *input.AccessKeyId == "INACTIVE"
+			}),
 			mock.Anything).Return(&iam.DeleteAccessKeyOutput{}, nil).Once()
 
-		_, err := km.RotateAccessKey(context.TODO(), "SECRET")
+		mock_iam.On(
+			"CreateAccessKey",
+			mock.Anything,
+			mock.AnythingOfType("*iam.CreateAccessKeyInput"),
+			mock.Anything).Return(access_key, nil).Once()
+
+		_, err := km.RotateAccessKey(context.TODO(), "OLD")
 		assert.Nil(t, err)
+		mock_iam.AssertExpectations(t)
 	})
 
-	t.Run("RotateAccessKey access key not found", func(t *testing.T) {
+	t.Run("RotateAccessKey key limit reached", func(t *testing.T) {
 		mock_iam := mocks.IAMAPI{}
 
 		// Create key manager
@@ -143,18 +242,37 @@ func TestAWSKeyManager_RotateAccessKey(t *testing.T) {
 		}
 
 		mock_iam.On(
-			"CreateAccessKey",
+			"ListAccessKeys",
 			mock.Anything,
-			mock.AnythingOfType("*iam.CreateAccessKeyInput"),
-			mock.Anything).Return(access_key, nil).Once()
+			mock.AnythingOfType("*iam.ListAccessKeysInput"),
+			mock.Anything).Return(&iam.ListAccessKeysOutput{
+			AccessKeyMetadata: []types.AccessKeyMetadata{
+				{AccessKeyId: aws.String("OLD"), Status: types.StatusTypeActive},
+				{AccessKeyId: aws.String("OTHER"), Status: types.StatusTypeActive},
+			},
+		}, nil).Once()
+
+		_, err := km.RotateAccessKey(context.TODO(), "OLD")
+		assert.Error(t, err)
+		mock_iam.AssertNotCalled(t, "CreateAccessKey", mock.Anything, mock.Anything, mock.Anything)
+	})
+
+	t.Run("RotateAccessKey can't list keys", func(t *testing.T) {
+		mock_iam := mocks.IAMAPI{}
+
+		// Create key manager
+		km := AWSKeyManager{
+			iam_user:   "test",
+			iam_client: &mock_iam,
+		}
 
 		mock_iam.On(
-			"DeleteAccessKey",
+			"ListAccessKeys",
 			mock.Anything,
-			mock.AnythingOfType("*iam.DeleteAccessKeyInput"),
-			mock.Anything).Return(&iam.DeleteAccessKeyOutput{}, errors.New("Key not found")).Once()
+			mock.AnythingOfType("*iam.ListAccessKeysInput"),
+			mock.Anything).Return(&iam.ListAccessKeysOutput{}, errors.New("Access denied")).Once()
 
-		_, err := km.RotateAccessKey(context.TODO(), "SECRET")
+		_, err := km.RotateAccessKey(context.TODO(), "OLD")
 		assert.Error(t, err)
 	})
 
@@ -168,18 +286,18 @@ func TestAWSKeyManager_RotateAccessKey(t *testing.T) {
 		}
 
 		mock_iam.On(
-			"CreateAccessKey",
+			"ListAccessKeys",
 			mock.Anything,
-			mock.AnythingOfType("*iam.CreateAccessKeyInput"),
-			mock.Anything).Return(access_key, errors.New("Can't create new key")).Once()
+			mock.AnythingOfType("*iam.ListAccessKeysInput"),
+			mock.Anything).Return(single_key, nil).Once()
 
 		mock_iam.On(
-			"DeleteAccessKey",
+			"CreateAccessKey",
 			mock.Anything,
-			mock.AnythingOfType("*iam.DeleteAccessKeyInput"),
-			mock.Anything).Return(&iam.DeleteAccessKeyOutput{}, nil).Once()
+			mock.AnythingOfType("*iam.CreateAccessKeyInput"),
+			mock.Anything).Return(access_key, errors.New("Can't create new key")).Once()
 
-		_, err := km.RotateAccessKey(context.TODO(), "SECRET")
+		_, err := km.RotateAccessKey(context.TODO(), "OLD")
 		assert.Error(t, err)
 	})
 }
@@ -202,3 +320,201 @@ func TestAWSKeyManager_DeleteAccessKey(t *testing.T) {
 	err := km.DeleteAccessKey(context.TODO(), "SECRET")
 	assert.Nil(t, err)
 }
+
+func TestAWSKeyManager_Caller(t *testing.T) {
+	mock_iam := mocks.IAMAPI{}
+
+	// Without a user name IAM manages the keys of the caller
+	km := AWSKeyManager{
+		iam_client: &mock_iam,
+	}
+
+	mock_iam.On(
+		"DeleteAccessKey",
+		mock.Anything,
+		mock.MatchedBy(func(input *iam.DeleteAccessKeyInput) bool { return input.UserName == nil }),
+		mock.Anything).Return(&iam.DeleteAccessKeyOutput{}, nil).Once()
+
+	err := km.DeleteAccessKey(context.TODO(), "SECRET")
+	assert.Nil(t, err)
+	mock_iam.AssertExpectations(t)
+}
+
+func TestAWSKeyManager_UpdateAccessKeyStatus(t *testing.T) {
+	t.Run("DeactivateAccessKey", func(t *testing.T) {
+		mock_iam := mocks.IAMAPI{}
+
+		// Create key manager
+		km := AWSKeyManager{
+			iam_user:   "test",
+			iam_client: &mock_iam,
+		}
+
+		mock_iam.On(
+			"UpdateAccessKey",
+			mock.Anything,
+			mock.MatchedBy(func(input *iam.UpdateAccessKeyInput) bool {
+				return *input.AccessKeyId == "SECRET" && input.Status == types.StatusTypeInactive
+			}),
+			mock.Anything).Return(&iam.UpdateAccessKeyOutput{}, nil).Once()
+
+		err := km.DeactivateAccessKey(context.TODO(), "SECRET")
+		assert.Nil(t, err)
+		mock_iam.AssertExpectations(t)
+	})
+
+	t.Run("ActivateAccessKey", func(t *testing.T) {
+		mock_iam := mocks.IAMAPI{}
+
+		// Create key manager
+		km := AWSKeyManager{
+			iam_user:   "test",
+			iam_client: &mock_iam,
+		}
+
+		mock_iam.On(
+			"UpdateAccessKey",
+			mock.Anything,
+			mock.MatchedBy(func(input *iam.UpdateAccessKeyInput) bool {
+				return *input.AccessKeyId == "SECRET" && input.Status == types.StatusTypeActive
+			}),
+			mock.Anything).Return(&iam.UpdateAccessKeyOutput{}, errors.New("Key not found")).Once()
+
+		err := km.ActivateAccessKey(context.TODO(), "SECRET")
+		assert.Error(t, err)
+		mock_iam.AssertExpectations(t)
+	})
+}
+
+func TestFindIAMUsers(t *testing.T) {
+	users := &iam.ListUsersOutput{
+		Users: []types.User{
+			{UserName: aws.String("deploy")},
+			{UserName: aws.String("ci")},
+		},
+	}
+
+	t.Run("Explicit users", func(t *testing.T) {
+		mock_iam := mocks.IAMAPI{}
+
+		found, err := FindIAMUsers(context.TODO(), &mock_iam, IAMUserSelector{Users: []string{"a", "b", "a"}})
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"a", "b"}, found)
+		mock_iam.AssertNotCalled(t, "ListUsers", mock.Anything, mock.Anything, mock.Anything)
+	})
+
+	t.Run("No users specified manages the caller", func(t *testing.T) {
+		mock_iam := mocks.IAMAPI{}
+
+		found, err := FindIAMUsers(context.TODO(), &mock_iam, IAMUserSelector{})
+		assert.Nil(t, err)
+		assert.Equal(t, []string{""}, found)
+		mock_iam.AssertNotCalled(t, "ListUsers", mock.Anything, mock.Anything, mock.Anything)
+	})
+
+	t.Run("Users by path prefix", func(t *testing.T) {
+		mock_iam := mocks.IAMAPI{}
+
+		mock_iam.On(
+			"ListUsers",
+			mock.Anything,
+			mock.MatchedBy(func(input *iam.ListUsersInput) bool {
+				return *input.PathPrefix == "/deploy/" && input.Marker == nil
+			}),
+			mock.Anything).Return(&iam.ListUsersOutput{
+			Users:       users.Users[:1],
+			IsTruncated: true,
+			Marker:      aws.String("next"),
+		}, nil).Once()
+
+		mock_iam.On(
+			"ListUsers",
+			mock.Anything,
+			mock.MatchedBy(func(input *iam.ListUsersInput) bool {
+				return input.Marker != nil && *input.Marker == "next"
+			}),
+			mock.Anything).Return(&iam.ListUsersOutput{
+			Users: users.Users[1:],
+		}, nil).Once()
+
+		found, err := FindIAMUsers(context.TODO(), &mock_iam, IAMUserSelector{PathPrefix: "/deploy/"})
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"deploy", "ci"}, found)
+		mock_iam.AssertExpectations(t)
+	})
+
+	t.Run("Users by tag", func(t *testing.T) {
+		mock_iam := mocks.IAMAPI{}
+
+		mock_iam.On(
+			"ListUsers",
+			mock.Anything,
+			mock.AnythingOfType("*iam.ListUsersInput"),
+			mock.Anything).Return(users, nil).Once()
+
+		mock_iam.On(
+			"ListUserTags",
+			mock.Anything,
+			mock.MatchedBy(func(input *iam.ListUserTagsInput) bool {
+				return *input.UserName == "deploy"
+			}),
+			mock.Anything).Return(&iam.ListUserTagsOutput{
+			Tags: []types.Tag{{Key: aws.String("rotate"), Value: aws.String("true")}},
+		}, nil).Once()
+
+		mock_iam.On(
+			"ListUserTags",
+			mock.Anything,
+			mock.MatchedBy(func(input *iam.ListUserTagsInput) bool {
+				return *input.UserName == "ci"
+			}),
+			mock.Anything).Return(&iam.ListUserTagsOutput{
+			Tags: []types.Tag{{Key: aws.String("rotate"), Value: aws.String("false")}},
+		}, nil).Once()
+
+		found, err := FindIAMUsers(context.TODO(), &mock_iam, IAMUserSelector{Tag: "rotate=true"})
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"deploy"}, found)
+		mock_iam.AssertExpectations(t)
+	})
+
+	t.Run("ListUsers error", func(t *testing.T) {
+		mock_iam := mocks.IAMAPI{}
+
+		mock_iam.On(
+			"ListUsers",
+			mock.Anything,
+			mock.AnythingOfType("*iam.ListUsersInput"),
+			mock.Anything).Return(&iam.ListUsersOutput{}, errors.New("Access denied")).Once()
+
+		_, err := FindIAMUsers(context.TODO(), &mock_iam, IAMUserSelector{PathPrefix: "/"})
+		assert.Error(t, err)
+	})
+}
+
+// fakeSTS returns the identity of a fixed IAM user for a single valid key
+type fakeSTS struct {
+	key entity.AccessKey
+	arn string
+}
+
+func (f fakeSTS) GetCallerIdentity(ctx context.Context, params *sts.GetCallerIdentityInput, optFns ...func(*sts.Options)) (*sts.GetCallerIdentityOutput, error) {
+	if f.key.ID != "NEW" || f.key.Secret != "SECRET" {
+		return nil, errors.New("InvalidClientTokenId")
+	}
+	return &sts.GetCallerIdentityOutput{Arn: aws.String(f.arn)}, nil
+}
+
+func TestAWSKeyVerifier_VerifyAccessKey(t *testing.T) {
+	verifier := AWSKeyVerifier{newClient: func(key entity.AccessKey) STSAPI {
+		return fakeSTS{key: key, arn: "arn:aws:iam::123456789012:user/ci/deploy"}
+	}}
+
+	assert.NoError(t, verifier.VerifyAccessKey(context.TODO(), entity.AccessKey{ID: "NEW", Secret: "SECRET", Owner: "deploy"}))
+	assert.Error(t, verifier.VerifyAccessKey(context.TODO(), entity.AccessKey{ID: "NEW", Secret: "WRONG", Owner: "deploy"}))
+
+	// Keys of other users are rejected
+	err := verifier.VerifyAccessKey(context.TODO(), entity.AccessKey{ID: "NEW", Secret: "SECRET", Owner: "other"})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "instead of other")
+}
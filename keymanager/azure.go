@@ -1,30 +1,304 @@
 package keymanager
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
 
+	"github.com/dorneanu/go-key-rotator/azureauth"
 	"github.com/dorneanu/go-key-rotator/entity"
+	"golang.org/x/oauth2/clientcredentials"
+	"golang.org/x/oauth2/microsoft"
 )
 
-// TODO
-type AzureKeyManager struct{}
+// AzureGraphAPI wraps the password credential endpoints of Microsoft Graph in order to make testing easy.
+// Objects are addressed by their resource path (e.g. applications(appId='...')).
+type AzureGraphAPI interface {
+	ListPasswordCredentials(ctx context.Context, object string) ([]AzurePasswordCredential, error)
+	AddPassword(ctx context.Context, object string, credential AzurePasswordCredential) (*AzurePasswordCredential, error)
+	RemovePassword(ctx context.Context, object string, keyID string) error
+}
+
+// AzurePasswordCredential represents a client secret as returned by Microsoft Graph
+type AzurePasswordCredential struct {
+	KeyID         string     `json:"keyId,omitempty"`
+	DisplayName   string     `json:"displayName,omitempty"`
+	Hint          string     `json:"hint,omitempty"`
+	StartDateTime *time.Time `json:"startDateTime,omitempty"`
+	EndDateTime   *time.Time `json:"endDateTime,omitempty"`
+	// SecretText is only returned when the credential is created
+	SecretText string `json:"secretText,omitempty"`
+}
+
+// azureProvider is the provider name used for keys managed by Entra ID
+const azureProvider = "azure"
+
+// azurePasswordType is the key type of client secrets
+const azurePasswordType = "Password"
+
+// ErrAzureStatusNotSupported is returned when trying to (de)activate a client secret
+var ErrAzureStatusNotSupported = errors.New("client secrets of Azure applications can't be activated or deactivated (use no grace period)")
+
+// AzureObjectType specifies whose client secrets are rotated
+type AzureObjectType string
 
-func NewAzureKeyManager() *AzureKeyManager {
-	return &AzureKeyManager{}
+const (
+	AzureApplication      AzureObjectType = "application"
+	AzureServicePrincipal AzureObjectType = "servicePrincipal"
+)
+
+// AzureSettings holds the settings for managing client secrets via Microsoft Graph
+type AzureSettings struct {
+	azureauth.Credentials
+
+	ObjectType     AzureObjectType `envconfig:"AZURE_OBJECT_TYPE" default:"application"`
+	SecretLifetime time.Duration   `envconfig:"AZURE_SECRET_LIFETIME" default:"2160h"`
+	DisplayName    string          `envconfig:"AZURE_SECRET_DISPLAY_NAME" default:"access-key-rotator"`
 }
 
+// AzureKeyManager manages the client secrets of a single application (or service principal)
+type AzureKeyManager struct {
+	app_id       string
+	object_type  AzureObjectType
+	lifetime     time.Duration
+	display_name string
+	graph_client AzureGraphAPI
+	now          func() time.Time
+}
+
+// NewAzureKeyManagers returns one key manager per application (client) ID. All of them share the same Graph client.
+func NewAzureKeyManagers(ctx context.Context, app_ids []string, settings AzureSettings) ([]*AzureKeyManager, error) {
+	if len(app_ids) == 0 {
+		return nil, fmt.Errorf("no application specified")
+	}
+	if settings.ObjectType != AzureApplication && settings.ObjectType != AzureServicePrincipal {
+		return nil, fmt.Errorf("unknown object type %q (expected %s or %s)", settings.ObjectType, AzureApplication, AzureServicePrincipal)
+	}
+
+	graph_client, err := NewAzureGraphClient(ctx, settings)
+	if err != nil {
+		return nil, err
+	}
+
+	keyManagers := make([]*AzureKeyManager, 0, len(app_ids))
+	for _, id := range app_ids {
+		keyManagers = append(keyManagers, &AzureKeyManager{
+			app_id:       id,
+			object_type:  settings.ObjectType,
+			lifetime:     settings.SecretLifetime,
+			display_name: settings.DisplayName,
+			graph_client: graph_client,
+			now:          time.Now,
+		})
+	}
+	return keyManagers, nil
+}
+
+// AppID returns the application (client) ID whose secrets are managed
+func (a *AzureKeyManager) AppID() string {
+	return a.app_id
+}
+
+// ListAccessKeys returns the client secrets. Expired secrets are reported as inactive.
 func (a *AzureKeyManager) ListAccessKeys(ctx context.Context) ([]entity.AccessKey, error) {
-	panic("not implemented") // TODO: Implement
+	credentials, err := a.graph_client.ListPasswordCredentials(ctx, a.object())
+	if err != nil {
+		return nil, err
+	}
+
+	access_keys := make([]entity.AccessKey, 0, len(credentials))
+	for _, credential := range credentials {
+		access_keys = append(access_keys, a.toAccessKey(credential))
+	}
+	return access_keys, nil
 }
 
+// CreateAccessKey adds a new client secret which expires after the configured lifetime
 func (a *AzureKeyManager) CreateAccessKey(ctx context.Context) (entity.AccessKey, error) {
-	panic("not implemented") // TODO: Implement
+	now := a.now().UTC()
+	credential := AzurePasswordCredential{
+		DisplayName: fmt.Sprintf("%s %s", a.display_name, now.Format(time.RFC3339)),
+	}
+	if a.lifetime > 0 {
+		end := now.Add(a.lifetime)
+		credential.EndDateTime = &end
+	}
+
+	created, err := a.graph_client.AddPassword(ctx, a.object(), credential)
+	if err != nil {
+		return entity.AccessKey{}, err
+	}
+
+	access_key := a.toAccessKey(*created)
+	access_key.Secret = created.SecretText
+	return access_key, nil
 }
 
+// DeleteAccessKey removes a client secret
 func (a *AzureKeyManager) DeleteAccessKey(ctx context.Context, id string) error {
-	panic("not implemented") // TODO: Implement
+	return a.graph_client.RemovePassword(ctx, a.object(), id)
 }
 
+// RotateAccessKey creates a new client secret. The old secret has to be retired by the caller.
 func (a *AzureKeyManager) RotateAccessKey(ctx context.Context, id string) (entity.AccessKey, error) {
-	panic("not implemented") // TODO: Implement
+	newKey, err := a.CreateAccessKey(ctx)
+	if err != nil {
+		return entity.AccessKey{}, fmt.Errorf("Couldn't create new key: %s", err)
+	}
+	return newKey, nil
+}
+
+// ActivateAccessKey isn't supported by Entra ID
+func (a *AzureKeyManager) ActivateAccessKey(ctx context.Context, id string) error {
+	return ErrAzureStatusNotSupported
+}
+
+// DeactivateAccessKey isn't supported by Entra ID. Client secrets stay valid until they expire or get deleted.
+func (a *AzureKeyManager) DeactivateAccessKey(ctx context.Context, id string) error {
+	return ErrAzureStatusNotSupported
+}
+
+// object returns the resource path of the application (or service principal)
+func (a *AzureKeyManager) object() string {
+	collection := "applications"
+	if a.object_type == AzureServicePrincipal {
+		collection = "servicePrincipals"
+	}
+	return fmt.Sprintf("%s(appId='%s')", collection, a.app_id)
+}
+
+// toAccessKey maps the metadata of a client secret
+func (a *AzureKeyManager) toAccessKey(credential AzurePasswordCredential) entity.AccessKey {
+	access_key := entity.AccessKey{
+		ID:       credential.KeyID,
+		Name:     credential.DisplayName,
+		Status:   entity.KeyStatusActive,
+		Type:     azurePasswordType,
+		Owner:    a.app_id,
+		Provider: azureProvider,
+	}
+	if credential.StartDateTime != nil {
+		access_key.CreatedAt = *credential.StartDateTime
+	}
+	if credential.EndDateTime != nil {
+		access_key.ExpiresAt = *credential.EndDateTime
+		if !a.now().Before(access_key.ExpiresAt) {
+			access_key.Status = entity.KeyStatusInactive
+		}
+	}
+	return access_key
+}
+
+// azureGraphEndpoint is the base URL of Microsoft Graph
+const azureGraphEndpoint = "https://graph.microsoft.com/v1.0/"
+
+// azureGraphResource is the resource tokens are requested for
+const azureGraphResource = "https://graph.microsoft.com/"
+
+// AzureGraphClient implements AzureGraphAPI using the Microsoft Graph REST API
+type AzureGraphClient struct {
+	endpoint   string
+	httpClient *http.Client
+}
+
+// NewAzureGraphClient returns a client authenticated either with client credentials or by a managed identity
+func NewAzureGraphClient(ctx context.Context, settings AzureSettings) (*AzureGraphClient, error) {
+	httpClient, err := azureauth.NewHTTPClient(ctx, settings.Credentials, azureGraphResource)
+	if err != nil {
+		return nil, err
+	}
+	return &AzureGraphClient{endpoint: azureGraphEndpoint, httpClient: httpClient}, nil
+}
+
+// ListPasswordCredentials returns the client secrets of an object
+func (c *AzureGraphClient) ListPasswordCredentials(ctx context.Context, object string) ([]AzurePasswordCredential, error) {
+	var result struct {
+		PasswordCredentials []AzurePasswordCredential `json:"passwordCredentials"`
+	}
+	err := c.do(ctx, http.MethodGet, object+"?$select=passwordCredentials", nil, &result)
+	return result.PasswordCredentials, err
+}
+
+// AddPassword creates a new client secret. The returned credential holds the secret text.
+func (c *AzureGraphClient) AddPassword(ctx context.Context, object string, credential AzurePasswordCredential) (*AzurePasswordCredential, error) {
+	request := map[string]AzurePasswordCredential{"passwordCredential": credential}
+	created := &AzurePasswordCredential{}
+	err := c.do(ctx, http.MethodPost, object+"/addPassword", request, created)
+	if err != nil {
+		return nil, err
+	}
+	return created, nil
+}
+
+// RemovePassword deletes the client secret with the specified key ID
+func (c *AzureGraphClient) RemovePassword(ctx context.Context, object string, keyID string) error {
+	return c.do(ctx, http.MethodPost, object+"/removePassword", map[string]string{"keyId": keyID}, nil)
+}
+
+// do sends a request to Microsoft Graph and decodes the response into result (if not nil)
+func (c *AzureGraphClient) do(ctx context.Context, method, path string, body, result interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		payload, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(payload)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.endpoint+path, reqBody)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(message)))
+	}
+
+	if result != nil {
+		err = json.NewDecoder(resp.Body).Decode(result)
+		if err != nil {
+			return fmt.Errorf("Couldn't decode response: %s", err)
+		}
+	}
+	return nil
+}
+
+// AzureKeyVerifier verifies a client secret by requesting a token for its application (client credentials flow)
+type AzureKeyVerifier struct {
+	tokenURL string
+}
+
+// NewAzureKeyVerifier returns a verifier requesting tokens from the specified tenant
+func NewAzureKeyVerifier(tenantID string) *AzureKeyVerifier {
+	return &AzureKeyVerifier{tokenURL: microsoft.AzureADEndpoint(tenantID).TokenURL}
+}
+
+// VerifyAccessKey requests a token for Microsoft Graph using the client ID (owner) and the secret of the key
+func (v *AzureKeyVerifier) VerifyAccessKey(ctx context.Context, key entity.AccessKey) error {
+	config := clientcredentials.Config{
+		ClientID:     key.Owner,
+		ClientSecret: key.Secret,
+		TokenURL:     v.tokenURL,
+		Scopes:       []string{azureGraphResource + ".default"},
+	}
+	_, err := config.Token(ctx)
+	return err
 }
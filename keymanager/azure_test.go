@@ -0,0 +1,194 @@
+package keymanager
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert"
+	"github.com/dorneanu/go-key-rotator/entity"
+)
+
+// fakeGraph implements the password credential endpoints of Microsoft Graph in memory
+type fakeGraph struct {
+	mu          sync.Mutex
+	credentials map[string][]AzurePasswordCredential // object -> credentials
+	nextID      int
+}
+
+func newFakeGraph() (*fakeGraph, *httptest.Server) {
+	fake := &fakeGraph{credentials: make(map[string][]AzurePasswordCredential)}
+	return fake, httptest.NewServer(fake)
+}
+
+func (f *fakeGraph) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.Header.Get("Authorization") != "Bearer TOKEN" {
+		http.Error(w, `{"error":{"code":"InvalidAuthenticationToken"}}`, http.StatusUnauthorized)
+		return
+	}
+
+	// /v1.0/<object>[/<action>]
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/v1.0/"), "/", 2)
+	object := parts[0]
+	if !strings.HasPrefix(object, "applications(appId='") {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		json.NewEncoder(w).Encode(map[string]interface{}{"passwordCredentials": f.credentials[object]})
+	case len(parts) == 2 && parts[1] == "addPassword":
+		var request struct {
+			PasswordCredential AzurePasswordCredential `json:"passwordCredential"`
+		}
+		json.NewDecoder(r.Body).Decode(&request)
+		f.nextID++
+		start := time.Date(2021, time.July, 1, 10, 0, 0, 0, time.UTC)
+		credential := request.PasswordCredential
+		credential.KeyID = fmt.Sprintf("key-%d", f.nextID)
+		credential.StartDateTime = &start
+		f.credentials[object] = append(f.credentials[object], credential)
+
+		credential.SecretText = "secret-" + credential.KeyID
+		json.NewEncoder(w).Encode(credential)
+	case len(parts) == 2 && parts[1] == "removePassword":
+		var request struct {
+			KeyID string `json:"keyId"`
+		}
+		json.NewDecoder(r.Body).Decode(&request)
+		credentials := f.credentials[object]
+		for i, c := range credentials {
+			if c.KeyID == request.KeyID {
+				f.credentials[object] = append(credentials[:i], credentials[i+1:]...)
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+		http.Error(w, `{"error":{"code":"Request_ResourceNotFound"}}`, http.StatusNotFound)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// bearerTransport adds a static token to every request
+type bearerTransport struct{}
+
+func (bearerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req.Header.Set("Authorization", "Bearer TOKEN")
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func newTestAzureKeyManager(server *httptest.Server, now time.Time) *AzureKeyManager {
+	return &AzureKeyManager{
+		app_id:       "11111111-2222-3333-4444-555555555555",
+		object_type:  AzureApplication,
+		lifetime:     90 * 24 * time.Hour,
+		display_name: "access-key-rotator",
+		graph_client: &AzureGraphClient{
+			endpoint:   server.URL + "/v1.0/",
+			httpClient: &http.Client{Transport: bearerTransport{}},
+		},
+		now: func() time.Time { return now },
+	}
+}
+
+func TestAzureKeyManager_RotateAccessKey(t *testing.T) {
+	fake, server := newFakeGraph()
+	defer server.Close()
+
+	now := time.Date(2021, time.July, 1, 10, 0, 0, 0, time.UTC)
+	key_manager := newTestAzureKeyManager(server, now)
+
+	old_key, err := key_manager.CreateAccessKey(context.TODO())
+	assert.Nil(t, err)
+	assert.Equal(t, "secret-key-1", old_key.Secret)
+
+	new_key, err := key_manager.RotateAccessKey(context.TODO(), old_key.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, entity.AccessKey{
+		ID:        "key-2",
+		Secret:    "secret-key-2",
+		Name:      "access-key-rotator 2021-07-01T10:00:00Z",
+		Status:    entity.KeyStatusActive,
+		CreatedAt: now,
+		ExpiresAt: now.Add(90 * 24 * time.Hour),
+		Type:      "Password",
+		Owner:     "11111111-2222-3333-4444-555555555555",
+		Provider:  "azure",
+	}, new_key)
+
+	assert.Nil(t, key_manager.DeleteAccessKey(context.TODO(), old_key.ID))
+	keys, err := key_manager.ListAccessKeys(context.TODO())
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(keys))
+	assert.Equal(t, "key-2", keys[0].ID)
+	assert.Equal(t, "", keys[0].Secret)
+	assert.Equal(t, 1, len(fake.credentials))
+
+	assert.Error(t, key_manager.DeleteAccessKey(context.TODO(), "unknown"))
+}
+
+func TestAzureKeyManager_ListAccessKeys(t *testing.T) {
+	fake, server := newFakeGraph()
+	defer server.Close()
+
+	now := time.Date(2021, time.July, 1, 10, 0, 0, 0, time.UTC)
+	key_manager := newTestAzureKeyManager(server, now)
+
+	start := now.Add(-48 * time.Hour)
+	expired := now.Add(-time.Hour)
+	fake.credentials[key_manager.object()] = []AzurePasswordCredential{
+		{KeyID: "expired", DisplayName: "old", StartDateTime: &start, EndDateTime: &expired},
+		{KeyID: "forever", StartDateTime: &start},
+	}
+
+	keys, err := key_manager.ListAccessKeys(context.TODO())
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(keys))
+	assert.Equal(t, entity.KeyStatusInactive, keys[0].Status)
+	assert.Equal(t, expired, keys[0].ExpiresAt)
+	assert.Equal(t, entity.KeyStatusActive, keys[1].Status)
+	assert.True(t, keys[1].ExpiresAt.IsZero())
+}
+
+func TestAzureKeyManager_UpdateKeyStatus(t *testing.T) {
+	key_manager := &AzureKeyManager{app_id: "app"}
+	assert.True(t, errors.Is(key_manager.DeactivateAccessKey(context.TODO(), "key"), ErrAzureStatusNotSupported))
+	assert.True(t, errors.Is(key_manager.ActivateAccessKey(context.TODO(), "key"), ErrAzureStatusNotSupported))
+
+	key_manager.object_type = AzureServicePrincipal
+	assert.Equal(t, "servicePrincipals(appId='app')", key_manager.object())
+}
+
+func TestAzureKeyVerifier_VerifyAccessKey(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clientID, clientSecret, ok := r.BasicAuth()
+		if !ok {
+			r.ParseForm()
+			clientID, clientSecret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if clientID != "app-1" || clientSecret != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"error": "invalid_client"}`)
+			return
+		}
+		fmt.Fprint(w, `{"access_token": "token", "token_type": "Bearer", "expires_in": 3600}`)
+	}))
+	defer server.Close()
+
+	verifier := AzureKeyVerifier{tokenURL: server.URL}
+	assert.NoError(t, verifier.VerifyAccessKey(context.TODO(), entity.AccessKey{ID: "key-1", Secret: "secret", Owner: "app-1"}))
+	assert.Error(t, verifier.VerifyAccessKey(context.TODO(), entity.AccessKey{ID: "key-1", Secret: "wrong", Owner: "app-1"}))
+}
@@ -1,30 +1,340 @@
 package keymanager
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/dorneanu/go-key-rotator/entity"
+	"golang.org/x/oauth2/google"
 )
 
-// TODO
-type GCPKeyManager struct{}
+// GCPIAMAPI wraps the service account key endpoints of the GCP IAM API in order to make testing easy
+type GCPIAMAPI interface {
+	ListServiceAccountKeys(ctx context.Context, serviceAccount string) ([]GCPServiceAccountKey, error)
+	CreateServiceAccountKey(ctx context.Context, serviceAccount string) (*GCPServiceAccountKey, error)
+	DeleteServiceAccountKey(ctx context.Context, name string) error
+	EnableServiceAccountKey(ctx context.Context, name string) error
+	DisableServiceAccountKey(ctx context.Context, name string) error
+}
+
+// GCPServiceAccountKey represents a service account key as returned by the IAM API
+type GCPServiceAccountKey struct {
+	// Name is the resource name of the key (projects/{project}/serviceAccounts/{email}/keys/{id})
+	Name            string `json:"name"`
+	PrivateKeyType  string `json:"privateKeyType,omitempty"`
+	KeyAlgorithm    string `json:"keyAlgorithm,omitempty"`
+	PrivateKeyData  string `json:"privateKeyData,omitempty"`
+	ValidAfterTime  string `json:"validAfterTime,omitempty"`
+	ValidBeforeTime string `json:"validBeforeTime,omitempty"`
+	KeyOrigin       string `json:"keyOrigin,omitempty"`
+	KeyType         string `json:"keyType,omitempty"`
+	Disabled        bool   `json:"disabled,omitempty"`
+}
+
+// maxKeysPerServiceAccount is the maximum number of keys GCP allows per service account
+const maxKeysPerServiceAccount = 10
+
+// gcpProvider is the provider name used for keys managed by GCP IAM
+const gcpProvider = "gcp"
+
+// GCPKeyManager manages the user-managed keys of a single service account
+type GCPKeyManager struct {
+	service_account string
+	iam_client      GCPIAMAPI
+}
+
+func NewGCPKeyManager(service_account string) *GCPKeyManager {
+	iam_client, err := NewGCPIAMClient(context.TODO())
+	if err != nil {
+		panic("configuration error, " + err.Error())
+	}
+
+	return &GCPKeyManager{
+		service_account: service_account,
+		iam_client:      iam_client,
+	}
+}
+
+// NewGCPKeyManagers returns one key manager per service account. All of them share the same IAM client.
+func NewGCPKeyManagers(ctx context.Context, service_accounts []string) ([]*GCPKeyManager, error) {
+	if len(service_accounts) == 0 {
+		return nil, fmt.Errorf("no service account specified")
+	}
+
+	iam_client, err := NewGCPIAMClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	keyManagers := make([]*GCPKeyManager, 0, len(service_accounts))
+	for _, sa := range service_accounts {
+		keyManagers = append(keyManagers, &GCPKeyManager{service_account: sa, iam_client: iam_client})
+	}
+	return keyManagers, nil
+}
+
+// ServiceAccount returns the email address of the service account whose keys are managed
+func (m *GCPKeyManager) ServiceAccount() string {
+	return m.service_account
+}
+
+// ListAccessKeys returns the user-managed keys of the service account
+func (m *GCPKeyManager) ListAccessKeys(ctx context.Context) ([]entity.AccessKey, error) {
+	keys, err := m.iam_client.ListServiceAccountKeys(ctx, m.service_account)
+	if err != nil {
+		return nil, err
+	}
+
+	access_keys := make([]entity.AccessKey, 0, len(keys))
+	for _, key := range keys {
+		access_keys = append(access_keys, m.toAccessKey(key))
+	}
+	return access_keys, nil
+}
+
+// CreateAccessKey creates a new key. The secret holds the JSON credentials file of the key.
+func (m *GCPKeyManager) CreateAccessKey(ctx context.Context) (entity.AccessKey, error) {
+	key, err := m.iam_client.CreateServiceAccountKey(ctx, m.service_account)
+	if err != nil {
+		return entity.AccessKey{}, err
+	}
+
+	credentials, err := base64.StdEncoding.DecodeString(key.PrivateKeyData)
+	if err != nil {
+		return entity.AccessKey{}, fmt.Errorf("Couldn't decode private key data: %s", err)
+	}
+
+	access_key := m.toAccessKey(*key)
+	access_key.Secret = string(credentials)
+	return access_key, nil
+}
+
+// RotateAccessKey creates a new key. The old key has to be retired by the caller.
+func (m *GCPKeyManager) RotateAccessKey(ctx context.Context, id string) (entity.AccessKey, error) {
+	// First make room for the new key
+	err := m.deleteOldestDisabledKey(ctx, id)
+	if err != nil {
+		return entity.AccessKey{}, fmt.Errorf("Couldn't make room for new key: %s", err)
+	}
+
+	newKey, err := m.CreateAccessKey(ctx)
+	if err != nil {
+		return entity.AccessKey{}, fmt.Errorf("Couldn't create new key: %s", err)
+	}
+	return newKey, nil
+}
+
+// deleteOldestDisabledKey deletes the oldest disabled key (except the one specified by id)
+// if the limit of keys per service account has been reached
+func (m *GCPKeyManager) deleteOldestDisabledKey(ctx context.Context, id string) error {
+	keys, err := m.ListAccessKeys(ctx)
+	if err != nil {
+		return err
+	}
+	if len(keys) < maxKeysPerServiceAccount {
+		return nil
+	}
+
+	var disabled []entity.AccessKey
+	for _, key := range keys {
+		if !key.IsActive() && key.ID != id {
+			disabled = append(disabled, key)
+		}
+	}
+	if len(disabled) == 0 {
+		return fmt.Errorf("service account %s already has %d keys and none of them is disabled", m.service_account, len(keys))
+	}
+
+	sort.Slice(disabled, func(i, j int) bool {
+		return disabled[i].CreatedAt.Before(disabled[j].CreatedAt)
+	})
+	return m.DeleteAccessKey(ctx, disabled[0].ID)
+}
+
+// DeleteAccessKey
+func (m *GCPKeyManager) DeleteAccessKey(ctx context.Context, id string) error {
+	return m.iam_client.DeleteServiceAccountKey(ctx, m.keyName(id))
+}
 
-func NewGCPKeyManager() *GCPKeyManager {
-	return &GCPKeyManager{}
+// MaxAccessKeys returns the number of keys GCP allows per service account
+func (m *GCPKeyManager) MaxAccessKeys() int {
+	return maxKeysPerServiceAccount
 }
 
-func (f *GCPKeyManager) ListAccessKeys(ctx context.Context) ([]entity.AccessKey, error) {
-	panic("not implemented") // TODO: Implement
+// ActivateAccessKey enables a disabled key
+func (m *GCPKeyManager) ActivateAccessKey(ctx context.Context, id string) error {
+	return m.iam_client.EnableServiceAccountKey(ctx, m.keyName(id))
 }
 
-func (f *GCPKeyManager) CreateAccessKey(ctx context.Context) (entity.AccessKey, error) {
-	panic("not implemented") // TODO: Implement
+// DeactivateAccessKey disables a key. The key can't be used anymore but it can still be enabled again.
+func (m *GCPKeyManager) DeactivateAccessKey(ctx context.Context, id string) error {
+	return m.iam_client.DisableServiceAccountKey(ctx, m.keyName(id))
 }
 
-func (f *GCPKeyManager) DeleteAccessKey(ctx context.Context, id string) error {
-	panic("not implemented") // TODO: Implement
+// keyName returns the resource name of a key of the service account
+func (m *GCPKeyManager) keyName(id string) string {
+	return fmt.Sprintf("projects/-/serviceAccounts/%s/keys/%s", m.service_account, id)
 }
 
-func (f *GCPKeyManager) RotateAccessKey(ctx context.Context, id string) (entity.AccessKey, error) {
-	panic("not implemented") // TODO: Implement
+// toAccessKey maps the metadata of a service account key
+func (m *GCPKeyManager) toAccessKey(key GCPServiceAccountKey) entity.AccessKey {
+	status := entity.KeyStatusActive
+	if key.Disabled {
+		status = entity.KeyStatusInactive
+	}
+
+	return entity.AccessKey{
+		ID:        key.Name[strings.LastIndex(key.Name, "/")+1:],
+		Status:    status,
+		CreatedAt: parseGCPTime(key.ValidAfterTime),
+		ExpiresAt: parseGCPTime(key.ValidBeforeTime),
+		Type:      key.KeyType,
+		Owner:     m.service_account,
+		Provider:  gcpProvider,
+	}
+}
+
+// parseGCPTime parses timestamps returned by the IAM API. Keys without expiration
+// are valid until the end of year 9999 which is mapped to the zero time.
+func parseGCPTime(value string) time.Time {
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil || t.Year() >= 9999 {
+		return time.Time{}
+	}
+	return t
+}
+
+// gcpIAMEndpoint is the base URL of the IAM API
+const gcpIAMEndpoint = "https://iam.googleapis.com/v1/"
+
+// GCPIAMClient implements GCPIAMAPI using the IAM REST API
+type GCPIAMClient struct {
+	endpoint   string
+	httpClient *http.Client
+}
+
+// NewGCPIAMClient returns a client authenticated with the application default credentials
+func NewGCPIAMClient(ctx context.Context) (*GCPIAMClient, error) {
+	httpClient, err := google.DefaultClient(ctx, "https://www.googleapis.com/auth/cloud-platform")
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't find GCP credentials: %s", err)
+	}
+	return &GCPIAMClient{endpoint: gcpIAMEndpoint, httpClient: httpClient}, nil
+}
+
+// ListServiceAccountKeys returns the user-managed keys of a service account
+func (c *GCPIAMClient) ListServiceAccountKeys(ctx context.Context, serviceAccount string) ([]GCPServiceAccountKey, error) {
+	var result struct {
+		Keys []GCPServiceAccountKey `json:"keys"`
+	}
+	path := fmt.Sprintf("projects/-/serviceAccounts/%s/keys?keyTypes=USER_MANAGED", url.PathEscape(serviceAccount))
+	err := c.do(ctx, http.MethodGet, path, nil, &result)
+	return result.Keys, err
+}
+
+// CreateServiceAccountKey creates a new key using the JSON credentials file format
+func (c *GCPIAMClient) CreateServiceAccountKey(ctx context.Context, serviceAccount string) (*GCPServiceAccountKey, error) {
+	request := map[string]string{
+		"privateKeyType": "TYPE_GOOGLE_CREDENTIALS_FILE",
+		"keyAlgorithm":   "KEY_ALG_RSA_2048",
+	}
+	key := &GCPServiceAccountKey{}
+	path := fmt.Sprintf("projects/-/serviceAccounts/%s/keys", url.PathEscape(serviceAccount))
+	err := c.do(ctx, http.MethodPost, path, request, key)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// DeleteServiceAccountKey deletes the key with the specified resource name
+func (c *GCPIAMClient) DeleteServiceAccountKey(ctx context.Context, name string) error {
+	return c.do(ctx, http.MethodDelete, name, nil, nil)
+}
+
+// EnableServiceAccountKey enables the key with the specified resource name
+func (c *GCPIAMClient) EnableServiceAccountKey(ctx context.Context, name string) error {
+	return c.do(ctx, http.MethodPost, name+":enable", struct{}{}, nil)
+}
+
+// DisableServiceAccountKey disables the key with the specified resource name
+func (c *GCPIAMClient) DisableServiceAccountKey(ctx context.Context, name string) error {
+	return c.do(ctx, http.MethodPost, name+":disable", struct{}{}, nil)
+}
+
+// do sends a request to the IAM API and decodes the response into result (if not nil)
+func (c *GCPIAMClient) do(ctx context.Context, method, path string, body, result interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		payload, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(payload)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.endpoint+path, reqBody)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(message)))
+	}
+
+	if result != nil {
+		err = json.NewDecoder(resp.Body).Decode(result)
+		if err != nil {
+			return fmt.Errorf("Couldn't decode response: %s", err)
+		}
+	}
+	return nil
+}
+
+// gcpVerificationScope is the scope of the access token requested when verifying a key
+const gcpVerificationScope = "https://www.googleapis.com/auth/cloud-platform"
+
+// GCPKeyVerifier verifies a key by exchanging a JWT signed with it for an access token
+type GCPKeyVerifier struct {
+	// tokenURL overrides the token endpoint of the credentials file (used by tests)
+	tokenURL string
+}
+
+// NewGCPKeyVerifier returns a verifier using the token endpoint of the credentials
+func NewGCPKeyVerifier() *GCPKeyVerifier {
+	return &GCPKeyVerifier{}
+}
+
+// VerifyAccessKey requests an access token using the JSON credentials file of the key
+func (v *GCPKeyVerifier) VerifyAccessKey(ctx context.Context, key entity.AccessKey) error {
+	config, err := google.JWTConfigFromJSON([]byte(key.Secret), gcpVerificationScope)
+	if err != nil {
+		return fmt.Errorf("Couldn't parse credentials: %s", err)
+	}
+	if v.tokenURL != "" {
+		config.TokenURL = v.tokenURL
+	}
+
+	_, err = config.TokenSource(ctx).Token()
+	return err
 }
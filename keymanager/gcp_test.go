@@ -0,0 +1,273 @@
+package keymanager
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert"
+	"github.com/dorneanu/go-key-rotator/entity"
+	"github.com/stretchr/testify/mock"
+)
+
+// mockGCPIAMAPI is a mock of GCPIAMAPI. It can't live within the mocks package since
+// that package would import keymanager (and vice versa within tests).
+type mockGCPIAMAPI struct {
+	mock.Mock
+}
+
+func (m *mockGCPIAMAPI) ListServiceAccountKeys(ctx context.Context, serviceAccount string) ([]GCPServiceAccountKey, error) {
+	ret := m.Called(ctx, serviceAccount)
+	keys, _ := ret.Get(0).([]GCPServiceAccountKey)
+	return keys, ret.Error(1)
+}
+
+func (m *mockGCPIAMAPI) CreateServiceAccountKey(ctx context.Context, serviceAccount string) (*GCPServiceAccountKey, error) {
+	ret := m.Called(ctx, serviceAccount)
+	key, _ := ret.Get(0).(*GCPServiceAccountKey)
+	return key, ret.Error(1)
+}
+
+func (m *mockGCPIAMAPI) DeleteServiceAccountKey(ctx context.Context, name string) error {
+	return m.Called(ctx, name).Error(0)
+}
+
+func (m *mockGCPIAMAPI) EnableServiceAccountKey(ctx context.Context, name string) error {
+	return m.Called(ctx, name).Error(0)
+}
+
+func (m *mockGCPIAMAPI) DisableServiceAccountKey(ctx context.Context, name string) error {
+	return m.Called(ctx, name).Error(0)
+}
+
+const testServiceAccount = "deploy@project.iam.gserviceaccount.com"
+
+func gcpKeyName(id string) string {
+	return fmt.Sprintf("projects/project/serviceAccounts/%s/keys/%s", testServiceAccount, id)
+}
+
+func TestGCPKeyManager_ListAccessKeys(t *testing.T) {
+	mock_iam := &mockGCPIAMAPI{}
+	mock_iam.On("ListServiceAccountKeys", mock.Anything, testServiceAccount).Return([]GCPServiceAccountKey{
+		{
+			Name:            gcpKeyName("KEY1"),
+			ValidAfterTime:  "2021-06-01T10:00:00Z",
+			ValidBeforeTime: "9999-12-31T23:59:59Z",
+			KeyType:         "USER_MANAGED",
+		},
+		{
+			Name:            gcpKeyName("KEY2"),
+			ValidAfterTime:  "2021-05-01T10:00:00Z",
+			ValidBeforeTime: "2021-08-01T10:00:00Z",
+			KeyType:         "USER_MANAGED",
+			Disabled:        true,
+		},
+	}, nil).Once()
+
+	key_manager := GCPKeyManager{service_account: testServiceAccount, iam_client: mock_iam}
+	keys, err := key_manager.ListAccessKeys(context.TODO())
+	assert.Nil(t, err)
+	assert.Equal(t, []entity.AccessKey{
+		{
+			ID:        "KEY1",
+			Status:    entity.KeyStatusActive,
+			CreatedAt: time.Date(2021, time.June, 1, 10, 0, 0, 0, time.UTC),
+			Type:      "USER_MANAGED",
+			Owner:     testServiceAccount,
+			Provider:  "gcp",
+		},
+		{
+			ID:        "KEY2",
+			Status:    entity.KeyStatusInactive,
+			CreatedAt: time.Date(2021, time.May, 1, 10, 0, 0, 0, time.UTC),
+			ExpiresAt: time.Date(2021, time.August, 1, 10, 0, 0, 0, time.UTC),
+			Type:      "USER_MANAGED",
+			Owner:     testServiceAccount,
+			Provider:  "gcp",
+		},
+	}, keys)
+}
+
+func TestGCPKeyManager_CreateAccessKey(t *testing.T) {
+	credentials := `{"type": "service_account", "private_key_id": "KEY3"}`
+
+	mock_iam := &mockGCPIAMAPI{}
+	mock_iam.On("CreateServiceAccountKey", mock.Anything, testServiceAccount).Return(&GCPServiceAccountKey{
+		Name:           gcpKeyName("KEY3"),
+		PrivateKeyData: base64.StdEncoding.EncodeToString([]byte(credentials)),
+		ValidAfterTime: "2021-07-01T10:00:00Z",
+		KeyType:        "USER_MANAGED",
+	}, nil).Once()
+
+	key_manager := GCPKeyManager{service_account: testServiceAccount, iam_client: mock_iam}
+	key, err := key_manager.CreateAccessKey(context.TODO())
+	assert.Nil(t, err)
+	assert.Equal(t, "KEY3", key.ID)
+	assert.Equal(t, credentials, key.Secret)
+	assert.Equal(t, entity.KeyStatusActive, key.Status)
+	assert.Equal(t, testServiceAccount, key.Owner)
+}
+
+func TestGCPKeyManager_RotateAccessKey(t *testing.T) {
+	newKey := &GCPServiceAccountKey{
+		Name:           gcpKeyName("NEW"),
+		PrivateKeyData: base64.StdEncoding.EncodeToString([]byte("{}")),
+	}
+
+	// Keys created at different days, the first one being the oldest
+	keys := func(disabled ...int) []GCPServiceAccountKey {
+		var result []GCPServiceAccountKey
+		for i := 0; i < maxKeysPerServiceAccount; i++ {
+			result = append(result, GCPServiceAccountKey{
+				Name:           gcpKeyName(fmt.Sprintf("KEY%d", i)),
+				ValidAfterTime: time.Date(2021, time.June, i+1, 0, 0, 0, 0, time.UTC).Format(time.RFC3339),
+			})
+		}
+		for _, i := range disabled {
+			result[i].Disabled = true
+		}
+		return result
+	}
+
+	t.Run("Below limit", func(t *testing.T) {
+		mock_iam := &mockGCPIAMAPI{}
+		mock_iam.On("ListServiceAccountKeys", mock.Anything, testServiceAccount).
+			Return(keys()[:2], nil).Once()
+		mock_iam.On("CreateServiceAccountKey", mock.Anything, testServiceAccount).Return(newKey, nil).Once()
+
+		key_manager := GCPKeyManager{service_account: testServiceAccount, iam_client: mock_iam}
+		key, err := key_manager.RotateAccessKey(context.TODO(), "KEY0")
+		assert.Nil(t, err)
+		assert.Equal(t, "NEW", key.ID)
+		mock_iam.AssertNotCalled(t, "DeleteServiceAccountKey", mock.Anything, mock.Anything)
+	})
+
+	t.Run("Oldest disabled key makes room", func(t *testing.T) {
+		mock_iam := &mockGCPIAMAPI{}
+		mock_iam.On("ListServiceAccountKeys", mock.Anything, testServiceAccount).
+			Return(keys(7, 3, 0), nil).Once()
+		mock_iam.On("DeleteServiceAccountKey", mock.Anything, "projects/-/serviceAccounts/"+testServiceAccount+"/keys/KEY3").
+			Return(nil).Once()
+		mock_iam.On("CreateServiceAccountKey", mock.Anything, testServiceAccount).Return(newKey, nil).Once()
+
+		// KEY0 is the one being rotated
+		key_manager := GCPKeyManager{service_account: testServiceAccount, iam_client: mock_iam}
+		_, err := key_manager.RotateAccessKey(context.TODO(), "KEY0")
+		assert.Nil(t, err)
+		mock_iam.AssertExpectations(t)
+	})
+
+	t.Run("Limit reached", func(t *testing.T) {
+		mock_iam := &mockGCPIAMAPI{}
+		mock_iam.On("ListServiceAccountKeys", mock.Anything, testServiceAccount).
+			Return(keys(), nil).Once()
+
+		key_manager := GCPKeyManager{service_account: testServiceAccount, iam_client: mock_iam}
+		_, err := key_manager.RotateAccessKey(context.TODO(), "KEY0")
+		assert.Error(t, err)
+		mock_iam.AssertNotCalled(t, "CreateServiceAccountKey", mock.Anything, mock.Anything)
+	})
+}
+
+func TestGCPKeyManager_UpdateKeyStatus(t *testing.T) {
+	name := "projects/-/serviceAccounts/" + testServiceAccount + "/keys/KEY1"
+
+	mock_iam := &mockGCPIAMAPI{}
+	mock_iam.On("DisableServiceAccountKey", mock.Anything, name).Return(nil).Once()
+	mock_iam.On("EnableServiceAccountKey", mock.Anything, name).Return(errors.New("Permission denied")).Once()
+
+	key_manager := GCPKeyManager{service_account: testServiceAccount, iam_client: mock_iam}
+	assert.Nil(t, key_manager.DeactivateAccessKey(context.TODO(), "KEY1"))
+	assert.Error(t, key_manager.ActivateAccessKey(context.TODO(), "KEY1"))
+	mock_iam.AssertExpectations(t)
+}
+
+func TestGCPIAMClient(t *testing.T) {
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.RequestURI())
+		switch r.Method {
+		case http.MethodGet:
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"keys": []GCPServiceAccountKey{{Name: gcpKeyName("KEY1")}},
+			})
+		case http.MethodPost:
+			var body map[string]string
+			json.NewDecoder(r.Body).Decode(&body)
+			if body["privateKeyType"] != "" {
+				json.NewEncoder(w).Encode(GCPServiceAccountKey{Name: gcpKeyName("KEY2")})
+				return
+			}
+			w.Write([]byte("{}"))
+		case http.MethodDelete:
+			http.Error(w, `{"error": {"code": 404}}`, http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	client := &GCPIAMClient{endpoint: server.URL + "/v1/", httpClient: server.Client()}
+
+	keys, err := client.ListServiceAccountKeys(context.TODO(), testServiceAccount)
+	assert.Nil(t, err)
+	assert.Equal(t, gcpKeyName("KEY1"), keys[0].Name)
+
+	key, err := client.CreateServiceAccountKey(context.TODO(), testServiceAccount)
+	assert.Nil(t, err)
+	assert.Equal(t, gcpKeyName("KEY2"), key.Name)
+
+	assert.Nil(t, client.DisableServiceAccountKey(context.TODO(), gcpKeyName("KEY1")))
+	assert.Error(t, client.DeleteServiceAccountKey(context.TODO(), gcpKeyName("KEY1")))
+
+	assert.Equal(t, []string{
+		"GET /v1/projects/-/serviceAccounts/" + testServiceAccount + "/keys?keyTypes=USER_MANAGED",
+		"POST /v1/projects/-/serviceAccounts/" + testServiceAccount + "/keys",
+		"POST /v1/" + gcpKeyName("KEY1") + ":disable",
+		"DELETE /v1/" + gcpKeyName("KEY1"),
+	}, requests)
+}
+
+func TestGCPKeyVerifier_VerifyAccessKey(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	pemKey := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)})
+
+	revoked := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		w.Header().Set("Content-Type", "application/json")
+		if revoked || r.PostForm.Get("assertion") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error": "invalid_grant"}`))
+			return
+		}
+		w.Write([]byte(`{"access_token": "token", "token_type": "Bearer", "expires_in": 3600}`))
+	}))
+	defer server.Close()
+
+	credentials, err := json.Marshal(map[string]string{
+		"type":           "service_account",
+		"client_email":   "deploy@project.iam.gserviceaccount.com",
+		"private_key_id": "key-1",
+		"private_key":    string(pemKey),
+		"token_uri":      server.URL,
+	})
+	assert.NoError(t, err)
+	key := entity.AccessKey{ID: "key-1", Secret: string(credentials)}
+
+	verifier := GCPKeyVerifier{tokenURL: server.URL}
+	assert.NoError(t, verifier.VerifyAccessKey(context.TODO(), key))
+
+	revoked = true
+	assert.Error(t, verifier.VerifyAccessKey(context.TODO(), key))
+	assert.Error(t, verifier.VerifyAccessKey(context.TODO(), entity.AccessKey{ID: "key-1", Secret: "not json"}))
+}
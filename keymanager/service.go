@@ -12,4 +12,19 @@ type KeyManager interface {
 	CreateAccessKey(ctx context.Context) (entity.AccessKey, error)
 	DeleteAccessKey(ctx context.Context, id string) error
 	RotateAccessKey(ctx context.Context, id string) (entity.AccessKey, error)
+	ActivateAccessKey(ctx context.Context, id string) error
+	DeactivateAccessKey(ctx context.Context, id string) error
+}
+
+// KeyLimiter is implemented by key managers which only allow a limited number of keys per principal.
+// When the limit is reached, the oldest inactive key is deleted in order to make room for a new one.
+// The rotator doesn't rotate if that key was retired by a rotation and is still within its grace period.
+type KeyLimiter interface {
+	MaxAccessKeys() int
+}
+
+// KeyVerifier checks whether a new key can actually be used for authentication. Providers are
+// eventually consistent, so a new key may be rejected for a while after it has been created.
+type KeyVerifier interface {
+	VerifyAccessKey(ctx context.Context, key entity.AccessKey) error
 }
@@ -15,6 +15,20 @@ type KeyManager struct {
 	mock.Mock
 }
 
+// ActivateAccessKey provides a mock function with given fields: ctx, id
+func (_m *KeyManager) ActivateAccessKey(ctx context.Context, id string) error {
+	ret := _m.Called(ctx, id)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string) error); ok {
+		r0 = rf(ctx, id)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // CreateAccessKey provides a mock function with given fields: ctx
 func (_m *KeyManager) CreateAccessKey(ctx context.Context) (entity.AccessKey, error) {
 	ret := _m.Called(ctx)
@@ -36,6 +50,20 @@ func (_m *KeyManager) CreateAccessKey(ctx context.Context) (entity.AccessKey, er
 	return r0, r1
 }
 
+// DeactivateAccessKey provides a mock function with given fields: ctx, id
+func (_m *KeyManager) DeactivateAccessKey(ctx context.Context, id string) error {
+	ret := _m.Called(ctx, id)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string) error); ok {
+		r0 = rf(ctx, id)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // DeleteAccessKey provides a mock function with given fields: ctx, id
 func (_m *KeyManager) DeleteAccessKey(ctx context.Context, id string) error {
 	ret := _m.Called(ctx, id)
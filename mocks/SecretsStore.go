@@ -6,6 +6,7 @@ import (
 	context "context"
 
 	entity "github.com/dorneanu/go-key-rotator/entity"
+
 	mock "github.com/stretchr/testify/mock"
 )
 
@@ -42,6 +43,20 @@ func (_m *SecretsStore) DeleteSecret(_a0 context.Context, _a1 entity.EncryptedKe
 	return r0
 }
 
+// Destination provides a mock function with given fields:
+func (_m *SecretsStore) Destination() string {
+	ret := _m.Called()
+
+	var r0 string
+	if rf, ok := ret.Get(0).(func() string); ok {
+		r0 = rf()
+	} else {
+		r0 = ret.Get(0).(string)
+	}
+
+	return r0
+}
+
 // EncryptKey provides a mock function with given fields: _a0, _a1
 func (_m *SecretsStore) EncryptKey(_a0 context.Context, _a1 entity.AccessKey) (*entity.EncryptedKey, error) {
 	ret := _m.Called(_a0, _a1)
@@ -0,0 +1,334 @@
+package secretsstore
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"github.com/dorneanu/go-key-rotator/entity"
+)
+
+// FileSecret is a single secret kept in a secrets file
+type FileSecret struct {
+	Value     string            `json:"value"`
+	UpdatedAt time.Time         `json:"updated_at"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+}
+
+// SecretsFile reads and writes all secrets kept in a local file
+type SecretsFile interface {
+	Path() string
+	Read() (map[string]FileSecret, error)
+	Write(secrets map[string]FileSecret) error
+}
+
+// Metadata attached to every secret written by a FileSecretsStore
+const (
+	FileMetadataProvider = "source-provider"
+	FileMetadataKeyID    = "key-id"
+)
+
+// FileSecretsStore implements a SecretsStore using a local (encrypted) file.
+// The file may be shared by several stores as long as they write different secrets.
+type FileSecretsStore struct {
+	file   SecretsFile
+	layout SecretLayout
+	now    func() time.Time
+}
+
+// NewFileSecretsStore returns a FileSecretsStore writing keys to file as described by layout
+func NewFileSecretsStore(file SecretsFile, layout SecretLayout) *FileSecretsStore {
+	return &FileSecretsStore{
+		file:   file,
+		layout: layout,
+		now:    time.Now,
+	}
+}
+
+// ListSecrets returns all secrets kept in the file sorted by name
+func (s *FileSecretsStore) ListSecrets(ctx context.Context) ([]entity.AccessKey, error) {
+	secrets, err := s.file.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	access_keys := make([]entity.AccessKey, 0, len(secrets))
+	for name, secret := range secrets {
+		access_keys = append(access_keys, entity.AccessKey{ID: name, CreatedAt: secret.UpdatedAt})
+	}
+	sort.Slice(access_keys, func(i, j int) bool {
+		return access_keys[i].ID < access_keys[j].ID
+	})
+	return access_keys, nil
+}
+
+// EncryptKey renders the secrets to be written. The values are encrypted along
+// with the rest of the file once it is written.
+func (s *FileSecretsStore) EncryptKey(ctx context.Context, k entity.AccessKey) (*entity.EncryptedKey, error) {
+	values, err := s.layout.Values(k)
+	if err != nil {
+		return nil, err
+	}
+
+	encrypted_key := &entity.EncryptedKey{
+		ID: k.ID,
+		Metadata: map[string]string{
+			FileMetadataProvider: k.Provider,
+			FileMetadataKeyID:    k.ID,
+		},
+	}
+	for _, value := range values {
+		encrypted_key.Secrets = append(encrypted_key.Secrets, entity.EncryptedSecret{Name: value.Name, Value: []byte(value.Value)})
+	}
+	if len(encrypted_key.Secrets) == 1 {
+		encrypted_key.Secret = encrypted_key.Secrets[0].Value
+	}
+	return encrypted_key, nil
+}
+
+// CreateSecret adds the secrets to the file or replaces them if they already exist
+func (s *FileSecretsStore) CreateSecret(ctx context.Context, k entity.EncryptedKey) error {
+	secrets, err := s.file.Read()
+	if err != nil {
+		return err
+	}
+
+	updates := k.Secrets
+	if len(updates) == 0 {
+		updates = []entity.EncryptedSecret{{Name: s.layout.Name, Value: k.Secret}}
+	}
+
+	metadata := make(map[string]string)
+	for key, value := range k.Metadata {
+		if value != "" {
+			metadata[key] = value
+		}
+	}
+	if len(metadata) == 0 {
+		metadata = nil
+	}
+
+	now := s.now().UTC()
+	for _, secret := range updates {
+		secrets[secret.Name] = FileSecret{Value: string(secret.Value), UpdatedAt: now, Metadata: metadata}
+	}
+	return s.file.Write(secrets)
+}
+
+// DeleteSecret removes the secret named by the key's ID from the file
+func (s *FileSecretsStore) DeleteSecret(ctx context.Context, k entity.EncryptedKey) error {
+	secrets, err := s.file.Read()
+	if err != nil {
+		return err
+	}
+	if _, ok := secrets[k.ID]; !ok {
+		return nil
+	}
+	delete(secrets, k.ID)
+	return s.file.Write(secrets)
+}
+
+// SnapshotSecrets returns the current values of the secrets named by the layout
+func (s *FileSecretsStore) SnapshotSecrets(ctx context.Context) (SecretsSnapshot, error) {
+	secrets, err := s.file.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := make(SecretsSnapshot)
+	for _, name := range s.layout.Names() {
+		if secret, ok := secrets[name]; ok {
+			snapshot[name] = []byte(secret.Value)
+		}
+	}
+	return snapshot, nil
+}
+
+// RestoreSecrets writes the values of a snapshot back. Secrets missing within the snapshot are removed.
+func (s *FileSecretsStore) RestoreSecrets(ctx context.Context, snapshot SecretsSnapshot) error {
+	secrets, err := s.file.Read()
+	if err != nil {
+		return err
+	}
+
+	now := s.now().UTC()
+	for _, name := range s.layout.Names() {
+		value, ok := snapshot[name]
+		if !ok {
+			delete(secrets, name)
+			continue
+		}
+		secrets[name] = FileSecret{Value: string(value), UpdatedAt: now}
+	}
+	return s.file.Write(secrets)
+}
+
+// Destination returns the path of the file and the names of the secrets
+func (s *FileSecretsStore) Destination() string {
+	return fmt.Sprintf("file:%s/%s", s.file.Path(), strings.Join(s.layout.Names(), ","))
+}
+
+// AgeFileSettings specifies the file and the age keys used to encrypt and decrypt it
+type AgeFileSettings struct {
+	Path string `envconfig:"SECRETS_FILE_PATH"`
+
+	// Recipients are the public keys (age1...) the file is encrypted to
+	Recipients []string `envconfig:"AGE_RECIPIENTS"`
+
+	// IdentityFile holds the private key(s) needed to read an existing file. The file
+	// is always encrypted to its X25519 identities as well.
+	IdentityFile string `envconfig:"AGE_IDENTITY_FILE"`
+
+	// Armor writes the file ASCII armored (PEM like) instead of binary
+	Armor bool `envconfig:"AGE_ARMOR"`
+}
+
+// AgeSecretsFile implements SecretsFile using a JSON document encrypted with age
+// (https://age-encryption.org). The file can be decrypted using "age -d -i <identity file>".
+type AgeSecretsFile struct {
+	path       string
+	recipients []age.Recipient
+	identities []age.Identity
+	armor      bool
+}
+
+// NewAgeSecretsFile parses the recipients and identities specified by settings
+func NewAgeSecretsFile(settings AgeFileSettings) (*AgeSecretsFile, error) {
+	if settings.Path == "" {
+		return nil, fmt.Errorf("path of the secrets file is required")
+	}
+	file := &AgeSecretsFile{path: settings.Path, armor: settings.Armor}
+
+	if len(settings.Recipients) > 0 {
+		recipients, err := age.ParseRecipients(strings.NewReader(strings.Join(settings.Recipients, "\n")))
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't parse age recipients: %s", err)
+		}
+		file.recipients = recipients
+	}
+
+	if settings.IdentityFile != "" {
+		content, err := ioutil.ReadFile(settings.IdentityFile)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't read age identity file: %s", err)
+		}
+		identities, err := age.ParseIdentities(bytes.NewReader(content))
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't parse age identity file: %s", err)
+		}
+		file.identities = identities
+
+		// Otherwise the file couldn't be updated by the next rotation
+		for _, identity := range identities {
+			if x25519, ok := identity.(*age.X25519Identity); ok {
+				file.recipients = append(file.recipients, x25519.Recipient())
+			}
+		}
+	}
+
+	if len(file.recipients) == 0 {
+		return nil, fmt.Errorf("at least one age recipient (or identity) is required")
+	}
+	return file, nil
+}
+
+// Path returns the path of the file
+func (f *AgeSecretsFile) Path() string {
+	return f.path
+}
+
+// Read decrypts the file. A missing file holds no secrets.
+func (f *AgeSecretsFile) Read() (map[string]FileSecret, error) {
+	content, err := os.Open(f.path)
+	if os.IsNotExist(err) {
+		return make(map[string]FileSecret), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer content.Close()
+
+	if len(f.identities) == 0 {
+		return nil, fmt.Errorf("age identity is required to update %s", f.path)
+	}
+
+	var src io.Reader = bufio.NewReader(content)
+	if header, _ := src.(*bufio.Reader).Peek(len(armor.Header)); string(header) == armor.Header {
+		src = armor.NewReader(src)
+	}
+	plaintext, err := age.Decrypt(src, f.identities...)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't decrypt %s: %s", f.path, err)
+	}
+
+	var document struct {
+		Secrets map[string]FileSecret `json:"secrets"`
+	}
+	err = json.NewDecoder(plaintext).Decode(&document)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't decode %s: %s", f.path, err)
+	}
+	if document.Secrets == nil {
+		document.Secrets = make(map[string]FileSecret)
+	}
+	return document.Secrets, nil
+}
+
+// Write encrypts the secrets and replaces the file atomically. Only the owner may read the file.
+func (f *AgeSecretsFile) Write(secrets map[string]FileSecret) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(f.path), "."+filepath.Base(f.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	err = f.encrypt(tmp, secrets)
+	if err != nil {
+		return fmt.Errorf("Couldn't encrypt %s: %s", f.path, err)
+	}
+	err = tmp.Chmod(0600)
+	if err == nil {
+		err = tmp.Close()
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f.path)
+}
+
+// encrypt writes the secrets as JSON document encrypted to all recipients
+func (f *AgeSecretsFile) encrypt(dst io.Writer, secrets map[string]FileSecret) error {
+	var armored io.WriteCloser
+	if f.armor {
+		armored = armor.NewWriter(dst)
+		dst = armored
+	}
+
+	w, err := age.Encrypt(dst, f.recipients...)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	err = encoder.Encode(map[string]interface{}{"secrets": secrets})
+	if err != nil {
+		return err
+	}
+	err = w.Close()
+	if err == nil && armored != nil {
+		err = armored.Close()
+	}
+	return err
+}
@@ -0,0 +1,122 @@
+package secretsstore
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	"github.com/alecthomas/assert"
+	"github.com/dorneanu/go-key-rotator/entity"
+)
+
+// newAgeIdentityFile writes a new X25519 identity to dir
+func newAgeIdentityFile(t *testing.T, dir, name string) (*age.X25519Identity, string) {
+	identity, err := age.GenerateX25519Identity()
+	assert.Nil(t, err)
+	path := filepath.Join(dir, name)
+	assert.Nil(t, ioutil.WriteFile(path, []byte("# created: test\n"+identity.String()+"\n"), 0600))
+	return identity, path
+}
+
+func TestFileSecretsStore_CreateSecret(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secrets")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	identity, identityFile := newAgeIdentityFile(t, dir, "rotator.key")
+	other, _ := newAgeIdentityFile(t, dir, "other.key")
+
+	path := filepath.Join(dir, "secrets.age")
+	file, err := NewAgeSecretsFile(AgeFileSettings{
+		Path:         path,
+		Recipients:   []string{other.Recipient().String()},
+		IdentityFile: identityFile,
+		Armor:        true,
+	})
+	assert.Nil(t, err)
+
+	// Both stores share the same file
+	deploy := NewFileSecretsStore(file, SecretLayout{Format: SecretFormatSeparate, IDName: "DEPLOY_ID", Name: "DEPLOY_SECRET"})
+	ci := NewFileSecretsStore(file, SecretLayout{Format: SecretFormatEnv, Name: "ci.env"})
+	deploy.now = func() time.Time { return time.Date(2021, time.July, 1, 10, 0, 0, 0, time.UTC) }
+	assert.Equal(t, "file:"+path+"/DEPLOY_ID,DEPLOY_SECRET", deploy.Destination())
+
+	for _, store := range []*FileSecretsStore{deploy, ci} {
+		encrypted_key, err := store.EncryptKey(context.TODO(), entity.AccessKey{ID: "AKIAEXAMPLE", Secret: "SECRET", Provider: "aws"})
+		assert.Nil(t, err)
+		assert.Nil(t, store.CreateSecret(context.TODO(), *encrypted_key))
+	}
+
+	info, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	content, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(string(content), "-----BEGIN AGE ENCRYPTED FILE-----"))
+	assert.False(t, strings.Contains(string(content), "SECRET"))
+
+	// Every recipient is able to decrypt the file
+	for _, i := range []*age.X25519Identity{identity, other} {
+		f := &AgeSecretsFile{path: path, identities: []age.Identity{i}}
+		secrets, err := f.Read()
+		assert.Nil(t, err)
+		assert.Equal(t, FileSecret{
+			Value:     "SECRET",
+			UpdatedAt: time.Date(2021, time.July, 1, 10, 0, 0, 0, time.UTC),
+			Metadata:  map[string]string{FileMetadataProvider: "aws", FileMetadataKeyID: "AKIAEXAMPLE"},
+		}, secrets["DEPLOY_SECRET"])
+		assert.Equal(t, "AKIAEXAMPLE", secrets["DEPLOY_ID"].Value)
+		assert.Equal(t, "AWS_ACCESS_KEY_ID=AKIAEXAMPLE\nAWS_SECRET_ACCESS_KEY=SECRET\n", secrets["ci.env"].Value)
+	}
+
+	secrets, err := deploy.ListSecrets(context.TODO())
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"DEPLOY_ID", "DEPLOY_SECRET", "ci.env"}, []string{secrets[0].ID, secrets[1].ID, secrets[2].ID})
+
+	assert.Nil(t, deploy.DeleteSecret(context.TODO(), entity.EncryptedKey{ID: "DEPLOY_ID"}))
+	secrets, err = deploy.ListSecrets(context.TODO())
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(secrets))
+}
+
+func TestNewAgeSecretsFile(t *testing.T) {
+	t.Run("Recipient is required", func(t *testing.T) {
+		_, err := NewAgeSecretsFile(AgeFileSettings{Path: "secrets.age"})
+		assert.Error(t, err)
+	})
+
+	t.Run("Invalid recipient", func(t *testing.T) {
+		_, err := NewAgeSecretsFile(AgeFileSettings{Path: "secrets.age", Recipients: []string{"age1invalid"}})
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "Couldn't parse age recipients")
+	})
+
+	t.Run("Existing file can't be updated without identity", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "secrets")
+		assert.Nil(t, err)
+		defer os.RemoveAll(dir)
+
+		identity, _ := newAgeIdentityFile(t, dir, "rotator.key")
+		file, err := NewAgeSecretsFile(AgeFileSettings{
+			Path:       filepath.Join(dir, "secrets.age"),
+			Recipients: []string{identity.Recipient().String()},
+		})
+		assert.Nil(t, err)
+
+		// Without a file, there is nothing to decrypt
+		secrets, err := file.Read()
+		assert.Nil(t, err)
+		assert.Equal(t, 0, len(secrets))
+
+		assert.Nil(t, file.Write(map[string]FileSecret{"KEY": {Value: "VALUE"}}))
+		_, err = file.Read()
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "age identity is required")
+	})
+}
@@ -3,8 +3,10 @@ package secretsstore
 import (
 	"context"
 	"encoding/base64"
+	"fmt"
 	"log"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/bradleyfalzon/ghinstallation"
@@ -21,11 +23,6 @@ type GithubAppSettings struct {
 	PrivateKey     []byte
 }
 
-// GithubClient implements GithubSecretsService
-// type GithubClient struct {
-// 	client *github.Client
-// }
-
 // GithubSecretsService
 type GithubSecretsService interface {
 	GetRepoPublicKey(ctx context.Context, owner, repo string) (*github.PublicKey, *github.Response, error)
@@ -39,6 +36,7 @@ type GithubSecretsStore struct {
 	repoOwner     string
 	repoName      string
 	secretName    string
+	secretLayout  SecretLayout
 	secretsClient GithubSecretsService
 	repoPublicKey *github.PublicKey
 }
@@ -52,6 +50,23 @@ func NewGithubSecretsStore(secretsService GithubSecretsService, repoOwner, repoN
 	}
 }
 
+// NewGithubSecretsStoreWithLayout returns a GithubSecretsStore writing keys as described by layout
+// (e.g. ID and secret as separate secrets)
+func NewGithubSecretsStoreWithLayout(secretsService GithubSecretsService, repoOwner, repoName string, layout SecretLayout) *GithubSecretsStore {
+	store := NewGithubSecretsStore(secretsService, repoOwner, repoName, layout.Name)
+	store.secretLayout = layout
+	return store
+}
+
+// layout returns the secret layout which defaults to storing the secret under secretName
+func (s *GithubSecretsStore) layout() SecretLayout {
+	layout := s.secretLayout
+	if layout.Name == "" {
+		layout.Name = s.secretName
+	}
+	return layout
+}
+
 // ListSecrets
 func (s *GithubSecretsStore) ListSecrets(ctx context.Context) ([]entity.AccessKey, error) {
 	// Fetch repository secrets
@@ -75,14 +90,24 @@ func (s *GithubSecretsStore) ListSecrets(ctx context.Context) ([]entity.AccessKe
 
 // CreateSecret
 func (s *GithubSecretsStore) CreateSecret(ctx context.Context, k entity.EncryptedKey) error {
-	b64Encoded := base64.StdEncoding.EncodeToString(k.Secret)
-	input := &github.EncryptedSecret{
-		Name:           s.secretName,
-		EncryptedValue: b64Encoded,
-		KeyID:          *s.repoPublicKey.KeyID,
+	secrets := k.Secrets
+	if len(secrets) == 0 {
+		secrets = []entity.EncryptedSecret{{Name: s.layout().Name, Value: k.Secret}}
 	}
-	_, err := s.secretsClient.CreateOrUpdateRepoSecret(ctx, s.repoOwner, s.repoName, input)
-	return err
+
+	for _, secret := range secrets {
+		b64Encoded := base64.StdEncoding.EncodeToString(secret.Value)
+		input := &github.EncryptedSecret{
+			Name:           secret.Name,
+			EncryptedValue: b64Encoded,
+			KeyID:          *s.repoPublicKey.KeyID,
+		}
+		_, err := s.secretsClient.CreateOrUpdateRepoSecret(ctx, s.repoOwner, s.repoName, input)
+		if err != nil {
+			return fmt.Errorf("Couldn't write secret %s: %s", secret.Name, err)
+		}
+	}
+	return nil
 }
 
 // DeleteSecret
@@ -100,35 +125,60 @@ func (s *GithubSecretsStore) EncryptKey(ctx context.Context, k entity.AccessKey)
 	}
 	s.repoPublicKey = public_key
 
-	// For a sealed box the public key must be of length 32 bytes
+	return sealKey(public_key, s.layout(), k)
+}
+
+// sealKey renders the secrets of a key and encrypts each one as sealed box
+// using the public key of the repository (or organization)
+func sealKey(public_key *github.PublicKey, layout SecretLayout, k entity.AccessKey) (*entity.EncryptedKey, error) {
+	// For a sealed box the public key must be of length 32 bytes. The API returns it base64 encoded.
+	key := []byte(public_key.GetKey())
+	if decoded, err := base64.StdEncoding.DecodeString(string(key)); err == nil && len(decoded) == 32 {
+		key = decoded
+	}
 	var pub_key [32]byte
-	copy(pub_key[:], *public_key.Key)
+	copy(pub_key[:], key)
 
-	// Create sealed box
-	box, err := box.SealAnonymous(nil, []byte(k.Secret), &pub_key, nil)
+	values, err := layout.Values(k)
 	if err != nil {
 		return nil, err
 	}
 
-	return &entity.EncryptedKey{
-		ID:     k.ID,
-		Secret: box,
-	}, nil
+	encrypted_key := &entity.EncryptedKey{ID: k.ID}
+	for _, value := range values {
+		// Create sealed box
+		box, err := box.SealAnonymous(nil, []byte(value.Value), &pub_key, nil)
+		if err != nil {
+			return nil, err
+		}
+		encrypted_key.Secrets = append(encrypted_key.Secrets, entity.EncryptedSecret{Name: value.Name, Value: box})
+	}
+
+	// Keys stored as a single secret
+	if len(encrypted_key.Secrets) == 1 {
+		encrypted_key.Secret = encrypted_key.Secrets[0].Value
+	}
+	return encrypted_key, nil
+}
+
+// Destination returns a human readable description of where secrets are stored
+func (s *GithubSecretsStore) Destination() string {
+	return fmt.Sprintf("github:%s/%s/%s", s.repoOwner, s.repoName, strings.Join(s.layout().Names(), ","))
 }
 
-// NewGithubClient returns an implementation of GithubSecretsService using OAUTH tokens
-func NewGithubClient(accessToken string) GithubSecretsService {
+// NewGithubClient returns a GithubClient using OAUTH tokens
+func NewGithubClient(accessToken string) *GithubClient {
 	ctx := context.Background()
 	ts := oauth2.StaticTokenSource(
 		&oauth2.Token{AccessToken: accessToken},
 	)
 	tc := oauth2.NewClient(ctx, ts)
 	client := github.NewClient(tc)
-	return client.Actions
+	return newGithubClient(client)
 }
 
-// NewGithubClientAsApp returns an implementation of GithubSecretsServce using a Github Application
-func NewGithubClientAsApp(settings GithubAppSettings) GithubSecretsService {
+// NewGithubClientAsApp returns a GithubClient authenticated as Github Application
+func NewGithubClientAsApp(settings GithubAppSettings) *GithubClient {
 	// Authenticate as Github application
 	itr, err := ghinstallation.New(http.DefaultTransport, settings.ApplicationID, settings.InstallationID, settings.PrivateKey)
 	if err != nil {
@@ -137,5 +187,5 @@ func NewGithubClientAsApp(settings GithubAppSettings) GithubSecretsService {
 
 	// Use installation transport with client.
 	client := github.NewClient(&http.Client{Transport: itr, Timeout: time.Second * 10})
-	return client.Actions
+	return newGithubClient(client)
 }
@@ -0,0 +1,307 @@
+package secretsstore
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/dorneanu/go-key-rotator/entity"
+	"github.com/google/go-github/v34/github"
+)
+
+// GithubSecretApp is the Github feature whose secrets are managed
+type GithubSecretApp string
+
+const (
+	GithubAppActions    GithubSecretApp = "actions"
+	GithubAppDependabot GithubSecretApp = "dependabot"
+	GithubAppCodespaces GithubSecretApp = "codespaces"
+)
+
+// Visibility of organization secrets
+const (
+	GithubVisibilityAll      = "all"
+	GithubVisibilityPrivate  = "private"
+	GithubVisibilitySelected = "selected"
+)
+
+// ParseGithubSecretApp returns the app specified by name. An empty name means GithubAppActions.
+func ParseGithubSecretApp(name string) (GithubSecretApp, error) {
+	switch app := GithubSecretApp(name); app {
+	case "":
+		return GithubAppActions, nil
+	case GithubAppActions, GithubAppDependabot, GithubAppCodespaces:
+		return app, nil
+	default:
+		return "", fmt.Errorf("unknown github secret app %q (expected actions, dependabot or codespaces)", name)
+	}
+}
+
+// GithubSecretTarget specifies whose secrets are managed: the secrets of a repository,
+// of an environment of a repository (Actions only) or of an organization (if Repo is empty).
+type GithubSecretTarget struct {
+	Owner       string
+	Repo        string
+	Environment string
+	App         GithubSecretApp
+}
+
+// app returns the app of the target which defaults to Actions
+func (t GithubSecretTarget) app() GithubSecretApp {
+	if t.App == "" {
+		return GithubAppActions
+	}
+	return t.App
+}
+
+// Validate checks whether the target is supported by the API
+func (t GithubSecretTarget) Validate() error {
+	app, err := ParseGithubSecretApp(string(t.App))
+	if err != nil {
+		return err
+	}
+	if t.Owner == "" {
+		return fmt.Errorf("owner is required")
+	}
+	if t.Environment != "" && t.Repo == "" {
+		return fmt.Errorf("environment secrets require a repository")
+	}
+	if t.Environment != "" && app != GithubAppActions {
+		return fmt.Errorf("environment secrets are only supported by actions")
+	}
+	return nil
+}
+
+// String returns the repository (or organization) and the environment (if any)
+func (t GithubSecretTarget) String() string {
+	if t.Repo == "" {
+		return "org:" + t.Owner
+	}
+	target := t.Owner + "/" + t.Repo
+	if t.Environment != "" {
+		target += "@" + t.Environment
+	}
+	return target
+}
+
+// path returns the API path of the target's secrets
+func (t GithubSecretTarget) path() string {
+	switch {
+	case t.Repo == "":
+		return fmt.Sprintf("orgs/%s/%s/secrets", url.PathEscape(t.Owner), t.app())
+	case t.Environment != "":
+		return fmt.Sprintf("repos/%s/%s/environments/%s/secrets", url.PathEscape(t.Owner), url.PathEscape(t.Repo), url.PathEscape(t.Environment))
+	default:
+		return fmt.Sprintf("repos/%s/%s/%s/secrets", url.PathEscape(t.Owner), url.PathEscape(t.Repo), t.app())
+	}
+}
+
+// GithubTargetSecretsService manages the secrets of repositories, environments and organizations
+// for Actions, Dependabot and Codespaces
+type GithubTargetSecretsService interface {
+	GetPublicKey(ctx context.Context, target GithubSecretTarget) (*github.PublicKey, error)
+	CreateOrUpdateSecret(ctx context.Context, target GithubSecretTarget, eSecret *github.EncryptedSecret) error
+	ListSecrets(ctx context.Context, target GithubSecretTarget) ([]*github.Secret, error)
+	DeleteSecret(ctx context.Context, target GithubSecretTarget, name string) error
+	RepositoryID(ctx context.Context, owner, repo string) (int64, error)
+}
+
+// GithubSecretOptions specifies which repositories may access organization secrets
+type GithubSecretOptions struct {
+	// Visibility is all, private (default) or selected
+	Visibility string `envconfig:"GITHUB_SECRET_VISIBILITY"`
+
+	// SelectedRepos are the names of the repositories allowed to access a secret with selected visibility
+	SelectedRepos []string `envconfig:"GITHUB_SELECTED_REPOS"`
+}
+
+// Validate checks the options of an organization secret
+func (o GithubSecretOptions) Validate() error {
+	switch o.Visibility {
+	case "", GithubVisibilityAll, GithubVisibilityPrivate:
+		if len(o.SelectedRepos) > 0 {
+			return fmt.Errorf("selected repositories require the %s visibility", GithubVisibilitySelected)
+		}
+	case GithubVisibilitySelected:
+		if len(o.SelectedRepos) == 0 {
+			return fmt.Errorf("the %s visibility requires at least one repository", GithubVisibilitySelected)
+		}
+	default:
+		return fmt.Errorf("unknown visibility %q (expected all, private or selected)", o.Visibility)
+	}
+	return nil
+}
+
+// GithubTargetSecretsStore implements a SecretsStore using the secrets of a GithubSecretTarget
+type GithubTargetSecretsStore struct {
+	client    GithubTargetSecretsService
+	target    GithubSecretTarget
+	layout    SecretLayout
+	options   GithubSecretOptions
+	publicKey *github.PublicKey
+}
+
+// NewGithubTargetSecretsStore returns a GithubTargetSecretsStore writing keys as described by layout.
+// The options are only used by organization secrets.
+func NewGithubTargetSecretsStore(client GithubTargetSecretsService, target GithubSecretTarget, layout SecretLayout, options GithubSecretOptions) *GithubTargetSecretsStore {
+	return &GithubTargetSecretsStore{
+		client:  client,
+		target:  target,
+		layout:  layout,
+		options: options,
+	}
+}
+
+// ListSecrets returns all secrets of the target
+func (s *GithubTargetSecretsStore) ListSecrets(ctx context.Context) ([]entity.AccessKey, error) {
+	secrets, err := s.client.ListSecrets(ctx, s.target)
+	if err != nil {
+		return nil, err
+	}
+
+	access_keys := make([]entity.AccessKey, 0, len(secrets))
+	for _, secret := range secrets {
+		access_keys = append(access_keys, entity.AccessKey{ID: secret.Name})
+	}
+	return access_keys, nil
+}
+
+// EncryptKey encrypts the secrets using the public key of the target
+func (s *GithubTargetSecretsStore) EncryptKey(ctx context.Context, k entity.AccessKey) (*entity.EncryptedKey, error) {
+	public_key, err := s.client.GetPublicKey(ctx, s.target)
+	if err != nil {
+		return nil, err
+	}
+	s.publicKey = public_key
+	return sealKey(public_key, s.layout, k)
+}
+
+// CreateSecret creates the secrets or updates them if they already exist
+func (s *GithubTargetSecretsStore) CreateSecret(ctx context.Context, k entity.EncryptedKey) error {
+	if s.publicKey == nil {
+		return fmt.Errorf("key has to be encrypted first")
+	}
+
+	secrets := k.Secrets
+	if len(secrets) == 0 {
+		secrets = []entity.EncryptedSecret{{Name: s.layout.Name, Value: k.Secret}}
+	}
+
+	// Organization secrets need a visibility
+	var visibility string
+	var selected github.SelectedRepoIDs
+	if s.target.Repo == "" {
+		visibility = valueOrDefault(s.options.Visibility, GithubVisibilityPrivate)
+		for _, repo := range s.options.SelectedRepos {
+			id, err := s.client.RepositoryID(ctx, s.target.Owner, repo)
+			if err != nil {
+				return fmt.Errorf("Couldn't look up repository %s: %s", repo, err)
+			}
+			selected = append(selected, id)
+		}
+	}
+
+	for _, secret := range secrets {
+		input := &github.EncryptedSecret{
+			Name:                  secret.Name,
+			EncryptedValue:        base64.StdEncoding.EncodeToString(secret.Value),
+			KeyID:                 s.publicKey.GetKeyID(),
+			Visibility:            visibility,
+			SelectedRepositoryIDs: selected,
+		}
+		err := s.client.CreateOrUpdateSecret(ctx, s.target, input)
+		if err != nil {
+			return fmt.Errorf("Couldn't write secret %s: %s", secret.Name, err)
+		}
+	}
+	return nil
+}
+
+// DeleteSecret
+func (s *GithubTargetSecretsStore) DeleteSecret(ctx context.Context, k entity.EncryptedKey) error {
+	return s.client.DeleteSecret(ctx, s.target, k.ID)
+}
+
+// Destination returns a human readable description of where secrets are stored
+func (s *GithubTargetSecretsStore) Destination() string {
+	kind := "github"
+	if s.target.app() != GithubAppActions {
+		kind += "-" + string(s.target.app())
+	}
+	return fmt.Sprintf("%s:%s/%s", kind, s.target, strings.Join(s.layout.Names(), ","))
+}
+
+// GithubClient implements GithubSecretsService (repository secrets of Actions) and
+// GithubTargetSecretsService. The latter isn't covered by go-github (yet), so the
+// requests are built by hand.
+type GithubClient struct {
+	*github.ActionsService
+	client *github.Client
+}
+
+// newGithubClient wraps a go-github client
+func newGithubClient(client *github.Client) *GithubClient {
+	return &GithubClient{ActionsService: client.Actions, client: client}
+}
+
+// GetPublicKey returns the public key used to encrypt secrets of the target
+func (c *GithubClient) GetPublicKey(ctx context.Context, target GithubSecretTarget) (*github.PublicKey, error) {
+	var public_key github.PublicKey
+	err := c.do(ctx, http.MethodGet, target.path()+"/public-key", nil, &public_key)
+	if err != nil {
+		return nil, err
+	}
+	return &public_key, nil
+}
+
+// CreateOrUpdateSecret writes an encrypted secret
+func (c *GithubClient) CreateOrUpdateSecret(ctx context.Context, target GithubSecretTarget, eSecret *github.EncryptedSecret) error {
+	return c.do(ctx, http.MethodPut, target.path()+"/"+url.PathEscape(eSecret.Name), eSecret, nil)
+}
+
+// ListSecrets returns all secrets of the target (without values)
+func (c *GithubClient) ListSecrets(ctx context.Context, target GithubSecretTarget) ([]*github.Secret, error) {
+	var secrets []*github.Secret
+	for page := 1; page != 0; {
+		var results github.Secrets
+		path := fmt.Sprintf("%s?per_page=100&page=%d", target.path(), page)
+		req, err := c.client.NewRequest(http.MethodGet, path, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := c.client.Do(ctx, req, &results)
+		if err != nil {
+			return nil, err
+		}
+		secrets = append(secrets, results.Secrets...)
+		page = resp.NextPage
+	}
+	return secrets, nil
+}
+
+// DeleteSecret deletes a secret
+func (c *GithubClient) DeleteSecret(ctx context.Context, target GithubSecretTarget, name string) error {
+	return c.do(ctx, http.MethodDelete, target.path()+"/"+url.PathEscape(name), nil, nil)
+}
+
+// RepositoryID returns the numeric ID of a repository
+func (c *GithubClient) RepositoryID(ctx context.Context, owner, repo string) (int64, error) {
+	repository, _, err := c.client.Repositories.Get(ctx, owner, repo)
+	if err != nil {
+		return 0, err
+	}
+	return repository.GetID(), nil
+}
+
+// do sends a request to the API and decodes the response into result (if not nil)
+func (c *GithubClient) do(ctx context.Context, method, path string, body, result interface{}) error {
+	req, err := c.client.NewRequest(method, path, body)
+	if err != nil {
+		return err
+	}
+	_, err = c.client.Do(ctx, req, result)
+	return err
+}
@@ -0,0 +1,170 @@
+package secretsstore
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/alecthomas/assert"
+	"github.com/dorneanu/go-key-rotator/entity"
+	"github.com/google/go-github/v34/github"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// fakeGithub implements the secrets endpoints of the Github API in memory
+type fakeGithub struct {
+	mu         sync.Mutex
+	publicKey  *[32]byte
+	privateKey *[32]byte
+	secrets    map[string]map[string]github.EncryptedSecret // secrets path -> name -> secret
+	repoIDs    map[string]int64
+}
+
+func newFakeGithub(t *testing.T) (*fakeGithub, *GithubClient, func()) {
+	publicKey, privateKey, err := box.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+
+	fake := &fakeGithub{
+		publicKey:  publicKey,
+		privateKey: privateKey,
+		secrets:    make(map[string]map[string]github.EncryptedSecret),
+		repoIDs:    map[string]int64{"dorneanu/infra": 42, "dorneanu/app": 43},
+	}
+	server := httptest.NewServer(fake)
+
+	client := github.NewClient(server.Client())
+	client.BaseURL, _ = url.Parse(server.URL + "/")
+	return fake, newGithubClient(client), server.Close
+}
+
+func (f *fakeGithub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	path := strings.TrimPrefix(r.URL.EscapedPath(), "/")
+	if id, ok := f.repoIDs[strings.TrimPrefix(path, "repos/")]; ok {
+		json.NewEncoder(w).Encode(map[string]int64{"id": id})
+		return
+	}
+
+	index := strings.LastIndex(path, "/secrets")
+	if index < 0 {
+		http.NotFound(w, r)
+		return
+	}
+	secretsPath, name := path[:index+len("/secrets")], strings.TrimPrefix(path[index+len("/secrets"):], "/")
+
+	switch {
+	case name == "public-key":
+		json.NewEncoder(w).Encode(map[string]string{"key_id": "KEY-ID", "key": base64.StdEncoding.EncodeToString(f.publicKey[:])})
+	case name == "" && r.Method == http.MethodGet:
+		var secrets []map[string]string
+		for n := range f.secrets[secretsPath] {
+			secrets = append(secrets, map[string]string{"name": n})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"total_count": len(secrets), "secrets": secrets})
+	case r.Method == http.MethodPut:
+		var secret github.EncryptedSecret
+		json.NewDecoder(r.Body).Decode(&secret)
+		if f.secrets[secretsPath] == nil {
+			f.secrets[secretsPath] = make(map[string]github.EncryptedSecret)
+		}
+		f.secrets[secretsPath][name] = secret
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodDelete:
+		delete(f.secrets[secretsPath], name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// decrypt opens the sealed box of a secret
+func (f *fakeGithub) decrypt(t *testing.T, secret github.EncryptedSecret) string {
+	sealed, err := base64.StdEncoding.DecodeString(secret.EncryptedValue)
+	assert.Nil(t, err)
+	value, ok := box.OpenAnonymous(nil, sealed, f.publicKey, f.privateKey)
+	assert.True(t, ok)
+	return string(value)
+}
+
+func TestGithubTargetSecretsStore_CreateSecret(t *testing.T) {
+	fake, client, closeServer := newFakeGithub(t)
+	defer closeServer()
+
+	key := entity.AccessKey{ID: "AKIAEXAMPLE", Secret: "SECRET"}
+	for _, tc := range []struct {
+		target      GithubSecretTarget
+		options     GithubSecretOptions
+		destination string
+		path        string
+		visibility  string
+		selected    github.SelectedRepoIDs
+	}{
+		{
+			target:      GithubSecretTarget{Owner: "dorneanu", Repo: "app", Environment: "production"},
+			destination: "github:dorneanu/app@production/AWS_KEY",
+			path:        "repos/dorneanu/app/environments/production/secrets",
+		},
+		{
+			target:      GithubSecretTarget{Owner: "dorneanu", Repo: "app", App: GithubAppDependabot},
+			destination: "github-dependabot:dorneanu/app/AWS_KEY",
+			path:        "repos/dorneanu/app/dependabot/secrets",
+		},
+		{
+			target:      GithubSecretTarget{Owner: "dorneanu", App: GithubAppCodespaces},
+			destination: "github-codespaces:org:dorneanu/AWS_KEY",
+			path:        "orgs/dorneanu/codespaces/secrets",
+			visibility:  GithubVisibilityPrivate,
+		},
+		{
+			target:      GithubSecretTarget{Owner: "dorneanu"},
+			options:     GithubSecretOptions{Visibility: GithubVisibilitySelected, SelectedRepos: []string{"infra", "app"}},
+			destination: "github:org:dorneanu/AWS_KEY",
+			path:        "orgs/dorneanu/actions/secrets",
+			visibility:  GithubVisibilitySelected,
+			selected:    github.SelectedRepoIDs{42, 43},
+		},
+	} {
+		t.Run(tc.destination, func(t *testing.T) {
+			assert.Nil(t, tc.target.Validate())
+			store := NewGithubTargetSecretsStore(client, tc.target, SecretLayout{Name: "AWS_KEY"}, tc.options)
+			assert.Equal(t, tc.destination, store.Destination())
+
+			encrypted_key, err := store.EncryptKey(context.TODO(), key)
+			assert.Nil(t, err)
+			assert.Nil(t, store.CreateSecret(context.TODO(), *encrypted_key))
+
+			secret := fake.secrets[tc.path]["AWS_KEY"]
+			assert.Equal(t, "KEY-ID", secret.KeyID)
+			assert.Equal(t, tc.visibility, secret.Visibility)
+			assert.Equal(t, tc.selected, secret.SelectedRepositoryIDs)
+			assert.Equal(t, "SECRET", fake.decrypt(t, secret))
+
+			secrets, err := store.ListSecrets(context.TODO())
+			assert.Nil(t, err)
+			assert.Equal(t, []entity.AccessKey{{ID: "AWS_KEY"}}, secrets)
+
+			assert.Nil(t, store.DeleteSecret(context.TODO(), entity.EncryptedKey{ID: "AWS_KEY"}))
+			assert.Equal(t, 0, len(fake.secrets[tc.path]))
+		})
+	}
+}
+
+func TestGithubSecretTarget_Validate(t *testing.T) {
+	assert.Error(t, GithubSecretTarget{Owner: "dorneanu", Environment: "production"}.Validate())
+	assert.Error(t, GithubSecretTarget{Owner: "dorneanu", Repo: "app", Environment: "production", App: GithubAppDependabot}.Validate())
+	assert.Error(t, GithubSecretTarget{Owner: "dorneanu", App: "packages"}.Validate())
+
+	assert.Nil(t, GithubSecretOptions{Visibility: GithubVisibilityAll}.Validate())
+	assert.Error(t, GithubSecretOptions{Visibility: GithubVisibilitySelected}.Validate())
+	assert.Error(t, GithubSecretOptions{SelectedRepos: []string{"app"}}.Validate())
+	assert.Error(t, GithubSecretOptions{Visibility: "internal"}.Validate())
+}
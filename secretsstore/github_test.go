@@ -3,6 +3,7 @@ package secretsstore
 import (
 	"context"
 	"crypto/rand"
+	"encoding/base64"
 	"testing"
 	"time"
 
@@ -187,3 +188,46 @@ func TestGithubSecretsStore_DeleteSecret(t *testing.T) {
 	err := github_store.DeleteSecret(context.TODO(), encrypted_key)
 	assert.Nil(t, err)
 }
+
+func TestGithubSecretsStore_Destination(t *testing.T) {
+	github_store := NewGithubSecretsStore(&mocks.GithubSecretsService{}, "dorneanu", "test", "SECRET")
+	assert.Equal(t, "github:dorneanu/test/SECRET", github_store.Destination())
+}
+
+func TestGithubSecretsStore_SeparateSecrets(t *testing.T) {
+	mock_secretsservice := &mocks.GithubSecretsService{}
+	github_store := NewGithubSecretsStoreWithLayout(mock_secretsservice, "dorneanu", "test", SecretLayout{
+		Format: SecretFormatSeparate,
+		IDName: "AWS_ACCESS_KEY_ID",
+		Name:   "AWS_SECRET_ACCESS_KEY",
+	})
+	assert.Equal(t, "github:dorneanu/test/AWS_ACCESS_KEY_ID,AWS_SECRET_ACCESS_KEY", github_store.Destination())
+
+	public_key, private_key, _ := box.GenerateKey(rand.Reader)
+	pk_id := "secret"
+	pk_secret := string(public_key[:])
+	mock_secretsservice.On("GetRepoPublicKey", mock.Anything, "dorneanu", "test").
+		Return(&github.PublicKey{KeyID: &pk_id, Key: &pk_secret}, &github.Response{}, nil).Once()
+
+	// Both secrets are written
+	written := make(map[string]string)
+	mock_secretsservice.On("CreateOrUpdateRepoSecret", mock.Anything, "dorneanu", "test", mock.AnythingOfType("*github.EncryptedSecret")).
+		Run(func(args mock.Arguments) {
+			secret := args.Get(3).(*github.EncryptedSecret)
+			encrypted, _ := base64.StdEncoding.DecodeString(secret.EncryptedValue)
+			decrypted, ok := box.OpenAnonymous(nil, encrypted, public_key, private_key)
+			assert.True(t, ok)
+			written[secret.Name] = string(decrypted)
+		}).
+		Return(&github.Response{}, nil).Twice()
+
+	encrypted_key, err := github_store.EncryptKey(context.TODO(), entity.AccessKey{ID: "AKIAEXAMPLE", Secret: "SUPER SECRET VALUE"})
+	assert.Nil(t, err)
+	err = github_store.CreateSecret(context.TODO(), *encrypted_key)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{
+		"AWS_ACCESS_KEY_ID":     "AKIAEXAMPLE",
+		"AWS_SECRET_ACCESS_KEY": "SUPER SECRET VALUE",
+	}, written)
+	mock_secretsservice.AssertExpectations(t)
+}
@@ -0,0 +1,322 @@
+package secretsstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/dorneanu/go-key-rotator/entity"
+)
+
+// DefaultGitlabURL is used if no GitLab instance is specified
+const DefaultGitlabURL = "https://gitlab.com"
+
+// ErrGitlabVariableNotFound is returned if a CI/CD variable doesn't exist
+var ErrGitlabVariableNotFound = errors.New("variable not found")
+
+// GitlabTarget specifies the project or the group whose CI/CD variables are managed.
+// Project and Group are either numeric IDs or full paths (e.g. dorneanu/access-key-rotator).
+type GitlabTarget struct {
+	Project string
+	Group   string
+}
+
+// String returns the project (or group) path
+func (t GitlabTarget) String() string {
+	if t.Project != "" {
+		return t.Project
+	}
+	return "group:" + t.Group
+}
+
+// path returns the API path of the target
+func (t GitlabTarget) path() string {
+	if t.Project != "" {
+		return "projects/" + escapePathSegment(t.Project)
+	}
+	return "groups/" + escapePathSegment(t.Group)
+}
+
+// GitlabVariable represents a CI/CD variable
+type GitlabVariable struct {
+	Key              string `json:"key"`
+	Value            string `json:"value"`
+	VariableType     string `json:"variable_type,omitempty"`
+	Protected        bool   `json:"protected"`
+	Masked           bool   `json:"masked"`
+	EnvironmentScope string `json:"environment_scope,omitempty"`
+}
+
+// GitlabVariablesService manages the CI/CD variables of GitLab projects and groups
+type GitlabVariablesService interface {
+	ListVariables(ctx context.Context, target GitlabTarget) ([]GitlabVariable, error)
+	CreateVariable(ctx context.Context, target GitlabTarget, variable GitlabVariable) error
+	UpdateVariable(ctx context.Context, target GitlabTarget, variable GitlabVariable) error
+	DeleteVariable(ctx context.Context, target GitlabTarget, key, environmentScope string) error
+}
+
+// GitlabVariableOptions holds the flags every variable written by a GitlabSecretsStore gets
+type GitlabVariableOptions struct {
+	Masked    bool `envconfig:"GITLAB_VARIABLE_MASKED"`
+	Protected bool `envconfig:"GITLAB_VARIABLE_PROTECTED"`
+
+	// EnvironmentScope limits the variable to some environments (default: all)
+	EnvironmentScope string `envconfig:"GITLAB_ENVIRONMENT_SCOPE"`
+}
+
+// GitlabSecretsStore implements a SecretsStore using GitLab CI/CD variables
+type GitlabSecretsStore struct {
+	client  GitlabVariablesService
+	target  GitlabTarget
+	layout  SecretLayout
+	options GitlabVariableOptions
+}
+
+// NewGitlabSecretsStore returns a GitlabSecretsStore writing keys as described by layout
+func NewGitlabSecretsStore(client GitlabVariablesService, target GitlabTarget, layout SecretLayout, options GitlabVariableOptions) *GitlabSecretsStore {
+	return &GitlabSecretsStore{
+		client:  client,
+		target:  target,
+		layout:  layout,
+		options: options,
+	}
+}
+
+// ListSecrets
+func (s *GitlabSecretsStore) ListSecrets(ctx context.Context) ([]entity.AccessKey, error) {
+	variables, err := s.client.ListVariables(ctx, s.target)
+	if err != nil {
+		return nil, err
+	}
+
+	access_keys := make([]entity.AccessKey, 0, len(variables))
+	for _, variable := range variables {
+		access_keys = append(access_keys, entity.AccessKey{ID: variable.Key})
+	}
+	return access_keys, nil
+}
+
+// EncryptKey renders the variables to be written. GitLab doesn't support client side
+// encryption, the values are only protected by TLS.
+func (s *GitlabSecretsStore) EncryptKey(ctx context.Context, k entity.AccessKey) (*entity.EncryptedKey, error) {
+	values, err := s.layout.Values(k)
+	if err != nil {
+		return nil, err
+	}
+
+	encrypted_key := &entity.EncryptedKey{ID: k.ID}
+	for _, value := range values {
+		encrypted_key.Secrets = append(encrypted_key.Secrets, entity.EncryptedSecret{Name: value.Name, Value: []byte(value.Value)})
+	}
+	if len(encrypted_key.Secrets) == 1 {
+		encrypted_key.Secret = encrypted_key.Secrets[0].Value
+	}
+	return encrypted_key, nil
+}
+
+// CreateSecret creates the variables or updates them if they already exist
+func (s *GitlabSecretsStore) CreateSecret(ctx context.Context, k entity.EncryptedKey) error {
+	secrets := k.Secrets
+	if len(secrets) == 0 {
+		secrets = []entity.EncryptedSecret{{Name: s.layout.Name, Value: k.Secret}}
+	}
+
+	for _, secret := range secrets {
+		variable := GitlabVariable{
+			Key:              secret.Name,
+			Value:            string(secret.Value),
+			VariableType:     "env_var",
+			Protected:        s.options.Protected,
+			Masked:           s.options.Masked,
+			EnvironmentScope: s.options.EnvironmentScope,
+		}
+
+		err := s.client.UpdateVariable(ctx, s.target, variable)
+		if errors.Is(err, ErrGitlabVariableNotFound) {
+			err = s.client.CreateVariable(ctx, s.target, variable)
+		}
+		if err != nil {
+			return fmt.Errorf("Couldn't write variable %s: %s", secret.Name, err)
+		}
+	}
+	return nil
+}
+
+// SnapshotSecrets returns the current values of the variables named by the layout
+// (within the environment scope of the store)
+func (s *GitlabSecretsStore) SnapshotSecrets(ctx context.Context) (SecretsSnapshot, error) {
+	variables, err := s.client.ListVariables(ctx, s.target)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := make(SecretsSnapshot)
+	for _, name := range s.layout.Names() {
+		for _, variable := range variables {
+			if variable.Key == name && sameEnvironmentScope(variable.EnvironmentScope, s.options.EnvironmentScope) {
+				snapshot[name] = []byte(variable.Value)
+			}
+		}
+	}
+	return snapshot, nil
+}
+
+// RestoreSecrets writes the values of a snapshot back. Variables missing within the snapshot are removed.
+func (s *GitlabSecretsStore) RestoreSecrets(ctx context.Context, snapshot SecretsSnapshot) error {
+	for _, name := range s.layout.Names() {
+		value, ok := snapshot[name]
+		if !ok {
+			err := s.client.DeleteVariable(ctx, s.target, name, s.options.EnvironmentScope)
+			if err != nil && !errors.Is(err, ErrGitlabVariableNotFound) {
+				return fmt.Errorf("Couldn't delete variable %s: %s", name, err)
+			}
+			continue
+		}
+
+		err := s.CreateSecret(ctx, entity.EncryptedKey{Secrets: []entity.EncryptedSecret{{Name: name, Value: value}}})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteSecret
+func (s *GitlabSecretsStore) DeleteSecret(ctx context.Context, k entity.EncryptedKey) error {
+	return s.client.DeleteVariable(ctx, s.target, k.ID, s.options.EnvironmentScope)
+}
+
+// Destination returns a human readable description of where secrets are stored
+func (s *GitlabSecretsStore) Destination() string {
+	destination := fmt.Sprintf("gitlab:%s/%s", s.target, strings.Join(s.layout.Names(), ","))
+	if s.options.EnvironmentScope != "" && s.options.EnvironmentScope != "*" {
+		destination += "@" + s.options.EnvironmentScope
+	}
+	return destination
+}
+
+// GitlabClient implements GitlabVariablesService using the GitLab REST API (v4)
+type GitlabClient struct {
+	baseURL    string
+	token      string
+	httpClient *http.Client
+}
+
+// NewGitlabClient returns a client for the GitLab instance at baseURL (e.g. https://gitlab.com)
+// authenticating with a personal, group or project access token
+func NewGitlabClient(baseURL, token string) *GitlabClient {
+	if baseURL == "" {
+		baseURL = DefaultGitlabURL
+	}
+	return &GitlabClient{
+		baseURL:    strings.TrimSuffix(baseURL, "/") + "/api/v4",
+		token:      token,
+		httpClient: &http.Client{Timeout: time.Second * 10},
+	}
+}
+
+// ListVariables returns all variables of the target
+func (c *GitlabClient) ListVariables(ctx context.Context, target GitlabTarget) ([]GitlabVariable, error) {
+	var variables []GitlabVariable
+	page := "1"
+	for page != "" {
+		var results []GitlabVariable
+		header, err := c.do(ctx, http.MethodGet, target.path()+"/variables?per_page=100&page="+page, nil, &results)
+		if err != nil {
+			return nil, err
+		}
+		variables = append(variables, results...)
+		page = header.Get("X-Next-Page")
+	}
+	return variables, nil
+}
+
+// CreateVariable creates a new variable
+func (c *GitlabClient) CreateVariable(ctx context.Context, target GitlabTarget, variable GitlabVariable) error {
+	_, err := c.do(ctx, http.MethodPost, target.path()+"/variables", variable, nil)
+	return err
+}
+
+// UpdateVariable updates an existing variable. ErrGitlabVariableNotFound is returned if it doesn't exist.
+func (c *GitlabClient) UpdateVariable(ctx context.Context, target GitlabTarget, variable GitlabVariable) error {
+	path := target.path() + "/variables/" + escapePathSegment(variable.Key) + environmentFilter(variable.EnvironmentScope)
+	_, err := c.do(ctx, http.MethodPut, path, variable, nil)
+	return err
+}
+
+// DeleteVariable deletes a variable
+func (c *GitlabClient) DeleteVariable(ctx context.Context, target GitlabTarget, key, environmentScope string) error {
+	path := target.path() + "/variables/" + escapePathSegment(key) + environmentFilter(environmentScope)
+	_, err := c.do(ctx, http.MethodDelete, path, nil, nil)
+	return err
+}
+
+// do sends a request to the API and decodes the response into result (if not nil)
+func (c *GitlabClient) do(ctx context.Context, method, path string, body, result interface{}) (http.Header, error) {
+	var reqBody io.Reader
+	if body != nil {
+		payload, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reqBody = bytes.NewReader(payload)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+"/"+path, reqBody)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("PRIVATE-TOKEN", c.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%s %s: %w", method, path, ErrGitlabVariableNotFound)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(message)))
+	}
+
+	if result != nil {
+		err = json.NewDecoder(resp.Body).Decode(result)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't decode response: %s", err)
+		}
+	}
+	return resp.Header, nil
+}
+
+// escapePathSegment escapes a value (e.g. a project path) to be used as single URL path segment
+func escapePathSegment(value string) string {
+	return url.PathEscape(value)
+}
+
+// sameEnvironmentScope checks whether two environment scopes are the same. Variables without
+// a scope are available in all environments (*).
+func sameEnvironmentScope(a, b string) bool {
+	return valueOrDefault(a, "*") == valueOrDefault(b, "*")
+}
+
+// environmentFilter selects a variable by its environment scope (if any)
+func environmentFilter(environmentScope string) string {
+	if environmentScope == "" {
+		return ""
+	}
+	return "?filter%5Benvironment_scope%5D=" + url.QueryEscape(environmentScope)
+}
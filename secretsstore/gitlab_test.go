@@ -0,0 +1,213 @@
+package secretsstore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/alecthomas/assert"
+	"github.com/dorneanu/go-key-rotator/entity"
+)
+
+// fakeGitlab implements the CI/CD variables endpoints of the GitLab API in memory
+type fakeGitlab struct {
+	mu        sync.Mutex
+	token     string
+	variables map[string]map[string]GitlabVariable // target path -> key -> variable
+}
+
+func newFakeGitlab(token string) (*fakeGitlab, *httptest.Server) {
+	fake := &fakeGitlab{token: token, variables: make(map[string]map[string]GitlabVariable)}
+	return fake, httptest.NewServer(fake)
+}
+
+func (f *fakeGitlab) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.Header.Get("PRIVATE-TOKEN") != f.token {
+		http.Error(w, `{"message":"401 Unauthorized"}`, http.StatusUnauthorized)
+		return
+	}
+
+	// /api/v4/<projects|groups>/<id>/variables[/<key>]
+	parts := strings.Split(strings.TrimPrefix(r.URL.EscapedPath(), "/api/v4/"), "/")
+	if len(parts) < 3 || parts[2] != "variables" {
+		http.NotFound(w, r)
+		return
+	}
+	target := parts[0] + "/" + parts[1]
+	if f.variables[target] == nil {
+		f.variables[target] = make(map[string]GitlabVariable)
+	}
+	variables := f.variables[target]
+
+	switch {
+	case len(parts) == 3 && r.Method == http.MethodGet:
+		list := make([]GitlabVariable, 0, len(variables))
+		for _, v := range variables {
+			list = append(list, v)
+		}
+		json.NewEncoder(w).Encode(list)
+	case len(parts) == 3 && r.Method == http.MethodPost:
+		var v GitlabVariable
+		json.NewDecoder(r.Body).Decode(&v)
+		if _, ok := variables[v.Key]; ok {
+			http.Error(w, `{"message":{"key":["has already been taken"]}}`, http.StatusBadRequest)
+			return
+		}
+		variables[v.Key] = v
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(v)
+	case len(parts) == 4:
+		v, ok := variables[parts[3]]
+		if !ok {
+			http.Error(w, `{"message":"404 Variable Not Found"}`, http.StatusNotFound)
+			return
+		}
+		switch r.Method {
+		case http.MethodPut:
+			json.NewDecoder(r.Body).Decode(&v)
+			variables[v.Key] = v
+			json.NewEncoder(w).Encode(v)
+		case http.MethodDelete:
+			delete(variables, v.Key)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestGitlabSecretsStore_CreateSecret(t *testing.T) {
+	fake, server := newFakeGitlab("TOKEN")
+	defer server.Close()
+
+	target := GitlabTarget{Project: "dorneanu/access-key-rotator"}
+	store := NewGitlabSecretsStore(NewGitlabClient(server.URL, "TOKEN"), target, SecretLayout{
+		Format: SecretFormatSeparate,
+		IDName: "AWS_ACCESS_KEY_ID",
+		Name:   "AWS_SECRET_ACCESS_KEY",
+	}, GitlabVariableOptions{Masked: true, Protected: true, EnvironmentScope: "production"})
+	assert.Equal(t, "gitlab:dorneanu/access-key-rotator/AWS_ACCESS_KEY_ID,AWS_SECRET_ACCESS_KEY@production", store.Destination())
+
+	// Variables are created first and updated afterwards
+	for _, key := range []entity.AccessKey{
+		{ID: "AKIAFIRST", Secret: "first-secret-value"},
+		{ID: "AKIASECOND", Secret: "second-secret-value"},
+	} {
+		encrypted_key, err := store.EncryptKey(context.TODO(), key)
+		assert.Nil(t, err)
+		err = store.CreateSecret(context.TODO(), *encrypted_key)
+		assert.Nil(t, err)
+	}
+
+	variables := fake.variables["projects/dorneanu%2Faccess-key-rotator"]
+	assert.Equal(t, 2, len(variables))
+	assert.Equal(t, GitlabVariable{
+		Key:              "AWS_ACCESS_KEY_ID",
+		Value:            "AKIASECOND",
+		VariableType:     "env_var",
+		Protected:        true,
+		Masked:           true,
+		EnvironmentScope: "production",
+	}, variables["AWS_ACCESS_KEY_ID"])
+	assert.Equal(t, "second-secret-value", variables["AWS_SECRET_ACCESS_KEY"].Value)
+
+	secrets, err := store.ListSecrets(context.TODO())
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(secrets))
+
+	err = store.DeleteSecret(context.TODO(), entity.EncryptedKey{ID: "AWS_ACCESS_KEY_ID"})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(variables))
+}
+
+func TestGitlabSecretsStore_RestoreSecrets(t *testing.T) {
+	fake, server := newFakeGitlab("TOKEN")
+	defer server.Close()
+
+	store := NewGitlabSecretsStore(NewGitlabClient(server.URL, "TOKEN"), GitlabTarget{Group: "platform"}, SecretLayout{
+		Format: SecretFormatSeparate,
+		IDName: "AWS_ACCESS_KEY_ID",
+		Name:   "AWS_SECRET_ACCESS_KEY",
+	}, GitlabVariableOptions{Masked: true})
+	write := func(id string) {
+		encrypted_key, err := store.EncryptKey(context.TODO(), entity.AccessKey{ID: id, Secret: "secret-" + id})
+		assert.Nil(t, err)
+		assert.Nil(t, store.CreateSecret(context.TODO(), *encrypted_key))
+	}
+
+	// The variables didn't exist before, so they are deleted again
+	snapshot, err := store.SnapshotSecrets(context.TODO())
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(snapshot))
+	write("AKIAFIRST")
+	assert.Nil(t, store.RestoreSecrets(context.TODO(), snapshot))
+	assert.Equal(t, 0, len(fake.variables["groups/platform"]))
+
+	// Previous values are written back, other variables and other scopes are kept
+	write("AKIAFIRST")
+	fake.variables["groups/platform"]["REGION"] = GitlabVariable{Key: "REGION", Value: "eu-central-1"}
+	snapshot, err = store.SnapshotSecrets(context.TODO())
+	assert.Nil(t, err)
+	assert.Equal(t, SecretsSnapshot{
+		"AWS_ACCESS_KEY_ID":     []byte("AKIAFIRST"),
+		"AWS_SECRET_ACCESS_KEY": []byte("secret-AKIAFIRST"),
+	}, snapshot)
+	write("AKIASECOND")
+	assert.Nil(t, store.RestoreSecrets(context.TODO(), snapshot))
+
+	variables := fake.variables["groups/platform"]
+	assert.Equal(t, 3, len(variables))
+	assert.Equal(t, "AKIAFIRST", variables["AWS_ACCESS_KEY_ID"].Value)
+	assert.Equal(t, "secret-AKIAFIRST", variables["AWS_SECRET_ACCESS_KEY"].Value)
+	assert.True(t, variables["AWS_SECRET_ACCESS_KEY"].Masked)
+	assert.Equal(t, "eu-central-1", variables["REGION"].Value)
+
+	// Variables of other environments aren't part of the snapshot
+	production := NewGitlabSecretsStore(NewGitlabClient(server.URL, "TOKEN"), GitlabTarget{Group: "platform"},
+		SecretLayout{Name: "AWS_SECRET_ACCESS_KEY"}, GitlabVariableOptions{EnvironmentScope: "production"})
+	snapshot, err = production.SnapshotSecrets(context.TODO())
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(snapshot))
+}
+
+func TestGitlabSecretsStore_GroupVariables(t *testing.T) {
+	fake, server := newFakeGitlab("TOKEN")
+	defer server.Close()
+
+	store := NewGitlabSecretsStore(NewGitlabClient(server.URL, "TOKEN"), GitlabTarget{Group: "platform"},
+		SecretLayout{Name: "AWS_SECRET"}, GitlabVariableOptions{})
+	assert.Equal(t, "gitlab:group:platform/AWS_SECRET", store.Destination())
+
+	encrypted_key, err := store.EncryptKey(context.TODO(), entity.AccessKey{ID: "AKIAEXAMPLE", Secret: "SECRET"})
+	assert.Nil(t, err)
+	assert.Nil(t, store.CreateSecret(context.TODO(), *encrypted_key))
+	assert.Equal(t, "SECRET", fake.variables["groups/platform"]["AWS_SECRET"].Value)
+}
+
+func TestGitlabClient_Errors(t *testing.T) {
+	_, server := newFakeGitlab("TOKEN")
+	defer server.Close()
+
+	target := GitlabTarget{Project: "42"}
+
+	t.Run("Invalid token", func(t *testing.T) {
+		client := NewGitlabClient(server.URL, "WRONG")
+		_, err := client.ListVariables(context.TODO(), target)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "401")
+	})
+
+	t.Run("Missing variable", func(t *testing.T) {
+		client := NewGitlabClient(server.URL, "TOKEN")
+		err := client.UpdateVariable(context.TODO(), target, GitlabVariable{Key: "MISSING"})
+		assert.True(t, errors.Is(err, ErrGitlabVariableNotFound))
+	})
+}
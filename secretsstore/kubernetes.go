@@ -0,0 +1,534 @@
+package secretsstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dorneanu/go-key-rotator/entity"
+)
+
+// ErrKubernetesNotFound is returned if a Kubernetes object doesn't exist
+var ErrKubernetesNotFound = errors.New("object not found")
+
+// Labels and annotations used by a KubernetesSecretsStore
+const (
+	// KubernetesManagedByLabel is set on every secret written by the rotator
+	KubernetesManagedByLabel = "app.kubernetes.io/managed-by"
+	KubernetesManagedBy      = "access-key-rotator"
+
+	// KubernetesRestartAnnotation marks Deployments which should be restarted once the
+	// secret(s) listed in its value (comma separated) have been rotated
+	KubernetesRestartAnnotation = "access-key-rotator/restart-on-rotation"
+
+	// KubernetesRestartedAtAnnotation is set on the pod template to trigger a rollout (like kubectl rollout restart)
+	KubernetesRestartedAtAnnotation = "kubectl.kubernetes.io/restartedAt"
+
+	KubernetesKeyIDAnnotation     = "access-key-rotator/key-id"
+	KubernetesProviderAnnotation  = "access-key-rotator/source-provider"
+	KubernetesRotatedAtAnnotation = "access-key-rotator/rotated-at"
+)
+
+// KubernetesObjectMeta holds the metadata of a Kubernetes object
+type KubernetesObjectMeta struct {
+	Name              string            `json:"name"`
+	Namespace         string            `json:"namespace,omitempty"`
+	Labels            map[string]string `json:"labels,omitempty"`
+	Annotations       map[string]string `json:"annotations,omitempty"`
+	ResourceVersion   string            `json:"resourceVersion,omitempty"`
+	CreationTimestamp *time.Time        `json:"creationTimestamp,omitempty"`
+}
+
+// KubernetesSecret represents a core/v1 Secret. Data is base64 encoded by the JSON encoder.
+type KubernetesSecret struct {
+	APIVersion string               `json:"apiVersion"`
+	Kind       string               `json:"kind"`
+	Metadata   KubernetesObjectMeta `json:"metadata"`
+	Type       string               `json:"type,omitempty"`
+	Data       map[string][]byte    `json:"data,omitempty"`
+}
+
+// KubernetesSecretPatch changes the data keys, labels and annotations owned by the rotator.
+// Everything else of the secret is left untouched. Data keys with a nil value are removed.
+type KubernetesSecretPatch struct {
+	Labels      map[string]string
+	Annotations map[string]string
+	Data        map[string][]byte
+}
+
+// KubernetesDeployment holds the metadata of an apps/v1 Deployment
+type KubernetesDeployment struct {
+	Metadata KubernetesObjectMeta `json:"metadata"`
+}
+
+// KubernetesService manages secrets within a Kubernetes cluster and restarts the Deployments using them
+type KubernetesService interface {
+	GetSecret(ctx context.Context, namespace, name string) (*KubernetesSecret, error)
+	CreateSecret(ctx context.Context, secret *KubernetesSecret) error
+	PatchSecret(ctx context.Context, namespace, name string, patch KubernetesSecretPatch) error
+	DeleteSecret(ctx context.Context, namespace, name string) error
+	ListDeployments(ctx context.Context, namespace string) ([]KubernetesDeployment, error)
+	RestartDeployment(ctx context.Context, namespace, name string, at time.Time) error
+}
+
+// KubernetesSecretOptions specifies where secrets are written to and which metadata they get
+type KubernetesSecretOptions struct {
+	Namespace   string            `envconfig:"KUBERNETES_NAMESPACE" default:"default"`
+	Labels      map[string]string `envconfig:"KUBERNETES_SECRET_LABELS"`
+	Annotations map[string]string `envconfig:"KUBERNETES_SECRET_ANNOTATIONS"`
+
+	// RestartDeployments triggers a rollout of all Deployments (within the namespace)
+	// annotated with KubernetesRestartAnnotation once a secret was written
+	RestartDeployments bool `envconfig:"KUBERNETES_RESTART_DEPLOYMENTS"`
+}
+
+// KubernetesSecretsStore implements a SecretsStore using Kubernetes secrets.
+// Every key is written to a single secret (named by the layout) whose data keys
+// hold the ID and the secret of the key. Other data keys of the secret are kept.
+type KubernetesSecretsStore struct {
+	client  KubernetesService
+	layout  SecretLayout
+	options KubernetesSecretOptions
+	now     func() time.Time
+}
+
+// NewKubernetesSecretsStore returns a KubernetesSecretsStore writing keys to the secret specified by layout
+func NewKubernetesSecretsStore(client KubernetesService, layout SecretLayout, options KubernetesSecretOptions) *KubernetesSecretsStore {
+	if options.Namespace == "" {
+		options.Namespace = "default"
+	}
+	return &KubernetesSecretsStore{
+		client:  client,
+		layout:  layout,
+		options: options,
+		now:     time.Now,
+	}
+}
+
+// dataKeys returns the data keys holding ID and secret. Secrets are mostly consumed
+// as environment variables, so the env names are used unless the json format is chosen.
+func (s *KubernetesSecretsStore) dataKeys() (string, string) {
+	if s.layout.Format == SecretFormatJSON {
+		return valueOrDefault(s.layout.IDKey, DefaultJSONIDKey), valueOrDefault(s.layout.SecretKey, DefaultJSONSecretKey)
+	}
+	return valueOrDefault(s.layout.IDKey, DefaultEnvIDKey), valueOrDefault(s.layout.SecretKey, DefaultEnvSecretKey)
+}
+
+// ListSecrets returns the secret if it exists
+func (s *KubernetesSecretsStore) ListSecrets(ctx context.Context) ([]entity.AccessKey, error) {
+	secret, err := s.client.GetSecret(ctx, s.options.Namespace, s.layout.Name)
+	if errors.Is(err, ErrKubernetesNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	access_key := entity.AccessKey{ID: secret.Metadata.Name}
+	if secret.Metadata.CreationTimestamp != nil {
+		access_key.CreatedAt = *secret.Metadata.CreationTimestamp
+	}
+	return []entity.AccessKey{access_key}, nil
+}
+
+// EncryptKey renders the data keys to be written. Kubernetes only base64 encodes secrets,
+// encryption at rest has to be configured for the cluster.
+func (s *KubernetesSecretsStore) EncryptKey(ctx context.Context, k entity.AccessKey) (*entity.EncryptedKey, error) {
+	idKey, secretKey := s.dataKeys()
+	return &entity.EncryptedKey{
+		ID: k.ID,
+		Secrets: []entity.EncryptedSecret{
+			{Name: idKey, Value: []byte(k.ID)},
+			{Name: secretKey, Value: []byte(k.Secret)},
+		},
+		Metadata: map[string]string{
+			KubernetesProviderAnnotation: k.Provider,
+			KubernetesKeyIDAnnotation:    k.ID,
+		},
+	}, nil
+}
+
+// CreateSecret creates the secret or patches it if it already exists. Afterwards the
+// annotated Deployments are restarted (if enabled), failing restarts are only logged.
+func (s *KubernetesSecretsStore) CreateSecret(ctx context.Context, k entity.EncryptedKey) error {
+	now := s.now().UTC()
+	data := make(map[string][]byte)
+	for _, secret := range k.Secrets {
+		data[secret.Name] = secret.Value
+	}
+	if len(k.Secrets) == 0 {
+		_, secretKey := s.dataKeys()
+		data[secretKey] = k.Secret
+	}
+
+	labels := map[string]string{KubernetesManagedByLabel: KubernetesManagedBy}
+	for key, value := range s.options.Labels {
+		labels[key] = value
+	}
+	annotations := map[string]string{KubernetesRotatedAtAnnotation: now.Format(time.RFC3339)}
+	for key, value := range s.options.Annotations {
+		annotations[key] = value
+	}
+	for key, value := range k.Metadata {
+		if value != "" {
+			annotations[key] = value
+		}
+	}
+
+	// Only the keys owned by the rotator are patched, the rest of an existing secret is kept
+	err := s.client.PatchSecret(ctx, s.options.Namespace, s.layout.Name, KubernetesSecretPatch{
+		Labels:      labels,
+		Annotations: annotations,
+		Data:        data,
+	})
+	if errors.Is(err, ErrKubernetesNotFound) {
+		err = s.client.CreateSecret(ctx, &KubernetesSecret{
+			APIVersion: "v1",
+			Kind:       "Secret",
+			Metadata: KubernetesObjectMeta{
+				Name:        s.layout.Name,
+				Namespace:   s.options.Namespace,
+				Labels:      labels,
+				Annotations: annotations,
+			},
+			Type: "Opaque",
+			Data: data,
+		})
+	}
+	if err != nil {
+		return fmt.Errorf("Couldn't write secret %s/%s: %s", s.options.Namespace, s.layout.Name, err)
+	}
+
+	// The secret has been written, Deployments not picking it up yet don't make the rotation fail
+	if s.options.RestartDeployments {
+		err = s.restartDeployments(ctx, now)
+		if err != nil {
+			log.Printf("Warning: secret %s/%s was written but not all deployments were restarted: %s\n", s.options.Namespace, s.layout.Name, err)
+		}
+	}
+	return nil
+}
+
+// restartDeployments triggers a rollout of all Deployments annotated with the name of the secret
+func (s *KubernetesSecretsStore) restartDeployments(ctx context.Context, at time.Time) error {
+	deployments, err := s.client.ListDeployments(ctx, s.options.Namespace)
+	if err != nil {
+		return fmt.Errorf("Couldn't list deployments: %s", err)
+	}
+
+	for _, deployment := range deployments {
+		if !containsSecretName(deployment.Metadata.Annotations[KubernetesRestartAnnotation], s.layout.Name) {
+			continue
+		}
+		err = s.client.RestartDeployment(ctx, s.options.Namespace, deployment.Metadata.Name, at)
+		if err != nil {
+			return fmt.Errorf("Couldn't restart deployment %s: %s", deployment.Metadata.Name, err)
+		}
+	}
+	return nil
+}
+
+// SnapshotSecrets returns the current values of the data keys holding ID and secret
+func (s *KubernetesSecretsStore) SnapshotSecrets(ctx context.Context) (SecretsSnapshot, error) {
+	snapshot := make(SecretsSnapshot)
+	secret, err := s.client.GetSecret(ctx, s.options.Namespace, s.layout.Name)
+	if errors.Is(err, ErrKubernetesNotFound) {
+		return snapshot, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	idKey, secretKey := s.dataKeys()
+	for _, key := range []string{idKey, secretKey} {
+		if value, ok := secret.Data[key]; ok {
+			snapshot[key] = value
+		}
+	}
+	return snapshot, nil
+}
+
+// RestoreSecrets writes the values of a snapshot back. Data keys missing within the snapshot are
+// removed and so is the secret if no data is left.
+func (s *KubernetesSecretsStore) RestoreSecrets(ctx context.Context, snapshot SecretsSnapshot) error {
+	secret, err := s.client.GetSecret(ctx, s.options.Namespace, s.layout.Name)
+	if errors.Is(err, ErrKubernetesNotFound) && len(snapshot) == 0 {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	data := make(map[string][]byte)
+	remaining := len(secret.Data)
+	idKey, secretKey := s.dataKeys()
+	for _, key := range []string{idKey, secretKey} {
+		if _, ok := secret.Data[key]; ok {
+			remaining--
+		}
+		value, ok := snapshot[key]
+		if !ok {
+			// Removes the key
+			data[key] = nil
+			continue
+		}
+		if value == nil {
+			value = []byte{}
+		}
+		data[key] = value
+		remaining++
+	}
+	if remaining == 0 {
+		return s.client.DeleteSecret(ctx, s.options.Namespace, s.layout.Name)
+	}
+	return s.client.PatchSecret(ctx, s.options.Namespace, s.layout.Name, KubernetesSecretPatch{Data: data})
+}
+
+// DeleteSecret deletes the secret specified by the key's ID
+func (s *KubernetesSecretsStore) DeleteSecret(ctx context.Context, k entity.EncryptedKey) error {
+	return s.client.DeleteSecret(ctx, s.options.Namespace, k.ID)
+}
+
+// Destination returns the namespace and the name of the secret
+func (s *KubernetesSecretsStore) Destination() string {
+	return fmt.Sprintf("kubernetes:%s/%s", s.options.Namespace, s.layout.Name)
+}
+
+// containsSecretName checks whether name is part of the comma separated list of names
+func containsSecretName(names, name string) bool {
+	for _, n := range strings.Split(names, ",") {
+		if strings.TrimSpace(n) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Paths of the service account credentials mounted into every pod
+const (
+	kubernetesTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	kubernetesCAFile    = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+)
+
+// KubernetesSettings holds the settings needed to access the API server. Without a server,
+// the in-cluster configuration (service account of the pod) is used.
+type KubernetesSettings struct {
+	Server string `envconfig:"KUBERNETES_SERVER"`
+	Token  string `envconfig:"KUBERNETES_TOKEN"`
+
+	// CAFile is the path of the CA certificate(s) of the API server (default: system roots)
+	CAFile string `envconfig:"KUBERNETES_CA_FILE"`
+}
+
+// KubernetesClient implements KubernetesService using the Kubernetes REST API
+type KubernetesClient struct {
+	server     string
+	token      string
+	httpClient *http.Client
+}
+
+// NewKubernetesClient returns a client for the API server specified by settings
+func NewKubernetesClient(settings KubernetesSettings) (*KubernetesClient, error) {
+	if settings.Server == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return nil, fmt.Errorf("KUBERNETES_SERVER is required when running outside of a cluster")
+		}
+		settings.Server = "https://" + net.JoinHostPort(host, port)
+		if settings.CAFile == "" {
+			settings.CAFile = kubernetesCAFile
+		}
+		if settings.Token == "" {
+			token, err := ioutil.ReadFile(kubernetesTokenFile)
+			if err != nil {
+				return nil, fmt.Errorf("Couldn't read service account token: %s", err)
+			}
+			settings.Token = strings.TrimSpace(string(token))
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if settings.CAFile != "" {
+		ca, err := ioutil.ReadFile(settings.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't read CA certificate: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("No CA certificate found in %s", settings.CAFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	return &KubernetesClient{
+		server:     strings.TrimSuffix(settings.Server, "/"),
+		token:      settings.Token,
+		httpClient: &http.Client{Timeout: time.Second * 10, Transport: transport},
+	}, nil
+}
+
+// secretPath returns the API path of a secret (or of all secrets if name is empty)
+func secretPath(namespace, name string) string {
+	path := "api/v1/namespaces/" + url.PathEscape(namespace) + "/secrets"
+	if name != "" {
+		path += "/" + url.PathEscape(name)
+	}
+	return path
+}
+
+// GetSecret returns a secret. ErrKubernetesNotFound is returned if it doesn't exist.
+func (c *KubernetesClient) GetSecret(ctx context.Context, namespace, name string) (*KubernetesSecret, error) {
+	var secret KubernetesSecret
+	err := c.do(ctx, http.MethodGet, secretPath(namespace, name), "", nil, &secret)
+	if err != nil {
+		return nil, err
+	}
+	return &secret, nil
+}
+
+// CreateSecret creates a new secret
+func (c *KubernetesClient) CreateSecret(ctx context.Context, secret *KubernetesSecret) error {
+	return c.do(ctx, http.MethodPost, secretPath(secret.Metadata.Namespace, ""), "application/json", secret, nil)
+}
+
+// PatchSecret changes parts of an existing secret using a strategic merge patch.
+// ErrKubernetesNotFound is returned if it doesn't exist.
+func (c *KubernetesClient) PatchSecret(ctx context.Context, namespace, name string, patch KubernetesSecretPatch) error {
+	body := map[string]interface{}{}
+	metadata := map[string]interface{}{}
+	if len(patch.Labels) > 0 {
+		metadata["labels"] = patch.Labels
+	}
+	if len(patch.Annotations) > 0 {
+		metadata["annotations"] = patch.Annotations
+	}
+	if len(metadata) > 0 {
+		body["metadata"] = metadata
+	}
+	if len(patch.Data) > 0 {
+		// nil values are encoded as null which removes the key
+		body["data"] = patch.Data
+	}
+	return c.do(ctx, http.MethodPatch, secretPath(namespace, name), "application/strategic-merge-patch+json", body, nil)
+}
+
+// DeleteSecret deletes a secret
+func (c *KubernetesClient) DeleteSecret(ctx context.Context, namespace, name string) error {
+	return c.do(ctx, http.MethodDelete, secretPath(namespace, name), "", nil, nil)
+}
+
+// ListDeployments returns all Deployments of the namespace sorted by name
+func (c *KubernetesClient) ListDeployments(ctx context.Context, namespace string) ([]KubernetesDeployment, error) {
+	var deployments []KubernetesDeployment
+	continueToken := ""
+	for {
+		path := "apis/apps/v1/namespaces/" + url.PathEscape(namespace) + "/deployments?limit=100"
+		if continueToken != "" {
+			path += "&continue=" + url.QueryEscape(continueToken)
+		}
+
+		var list struct {
+			Metadata struct {
+				Continue string `json:"continue"`
+			} `json:"metadata"`
+			Items []KubernetesDeployment `json:"items"`
+		}
+		err := c.do(ctx, http.MethodGet, path, "", nil, &list)
+		if err != nil {
+			return nil, err
+		}
+		deployments = append(deployments, list.Items...)
+
+		continueToken = list.Metadata.Continue
+		if continueToken == "" {
+			break
+		}
+	}
+
+	sort.Slice(deployments, func(i, j int) bool {
+		return deployments[i].Metadata.Name < deployments[j].Metadata.Name
+	})
+	return deployments, nil
+}
+
+// RestartDeployment triggers a rollout by annotating the pod template (like kubectl rollout restart)
+func (c *KubernetesClient) RestartDeployment(ctx context.Context, namespace, name string, at time.Time) error {
+	patch := map[string]interface{}{
+		"spec": map[string]interface{}{
+			"template": map[string]interface{}{
+				"metadata": map[string]interface{}{
+					"annotations": map[string]string{KubernetesRestartedAtAnnotation: at.UTC().Format(time.RFC3339)},
+				},
+			},
+		},
+	}
+	path := "apis/apps/v1/namespaces/" + url.PathEscape(namespace) + "/deployments/" + url.PathEscape(name)
+	return c.do(ctx, http.MethodPatch, path, "application/strategic-merge-patch+json", patch, nil)
+}
+
+// do sends a request to the API server and decodes the response into result (if not nil)
+func (c *KubernetesClient) do(ctx context.Context, method, path, contentType string, body, result interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		payload, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(payload)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.server+"/"+path, reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%s %s: %w", method, path, ErrKubernetesNotFound)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		// Errors are reported as Status objects
+		var status struct {
+			Message string `json:"message"`
+		}
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		if json.Unmarshal(message, &status) == nil && status.Message != "" {
+			message = []byte(status.Message)
+		}
+		return fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(message)))
+	}
+
+	if result != nil {
+		err = json.NewDecoder(resp.Body).Decode(result)
+		if err != nil {
+			return fmt.Errorf("Couldn't decode response: %s", err)
+		}
+	}
+	return nil
+}
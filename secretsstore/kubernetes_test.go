@@ -0,0 +1,401 @@
+package secretsstore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert"
+	"github.com/dorneanu/go-key-rotator/entity"
+)
+
+// fakeKubernetes implements the secrets and deployments endpoints of the Kubernetes API in memory
+type fakeKubernetes struct {
+	mu          sync.Mutex
+	token       string
+	secrets     map[string]*KubernetesSecret // namespace/name -> secret
+	deployments map[string][]KubernetesDeployment
+	patches     map[string]string // namespace/name -> restartedAt
+	version     int
+}
+
+func newFakeKubernetes(token string) (*fakeKubernetes, *httptest.Server) {
+	fake := &fakeKubernetes{
+		token:       token,
+		secrets:     make(map[string]*KubernetesSecret),
+		deployments: make(map[string][]KubernetesDeployment),
+		patches:     make(map[string]string),
+	}
+	return fake, httptest.NewServer(fake)
+}
+
+func (f *fakeKubernetes) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.Header.Get("Authorization") != "Bearer "+f.token {
+		http.Error(w, `{"kind":"Status","message":"Unauthorized"}`, http.StatusUnauthorized)
+		return
+	}
+
+	// api/v1/namespaces/<ns>/secrets[/<name>] or apis/apps/v1/namespaces/<ns>/deployments[/<name>]
+	path := strings.TrimPrefix(r.URL.Path, "/api/v1/namespaces/")
+	path = strings.TrimPrefix(path, "/apis/apps/v1/namespaces/")
+	parts := strings.Split(path, "/")
+	if len(parts) < 2 {
+		http.NotFound(w, r)
+		return
+	}
+	namespace, resource := parts[0], parts[1]
+	name := ""
+	if len(parts) > 2 {
+		name = parts[2]
+	}
+
+	switch {
+	case resource == "secrets" && r.Method == http.MethodGet:
+		secret, ok := f.secrets[namespace+"/"+name]
+		if !ok {
+			http.Error(w, `{"kind":"Status","message":"secrets \"`+name+`\" not found"}`, http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(secret)
+	case resource == "secrets" && r.Method == http.MethodPost:
+		var secret KubernetesSecret
+		json.NewDecoder(r.Body).Decode(&secret)
+		if _, ok := f.secrets[namespace+"/"+secret.Metadata.Name]; ok {
+			http.Error(w, `{"kind":"Status","message":"already exists"}`, http.StatusConflict)
+			return
+		}
+		created := time.Date(2021, time.July, 1, 10, 0, 0, 0, time.UTC)
+		secret.Metadata.CreationTimestamp = &created
+		f.store(namespace, &secret)
+		w.WriteHeader(http.StatusCreated)
+	case resource == "secrets" && r.Method == http.MethodPatch:
+		if r.Header.Get("Content-Type") != "application/strategic-merge-patch+json" {
+			http.Error(w, `{"kind":"Status","message":"unsupported patch type"}`, http.StatusUnsupportedMediaType)
+			return
+		}
+		var patch struct {
+			Metadata KubernetesObjectMeta `json:"metadata"`
+			Data     map[string]*[]byte   `json:"data"`
+		}
+		json.NewDecoder(r.Body).Decode(&patch)
+		existing, ok := f.secrets[namespace+"/"+name]
+		if !ok {
+			http.Error(w, `{"kind":"Status","message":"secrets \"`+name+`\" not found"}`, http.StatusNotFound)
+			return
+		}
+		existing.Metadata.Labels = mergeMaps(existing.Metadata.Labels, patch.Metadata.Labels)
+		existing.Metadata.Annotations = mergeMaps(existing.Metadata.Annotations, patch.Metadata.Annotations)
+		for key, value := range patch.Data {
+			if value == nil {
+				delete(existing.Data, key)
+				continue
+			}
+			if existing.Data == nil {
+				existing.Data = make(map[string][]byte)
+			}
+			existing.Data[key] = *value
+		}
+		f.store(namespace, existing)
+	case resource == "secrets" && r.Method == http.MethodDelete:
+		delete(f.secrets, namespace+"/"+name)
+	case resource == "deployments" && r.Method == http.MethodGet:
+		json.NewEncoder(w).Encode(map[string]interface{}{"items": f.deployments[namespace]})
+	case resource == "deployments" && r.Method == http.MethodPatch:
+		if r.Header.Get("Content-Type") != "application/strategic-merge-patch+json" {
+			http.Error(w, `{"kind":"Status","message":"unsupported patch type"}`, http.StatusUnsupportedMediaType)
+			return
+		}
+		var patch struct {
+			Spec struct {
+				Template struct {
+					Metadata KubernetesObjectMeta `json:"metadata"`
+				} `json:"template"`
+			} `json:"spec"`
+		}
+		json.NewDecoder(r.Body).Decode(&patch)
+		f.patches[namespace+"/"+name] = patch.Spec.Template.Metadata.Annotations[KubernetesRestartedAtAnnotation]
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func mergeMaps(dst, src map[string]string) map[string]string {
+	if dst == nil && len(src) > 0 {
+		dst = make(map[string]string, len(src))
+	}
+	for key, value := range src {
+		dst[key] = value
+	}
+	return dst
+}
+
+func (f *fakeKubernetes) store(namespace string, secret *KubernetesSecret) {
+	f.version++
+	secret.Metadata.ResourceVersion = strconv.Itoa(f.version)
+	f.secrets[namespace+"/"+secret.Metadata.Name] = secret
+}
+
+func TestKubernetesSecretsStore_CreateSecret(t *testing.T) {
+	fake, server := newFakeKubernetes("TOKEN")
+	defer server.Close()
+
+	fake.deployments["ci"] = []KubernetesDeployment{
+		{Metadata: KubernetesObjectMeta{Name: "api", Annotations: map[string]string{KubernetesRestartAnnotation: "other, aws-deploy"}}},
+		{Metadata: KubernetesObjectMeta{Name: "worker", Annotations: map[string]string{KubernetesRestartAnnotation: "other"}}},
+		{Metadata: KubernetesObjectMeta{Name: "web"}},
+	}
+
+	client, err := NewKubernetesClient(KubernetesSettings{Server: server.URL, Token: "TOKEN"})
+	assert.Nil(t, err)
+
+	store := NewKubernetesSecretsStore(client, SecretLayout{Name: "aws-deploy"}, KubernetesSecretOptions{
+		Namespace:          "ci",
+		Labels:             map[string]string{"team": "platform"},
+		Annotations:        map[string]string{"owner": "ops"},
+		RestartDeployments: true,
+	})
+	store.now = func() time.Time { return time.Date(2021, time.July, 1, 10, 0, 0, 0, time.UTC) }
+	assert.Equal(t, "kubernetes:ci/aws-deploy", store.Destination())
+
+	// The first rotation creates the secret, the second one updates it
+	for _, key := range []entity.AccessKey{
+		{ID: "AKIAFIRST", Secret: "first-secret", Provider: "aws"},
+		{ID: "AKIASECOND", Secret: "second-secret", Provider: "aws"},
+	} {
+		encrypted_key, err := store.EncryptKey(context.TODO(), key)
+		assert.Nil(t, err)
+		assert.Nil(t, store.CreateSecret(context.TODO(), *encrypted_key))
+
+		// Keys not written by the rotator are kept
+		fake.secrets["ci/aws-deploy"].Data["REGION"] = []byte("eu-central-1")
+	}
+
+	secret := fake.secrets["ci/aws-deploy"]
+	assert.Equal(t, "Opaque", secret.Type)
+	assert.Equal(t, map[string][]byte{
+		"AWS_ACCESS_KEY_ID":     []byte("AKIASECOND"),
+		"AWS_SECRET_ACCESS_KEY": []byte("second-secret"),
+		"REGION":                []byte("eu-central-1"),
+	}, secret.Data)
+	assert.Equal(t, map[string]string{KubernetesManagedByLabel: KubernetesManagedBy, "team": "platform"}, secret.Metadata.Labels)
+	assert.Equal(t, map[string]string{
+		"owner":                       "ops",
+		KubernetesKeyIDAnnotation:     "AKIASECOND",
+		KubernetesProviderAnnotation:  "aws",
+		KubernetesRotatedAtAnnotation: "2021-07-01T10:00:00Z",
+	}, secret.Metadata.Annotations)
+
+	// Only the deployment referencing the secret is restarted
+	assert.Equal(t, map[string]string{"ci/api": "2021-07-01T10:00:00Z"}, fake.patches)
+
+	secrets, err := store.ListSecrets(context.TODO())
+	assert.Nil(t, err)
+	assert.Equal(t, []entity.AccessKey{{ID: "aws-deploy", CreatedAt: time.Date(2021, time.July, 1, 10, 0, 0, 0, time.UTC)}}, secrets)
+
+	assert.Nil(t, store.DeleteSecret(context.TODO(), entity.EncryptedKey{ID: "aws-deploy"}))
+	secrets, err = store.ListSecrets(context.TODO())
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(secrets))
+}
+
+func TestKubernetesSecretsStore_RestoreSecrets(t *testing.T) {
+	fake, server := newFakeKubernetes("TOKEN")
+	defer server.Close()
+
+	client, err := NewKubernetesClient(KubernetesSettings{Server: server.URL, Token: "TOKEN"})
+	assert.Nil(t, err)
+	store := NewKubernetesSecretsStore(client, SecretLayout{Name: "aws-deploy"}, KubernetesSecretOptions{Namespace: "ci"})
+
+	write := func(id string) {
+		encrypted_key, err := store.EncryptKey(context.TODO(), entity.AccessKey{ID: id, Secret: "secret-" + id})
+		assert.Nil(t, err)
+		assert.Nil(t, store.CreateSecret(context.TODO(), *encrypted_key))
+	}
+
+	// The secret didn't exist before, so it is deleted again
+	snapshot, err := store.SnapshotSecrets(context.TODO())
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(snapshot))
+	write("AKIAFIRST")
+	assert.Nil(t, store.RestoreSecrets(context.TODO(), snapshot))
+	assert.Equal(t, 0, len(fake.secrets))
+
+	// Previous values are written back, other data keys are kept
+	write("AKIAFIRST")
+	fake.secrets["ci/aws-deploy"].Data["REGION"] = []byte("eu-central-1")
+	snapshot, err = store.SnapshotSecrets(context.TODO())
+	assert.Nil(t, err)
+	write("AKIASECOND")
+	assert.Nil(t, store.RestoreSecrets(context.TODO(), snapshot))
+	assert.Equal(t, map[string][]byte{
+		"AWS_ACCESS_KEY_ID":     []byte("AKIAFIRST"),
+		"AWS_SECRET_ACCESS_KEY": []byte("secret-AKIAFIRST"),
+		"REGION":                []byte("eu-central-1"),
+	}, fake.secrets["ci/aws-deploy"].Data)
+}
+
+// memoryKubernetes implements KubernetesService in memory and records the patches
+type memoryKubernetes struct {
+	secrets     map[string]*KubernetesSecret
+	patches     []KubernetesSecretPatch
+	deployments []KubernetesDeployment
+	restarted   []string
+	restartErr  error
+}
+
+func (m *memoryKubernetes) GetSecret(ctx context.Context, namespace, name string) (*KubernetesSecret, error) {
+	secret, ok := m.secrets[namespace+"/"+name]
+	if !ok {
+		return nil, ErrKubernetesNotFound
+	}
+	return secret, nil
+}
+
+func (m *memoryKubernetes) CreateSecret(ctx context.Context, secret *KubernetesSecret) error {
+	m.secrets[secret.Metadata.Namespace+"/"+secret.Metadata.Name] = secret
+	return nil
+}
+
+func (m *memoryKubernetes) PatchSecret(ctx context.Context, namespace, name string, patch KubernetesSecretPatch) error {
+	secret, ok := m.secrets[namespace+"/"+name]
+	if !ok {
+		return ErrKubernetesNotFound
+	}
+	m.patches = append(m.patches, patch)
+	secret.Metadata.Labels = mergeMaps(secret.Metadata.Labels, patch.Labels)
+	secret.Metadata.Annotations = mergeMaps(secret.Metadata.Annotations, patch.Annotations)
+	for key, value := range patch.Data {
+		if value == nil {
+			delete(secret.Data, key)
+		} else {
+			secret.Data[key] = value
+		}
+	}
+	return nil
+}
+
+func (m *memoryKubernetes) DeleteSecret(ctx context.Context, namespace, name string) error {
+	delete(m.secrets, namespace+"/"+name)
+	return nil
+}
+
+func (m *memoryKubernetes) ListDeployments(ctx context.Context, namespace string) ([]KubernetesDeployment, error) {
+	return m.deployments, nil
+}
+
+func (m *memoryKubernetes) RestartDeployment(ctx context.Context, namespace, name string, at time.Time) error {
+	if m.restartErr != nil {
+		return m.restartErr
+	}
+	m.restarted = append(m.restarted, name)
+	return nil
+}
+
+func TestKubernetesSecretsStore_PatchSecret(t *testing.T) {
+	existing := func() *memoryKubernetes {
+		return &memoryKubernetes{
+			secrets: map[string]*KubernetesSecret{"ci/aws-deploy": {
+				Metadata: KubernetesObjectMeta{
+					Name:        "aws-deploy",
+					Namespace:   "ci",
+					Labels:      map[string]string{"team": "platform"},
+					Annotations: map[string]string{"owner": "ops"},
+				},
+				Type: "Opaque",
+				Data: map[string][]byte{"AWS_ACCESS_KEY_ID": []byte("AKIAOLD"), "REGION": []byte("eu-central-1")},
+			}},
+			deployments: []KubernetesDeployment{
+				{Metadata: KubernetesObjectMeta{Name: "api", Annotations: map[string]string{KubernetesRestartAnnotation: "aws-deploy"}}},
+			},
+		}
+	}
+	write := func(store *KubernetesSecretsStore) error {
+		encrypted_key, err := store.EncryptKey(context.TODO(), entity.AccessKey{ID: "AKIANEW", Secret: "new-secret", Provider: "aws"})
+		assert.Nil(t, err)
+		return store.CreateSecret(context.TODO(), *encrypted_key)
+	}
+
+	t.Run("Only the keys owned by the rotator are patched", func(t *testing.T) {
+		client := existing()
+		store := NewKubernetesSecretsStore(client, SecretLayout{Name: "aws-deploy"}, KubernetesSecretOptions{Namespace: "ci"})
+		store.now = func() time.Time { return time.Date(2021, time.July, 1, 10, 0, 0, 0, time.UTC) }
+
+		assert.Nil(t, write(store))
+		assert.Equal(t, []KubernetesSecretPatch{{
+			Labels: map[string]string{KubernetesManagedByLabel: KubernetesManagedBy},
+			Annotations: map[string]string{
+				KubernetesKeyIDAnnotation:     "AKIANEW",
+				KubernetesProviderAnnotation:  "aws",
+				KubernetesRotatedAtAnnotation: "2021-07-01T10:00:00Z",
+			},
+			Data: map[string][]byte{"AWS_ACCESS_KEY_ID": []byte("AKIANEW"), "AWS_SECRET_ACCESS_KEY": []byte("new-secret")},
+		}}, client.patches)
+
+		secret := client.secrets["ci/aws-deploy"]
+		assert.Equal(t, "platform", secret.Metadata.Labels["team"])
+		assert.Equal(t, "ops", secret.Metadata.Annotations["owner"])
+		assert.Equal(t, []byte("eu-central-1"), secret.Data["REGION"])
+
+		// The secret didn't have a secret access key before, so it is removed again
+		client.patches = nil
+		assert.Nil(t, store.RestoreSecrets(context.TODO(), SecretsSnapshot{"AWS_ACCESS_KEY_ID": []byte("AKIAOLD")}))
+		assert.Equal(t, []KubernetesSecretPatch{{
+			Data: map[string][]byte{"AWS_ACCESS_KEY_ID": []byte("AKIAOLD"), "AWS_SECRET_ACCESS_KEY": nil},
+		}}, client.patches)
+		assert.Equal(t, map[string][]byte{"AWS_ACCESS_KEY_ID": []byte("AKIAOLD"), "REGION": []byte("eu-central-1")}, secret.Data)
+	})
+
+	t.Run("Failing restarts don't fail the write", func(t *testing.T) {
+		client := existing()
+		client.restartErr = errors.New("forbidden")
+		store := NewKubernetesSecretsStore(client, SecretLayout{Name: "aws-deploy"}, KubernetesSecretOptions{Namespace: "ci", RestartDeployments: true})
+
+		assert.Nil(t, write(store))
+		assert.Equal(t, []byte("AKIANEW"), client.secrets["ci/aws-deploy"].Data["AWS_ACCESS_KEY_ID"])
+		assert.Equal(t, 0, len(client.restarted))
+
+		client.restartErr = nil
+		assert.Nil(t, write(store))
+		assert.Equal(t, []string{"api"}, client.restarted)
+	})
+}
+
+func TestKubernetesSecretsStore_JSONDataKeys(t *testing.T) {
+	store := NewKubernetesSecretsStore(nil, SecretLayout{Format: SecretFormatJSON, Name: "deploy", SecretKey: "secret"}, KubernetesSecretOptions{})
+	assert.Equal(t, "kubernetes:default/deploy", store.Destination())
+
+	encrypted_key, err := store.EncryptKey(context.TODO(), entity.AccessKey{ID: "ID", Secret: "VALUE"})
+	assert.Nil(t, err)
+	assert.Equal(t, []entity.EncryptedSecret{
+		{Name: "AccessKeyId", Value: []byte("ID")},
+		{Name: "secret", Value: []byte("VALUE")},
+	}, encrypted_key.Secrets)
+}
+
+func TestKubernetesClient(t *testing.T) {
+	_, server := newFakeKubernetes("TOKEN")
+	defer server.Close()
+
+	t.Run("Missing secret", func(t *testing.T) {
+		client := &KubernetesClient{server: server.URL, token: "TOKEN", httpClient: server.Client()}
+		_, err := client.GetSecret(context.TODO(), "ci", "missing")
+		assert.True(t, errors.Is(err, ErrKubernetesNotFound))
+	})
+
+	t.Run("Status messages are reported", func(t *testing.T) {
+		client := &KubernetesClient{server: server.URL, token: "WRONG", httpClient: server.Client()}
+		_, err := client.ListDeployments(context.TODO(), "ci")
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "401 Unauthorized: Unauthorized")
+	})
+}
@@ -0,0 +1,138 @@
+package secretsstore
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/dorneanu/go-key-rotator/entity"
+)
+
+// SecretFormat describes how an access key is written to a secrets store
+type SecretFormat string
+
+const (
+	// SecretFormatSecret stores only the secret of the key (default)
+	SecretFormatSecret SecretFormat = "secret"
+	// SecretFormatSeparate stores the ID and the secret as two separate secrets
+	SecretFormatSeparate SecretFormat = "separate"
+	// SecretFormatJSON stores ID and secret as JSON object within a single secret
+	SecretFormatJSON SecretFormat = "json"
+	// SecretFormatEnv stores ID and secret as env file (KEY=value lines) within a single secret
+	SecretFormatEnv SecretFormat = "env"
+)
+
+// Default field names used by the json and env formats
+const (
+	DefaultJSONIDKey     = "AccessKeyId"
+	DefaultJSONSecretKey = "SecretAccessKey"
+	DefaultEnvIDKey      = "AWS_ACCESS_KEY_ID"
+	DefaultEnvSecretKey  = "AWS_SECRET_ACCESS_KEY"
+)
+
+// SecretLayout describes which secrets are written for an access key
+type SecretLayout struct {
+	Format SecretFormat
+
+	// Name is the name of the secret holding the key's secret (or the whole key
+	// for the json and env formats)
+	Name string
+
+	// IDName is the name of the secret holding the key's ID (separate format only)
+	IDName string
+
+	// IDKey and SecretKey are the field names used by the json and env formats
+	IDKey     string
+	SecretKey string
+}
+
+// SecretValue is a single named secret in plain text
+type SecretValue struct {
+	Name  string
+	Value string
+}
+
+// ParseSecretFormat returns the format specified by name. An empty name means SecretFormatSecret.
+func ParseSecretFormat(name string) (SecretFormat, error) {
+	switch f := SecretFormat(name); f {
+	case "":
+		return SecretFormatSecret, nil
+	case SecretFormatSecret, SecretFormatSeparate, SecretFormatJSON, SecretFormatEnv:
+		return f, nil
+	default:
+		return "", fmt.Errorf("unknown secret format %q (expected secret, separate, json or env)", name)
+	}
+}
+
+// Validate checks whether all names required by the format are set
+func (l SecretLayout) Validate() error {
+	format, err := ParseSecretFormat(string(l.Format))
+	if err != nil {
+		return err
+	}
+	if l.Name == "" {
+		return fmt.Errorf("secret name is required")
+	}
+	if format == SecretFormatSeparate && l.IDName == "" {
+		return fmt.Errorf("name of the ID secret is required for the %s format", format)
+	}
+	if format == SecretFormatSeparate && l.IDName == l.Name {
+		return fmt.Errorf("ID and secret must be stored under different names")
+	}
+	return nil
+}
+
+// Names returns the names of all secrets written for a key
+func (l SecretLayout) Names() []string {
+	if l.Format == SecretFormatSeparate {
+		return []string{l.IDName, l.Name}
+	}
+	return []string{l.Name}
+}
+
+// Values renders the secrets to be written for a key
+func (l SecretLayout) Values(k entity.AccessKey) ([]SecretValue, error) {
+	switch l.Format {
+	case "", SecretFormatSecret:
+		return []SecretValue{{Name: l.Name, Value: k.Secret}}, nil
+	case SecretFormatSeparate:
+		return []SecretValue{{Name: l.IDName, Value: k.ID}, {Name: l.Name, Value: k.Secret}}, nil
+	case SecretFormatJSON:
+		value, err := json.Marshal(map[string]string{
+			valueOrDefault(l.IDKey, DefaultJSONIDKey):         k.ID,
+			valueOrDefault(l.SecretKey, DefaultJSONSecretKey): k.Secret,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return []SecretValue{{Name: l.Name, Value: string(value)}}, nil
+	case SecretFormatEnv:
+		lines := []string{
+			fmt.Sprintf("%s=%s", valueOrDefault(l.IDKey, DefaultEnvIDKey), k.ID),
+			fmt.Sprintf("%s=%s", valueOrDefault(l.SecretKey, DefaultEnvSecretKey), k.Secret),
+		}
+		return []SecretValue{{Name: l.Name, Value: strings.Join(lines, "\n") + "\n"}}, nil
+	default:
+		return nil, fmt.Errorf("unknown secret format %q", l.Format)
+	}
+}
+
+// Render returns a copy of the layout where all secret names are rendered as templates
+func (l SecretLayout) Render(data SecretNameData) (SecretLayout, error) {
+	var err error
+	l.Name, err = RenderSecretName(l.Name, data)
+	if err != nil {
+		return l, err
+	}
+	if l.IDName != "" {
+		l.IDName, err = RenderSecretName(l.IDName, data)
+	}
+	return l, err
+}
+
+func valueOrDefault(value, defaultValue string) string {
+	if value == "" {
+		return defaultValue
+	}
+	return value
+}
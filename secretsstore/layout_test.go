@@ -0,0 +1,73 @@
+package secretsstore
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/alecthomas/assert"
+	"github.com/dorneanu/go-key-rotator/entity"
+)
+
+func TestSecretLayout_Values(t *testing.T) {
+	key := entity.AccessKey{ID: "AKIAEXAMPLE", Secret: "SUPER SECRET VALUE"}
+
+	t.Run("Secret only", func(t *testing.T) {
+		values, err := SecretLayout{Name: "AWS_SECRET"}.Values(key)
+		assert.Nil(t, err)
+		assert.Equal(t, []SecretValue{{Name: "AWS_SECRET", Value: "SUPER SECRET VALUE"}}, values)
+	})
+
+	t.Run("Separate secrets", func(t *testing.T) {
+		layout := SecretLayout{Format: SecretFormatSeparate, IDName: "AWS_ACCESS_KEY_ID", Name: "AWS_SECRET_ACCESS_KEY"}
+		values, err := layout.Values(key)
+		assert.Nil(t, err)
+		assert.Equal(t, []SecretValue{
+			{Name: "AWS_ACCESS_KEY_ID", Value: "AKIAEXAMPLE"},
+			{Name: "AWS_SECRET_ACCESS_KEY", Value: "SUPER SECRET VALUE"},
+		}, values)
+		assert.Equal(t, []string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY"}, layout.Names())
+	})
+
+	t.Run("JSON", func(t *testing.T) {
+		values, err := SecretLayout{Format: SecretFormatJSON, Name: "AWS_CREDENTIALS"}.Values(key)
+		assert.Nil(t, err)
+		assert.Equal(t, 1, len(values))
+
+		var fields map[string]string
+		assert.Nil(t, json.Unmarshal([]byte(values[0].Value), &fields))
+		assert.Equal(t, map[string]string{"AccessKeyId": "AKIAEXAMPLE", "SecretAccessKey": "SUPER SECRET VALUE"}, fields)
+	})
+
+	t.Run("Env file with custom keys", func(t *testing.T) {
+		layout := SecretLayout{Format: SecretFormatEnv, Name: "AWS_ENV", IDKey: "KEY_ID", SecretKey: "KEY_SECRET"}
+		values, err := layout.Values(key)
+		assert.Nil(t, err)
+		assert.Equal(t, []SecretValue{{Name: "AWS_ENV", Value: "KEY_ID=AKIAEXAMPLE\nKEY_SECRET=SUPER SECRET VALUE\n"}}, values)
+	})
+
+	t.Run("Unknown format", func(t *testing.T) {
+		_, err := SecretLayout{Format: "yaml", Name: "AWS"}.Values(key)
+		assert.Error(t, err)
+	})
+}
+
+func TestSecretLayout_Validate(t *testing.T) {
+	assert.Nil(t, SecretLayout{Name: "AWS_SECRET"}.Validate())
+	assert.Error(t, SecretLayout{}.Validate())
+	assert.Error(t, SecretLayout{Format: "yaml", Name: "AWS_SECRET"}.Validate())
+	assert.Error(t, SecretLayout{Format: SecretFormatSeparate, Name: "AWS_SECRET"}.Validate())
+	assert.Error(t, SecretLayout{Format: SecretFormatSeparate, Name: "AWS_SECRET", IDName: "AWS_SECRET"}.Validate())
+	assert.Nil(t, SecretLayout{Format: SecretFormatSeparate, Name: "AWS_SECRET", IDName: "AWS_ID"}.Validate())
+}
+
+func TestSecretLayout_Render(t *testing.T) {
+	layout := SecretLayout{
+		Format: SecretFormatSeparate,
+		IDName: "AWS_ACCESS_KEY_ID_{{ .Principal | upper }}",
+		Name:   "AWS_SECRET_ACCESS_KEY_{{ .Principal | upper }}",
+	}
+	rendered, err := layout.Render(SecretNameData{Principal: "deploy"})
+	assert.Nil(t, err)
+	assert.Equal(t, "AWS_ACCESS_KEY_ID_DEPLOY", rendered.IDName)
+	assert.Equal(t, "AWS_SECRET_ACCESS_KEY_DEPLOY", rendered.Name)
+}
@@ -0,0 +1,42 @@
+package secretsstore
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// SecretNameData holds the values which can be used within secret name templates
+type SecretNameData struct {
+	Principal string
+	Provider  string
+}
+
+var invalidSecretNameChars = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+var secretNameFuncs = template.FuncMap{
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+	// sanitize replaces all characters which are not allowed within secret names
+	"sanitize": func(s string) string {
+		return invalidSecretNameChars.ReplaceAllString(s, "_")
+	},
+}
+
+// RenderSecretName renders a secret name template, e.g. "AWS_KEY_{{ .Principal | sanitize | upper }}".
+// Names without any template actions are returned as they are.
+func RenderSecretName(name string, data SecretNameData) (string, error) {
+	tmpl, err := template.New("secret-name").Funcs(secretNameFuncs).Option("missingkey=error").Parse(name)
+	if err != nil {
+		return "", fmt.Errorf("invalid secret name template %q: %s", name, err)
+	}
+
+	var rendered bytes.Buffer
+	err = tmpl.Execute(&rendered, data)
+	if err != nil {
+		return "", fmt.Errorf("couldn't render secret name template %q: %s", name, err)
+	}
+	return rendered.String(), nil
+}
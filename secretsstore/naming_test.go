@@ -0,0 +1,33 @@
+package secretsstore
+
+import (
+	"testing"
+
+	"github.com/alecthomas/assert"
+)
+
+func TestRenderSecretName(t *testing.T) {
+	data := SecretNameData{Principal: "deploy-user@prod", Provider: "aws"}
+
+	t.Run("Plain secret name", func(t *testing.T) {
+		name, err := RenderSecretName("AWS_SECRET", data)
+		assert.Nil(t, err)
+		assert.Equal(t, "AWS_SECRET", name)
+	})
+
+	t.Run("Templated secret name", func(t *testing.T) {
+		name, err := RenderSecretName("{{ .Provider | upper }}_KEY_{{ .Principal | sanitize | upper }}", data)
+		assert.Nil(t, err)
+		assert.Equal(t, "AWS_KEY_DEPLOY_USER_PROD", name)
+	})
+
+	t.Run("Invalid template", func(t *testing.T) {
+		_, err := RenderSecretName("AWS_{{ .Principal", data)
+		assert.Error(t, err)
+	})
+
+	t.Run("Unknown field", func(t *testing.T) {
+		_, err := RenderSecretName("AWS_{{ .User }}", data)
+		assert.Error(t, err)
+	})
+}
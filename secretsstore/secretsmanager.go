@@ -0,0 +1,263 @@
+package secretsstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager/types"
+	"github.com/dorneanu/go-key-rotator/entity"
+)
+
+// SecretsManagerService defines the Secrets Manager methods needed for publishing keys
+type SecretsManagerService interface {
+	DescribeSecret(ctx context.Context, params *secretsmanager.DescribeSecretInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.DescribeSecretOutput, error)
+	CreateSecret(ctx context.Context, params *secretsmanager.CreateSecretInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.CreateSecretOutput, error)
+	PutSecretValue(ctx context.Context, params *secretsmanager.PutSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.PutSecretValueOutput, error)
+	DeleteSecret(ctx context.Context, params *secretsmanager.DeleteSecretInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.DeleteSecretOutput, error)
+	RestoreSecret(ctx context.Context, params *secretsmanager.RestoreSecretInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.RestoreSecretOutput, error)
+	UpdateSecretVersionStage(ctx context.Context, params *secretsmanager.UpdateSecretVersionStageInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.UpdateSecretVersionStageOutput, error)
+}
+
+// SecretsManagerOptions holds the settings used when a secret has to be created
+type SecretsManagerOptions struct {
+	// KMSKeyID is the key used to encrypt new secrets (default: aws/secretsmanager)
+	KMSKeyID string `envconfig:"SECRETS_MANAGER_KMS_KEY_ID"`
+}
+
+// secretsManagerCurrentStage is the staging label of the version consumers read by default.
+// When a new version is added, the former current version gets the label AWSPREVIOUS.
+const secretsManagerCurrentStage = "AWSCURRENT"
+
+// secretsManagerNoVersion is recorded within a snapshot for secrets which exist without a current version
+const secretsManagerNoVersion = ""
+
+// SecretsManagerSecretsStore implements a SecretsStore using AWS Secrets Manager
+type SecretsManagerSecretsStore struct {
+	client  SecretsManagerService
+	layout  SecretLayout
+	options SecretsManagerOptions
+}
+
+// NewSecretsManagerClient returns a Secrets Manager client using the default AWS configuration
+func NewSecretsManagerClient(ctx context.Context) (SecretsManagerService, error) {
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("configuration error, %s", err)
+	}
+	return secretsmanager.NewFromConfig(cfg), nil
+}
+
+// NewSecretsManagerSecretsStore returns a SecretsManagerSecretsStore writing keys as described by layout.
+// A single secret can't hold the ID next to the secret, so the json format is used instead of the secret format.
+func NewSecretsManagerSecretsStore(client SecretsManagerService, layout SecretLayout, options SecretsManagerOptions) *SecretsManagerSecretsStore {
+	if layout.Format == "" || layout.Format == SecretFormatSecret {
+		layout.Format = SecretFormatJSON
+	}
+	return &SecretsManagerSecretsStore{
+		client:  client,
+		layout:  layout,
+		options: options,
+	}
+}
+
+// ListSecrets returns the secrets of the layout which already exist
+func (s *SecretsManagerSecretsStore) ListSecrets(ctx context.Context) ([]entity.AccessKey, error) {
+	var access_keys []entity.AccessKey
+	for _, name := range s.layout.Names() {
+		output, err := s.client.DescribeSecret(ctx, &secretsmanager.DescribeSecretInput{SecretId: aws.String(name)})
+		if isSecretsManagerNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		access_key := entity.AccessKey{ID: name}
+		if output.CreatedDate != nil {
+			access_key.CreatedAt = *output.CreatedDate
+		}
+		access_keys = append(access_keys, access_key)
+	}
+	return access_keys, nil
+}
+
+// EncryptKey renders the secret values to be written. Secrets Manager encrypts them with KMS.
+func (s *SecretsManagerSecretsStore) EncryptKey(ctx context.Context, k entity.AccessKey) (*entity.EncryptedKey, error) {
+	values, err := s.layout.Values(k)
+	if err != nil {
+		return nil, err
+	}
+
+	encrypted_key := &entity.EncryptedKey{ID: k.ID}
+	for _, value := range values {
+		encrypted_key.Secrets = append(encrypted_key.Secrets, entity.EncryptedSecret{Name: value.Name, Value: []byte(value.Value)})
+	}
+	if len(encrypted_key.Secrets) == 1 {
+		encrypted_key.Secret = encrypted_key.Secrets[0].Value
+	}
+	return encrypted_key, nil
+}
+
+// CreateSecret adds a new current version to every secret. Missing secrets are created.
+func (s *SecretsManagerSecretsStore) CreateSecret(ctx context.Context, k entity.EncryptedKey) error {
+	secrets := k.Secrets
+	if len(secrets) == 0 {
+		secrets = []entity.EncryptedSecret{{Name: s.layout.Name, Value: k.Secret}}
+	}
+
+	for _, secret := range secrets {
+		err := s.putSecretValue(ctx, secret)
+		if isSecretsManagerNotFound(err) {
+			err = s.createSecret(ctx, secret)
+		}
+		if isSecretsManagerInvalidRequest(err) {
+			// Secrets deleted by a rollback can't be written until their deletion is cancelled
+			var cancelled bool
+			cancelled, err = s.cancelDeletion(ctx, secret.Name, err)
+			if cancelled {
+				err = s.putSecretValue(ctx, secret)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %s", secret.Name, err)
+		}
+	}
+	return nil
+}
+
+// putSecretValue adds a new current version holding the value
+func (s *SecretsManagerSecretsStore) putSecretValue(ctx context.Context, secret entity.EncryptedSecret) error {
+	_, err := s.client.PutSecretValue(ctx, &secretsmanager.PutSecretValueInput{
+		SecretId:      aws.String(secret.Name),
+		SecretString:  aws.String(string(secret.Value)),
+		VersionStages: []string{secretsManagerCurrentStage},
+	})
+	return err
+}
+
+// cancelDeletion restores a secret which is scheduled for deletion. Otherwise cause is returned.
+func (s *SecretsManagerSecretsStore) cancelDeletion(ctx context.Context, name string, cause error) (bool, error) {
+	output, err := s.client.DescribeSecret(ctx, &secretsmanager.DescribeSecretInput{SecretId: aws.String(name)})
+	if err != nil {
+		return false, err
+	}
+	if output.DeletedDate == nil {
+		return false, cause
+	}
+	_, err = s.client.RestoreSecret(ctx, &secretsmanager.RestoreSecretInput{SecretId: aws.String(name)})
+	if err != nil {
+		return false, fmt.Errorf("Couldn't cancel deletion: %s", err)
+	}
+	return true, nil
+}
+
+// createSecret creates a secret whose first version holds the value
+func (s *SecretsManagerSecretsStore) createSecret(ctx context.Context, secret entity.EncryptedSecret) error {
+	input := &secretsmanager.CreateSecretInput{
+		Name:         aws.String(secret.Name),
+		SecretString: aws.String(string(secret.Value)),
+		Description:  aws.String("Access key managed by access-key-rotator"),
+	}
+	if s.options.KMSKeyID != "" {
+		input.KmsKeyId = aws.String(s.options.KMSKeyID)
+	}
+	_, err := s.client.CreateSecret(ctx, input)
+	return err
+}
+
+// SnapshotSecrets returns the IDs of the current versions of the secrets. Previous versions are
+// kept by Secrets Manager, so there's no need to read their values. Secrets which don't exist are
+// missing within the snapshot.
+func (s *SecretsManagerSecretsStore) SnapshotSecrets(ctx context.Context) (SecretsSnapshot, error) {
+	snapshot := make(SecretsSnapshot)
+	for _, name := range s.layout.Names() {
+		version, err := s.currentVersion(ctx, name)
+		if isSecretsManagerNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+		snapshot[name] = []byte(version)
+	}
+	return snapshot, nil
+}
+
+// RestoreSecrets moves the AWSCURRENT label back to the versions of the snapshot. Secrets missing
+// within the snapshot have been created since and are deleted (using the default recovery window).
+// The label can't be removed from secrets which didn't have a current version, they are left as is.
+func (s *SecretsManagerSecretsStore) RestoreSecrets(ctx context.Context, snapshot SecretsSnapshot) error {
+	for _, name := range s.layout.Names() {
+		current, err := s.currentVersion(ctx, name)
+		if isSecretsManagerNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+
+		previous, ok := snapshot[name]
+		switch {
+		case !ok:
+			_, err = s.client.DeleteSecret(ctx, &secretsmanager.DeleteSecretInput{SecretId: aws.String(name)})
+		case string(previous) == secretsManagerNoVersion:
+			continue
+		case string(previous) != current:
+			_, err = s.client.UpdateSecretVersionStage(ctx, &secretsmanager.UpdateSecretVersionStageInput{
+				SecretId:            aws.String(name),
+				VersionStage:        aws.String(secretsManagerCurrentStage),
+				MoveToVersionId:     aws.String(string(previous)),
+				RemoveFromVersionId: aws.String(current),
+			})
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+// currentVersion returns the ID of the version labeled AWSCURRENT
+func (s *SecretsManagerSecretsStore) currentVersion(ctx context.Context, name string) (string, error) {
+	output, err := s.client.DescribeSecret(ctx, &secretsmanager.DescribeSecretInput{SecretId: aws.String(name)})
+	if err != nil {
+		return "", err
+	}
+	for version, stages := range output.VersionIdsToStages {
+		for _, stage := range stages {
+			if stage == secretsManagerCurrentStage {
+				return version, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// DeleteSecret schedules the deletion of a secret (using the default recovery window)
+func (s *SecretsManagerSecretsStore) DeleteSecret(ctx context.Context, k entity.EncryptedKey) error {
+	_, err := s.client.DeleteSecret(ctx, &secretsmanager.DeleteSecretInput{SecretId: aws.String(k.ID)})
+	return err
+}
+
+// Destination returns the name(s) of the secret(s)
+func (s *SecretsManagerSecretsStore) Destination() string {
+	return "secretsmanager:" + strings.Join(s.layout.Names(), ",")
+}
+
+// isSecretsManagerInvalidRequest returns true if err reports a request which isn't valid for the state
+// of the secret (e.g. it is scheduled for deletion)
+func isSecretsManagerInvalidRequest(err error) bool {
+	var invalid *types.InvalidRequestException
+	return errors.As(err, &invalid)
+}
+
+// isSecretsManagerNotFound returns true if err reports a missing secret
+func isSecretsManagerNotFound(err error) bool {
+	var notFound *types.ResourceNotFoundException
+	return errors.As(err, &notFound)
+}
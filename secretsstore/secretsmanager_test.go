@@ -0,0 +1,180 @@
+package secretsstore
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager/types"
+	"github.com/dorneanu/go-key-rotator/entity"
+	"github.com/dorneanu/go-key-rotator/mocks"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestSecretsManagerSecretsStore_CreateSecret(t *testing.T) {
+	key := entity.AccessKey{ID: "AKIAEXAMPLE", Secret: "SECRET"}
+
+	t.Run("Add new version", func(t *testing.T) {
+		mock_sm := &mocks.SecretsManagerService{}
+		store := NewSecretsManagerSecretsStore(mock_sm, SecretLayout{Name: "ci/deploy"}, SecretsManagerOptions{})
+		assert.Equal(t, "secretsmanager:ci/deploy", store.Destination())
+
+		mock_sm.On("PutSecretValue", mock.Anything, mock.MatchedBy(func(input *secretsmanager.PutSecretValueInput) bool {
+			return *input.SecretId == "ci/deploy" &&
+				*input.SecretString == `{"AccessKeyId":"AKIAEXAMPLE","SecretAccessKey":"SECRET"}` &&
+				len(input.VersionStages) == 1 && input.VersionStages[0] == "AWSCURRENT"
+		}), mock.Anything).Return(&secretsmanager.PutSecretValueOutput{}, nil).Once()
+
+		encrypted_key, err := store.EncryptKey(context.TODO(), key)
+		assert.Nil(t, err)
+		assert.Nil(t, store.CreateSecret(context.TODO(), *encrypted_key))
+		mock_sm.AssertExpectations(t)
+		mock_sm.AssertNotCalled(t, "CreateSecret", mock.Anything, mock.Anything, mock.Anything)
+	})
+
+	t.Run("Create missing secret", func(t *testing.T) {
+		mock_sm := &mocks.SecretsManagerService{}
+		store := NewSecretsManagerSecretsStore(mock_sm, SecretLayout{
+			Format:    SecretFormatJSON,
+			Name:      "ci/deploy",
+			IDKey:     "id",
+			SecretKey: "secret",
+		}, SecretsManagerOptions{KMSKeyID: "alias/ci"})
+
+		mock_sm.On("PutSecretValue", mock.Anything, mock.Anything, mock.Anything).
+			Return(nil, &types.ResourceNotFoundException{Message: aws.String("Secrets Manager can't find the specified secret.")}).Once()
+		mock_sm.On("CreateSecret", mock.Anything, mock.MatchedBy(func(input *secretsmanager.CreateSecretInput) bool {
+			return *input.Name == "ci/deploy" &&
+				*input.SecretString == `{"id":"AKIAEXAMPLE","secret":"SECRET"}` &&
+				*input.KmsKeyId == "alias/ci"
+		}), mock.Anything).Return(&secretsmanager.CreateSecretOutput{}, nil).Once()
+
+		encrypted_key, err := store.EncryptKey(context.TODO(), key)
+		assert.Nil(t, err)
+		assert.Nil(t, store.CreateSecret(context.TODO(), *encrypted_key))
+		mock_sm.AssertExpectations(t)
+	})
+
+	t.Run("Restore secret scheduled for deletion", func(t *testing.T) {
+		mock_sm := &mocks.SecretsManagerService{}
+		store := NewSecretsManagerSecretsStore(mock_sm, SecretLayout{Name: "ci/deploy"}, SecretsManagerOptions{})
+
+		deleted := time.Date(2021, time.July, 1, 10, 0, 0, 0, time.UTC)
+		mock_sm.On("PutSecretValue", mock.Anything, mock.Anything, mock.Anything).
+			Return(nil, &types.InvalidRequestException{Message: aws.String("The secret is marked for deletion.")}).Once()
+		mock_sm.On("DescribeSecret", mock.Anything, mock.Anything, mock.Anything).
+			Return(&secretsmanager.DescribeSecretOutput{DeletedDate: &deleted}, nil).Once()
+		mock_sm.On("RestoreSecret", mock.Anything, mock.MatchedBy(func(input *secretsmanager.RestoreSecretInput) bool {
+			return *input.SecretId == "ci/deploy"
+		}), mock.Anything).Return(&secretsmanager.RestoreSecretOutput{}, nil).Once()
+		mock_sm.On("PutSecretValue", mock.Anything, mock.Anything, mock.Anything).
+			Return(&secretsmanager.PutSecretValueOutput{}, nil).Once()
+
+		encrypted_key, err := store.EncryptKey(context.TODO(), key)
+		assert.Nil(t, err)
+		assert.Nil(t, store.CreateSecret(context.TODO(), *encrypted_key))
+		mock_sm.AssertExpectations(t)
+	})
+
+	t.Run("Other errors", func(t *testing.T) {
+		mock_sm := &mocks.SecretsManagerService{}
+		store := NewSecretsManagerSecretsStore(mock_sm, SecretLayout{Name: "ci/deploy"}, SecretsManagerOptions{})
+
+		mock_sm.On("PutSecretValue", mock.Anything, mock.Anything, mock.Anything).
+			Return(nil, errors.New("AccessDeniedException")).Once()
+
+		encrypted_key, err := store.EncryptKey(context.TODO(), key)
+		assert.Nil(t, err)
+		err = store.CreateSecret(context.TODO(), *encrypted_key)
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "ci/deploy: AccessDeniedException")
+		mock_sm.AssertNotCalled(t, "CreateSecret", mock.Anything, mock.Anything, mock.Anything)
+	})
+}
+
+func TestSecretsManagerSecretsStore_ListSecrets(t *testing.T) {
+	mock_sm := &mocks.SecretsManagerService{}
+	store := NewSecretsManagerSecretsStore(mock_sm, SecretLayout{
+		Format: SecretFormatSeparate,
+		IDName: "ci/deploy-id",
+		Name:   "ci/deploy-secret",
+	}, SecretsManagerOptions{})
+	assert.Equal(t, "secretsmanager:ci/deploy-id,ci/deploy-secret", store.Destination())
+
+	created := time.Date(2021, time.July, 1, 10, 0, 0, 0, time.UTC)
+	mock_sm.On("DescribeSecret", mock.Anything, mock.MatchedBy(func(input *secretsmanager.DescribeSecretInput) bool {
+		return *input.SecretId == "ci/deploy-id"
+	}), mock.Anything).Return(&secretsmanager.DescribeSecretOutput{CreatedDate: &created}, nil)
+	mock_sm.On("DescribeSecret", mock.Anything, mock.Anything, mock.Anything).
+		Return(nil, &types.ResourceNotFoundException{})
+
+	secrets, err := store.ListSecrets(context.TODO())
+	assert.Nil(t, err)
+	assert.Equal(t, []entity.AccessKey{{ID: "ci/deploy-id", CreatedAt: created}}, secrets)
+}
+
+func TestSecretsManagerSecretsStore_RestoreSecrets(t *testing.T) {
+	mock_sm := &mocks.SecretsManagerService{}
+	store := NewSecretsManagerSecretsStore(mock_sm, SecretLayout{
+		Format: SecretFormatSeparate,
+		IDName: "ci/deploy-id",
+		Name:   "ci/deploy-secret",
+	}, SecretsManagerOptions{})
+
+	describe := func(name string, versions map[string][]string) *mock.Call {
+		return mock_sm.On("DescribeSecret", mock.Anything, mock.MatchedBy(func(input *secretsmanager.DescribeSecretInput) bool {
+			return *input.SecretId == name
+		}), mock.Anything).Return(&secretsmanager.DescribeSecretOutput{VersionIdsToStages: versions}, nil).Once()
+	}
+
+	// The secret holding the ID didn't exist before
+	describe("ci/deploy-secret", map[string][]string{"v1": {"AWSCURRENT"}})
+	mock_sm.On("DescribeSecret", mock.Anything, mock.MatchedBy(func(input *secretsmanager.DescribeSecretInput) bool {
+		return *input.SecretId == "ci/deploy-id"
+	}), mock.Anything).Return(nil, &types.ResourceNotFoundException{}).Once()
+
+	snapshot, err := store.SnapshotSecrets(context.TODO())
+	assert.Nil(t, err)
+	assert.Equal(t, SecretsSnapshot{"ci/deploy-secret": []byte("v1")}, snapshot)
+
+	// The previous version becomes current again, the created secret is deleted (with recovery window)
+	describe("ci/deploy-id", map[string][]string{"v1": {"AWSCURRENT"}})
+	describe("ci/deploy-secret", map[string][]string{"v1": {"AWSPREVIOUS"}, "v2": {"AWSCURRENT"}})
+	mock_sm.On("DeleteSecret", mock.Anything, mock.MatchedBy(func(input *secretsmanager.DeleteSecretInput) bool {
+		return *input.SecretId == "ci/deploy-id" && !input.ForceDeleteWithoutRecovery
+	}), mock.Anything).Return(&secretsmanager.DeleteSecretOutput{}, nil).Once()
+	mock_sm.On("UpdateSecretVersionStage", mock.Anything, mock.MatchedBy(func(input *secretsmanager.UpdateSecretVersionStageInput) bool {
+		return *input.SecretId == "ci/deploy-secret" &&
+			*input.VersionStage == "AWSCURRENT" &&
+			*input.MoveToVersionId == "v1" &&
+			*input.RemoveFromVersionId == "v2"
+	}), mock.Anything).Return(&secretsmanager.UpdateSecretVersionStageOutput{}, nil).Once()
+
+	assert.Nil(t, store.RestoreSecrets(context.TODO(), snapshot))
+	mock_sm.AssertExpectations(t)
+
+	// Nothing is changed if the previous version is still current
+	describe("ci/deploy-id", map[string][]string{"v1": {"AWSCURRENT"}})
+	describe("ci/deploy-secret", map[string][]string{"v1": {"AWSCURRENT"}})
+	assert.Nil(t, store.RestoreSecrets(context.TODO(), SecretsSnapshot{"ci/deploy-id": []byte("v1"), "ci/deploy-secret": []byte("v1")}))
+	mock_sm.AssertExpectations(t)
+	mock_sm.AssertNumberOfCalls(t, "UpdateSecretVersionStage", 1)
+
+	// Secrets without a current version existed before, so they are never deleted
+	describe("ci/deploy-id", map[string][]string{"v1": {"AWSCURRENT"}})
+	describe("ci/deploy-secret", map[string][]string{})
+	snapshot, err = store.SnapshotSecrets(context.TODO())
+	assert.Nil(t, err)
+	assert.Equal(t, SecretsSnapshot{"ci/deploy-id": []byte("v1"), "ci/deploy-secret": []byte{}}, snapshot)
+
+	describe("ci/deploy-id", map[string][]string{"v1": {"AWSCURRENT"}})
+	describe("ci/deploy-secret", map[string][]string{"v2": {"AWSCURRENT"}})
+	assert.Nil(t, store.RestoreSecrets(context.TODO(), snapshot))
+	mock_sm.AssertExpectations(t)
+	mock_sm.AssertNumberOfCalls(t, "DeleteSecret", 1)
+	mock_sm.AssertNumberOfCalls(t, "UpdateSecretVersionStage", 1)
+}
@@ -11,4 +11,17 @@ type SecretsStore interface {
 	ListSecrets(context.Context) ([]entity.AccessKey, error)
 	CreateSecret(context.Context, entity.EncryptedKey) error
 	DeleteSecret(context.Context, entity.EncryptedKey) error
+	Destination() string
+}
+
+// SecretsSnapshot holds the values of the secrets written for a key at some point in time.
+// Secrets which didn't exist are missing.
+type SecretsSnapshot map[string][]byte
+
+// RestorableSecretsStore is implemented by secrets stores which are able to read their secrets.
+// The previous secrets are restored if a rotation is rolled back.
+type RestorableSecretsStore interface {
+	SecretsStore
+	SnapshotSecrets(context.Context) (SecretsSnapshot, error)
+	RestoreSecrets(context.Context, SecretsSnapshot) error
 }
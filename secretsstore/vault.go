@@ -0,0 +1,490 @@
+package secretsstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/dorneanu/go-key-rotator/entity"
+)
+
+// ErrVaultSecretNotFound is returned if a secret doesn't exist
+var ErrVaultSecretNotFound = errors.New("secret not found")
+
+// VaultSecretMetadata holds the metadata of a KV v2 secret
+type VaultSecretMetadata struct {
+	CurrentVersion int               `json:"current_version,omitempty"`
+	MaxVersions    int               `json:"max_versions,omitempty"`
+	CreatedTime    time.Time         `json:"created_time"`
+	UpdatedTime    time.Time         `json:"updated_time"`
+	CustomMetadata map[string]string `json:"custom_metadata,omitempty"`
+}
+
+// VaultKVService manages secrets of a KV v2 secrets engine. Every write creates a new version.
+type VaultKVService interface {
+	WriteSecret(ctx context.Context, mount, path string, data map[string]string) (int, error)
+	ReadSecret(ctx context.Context, mount, path string, version int) (map[string]string, error)
+	ReadMetadata(ctx context.Context, mount, path string) (*VaultSecretMetadata, error)
+	WriteMetadata(ctx context.Context, mount, path string, metadata VaultSecretMetadata) error
+	DeleteMetadata(ctx context.Context, mount, path string) error
+}
+
+// VaultKVOptions specifies the secrets engine keys are written to
+type VaultKVOptions struct {
+	Mount string `envconfig:"VAULT_KV_MOUNT" default:"secret"`
+
+	// MaxVersions limits the number of versions kept per secret (default: setting of the engine)
+	MaxVersions int `envconfig:"VAULT_KV_MAX_VERSIONS"`
+}
+
+// Custom metadata attached to every secret written by a VaultSecretsStore
+const (
+	VaultMetadataProvider  = "source-provider"
+	VaultMetadataKeyID     = "key-id"
+	VaultMetadataRotatedAt = "rotated-at"
+)
+
+// VaultSecretsStore implements a SecretsStore using a KV v2 secrets engine of HashiCorp Vault.
+// Every key is written as a single secret (at the path given by the layout's name) whose
+// fields hold the ID and the secret of the key.
+type VaultSecretsStore struct {
+	client  VaultKVService
+	layout  SecretLayout
+	options VaultKVOptions
+	now     func() time.Time
+}
+
+// NewVaultSecretsStore returns a VaultSecretsStore writing keys to the path specified by layout
+func NewVaultSecretsStore(client VaultKVService, layout SecretLayout, options VaultKVOptions) *VaultSecretsStore {
+	if options.Mount == "" {
+		options.Mount = "secret"
+	}
+	return &VaultSecretsStore{
+		client:  client,
+		layout:  layout,
+		options: options,
+		now:     time.Now,
+	}
+}
+
+// fieldNames returns the names of the fields holding ID and secret
+func (s *VaultSecretsStore) fieldNames() (string, string) {
+	if s.layout.Format == SecretFormatEnv {
+		return valueOrDefault(s.layout.IDKey, DefaultEnvIDKey), valueOrDefault(s.layout.SecretKey, DefaultEnvSecretKey)
+	}
+	return valueOrDefault(s.layout.IDKey, DefaultJSONIDKey), valueOrDefault(s.layout.SecretKey, DefaultJSONSecretKey)
+}
+
+// ListSecrets returns the secret if it exists
+func (s *VaultSecretsStore) ListSecrets(ctx context.Context) ([]entity.AccessKey, error) {
+	metadata, err := s.client.ReadMetadata(ctx, s.options.Mount, s.layout.Name)
+	if errors.Is(err, ErrVaultSecretNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return []entity.AccessKey{{ID: s.layout.Name, CreatedAt: metadata.UpdatedTime}}, nil
+}
+
+// EncryptKey renders the fields to be written. Vault doesn't support client side encryption,
+// the values are only protected by TLS.
+func (s *VaultSecretsStore) EncryptKey(ctx context.Context, k entity.AccessKey) (*entity.EncryptedKey, error) {
+	idField, secretField := s.fieldNames()
+	return &entity.EncryptedKey{
+		ID: k.ID,
+		Secrets: []entity.EncryptedSecret{
+			{Name: idField, Value: []byte(k.ID)},
+			{Name: secretField, Value: []byte(k.Secret)},
+		},
+		Metadata: map[string]string{
+			VaultMetadataProvider: k.Provider,
+			VaultMetadataKeyID:    k.ID,
+		},
+	}, nil
+}
+
+// CreateSecret writes a new version of the secret and updates the custom metadata owned by the rotator
+func (s *VaultSecretsStore) CreateSecret(ctx context.Context, k entity.EncryptedKey) error {
+	data := make(map[string]string)
+	for _, secret := range k.Secrets {
+		data[secret.Name] = string(secret.Value)
+	}
+	if len(k.Secrets) == 0 {
+		_, secretField := s.fieldNames()
+		data[secretField] = string(k.Secret)
+	}
+
+	_, err := s.client.WriteSecret(ctx, s.options.Mount, s.layout.Name, data)
+	if err != nil {
+		return err
+	}
+
+	// Writing the metadata replaces all of the custom metadata, so entries set by others are merged
+	current, err := s.client.ReadMetadata(ctx, s.options.Mount, s.layout.Name)
+	if err != nil {
+		return fmt.Errorf("Couldn't read metadata: %s", err)
+	}
+	metadata := VaultSecretMetadata{MaxVersions: s.options.MaxVersions, CustomMetadata: make(map[string]string)}
+	for key, value := range current.CustomMetadata {
+		metadata.CustomMetadata[key] = value
+	}
+	metadata.CustomMetadata[VaultMetadataRotatedAt] = s.now().UTC().Format(time.RFC3339)
+	for key, value := range k.Metadata {
+		if value != "" {
+			metadata.CustomMetadata[key] = value
+		}
+	}
+	err = s.client.WriteMetadata(ctx, s.options.Mount, s.layout.Name, metadata)
+	if err != nil {
+		return fmt.Errorf("Couldn't update metadata: %s", err)
+	}
+	return nil
+}
+
+// vaultSnapshotVersion is the entry of a snapshot holding the current version of the secret.
+// The other entries hold the custom metadata.
+const vaultSnapshotVersion = "version"
+
+// SnapshotSecrets returns the current version of the secret and its custom metadata. The
+// values of previous versions are kept by Vault.
+func (s *VaultSecretsStore) SnapshotSecrets(ctx context.Context) (SecretsSnapshot, error) {
+	snapshot := make(SecretsSnapshot)
+	metadata, err := s.client.ReadMetadata(ctx, s.options.Mount, s.layout.Name)
+	if errors.Is(err, ErrVaultSecretNotFound) {
+		return snapshot, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for key, value := range metadata.CustomMetadata {
+		snapshot["metadata:"+key] = []byte(value)
+	}
+	snapshot[vaultSnapshotVersion] = []byte(strconv.Itoa(metadata.CurrentVersion))
+	return snapshot, nil
+}
+
+// RestoreSecrets writes the data of the version within the snapshot back as a new version and
+// restores the custom metadata. The secret is deleted if it didn't exist before.
+func (s *VaultSecretsStore) RestoreSecrets(ctx context.Context, snapshot SecretsSnapshot) error {
+	if _, ok := snapshot[vaultSnapshotVersion]; !ok {
+		err := s.client.DeleteMetadata(ctx, s.options.Mount, s.layout.Name)
+		if errors.Is(err, ErrVaultSecretNotFound) {
+			return nil
+		}
+		return err
+	}
+
+	version, err := strconv.Atoi(string(snapshot[vaultSnapshotVersion]))
+	if err != nil {
+		return fmt.Errorf("invalid version %q", snapshot[vaultSnapshotVersion])
+	}
+	metadata, err := s.client.ReadMetadata(ctx, s.options.Mount, s.layout.Name)
+	if err != nil {
+		return err
+	}
+	if metadata.CurrentVersion == version {
+		return nil
+	}
+
+	data, err := s.client.ReadSecret(ctx, s.options.Mount, s.layout.Name, version)
+	if err != nil {
+		return fmt.Errorf("Couldn't read version %d: %s", version, err)
+	}
+	_, err = s.client.WriteSecret(ctx, s.options.Mount, s.layout.Name, data)
+	if err != nil {
+		return err
+	}
+
+	previous := VaultSecretMetadata{MaxVersions: s.options.MaxVersions, CustomMetadata: make(map[string]string)}
+	for key, value := range snapshot {
+		if strings.HasPrefix(key, "metadata:") {
+			previous.CustomMetadata[strings.TrimPrefix(key, "metadata:")] = string(value)
+		}
+	}
+	err = s.client.WriteMetadata(ctx, s.options.Mount, s.layout.Name, previous)
+	if err != nil {
+		return fmt.Errorf("Couldn't update metadata: %s", err)
+	}
+	return nil
+}
+
+// DeleteSecret deletes all versions of the secret at the path specified by the key's ID
+func (s *VaultSecretsStore) DeleteSecret(ctx context.Context, k entity.EncryptedKey) error {
+	return s.client.DeleteMetadata(ctx, s.options.Mount, k.ID)
+}
+
+// Destination returns the path of the secret
+func (s *VaultSecretsStore) Destination() string {
+	return fmt.Sprintf("vault:%s/%s", s.options.Mount, s.layout.Name)
+}
+
+// VaultAuthMethod specifies how to log in to Vault
+type VaultAuthMethod string
+
+const (
+	VaultAuthToken   VaultAuthMethod = "token"
+	VaultAuthAppRole VaultAuthMethod = "approle"
+	VaultAuthAWS     VaultAuthMethod = "aws"
+)
+
+// VaultSettings holds the settings needed to access Vault
+type VaultSettings struct {
+	Address   string `envconfig:"VAULT_ADDR"`
+	Namespace string `envconfig:"VAULT_NAMESPACE"`
+
+	AuthMethod VaultAuthMethod `envconfig:"VAULT_AUTH_METHOD" default:"token"`
+	// AuthMount is the path the auth method is mounted at (default: name of the method)
+	AuthMount string `envconfig:"VAULT_AUTH_MOUNT"`
+
+	// Token is used by the token method
+	Token string `envconfig:"VAULT_TOKEN"`
+
+	// RoleID and SecretID are used by the approle method
+	RoleID   string `envconfig:"VAULT_ROLE_ID"`
+	SecretID string `envconfig:"VAULT_SECRET_ID"`
+
+	// Role and IAMServerID (value of the X-Vault-AWS-IAM-Server-ID header) are used by the aws method
+	Role        string `envconfig:"VAULT_ROLE"`
+	IAMServerID string `envconfig:"VAULT_AWS_IAM_SERVER_ID"`
+}
+
+// VaultClient implements VaultKVService using the Vault HTTP API
+type VaultClient struct {
+	address    string
+	namespace  string
+	token      string
+	httpClient *http.Client
+}
+
+// NewVaultClient logs in to Vault using the configured auth method
+func NewVaultClient(ctx context.Context, settings VaultSettings) (*VaultClient, error) {
+	if settings.Address == "" {
+		return nil, fmt.Errorf("address of Vault (VAULT_ADDR) is required")
+	}
+	client := &VaultClient{
+		address:    strings.TrimSuffix(settings.Address, "/"),
+		namespace:  settings.Namespace,
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+	}
+
+	var err error
+	switch settings.AuthMethod {
+	case VaultAuthToken, "":
+		if settings.Token == "" {
+			return nil, fmt.Errorf("token is required for the token auth method")
+		}
+		client.token = settings.Token
+	case VaultAuthAppRole:
+		err = client.loginAppRole(ctx, valueOrDefault(settings.AuthMount, string(VaultAuthAppRole)), settings.RoleID, settings.SecretID)
+	case VaultAuthAWS:
+		var cfg aws.Config
+		cfg, err = config.LoadDefaultConfig(ctx)
+		if err == nil {
+			err = client.loginAWS(ctx, valueOrDefault(settings.AuthMount, string(VaultAuthAWS)), settings.Role, settings.IAMServerID, cfg.Credentials)
+		}
+	default:
+		return nil, fmt.Errorf("unknown auth method %q (expected token, approle or aws)", settings.AuthMethod)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't log in to Vault: %s", err)
+	}
+	return client, nil
+}
+
+// loginAppRole logs in using the AppRole auth method
+func (c *VaultClient) loginAppRole(ctx context.Context, mount, roleID, secretID string) error {
+	if roleID == "" || secretID == "" {
+		return fmt.Errorf("role ID and secret ID are required for the approle auth method")
+	}
+	return c.login(ctx, mount, map[string]string{"role_id": roleID, "secret_id": secretID})
+}
+
+// loginAWS logs in using the AWS auth method. Vault verifies the identity by sending
+// the signed sts:GetCallerIdentity request to AWS.
+func (c *VaultClient) loginAWS(ctx context.Context, mount, role, serverID string, credentials aws.CredentialsProvider) error {
+	if credentials == nil {
+		return fmt.Errorf("no AWS credentials found")
+	}
+	creds, err := credentials.Retrieve(ctx)
+	if err != nil {
+		return err
+	}
+
+	body := "Action=GetCallerIdentity&Version=2011-06-15"
+	req, err := http.NewRequest(http.MethodPost, "https://sts.amazonaws.com/", strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	if serverID != "" {
+		req.Header.Set("X-Vault-AWS-IAM-Server-ID", serverID)
+	}
+
+	payloadHash := sha256.Sum256([]byte(body))
+	err = v4.NewSigner().SignHTTP(ctx, creds, req, hex.EncodeToString(payloadHash[:]), "sts", "us-east-1", time.Now())
+	if err != nil {
+		return err
+	}
+
+	headers, err := json.Marshal(req.Header)
+	if err != nil {
+		return err
+	}
+	return c.login(ctx, mount, map[string]string{
+		"role":                    role,
+		"iam_http_request_method": req.Method,
+		"iam_request_url":         base64.StdEncoding.EncodeToString([]byte(req.URL.String())),
+		"iam_request_body":        base64.StdEncoding.EncodeToString([]byte(body)),
+		"iam_request_headers":     base64.StdEncoding.EncodeToString(headers),
+	})
+}
+
+// login authenticates against an auth method and keeps the returned token
+func (c *VaultClient) login(ctx context.Context, mount string, payload map[string]string) error {
+	var result struct {
+		Auth struct {
+			ClientToken string `json:"client_token"`
+		} `json:"auth"`
+	}
+	err := c.do(ctx, http.MethodPost, "auth/"+strings.Trim(mount, "/")+"/login", payload, &result)
+	if err != nil {
+		return err
+	}
+	if result.Auth.ClientToken == "" {
+		return fmt.Errorf("no token returned")
+	}
+	c.token = result.Auth.ClientToken
+	return nil
+}
+
+// WriteSecret creates a new version of a secret and returns its number
+func (c *VaultClient) WriteSecret(ctx context.Context, mount, path string, data map[string]string) (int, error) {
+	var result struct {
+		Data struct {
+			Version int `json:"version"`
+		} `json:"data"`
+	}
+	err := c.do(ctx, http.MethodPost, kvPath(mount, "data", path), map[string]interface{}{"data": data}, &result)
+	return result.Data.Version, err
+}
+
+// ReadSecret returns the data of a version of a secret (0 is the current version)
+func (c *VaultClient) ReadSecret(ctx context.Context, mount, path string, version int) (map[string]string, error) {
+	var result struct {
+		Data struct {
+			Data map[string]string `json:"data"`
+		} `json:"data"`
+	}
+	err := c.do(ctx, http.MethodGet, kvPath(mount, "data", path)+"?version="+strconv.Itoa(version), nil, &result)
+	if err != nil {
+		return nil, err
+	}
+	return result.Data.Data, nil
+}
+
+// ReadMetadata returns the metadata of a secret
+func (c *VaultClient) ReadMetadata(ctx context.Context, mount, path string) (*VaultSecretMetadata, error) {
+	var result struct {
+		Data VaultSecretMetadata `json:"data"`
+	}
+	err := c.do(ctx, http.MethodGet, kvPath(mount, "metadata", path), nil, &result)
+	if err != nil {
+		return nil, err
+	}
+	return &result.Data, nil
+}
+
+// WriteMetadata updates the settings of a secret and replaces all of its custom metadata
+func (c *VaultClient) WriteMetadata(ctx context.Context, mount, path string, metadata VaultSecretMetadata) error {
+	payload := map[string]interface{}{"custom_metadata": metadata.CustomMetadata}
+	if metadata.MaxVersions > 0 {
+		payload["max_versions"] = metadata.MaxVersions
+	}
+	return c.do(ctx, http.MethodPost, kvPath(mount, "metadata", path), payload, nil)
+}
+
+// DeleteMetadata deletes a secret including all of its versions
+func (c *VaultClient) DeleteMetadata(ctx context.Context, mount, path string) error {
+	return c.do(ctx, http.MethodDelete, kvPath(mount, "metadata", path), nil, nil)
+}
+
+// kvPath returns the API path of a secret within a KV v2 engine
+func kvPath(mount, kind, path string) string {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Trim(mount, "/") + "/" + kind + "/" + strings.Join(segments, "/")
+}
+
+// do sends a request to the Vault API and decodes the response into result (if not nil)
+func (c *VaultClient) do(ctx context.Context, method, path string, body, result interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		payload, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(payload)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.address+"/v1/"+path, reqBody)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("X-Vault-Token", c.token)
+	}
+	if c.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", c.namespace)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		var vaultErr struct {
+			Errors []string `json:"errors"`
+		}
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		if json.Unmarshal(message, &vaultErr) == nil && len(vaultErr.Errors) > 0 {
+			message = []byte(strings.Join(vaultErr.Errors, "; "))
+		}
+		err = fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(message)))
+		if resp.StatusCode == http.StatusNotFound {
+			return fmt.Errorf("%w: %s", ErrVaultSecretNotFound, err)
+		}
+		return err
+	}
+
+	if result != nil && resp.StatusCode != http.StatusNoContent {
+		err = json.NewDecoder(resp.Body).Decode(result)
+		if err != nil {
+			return fmt.Errorf("Couldn't decode response: %s", err)
+		}
+	}
+	return nil
+}
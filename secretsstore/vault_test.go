@@ -0,0 +1,269 @@
+package secretsstore
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/dorneanu/go-key-rotator/entity"
+)
+
+// fakeVault implements the KV v2 and login endpoints of the Vault API in memory
+type fakeVault struct {
+	mu       sync.Mutex
+	token    string
+	versions map[string][]map[string]string // mount/path -> versions
+	metadata map[string]map[string]interface{}
+	logins   []map[string]string
+}
+
+func newFakeVault(token string) (*fakeVault, *httptest.Server) {
+	fake := &fakeVault{
+		token:    token,
+		versions: make(map[string][]map[string]string),
+		metadata: make(map[string]map[string]interface{}),
+	}
+	return fake, httptest.NewServer(fake)
+}
+
+func (f *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	path := strings.TrimPrefix(r.URL.Path, "/v1/")
+	if strings.HasPrefix(path, "auth/") && strings.HasSuffix(path, "/login") {
+		var payload map[string]string
+		json.NewDecoder(r.Body).Decode(&payload)
+		f.logins = append(f.logins, payload)
+		if payload["secret_id"] == "wrong" {
+			http.Error(w, `{"errors":["invalid role or secret ID"]}`, http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"auth": map[string]string{"client_token": f.token}})
+		return
+	}
+
+	if r.Header.Get("X-Vault-Token") != f.token {
+		http.Error(w, `{"errors":["permission denied"]}`, http.StatusForbidden)
+		return
+	}
+
+	// <mount>/<data|metadata>/<path>
+	parts := strings.SplitN(path, "/", 3)
+	if len(parts) != 3 {
+		http.NotFound(w, r)
+		return
+	}
+	secret := parts[0] + "/" + parts[2]
+
+	switch {
+	case parts[1] == "data" && r.Method == http.MethodPost:
+		var payload struct {
+			Data map[string]string `json:"data"`
+		}
+		json.NewDecoder(r.Body).Decode(&payload)
+		f.versions[secret] = append(f.versions[secret], payload.Data)
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]int{"version": len(f.versions[secret])}})
+	case parts[1] == "data" && r.Method == http.MethodGet:
+		versions := f.versions[secret]
+		version, _ := strconv.Atoi(r.URL.Query().Get("version"))
+		if version == 0 {
+			version = len(versions)
+		}
+		if version < 1 || version > len(versions) {
+			http.Error(w, `{"errors":[]}`, http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{"data": versions[version-1]}})
+	case parts[1] == "metadata" && r.Method == http.MethodPost:
+		var payload map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&payload)
+		f.metadata[secret] = payload
+		w.WriteHeader(http.StatusNoContent)
+	case parts[1] == "metadata" && r.Method == http.MethodGet:
+		if len(f.versions[secret]) == 0 {
+			http.Error(w, `{"errors":[]}`, http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{
+			"current_version": len(f.versions[secret]),
+			"created_time":    "2021-07-01T10:00:00Z",
+			"updated_time":    "2021-07-02T10:00:00Z",
+			"custom_metadata": f.metadata[secret]["custom_metadata"],
+		}})
+	case parts[1] == "metadata" && r.Method == http.MethodDelete:
+		delete(f.versions, secret)
+		delete(f.metadata, secret)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestVaultSecretsStore_CreateSecret(t *testing.T) {
+	fake, server := newFakeVault("TOKEN")
+	defer server.Close()
+
+	client, err := NewVaultClient(context.TODO(), VaultSettings{Address: server.URL, Token: "TOKEN"})
+	assert.Nil(t, err)
+
+	store := NewVaultSecretsStore(client, SecretLayout{Name: "ci/aws/deploy"}, VaultKVOptions{Mount: "kv", MaxVersions: 5})
+	store.now = func() time.Time { return time.Date(2021, time.July, 1, 10, 0, 0, 0, time.UTC) }
+	assert.Equal(t, "vault:kv/ci/aws/deploy", store.Destination())
+
+	// Custom metadata of others is kept
+	fake.versions["kv/ci/aws/deploy"] = []map[string]string{{"note": "created by hand"}}
+	fake.metadata["kv/ci/aws/deploy"] = map[string]interface{}{"custom_metadata": map[string]interface{}{"team": "platform"}}
+
+	// Every rotation adds a new version
+	for _, key := range []entity.AccessKey{
+		{ID: "AKIAFIRST", Secret: "first-secret", Provider: "aws"},
+		{ID: "AKIASECOND", Secret: "second-secret", Provider: "aws"},
+	} {
+		encrypted_key, err := store.EncryptKey(context.TODO(), key)
+		assert.Nil(t, err)
+		assert.Nil(t, store.CreateSecret(context.TODO(), *encrypted_key))
+	}
+
+	versions := fake.versions["kv/ci/aws/deploy"]
+	assert.Equal(t, 3, len(versions))
+	assert.Equal(t, map[string]string{"AccessKeyId": "AKIAFIRST", "SecretAccessKey": "first-secret"}, versions[1])
+	assert.Equal(t, map[string]string{"AccessKeyId": "AKIASECOND", "SecretAccessKey": "second-secret"}, versions[2])
+	assert.Equal(t, map[string]interface{}{
+		"max_versions": float64(5),
+		"custom_metadata": map[string]interface{}{
+			"team":            "platform",
+			"source-provider": "aws",
+			"key-id":          "AKIASECOND",
+			"rotated-at":      "2021-07-01T10:00:00Z",
+		},
+	}, fake.metadata["kv/ci/aws/deploy"])
+
+	secrets, err := store.ListSecrets(context.TODO())
+	assert.Nil(t, err)
+	assert.Equal(t, []entity.AccessKey{{ID: "ci/aws/deploy", CreatedAt: time.Date(2021, time.July, 2, 10, 0, 0, 0, time.UTC)}}, secrets)
+
+	assert.Nil(t, store.DeleteSecret(context.TODO(), entity.EncryptedKey{ID: "ci/aws/deploy"}))
+	secrets, err = store.ListSecrets(context.TODO())
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(secrets))
+}
+
+func TestVaultSecretsStore_RestoreSecrets(t *testing.T) {
+	fake, server := newFakeVault("TOKEN")
+	defer server.Close()
+
+	client, err := NewVaultClient(context.TODO(), VaultSettings{Address: server.URL, Token: "TOKEN"})
+	assert.Nil(t, err)
+	store := NewVaultSecretsStore(client, SecretLayout{Name: "ci/aws/deploy"}, VaultKVOptions{Mount: "kv"})
+
+	write := func(id string) {
+		encrypted_key, err := store.EncryptKey(context.TODO(), entity.AccessKey{ID: id, Secret: "secret-" + id, Provider: "aws"})
+		assert.Nil(t, err)
+		assert.Nil(t, store.CreateSecret(context.TODO(), *encrypted_key))
+	}
+
+	// The secret didn't exist before, so it is deleted again
+	snapshot, err := store.SnapshotSecrets(context.TODO())
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(snapshot))
+	write("AKIAFIRST")
+	assert.Nil(t, store.RestoreSecrets(context.TODO(), snapshot))
+	assert.Equal(t, 0, len(fake.versions))
+
+	// The previous version is written back along with its metadata
+	write("AKIAFIRST")
+	snapshot, err = store.SnapshotSecrets(context.TODO())
+	assert.Nil(t, err)
+	write("AKIASECOND")
+	assert.Nil(t, store.RestoreSecrets(context.TODO(), snapshot))
+
+	versions := fake.versions["kv/ci/aws/deploy"]
+	assert.Equal(t, 3, len(versions))
+	assert.Equal(t, map[string]string{"AccessKeyId": "AKIAFIRST", "SecretAccessKey": "secret-AKIAFIRST"}, versions[2])
+	custom := fake.metadata["kv/ci/aws/deploy"]["custom_metadata"].(map[string]interface{})
+	assert.Equal(t, "AKIAFIRST", custom["key-id"])
+
+	// Nothing is written if the version is still current
+	snapshot, err = store.SnapshotSecrets(context.TODO())
+	assert.Nil(t, err)
+	assert.Nil(t, store.RestoreSecrets(context.TODO(), snapshot))
+	assert.Equal(t, 3, len(fake.versions["kv/ci/aws/deploy"]))
+}
+
+func TestVaultSecretsStore_EnvFieldNames(t *testing.T) {
+	store := NewVaultSecretsStore(nil, SecretLayout{Format: SecretFormatEnv, Name: "ci", SecretKey: "SECRET"}, VaultKVOptions{})
+	assert.Equal(t, "vault:secret/ci", store.Destination())
+
+	encrypted_key, err := store.EncryptKey(context.TODO(), entity.AccessKey{ID: "ID", Secret: "VALUE"})
+	assert.Nil(t, err)
+	assert.Equal(t, []entity.EncryptedSecret{
+		{Name: "AWS_ACCESS_KEY_ID", Value: []byte("ID")},
+		{Name: "SECRET", Value: []byte("VALUE")},
+	}, encrypted_key.Secrets)
+}
+
+func TestVaultClient_Login(t *testing.T) {
+	fake, server := newFakeVault("LOGIN-TOKEN")
+	defer server.Close()
+
+	t.Run("AppRole", func(t *testing.T) {
+		client, err := NewVaultClient(context.TODO(), VaultSettings{
+			Address:    server.URL,
+			AuthMethod: VaultAuthAppRole,
+			RoleID:     "role",
+			SecretID:   "secret",
+		})
+		assert.Nil(t, err)
+		_, err = client.WriteSecret(context.TODO(), "secret", "ci", map[string]string{"a": "b"})
+		assert.Nil(t, err)
+	})
+
+	t.Run("AppRole with invalid secret ID", func(t *testing.T) {
+		_, err := NewVaultClient(context.TODO(), VaultSettings{
+			Address:    server.URL,
+			AuthMethod: VaultAuthAppRole,
+			RoleID:     "role",
+			SecretID:   "wrong",
+		})
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "invalid role or secret ID")
+	})
+
+	t.Run("AWS IAM", func(t *testing.T) {
+		client := &VaultClient{address: server.URL, httpClient: server.Client()}
+		credentials := aws.CredentialsProviderFunc(func(ctx context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: "AKIAEXAMPLE", SecretAccessKey: "SECRET"}, nil
+		})
+		err := client.loginAWS(context.TODO(), "aws", "rotator", "vault.example.com", credentials)
+		assert.Nil(t, err)
+		assert.Equal(t, "LOGIN-TOKEN", client.token)
+
+		login := fake.logins[len(fake.logins)-1]
+		assert.Equal(t, "rotator", login["role"])
+		assert.Equal(t, "POST", login["iam_http_request_method"])
+
+		var headers map[string][]string
+		raw, _ := base64.StdEncoding.DecodeString(login["iam_request_headers"])
+		assert.Nil(t, json.Unmarshal(raw, &headers))
+		assert.Equal(t, []string{"vault.example.com"}, headers["X-Vault-Aws-Iam-Server-Id"])
+		assert.Contains(t, headers["Authorization"][0], "Credential=AKIAEXAMPLE/")
+		assert.Contains(t, headers["Authorization"][0], "x-vault-aws-iam-server-id")
+	})
+
+	t.Run("Missing secret", func(t *testing.T) {
+		client := &VaultClient{address: server.URL, token: "LOGIN-TOKEN", httpClient: server.Client()}
+		_, err := client.ReadMetadata(context.TODO(), "secret", "missing")
+		assert.True(t, errors.Is(err, ErrVaultSecretNotFound))
+	})
+}
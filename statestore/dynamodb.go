@@ -0,0 +1,220 @@
+package statestore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// DynamoDBAPI defines the DynamoDB methods needed for keeping state
+type DynamoDBAPI interface {
+	PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error)
+	DeleteItem(ctx context.Context, params *dynamodb.DeleteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error)
+	Query(ctx context.Context, params *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error)
+	Scan(ctx context.Context, params *dynamodb.ScanInput, optFns ...func(*dynamodb.Options)) (*dynamodb.ScanOutput, error)
+}
+
+// DynamoDBSettings specifies the table holding the state. The table needs a partition
+// key "pk" and a sort key "sk" (both strings).
+type DynamoDBSettings struct {
+	Table string `envconfig:"STATE_TABLE"`
+}
+
+// NewDynamoDBClient returns a DynamoDB client using the default AWS configuration
+func NewDynamoDBClient(ctx context.Context) (DynamoDBAPI, error) {
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("configuration error, %s", err)
+	}
+	return dynamodb.NewFromConfig(cfg), nil
+}
+
+// Prefixes of the partition keys of rotation records and locks
+const (
+	rotationPrefix = "rotation#"
+	lockPrefix     = "lock#"
+)
+
+// DynamoDBStateStore implements a StateStore and a Locker using a DynamoDB table (e.g. for the Lambda).
+// Every job is a partition of the table, its records are sorted by their IDs. Locks are items of
+// their own which are only written if they don't exist or have expired (conditional writes).
+type DynamoDBStateStore struct {
+	client DynamoDBAPI
+	table  string
+}
+
+// NewDynamoDBStateStore returns a DynamoDBStateStore keeping its records in table
+func NewDynamoDBStateStore(client DynamoDBAPI, table string) *DynamoDBStateStore {
+	return &DynamoDBStateStore{client: client, table: table}
+}
+
+// SaveRotation creates the record or replaces it if it already exists
+func (s *DynamoDBStateStore) SaveRotation(ctx context.Context, r RotationRecord) error {
+	content, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(s.table),
+		Item: map[string]types.AttributeValue{
+			"pk":     &types.AttributeValueMemberS{Value: rotationPrefix + r.Job},
+			"sk":     &types.AttributeValueMemberS{Value: r.ID},
+			"phase":  &types.AttributeValueMemberS{Value: string(r.Phase)},
+			"record": &types.AttributeValueMemberS{Value: string(content)},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("Couldn't save rotation %s: %s", r.ID, err)
+	}
+	return nil
+}
+
+// ListRotations returns the records of a job (or of all jobs) ordered by their start
+func (s *DynamoDBStateStore) ListRotations(ctx context.Context, job string) ([]RotationRecord, error) {
+	var items []map[string]types.AttributeValue
+	var startKey map[string]types.AttributeValue
+	for {
+		var page []map[string]types.AttributeValue
+		var err error
+		if job == "" {
+			var output *dynamodb.ScanOutput
+			output, err = s.client.Scan(ctx, &dynamodb.ScanInput{
+				TableName:                 aws.String(s.table),
+				FilterExpression:          aws.String("begins_with(pk, :prefix)"),
+				ExpressionAttributeValues: map[string]types.AttributeValue{":prefix": &types.AttributeValueMemberS{Value: rotationPrefix}},
+				ExclusiveStartKey:         startKey,
+				ConsistentRead:            aws.Bool(true),
+			})
+			if err == nil {
+				page, startKey = output.Items, output.LastEvaluatedKey
+			}
+		} else {
+			var output *dynamodb.QueryOutput
+			output, err = s.client.Query(ctx, &dynamodb.QueryInput{
+				TableName:                 aws.String(s.table),
+				KeyConditionExpression:    aws.String("pk = :pk"),
+				ExpressionAttributeValues: map[string]types.AttributeValue{":pk": &types.AttributeValueMemberS{Value: rotationPrefix + job}},
+				ExclusiveStartKey:         startKey,
+				ConsistentRead:            aws.Bool(true),
+			})
+			if err == nil {
+				page, startKey = output.Items, output.LastEvaluatedKey
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't list rotations: %s", err)
+		}
+
+		items = append(items, page...)
+		if len(startKey) == 0 {
+			break
+		}
+	}
+
+	records := make([]RotationRecord, 0, len(items))
+	for _, item := range items {
+		content, ok := item["record"].(*types.AttributeValueMemberS)
+		if !ok {
+			continue
+		}
+		var r RotationRecord
+		err := json.Unmarshal([]byte(content.Value), &r)
+		if err != nil {
+			return nil, fmt.Errorf("Couldn't decode rotation: %s", err)
+		}
+		records = append(records, r)
+	}
+	sortRecords(records)
+	return records, nil
+}
+
+// Lock acquires the lock unless it is held by someone else and hasn't expired yet. The expiry is
+// kept in the attribute expires_at (seconds since epoch) which may be used as TTL of the table.
+func (s *DynamoDBStateStore) Lock(ctx context.Context, name, holder string, lease time.Duration) error {
+	now := time.Now().UTC()
+	expiresAt := now.Add(lease)
+	_, err := s.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(s.table),
+		Item: map[string]types.AttributeValue{
+			"pk":         &types.AttributeValueMemberS{Value: lockPrefix + name},
+			"sk":         &types.AttributeValueMemberS{Value: name},
+			"holder":     &types.AttributeValueMemberS{Value: holder},
+			"expires_at": &types.AttributeValueMemberN{Value: strconv.FormatInt(expiresAt.Unix(), 10)},
+		},
+		ConditionExpression: aws.String("attribute_not_exists(pk) OR expires_at <= :now OR holder = :holder"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":now":    &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Unix(), 10)},
+			":holder": &types.AttributeValueMemberS{Value: holder},
+		},
+	})
+
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		current, err := s.lockInfo(ctx, name)
+		if err != nil {
+			return err
+		}
+		return &LockedError{current}
+	}
+	if err != nil {
+		return fmt.Errorf("Couldn't acquire lock %s: %s", name, err)
+	}
+	return nil
+}
+
+// Unlock deletes the lock if it is still held by holder
+func (s *DynamoDBStateStore) Unlock(ctx context.Context, name, holder string) error {
+	_, err := s.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(s.table),
+		Key: map[string]types.AttributeValue{
+			"pk": &types.AttributeValueMemberS{Value: lockPrefix + name},
+			"sk": &types.AttributeValueMemberS{Value: name},
+		},
+		ConditionExpression:       aws.String("holder = :holder"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{":holder": &types.AttributeValueMemberS{Value: holder}},
+	})
+
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		return fmt.Errorf("Couldn't release lock %s: it isn't held by %s anymore", name, holder)
+	}
+	if err != nil {
+		return fmt.Errorf("Couldn't release lock %s: %s", name, err)
+	}
+	return nil
+}
+
+// lockInfo returns the current holder of a lock
+func (s *DynamoDBStateStore) lockInfo(ctx context.Context, name string) (LockInfo, error) {
+	info := LockInfo{Name: name}
+	output, err := s.client.Query(ctx, &dynamodb.QueryInput{
+		TableName:                 aws.String(s.table),
+		KeyConditionExpression:    aws.String("pk = :pk"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{":pk": &types.AttributeValueMemberS{Value: lockPrefix + name}},
+		ConsistentRead:            aws.Bool(true),
+	})
+	if err != nil {
+		return info, fmt.Errorf("Couldn't read lock %s: %s", name, err)
+	}
+	for _, item := range output.Items {
+		if holder, ok := item["holder"].(*types.AttributeValueMemberS); ok {
+			info.Holder = holder.Value
+		}
+		if expiresAt, ok := item["expires_at"].(*types.AttributeValueMemberN); ok {
+			seconds, err := strconv.ParseInt(expiresAt.Value, 10, 64)
+			if err == nil {
+				info.ExpiresAt = time.Unix(seconds, 0).UTC()
+			}
+		}
+	}
+	return info, nil
+}
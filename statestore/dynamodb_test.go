@@ -0,0 +1,159 @@
+package statestore
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeDynamoDB is a local stand-in for a DynamoDB table with the keys pk and sk.
+// Only the expressions used by this package are supported.
+type fakeDynamoDB struct {
+	mu       sync.Mutex
+	items    map[string]map[string]types.AttributeValue // pk + "|" + sk -> item
+	pageSize int
+}
+
+func newFakeDynamoDB() *fakeDynamoDB {
+	return &fakeDynamoDB{items: make(map[string]map[string]types.AttributeValue), pageSize: 2}
+}
+
+// stringValue returns the value of a string attribute
+func stringValue(v types.AttributeValue) string {
+	if s, ok := v.(*types.AttributeValueMemberS); ok {
+		return s.Value
+	}
+	return ""
+}
+
+func itemKey(item map[string]types.AttributeValue) string {
+	return stringValue(item["pk"]) + "|" + stringValue(item["sk"])
+}
+
+// numberValue returns the value of a number attribute
+func numberValue(v types.AttributeValue) int64 {
+	if n, ok := v.(*types.AttributeValueMemberN); ok {
+		value, _ := strconv.ParseInt(n.Value, 10, 64)
+		return value
+	}
+	return 0
+}
+
+// check evaluates the condition expressions used by the locks against the existing item (if any)
+func (f *fakeDynamoDB) check(condition *string, values map[string]types.AttributeValue, existing map[string]types.AttributeValue) error {
+	if condition == nil {
+		return nil
+	}
+
+	holderMatches := existing != nil && stringValue(existing["holder"]) == stringValue(values[":holder"])
+	var ok bool
+	switch *condition {
+	case "attribute_not_exists(pk) OR expires_at <= :now OR holder = :holder":
+		ok = existing == nil || numberValue(existing["expires_at"]) <= numberValue(values[":now"]) || holderMatches
+	case "holder = :holder":
+		ok = holderMatches
+	default:
+		return fmt.Errorf("unsupported condition %q", *condition)
+	}
+	if !ok {
+		return &types.ConditionalCheckFailedException{Message: aws.String("The conditional request failed")}
+	}
+	return nil
+}
+
+func (f *fakeDynamoDB) PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := itemKey(params.Item)
+	err := f.check(params.ConditionExpression, params.ExpressionAttributeValues, f.items[key])
+	if err != nil {
+		return nil, err
+	}
+	f.items[key] = params.Item
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (f *fakeDynamoDB) DeleteItem(ctx context.Context, params *dynamodb.DeleteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := itemKey(params.Key)
+	err := f.check(params.ConditionExpression, params.ExpressionAttributeValues, f.items[key])
+	if err != nil {
+		return nil, err
+	}
+	delete(f.items, key)
+	return &dynamodb.DeleteItemOutput{}, nil
+}
+
+func (f *fakeDynamoDB) Query(ctx context.Context, params *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error) {
+	pk := stringValue(params.ExpressionAttributeValues[":pk"])
+	items, last := f.page(params.ExclusiveStartKey, func(item map[string]types.AttributeValue) bool {
+		return stringValue(item["pk"]) == pk
+	})
+	return &dynamodb.QueryOutput{Items: items, LastEvaluatedKey: last}, nil
+}
+
+func (f *fakeDynamoDB) Scan(ctx context.Context, params *dynamodb.ScanInput, optFns ...func(*dynamodb.Options)) (*dynamodb.ScanOutput, error) {
+	prefix := stringValue(params.ExpressionAttributeValues[":prefix"])
+	items, last := f.page(params.ExclusiveStartKey, func(item map[string]types.AttributeValue) bool {
+		return strings.HasPrefix(stringValue(item["pk"]), prefix)
+	})
+	return &dynamodb.ScanOutput{Items: items, LastEvaluatedKey: last}, nil
+}
+
+// page returns the matching items following start (ordered by their keys) and the key of the last one
+// if there are more items
+func (f *fakeDynamoDB) page(start map[string]types.AttributeValue, match func(map[string]types.AttributeValue) bool) ([]map[string]types.AttributeValue, map[string]types.AttributeValue) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var keys []string
+	for key, item := range f.items {
+		if match(item) && (start == nil || key > itemKey(start)) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var items []map[string]types.AttributeValue
+	for _, key := range keys {
+		if len(items) == f.pageSize {
+			last := items[len(items)-1]
+			return items, map[string]types.AttributeValue{"pk": last["pk"], "sk": last["sk"]}
+		}
+		items = append(items, f.items[key])
+	}
+	return items, nil
+}
+
+func TestDynamoDBStateStore(t *testing.T) {
+	fake := newFakeDynamoDB()
+	testStateStore(t, NewDynamoDBStateStore(fake, "rotator-state"))
+
+	// Secrets are never stored, only the IDs of the keys
+	item := fake.items["rotation#aws:deploy|1"]
+	assert.Equal(t, string(PhaseCompleted), stringValue(item["phase"]))
+	assert.Contains(t, stringValue(item["record"]), `"new_key_id":"NEW1"`)
+}
+
+func TestDynamoDBStateStore_Lock(t *testing.T) {
+	fake := newFakeDynamoDB()
+	testLocker(t, NewDynamoDBStateStore(fake, "rotator-state"))
+
+	// Locks aren't listed as rotations
+	store := NewDynamoDBStateStore(fake, "rotator-state")
+	assert.NoError(t, store.Lock(context.TODO(), "aws:deploy", "cli", time.Minute))
+	records, err := store.ListRotations(context.TODO(), "")
+	assert.NoError(t, err)
+	assert.Empty(t, records)
+}
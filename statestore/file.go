@@ -0,0 +1,243 @@
+package statestore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// FileStateStore implements a StateStore and a Locker using local files. It is meant to be used by the CLI:
+// the state file and the locks are only protected (flock) against processes on the same machine.
+type FileStateStore struct {
+	path string
+	mu   sync.Mutex
+}
+
+// NewFileStateStore returns a FileStateStore keeping its records in the file at path
+func NewFileStateStore(path string) *FileStateStore {
+	return &FileStateStore{path: path}
+}
+
+// SaveRotation creates the record or replaces it if it already exists. The state file is locked
+// exclusively until the new version has replaced it, so that other processes don't lose their records.
+func (s *FileStateStore) SaveRotation(ctx context.Context, r RotationRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := openLockFile(s.path)
+	if err != nil {
+		return fmt.Errorf("Couldn't lock %s: %s", s.path, err)
+	}
+	defer f.Close()
+
+	records, err := s.read()
+	if err != nil {
+		return err
+	}
+
+	replaced := false
+	for i := range records {
+		if records[i].ID == r.ID {
+			records[i] = r
+			replaced = true
+		}
+	}
+	if !replaced {
+		records = append(records, r)
+	}
+	return s.write(records)
+}
+
+// ListRotations returns the records of a job (or of all jobs) ordered by their start
+func (s *FileStateStore) ListRotations(ctx context.Context, job string) ([]RotationRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	records, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+
+	var selected []RotationRecord
+	for _, r := range records {
+		if job == "" || r.Job == job {
+			selected = append(selected, r)
+		}
+	}
+	sortRecords(selected)
+	return selected, nil
+}
+
+// read returns all records of the file. A missing (or empty) file holds no records.
+func (s *FileStateStore) read() ([]RotationRecord, error) {
+	content, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) || (err == nil && len(content) == 0) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var document struct {
+		Rotations []RotationRecord `json:"rotations"`
+	}
+	err = json.Unmarshal(content, &document)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't decode %s: %s", s.path, err)
+	}
+	return document.Rotations, nil
+}
+
+// write replaces the file atomically
+func (s *FileStateStore) write(records []RotationRecord) error {
+	content, err := json.MarshalIndent(map[string]interface{}{"rotations": records}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), "."+filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	_, err = tmp.Write(content)
+	if err == nil {
+		err = tmp.Chmod(0600)
+	}
+	if err == nil {
+		err = tmp.Close()
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// sortRecords orders records by their start
+func sortRecords(records []RotationRecord) {
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].StartedAt.Before(records[j].StartedAt)
+	})
+}
+
+// Lock acquires a lock which is kept in a file next to the state file. Processes change the
+// file one after another, it is locked exclusively (flock) while it is read and written.
+func (s *FileStateStore) Lock(ctx context.Context, name, holder string, lease time.Duration) error {
+	f, err := openLockFile(s.lockPath(name))
+	if err != nil {
+		return fmt.Errorf("Couldn't acquire lock %s: %s", name, err)
+	}
+	defer f.Close()
+
+	now := time.Now().UTC()
+	current, err := readLock(f)
+	if err != nil {
+		return err
+	}
+	if current.Holder != "" && current.Holder != holder && !current.expired(now) {
+		return &LockedError{current}
+	}
+
+	// Take a free or expired lock or extend our own
+	return writeLock(f, LockInfo{Name: name, Holder: holder, ExpiresAt: now.Add(lease)})
+}
+
+// Unlock removes the lock file if the lock is still held by holder
+func (s *FileStateStore) Unlock(ctx context.Context, name, holder string) error {
+	path := s.lockPath(name)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+	f, err := openLockFile(path)
+	if err != nil {
+		return fmt.Errorf("Couldn't release lock %s: %s", name, err)
+	}
+	defer f.Close()
+
+	current, err := readLock(f)
+	if err != nil {
+		return err
+	}
+	if current.Holder != "" && current.Holder != holder {
+		return fmt.Errorf("Couldn't release lock %s: it is held by %s", name, current.Holder)
+	}
+	return os.Remove(path)
+}
+
+// lockPath returns the path of the lock file of name (e.g. state.json.aws_deploy.lock)
+func (s *FileStateStore) lockPath(name string) string {
+	safe := []rune(name)
+	for i, r := range safe {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '.') {
+			safe[i] = '_'
+		}
+	}
+	return fmt.Sprintf("%s.%s.lock", s.path, string(safe))
+}
+
+// openLockFile opens the lock file at path, creating it if necessary, and waits until it is locked
+// exclusively. The lock is released once the file is closed.
+func openLockFile(path string) (*os.File, error) {
+	for {
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+		err = lockFile(f)
+		if err == nil {
+			// The file may have been removed by Unlock in the meantime
+			var opened, current os.FileInfo
+			opened, err = f.Stat()
+			if err == nil {
+				current, err = os.Stat(path)
+			}
+			if err == nil && os.SameFile(opened, current) {
+				return f, nil
+			}
+			if err == nil || os.IsNotExist(err) {
+				f.Close()
+				continue
+			}
+		}
+		f.Close()
+		return nil, err
+	}
+}
+
+// readLock returns the lock held by the lock file. An empty file holds no lock.
+func readLock(f *os.File) (LockInfo, error) {
+	var info LockInfo
+	content, err := ioutil.ReadAll(f)
+	if err != nil || len(content) == 0 {
+		return info, err
+	}
+	err = json.Unmarshal(content, &info)
+	if err != nil {
+		return info, fmt.Errorf("Couldn't decode %s: %s", f.Name(), err)
+	}
+	return info, nil
+}
+
+// writeLock replaces the content of the lock file
+func writeLock(f *os.File, info LockInfo) error {
+	content, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	err = f.Truncate(0)
+	if err == nil {
+		_, err = f.WriteAt(content, 0)
+	}
+	if err != nil {
+		return fmt.Errorf("Couldn't write %s: %s", f.Name(), err)
+	}
+	return nil
+}
@@ -0,0 +1,14 @@
+//go:build !windows
+// +build !windows
+
+package statestore
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile waits until f is locked exclusively
+func lockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+}
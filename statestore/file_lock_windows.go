@@ -0,0 +1,14 @@
+//go:build windows
+// +build windows
+
+package statestore
+
+import (
+	"fmt"
+	"os"
+)
+
+// lockFile isn't supported on Windows, the DynamoDB state store has to be used instead
+func lockFile(f *os.File) error {
+	return fmt.Errorf("file locks aren't supported on windows")
+}
@@ -0,0 +1,150 @@
+package statestore
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testRecords returns records of two jobs, the first one is still running
+func testRecords() []RotationRecord {
+	started := time.Date(2021, time.July, 1, 10, 0, 0, 0, time.UTC)
+	running := RotationRecord{ID: "2", Job: "aws:deploy", OldKeyID: "OLD2", StartedAt: started.Add(time.Hour)}
+	running.Log(started.Add(time.Hour), PhaseStarted, "")
+	running.NewKeyID = "NEW2"
+	running.Log(started.Add(time.Hour), PhaseKeyCreated, "")
+
+	completed := RotationRecord{ID: "1", Job: "aws:deploy", OldKeyID: "OLD1", NewKeyID: "NEW1", Published: []string{"github:owner/app/AWS_KEY"}, StartedAt: started}
+	completed.Log(started, PhaseCompleted, "")
+
+	other := RotationRecord{ID: "3", Job: "aws:ci", OldKeyID: "OLD3", StartedAt: started}
+	other.Log(started, PhaseRolledBack, "Upload failed")
+	return []RotationRecord{running, completed, other}
+}
+
+// testStateStore saves the test records and checks that they can be listed
+func testStateStore(t *testing.T, store StateStore) {
+	for _, r := range testRecords() {
+		assert.NoError(t, store.SaveRotation(context.TODO(), r))
+	}
+
+	records, err := store.ListRotations(context.TODO(), "aws:deploy")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(records))
+	assert.Equal(t, "NEW1", records[0].NewKeyID)
+	assert.Equal(t, []string{"github:owner/app/AWS_KEY"}, records[0].Published)
+
+	unfinished := Unfinished(records)
+	assert.Equal(t, 1, len(unfinished))
+	assert.Equal(t, PhaseKeyCreated, unfinished[0].Phase)
+	assert.Equal(t, 2, len(unfinished[0].Journal))
+
+	// Records are replaced
+	running := unfinished[0]
+	running.Log(running.UpdatedAt, PhaseCompleted, "")
+	assert.NoError(t, store.SaveRotation(context.TODO(), running))
+
+	records, err = store.ListRotations(context.TODO(), "")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(records))
+	assert.Empty(t, Unfinished(records))
+}
+
+func TestFileStateStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "state.json")
+	testStateStore(t, NewFileStateStore(path))
+
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// A missing file holds no records
+	records, err := NewFileStateStore(filepath.Join(dir, "missing.json")).ListRotations(context.TODO(), "")
+	assert.NoError(t, err)
+	assert.Empty(t, records)
+}
+
+func TestFileStateStore_ConcurrentSaves(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// Every store acts like a separate process, none of the records must get lost
+	path := filepath.Join(dir, "state.json")
+	errs := make([]error, 16)
+	var wg sync.WaitGroup
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r := RotationRecord{ID: fmt.Sprint(i), Job: "aws:deploy", OldKeyID: fmt.Sprintf("OLD%d", i)}
+			errs[i] = NewFileStateStore(path).SaveRotation(context.TODO(), r)
+		}(i)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		assert.NoError(t, err)
+	}
+	records, err := NewFileStateStore(path).ListRotations(context.TODO(), "")
+	assert.NoError(t, err)
+	assert.Equal(t, len(errs), len(records))
+}
+
+func TestFileStateStore_Lock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	store := NewFileStateStore(filepath.Join(dir, "state.json"))
+	testLocker(t, store)
+
+	// Released locks leave no files behind
+	assert.NoError(t, store.Unlock(context.TODO(), "aws:ci", "lambda"))
+	files, err := ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+func TestFileStateStore_LockTakeover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "state.json")
+	assert.NoError(t, NewFileStateStore(path).Lock(context.TODO(), "aws:deploy", "crashed", -time.Minute))
+
+	// Processes taking over the expired lock at the same time never hold it both
+	errs := make([]error, 8)
+	var wg sync.WaitGroup
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = NewFileStateStore(path).Lock(context.TODO(), "aws:deploy", fmt.Sprintf("cli-%d", i), time.Minute)
+		}(i)
+	}
+	wg.Wait()
+
+	held := 0
+	for _, err := range errs {
+		if err == nil {
+			held++
+			continue
+		}
+		_, locked := err.(*LockedError)
+		assert.True(t, locked, err.Error())
+	}
+	assert.Equal(t, 1, held)
+}
@@ -0,0 +1,53 @@
+package statestore
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+)
+
+// DefaultLockLease is used if no lease is specified. It matches the maximum run time of a Lambda.
+const DefaultLockLease = 15 * time.Minute
+
+// LockInfo describes who holds a lock and until when
+type LockInfo struct {
+	Name      string    `json:"name"`
+	Holder    string    `json:"holder"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// expired returns true if the lease of the lock is over
+func (l LockInfo) expired(now time.Time) bool {
+	return !now.Before(l.ExpiresAt)
+}
+
+// LockedError is returned if a lock is held by someone else
+type LockedError struct {
+	LockInfo
+}
+
+func (e *LockedError) Error() string {
+	return fmt.Sprintf("%s is locked by %s until %s", e.Name, e.Holder, e.ExpiresAt.Format(time.RFC3339))
+}
+
+// Locker grants exclusive access to the keys of a principal (e.g. to the Lambda and to
+// someone running the CLI at the same time). Locks expire after their lease so that a
+// crashed holder doesn't block everyone else forever.
+type Locker interface {
+	// Lock acquires the lock for holder or extends its lease if holder has it already.
+	// A *LockedError is returned if someone else holds the lock.
+	Lock(ctx context.Context, name, holder string, lease time.Duration) error
+
+	// Unlock releases the lock if it is still held by holder
+	Unlock(ctx context.Context, name, holder string) error
+}
+
+// NewLockHolder returns an identifier which is unique to this process and call
+func NewLockHolder() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return fmt.Sprintf("%s/%d/%d", hostname, os.Getpid(), time.Now().UnixNano())
+}
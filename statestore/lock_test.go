@@ -0,0 +1,39 @@
+package statestore
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testLocker checks that a lock is exclusive until it is released or its lease expires
+func testLocker(t *testing.T, locker Locker) {
+	ctx := context.TODO()
+	assert.NoError(t, locker.Lock(ctx, "aws:deploy", "cli", time.Minute))
+
+	// Someone else can't get the lock
+	err := locker.Lock(ctx, "aws:deploy", "lambda", time.Minute)
+	assert.Error(t, err)
+	locked, ok := err.(*LockedError)
+	assert.True(t, ok)
+	if ok {
+		assert.Equal(t, "cli", locked.Holder)
+		assert.True(t, locked.ExpiresAt.After(time.Now()))
+	}
+	assert.Error(t, locker.Unlock(ctx, "aws:deploy", "lambda"))
+
+	// Locks of other principals are independent
+	assert.NoError(t, locker.Lock(ctx, "aws:ci", "lambda", time.Minute))
+
+	// The holder may extend its lease
+	assert.NoError(t, locker.Lock(ctx, "aws:deploy", "cli", time.Minute))
+	assert.NoError(t, locker.Unlock(ctx, "aws:deploy", "cli"))
+	assert.NoError(t, locker.Lock(ctx, "aws:deploy", "lambda", -time.Minute))
+
+	// Expired locks are taken over
+	assert.NoError(t, locker.Lock(ctx, "aws:deploy", "cli", time.Minute))
+	assert.Error(t, locker.Unlock(ctx, "aws:deploy", "lambda"))
+	assert.NoError(t, locker.Unlock(ctx, "aws:deploy", "cli"))
+}
@@ -0,0 +1,86 @@
+package statestore
+
+import (
+	"context"
+	"time"
+)
+
+// RotationPhase tells how far a rotation got
+type RotationPhase string
+
+const (
+	PhaseStarted    RotationPhase = "started"
+	PhaseKeyCreated RotationPhase = "key created"
+	PhaseVerified   RotationPhase = "key verified"
+	PhasePublished  RotationPhase = "published"
+	PhaseRetired    RotationPhase = "old key retired"
+
+	// Final phases
+	PhaseCompleted  RotationPhase = "completed"
+	PhaseRolledBack RotationPhase = "rolled back"
+	PhaseFailed     RotationPhase = "failed"
+)
+
+// Final returns true if nothing is left to be done for a rotation in this phase
+func (p RotationPhase) Final() bool {
+	return p == PhaseCompleted || p == PhaseRolledBack || p == PhaseFailed
+}
+
+// RotationRecord describes a single key rotation of a job. It never holds secrets,
+// only the IDs of the keys and the destinations the new key was published to.
+type RotationRecord struct {
+	ID        string `json:"id"`
+	Job       string `json:"job"`
+	Provider  string `json:"provider,omitempty"`
+	Principal string `json:"principal,omitempty"`
+
+	OldKeyID string        `json:"old_key_id"`
+	NewKeyID string        `json:"new_key_id,omitempty"`
+	Phase    RotationPhase `json:"phase"`
+
+	// Published lists the destinations which hold the new key
+	Published []string `json:"published,omitempty"`
+
+	// Outcome describes how a rotation ended (e.g. the error and the state of the rollback)
+	Outcome string `json:"outcome,omitempty"`
+
+	StartedAt time.Time      `json:"started_at"`
+	UpdatedAt time.Time      `json:"updated_at"`
+	Journal   []JournalEntry `json:"journal"`
+}
+
+// JournalEntry is a single event of a rotation
+type JournalEntry struct {
+	At      time.Time     `json:"at"`
+	Phase   RotationPhase `json:"phase"`
+	Message string        `json:"message,omitempty"`
+}
+
+// Log moves the rotation to the specified phase and adds an entry to its journal
+func (r *RotationRecord) Log(at time.Time, phase RotationPhase, message string) {
+	r.Phase = phase
+	r.UpdatedAt = at
+	r.Journal = append(r.Journal, JournalEntry{At: at, Phase: phase, Message: message})
+}
+
+// StateStore persists rotation records so that a later run knows what happened
+// (e.g. that a rotation was interrupted)
+type StateStore interface {
+	// SaveRotation creates the record or replaces it if it already exists
+	SaveRotation(ctx context.Context, r RotationRecord) error
+
+	// ListRotations returns the records of a job ordered by their start (oldest first).
+	// Without a job, the records of all jobs are returned.
+	ListRotations(ctx context.Context, job string) ([]RotationRecord, error)
+}
+
+// Unfinished returns the records which didn't reach a final phase
+func Unfinished(records []RotationRecord) []RotationRecord {
+	var unfinished []RotationRecord
+	for _, r := range records {
+		if !r.Phase.Final() {
+			unfinished = append(unfinished, r)
+		}
+	}
+	return unfinished
+}